@@ -81,6 +81,12 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// InvalidParam is an error when a query parameter has a value which is
+// malformed or otherwise can't be used.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -52,3 +52,22 @@ func (p *EDUServerProducer) SendTyping(
 
 	return err
 }
+
+// SendTypingBatch sends several typing events to EDU server in a single
+// request. Only the UserID, RoomID, Typing and TimeoutMS of each event are
+// used. The events are applied in the order they are given.
+func (p *EDUServerProducer) SendTypingBatch(
+	ctx context.Context, events []api.InputTypingEvent,
+) error {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	request := api.InputTypingEventsRequest{
+		InputTypingEvents: make([]api.InputTypingEvent, len(events)),
+	}
+	for i, ev := range events {
+		ev.OriginServerTS = now
+		request.InputTypingEvents[i] = ev
+	}
+
+	var response api.InputTypingEventsResponse
+	return p.InputAPI.InputTypingEvents(ctx, &request, &response)
+}
@@ -34,9 +34,11 @@ func NewRoomserverProducer(rsAPI api.RoomserverInternalAPI) *RoomserverProducer
 }
 
 // SendEvents writes the given events to the roomserver input log. The events are written with KindNew.
+// If the events were received over federation then origin should be the server that sent them,
+// otherwise it should be empty.
 func (c *RoomserverProducer) SendEvents(
 	ctx context.Context, events []gomatrixserverlib.HeaderedEvent, sendAsServer gomatrixserverlib.ServerName,
-	txnID *api.TransactionID,
+	txnID *api.TransactionID, origin gomatrixserverlib.ServerName,
 ) (string, error) {
 	ires := make([]api.InputRoomEvent, len(events))
 	for i, event := range events {
@@ -46,6 +48,7 @@ func (c *RoomserverProducer) SendEvents(
 			AuthEventIDs:  event.AuthEventIDs(),
 			SendAsServer:  string(sendAsServer),
 			TransactionID: txnID,
+			Origin:        origin,
 		}
 	}
 	return c.SendInputRoomEvents(ctx, ires)
@@ -53,9 +56,12 @@ func (c *RoomserverProducer) SendEvents(
 
 // SendEventWithState writes an event with KindNew to the roomserver input log
 // with the state at the event as KindOutlier before it. Will not send any event that is
-// marked as `true` in haveEventIDs
+// marked as `true` in haveEventIDs. The origin is the server that sent us the event and
+// its state. If historical is true then the event was found while filling in a gap in
+// the room, so it is marked as one that shouldn't cause notifications.
 func (c *RoomserverProducer) SendEventWithState(
 	ctx context.Context, state *gomatrixserverlib.RespState, event gomatrixserverlib.HeaderedEvent, haveEventIDs map[string]bool,
+	origin gomatrixserverlib.ServerName, historical bool,
 ) error {
 	outliers, err := state.Events()
 	if err != nil {
@@ -71,6 +77,7 @@ func (c *RoomserverProducer) SendEventWithState(
 			Kind:         api.KindOutlier,
 			Event:        outlier.Headered(event.RoomVersion),
 			AuthEventIDs: outlier.AuthEventIDs(),
+			Origin:       origin,
 		})
 	}
 
@@ -85,6 +92,8 @@ func (c *RoomserverProducer) SendEventWithState(
 		AuthEventIDs:  event.AuthEventIDs(),
 		HasState:      true,
 		StateEventIDs: stateEventIDs,
+		Origin:        origin,
+		Historical:    historical,
 	})
 
 	_, err = c.SendInputRoomEvents(ctx, ires)
@@ -102,6 +111,16 @@ func (c *RoomserverProducer) SendInputRoomEvents(
 	return
 }
 
+// SendRejectedEvents tells the roomserver about events received over
+// federation which were rejected, so that it can write them to its output log.
+func (c *RoomserverProducer) SendRejectedEvents(
+	ctx context.Context, rejected []api.InputRejectedEvent,
+) error {
+	request := api.InputRoomEventsRequest{InputRejectedEvents: rejected}
+	var response api.InputRoomEventsResponse
+	return c.RsAPI.InputRoomEvents(ctx, &request, &response)
+}
+
 // SendInvite writes the invite event to the roomserver input API.
 // This should only be needed for invite events that occur outside of a known room.
 // If we are in the room then the event should be sent using the SendEvents method.
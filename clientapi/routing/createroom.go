@@ -58,13 +58,6 @@ const (
 	presetPublicChat         = "public_chat"
 )
 
-const (
-	historyVisibilityShared = "shared"
-	// TODO: These should be implemented once history visibility is implemented
-	// historyVisibilityWorldReadable = "world_readable"
-	// historyVisibilityInvited       = "invited"
-)
-
 func (r createRoomRequest) Validate() *util.JSONResponse {
 	whitespace := "\t\n\x0b\x0c\r " // https://docs.python.org/2/library/string.html#string.whitespace
 	// https://github.com/matrix-org/synapse/blob/v0.19.2/synapse/handlers/room.py#L81
@@ -223,19 +216,19 @@ func createRoom(
 	switch r.Preset {
 	case presetPrivateChat:
 		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+		historyVisibility = common.HistoryVisibilityShared
 	case presetTrustedPrivateChat:
 		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+		historyVisibility = common.HistoryVisibilityShared
 		// TODO If trusted_private_chat, all invitees are given the same power level as the room creator.
 	case presetPublicChat:
 		joinRules = gomatrixserverlib.Public
-		historyVisibility = historyVisibilityShared
+		historyVisibility = common.HistoryVisibilityShared
 	default:
 		// Default room rules, r.Preset was previously checked for valid values so
 		// only a request with no preset should end up here.
 		joinRules = gomatrixserverlib.Invite
-		historyVisibility = historyVisibilityShared
+		historyVisibility = common.HistoryVisibilityShared
 	}
 
 	var builtEvents []gomatrixserverlib.HeaderedEvent
@@ -321,7 +314,7 @@ func createRoom(
 	}
 
 	// send events to the room server
-	_, err = producer.SendEvents(req.Context(), builtEvents, cfg.Matrix.ServerName, nil)
+	_, err = producer.SendEvents(req.Context(), builtEvents, cfg.Matrix.ServerName, nil, "")
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
 		return jsonerror.InternalServerError()
@@ -135,6 +135,7 @@ func SendMembership(
 			[]gomatrixserverlib.HeaderedEvent{event.Headered(verRes.RoomVersion)},
 			cfg.Matrix.ServerName,
 			nil,
+			"",
 		)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
@@ -161,7 +161,7 @@ func SetAvatarURL(
 		return jsonerror.InternalServerError()
 	}
 
-	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
+	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil, ""); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("rsProducer.SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -275,7 +275,7 @@ func SetDisplayName(
 		return jsonerror.InternalServerError()
 	}
 
-	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil); err != nil {
+	if _, err := rsProducer.SendEvents(req.Context(), events, cfg.Matrix.ServerName, nil, ""); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("rsProducer.SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
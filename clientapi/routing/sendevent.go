@@ -87,6 +87,7 @@ func SendEvent(
 		},
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
+		"",
 	)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
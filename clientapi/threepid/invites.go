@@ -366,6 +366,7 @@ func emit3PIDInviteEvent(
 		},
 		cfg.Matrix.ServerName,
 		nil,
+		"",
 	)
 	return err
 }
@@ -15,12 +15,15 @@
 package main
 
 import (
+	"net/http"
+
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common/basecomponent"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/eduserver"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/matrix-org/dendrite/federationapi/routing"
 )
 
 func main() {
@@ -45,6 +48,12 @@ func main() {
 		base, accountDB, deviceDB, federation, &keyRing,
 		rsAPI, asAPI, fsAPI, eduProducer,
 	)
+	if cfg.FederationAPI.EnableValidateEventAPI {
+		routing.SetupValidateEventHTTP(http.DefaultServeMux, rsAPI, &keyRing)
+	}
+	if cfg.FederationAPI.EnableRoomExtremitiesAPI {
+		routing.SetupRoomExtremitiesHTTP(http.DefaultServeMux, rsAPI)
+	}
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.FederationAPI), string(base.Cfg.Listen.FederationAPI))
 
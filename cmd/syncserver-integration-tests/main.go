@@ -441,7 +441,7 @@ func main() {
 	writeToRoomServerLog(i11StateAliceRoomName, i12AliceMsg, i13StateBobInviteCharlie)
 
 	// Make sure charlie sees the invite both with and without a ?since= token
-	// TODO: Invite state should include the invite event and the room name.
+	// TODO: Invite state should also include the room name.
 	charlieInviteData := `{
 		"account_data": {
 			"events": []
@@ -454,7 +454,12 @@ func main() {
 			"invite": {
 				"!PjrbIMW2cIiaYF4t:localhost": {
 					"invite_state": {
-						"events": []
+						"events": [{
+							"content": {"membership": "invite"},
+							"sender": "@bob:localhost",
+							"state_key": "@charlie:localhost",
+							"type": "m.room.member"
+						}]
 					}
 				}
 			},
@@ -40,6 +40,17 @@ import (
 // This will change whenever we make breaking changes to the config format.
 const Version = 0
 
+// The strategies for fetching the state before an incoming event from the
+// sending server, see FederationAPI.StateFetchStrategy.
+const (
+	// StateFetchStateIDsThenState tries /state_ids and falls back to /state.
+	StateFetchStateIDsThenState = "state_ids_then_state"
+	// StateFetchStateOnly only uses /state.
+	StateFetchStateOnly = "state_only"
+	// StateFetchStateIDsOnly only uses /state_ids.
+	StateFetchStateIDsOnly = "state_ids_only"
+)
+
 // Dendrite contains all the config used by a dendrite process.
 // Relative paths are resolved relative to the current working directory
 type Dendrite struct {
@@ -122,6 +133,230 @@ type Dendrite struct {
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
 	} `yaml:"media"`
 
+	// The configuration specific to the federation API.
+	FederationAPI struct {
+		// The maximum number of bytes that a compressed federation transaction
+		// body is allowed to expand to once decompressed. Requests which exceed
+		// this are rejected to protect against decompression bombs.
+		// Defaults to 10485760 (10MB).
+		MaxDecompressedTransactionBytes int64 `yaml:"max_decompressed_transaction_bytes"`
+		// Whether to expose the internal event validation API on the
+		// standalone federation API server. The API has no authentication
+		// and causes key fetches from arbitrary servers, so it must only be
+		// enabled where the listener is not reachable from the internet.
+		// It is never exposed by the monolith. Defaults to false.
+		EnableValidateEventAPI bool `yaml:"enable_validate_event_api"`
+		// Whether to expose the internal API which returns the forward
+		// extremities of a room on the standalone federation API server. The
+		// API has no authentication, so it must only be enabled where the
+		// listener is not reachable from the internet. It is never exposed by
+		// the monolith. Defaults to false.
+		EnableRoomExtremitiesAPI bool `yaml:"enable_room_extremities_api"`
+		// The maximum number of events for a single room that may be processed
+		// concurrently from incoming transactions. This stops one busy room
+		// from starving all of the others. Defaults to 5.
+		MaxConcurrentEventsPerRoom int64 `yaml:"max_concurrent_events_per_room"`
+		// How long an incoming event will wait for a free slot in its room
+		// before it is skipped with a transient error. Defaults to 10s.
+		RoomEventSlotTimeout time.Duration `yaml:"room_event_slot_timeout"`
+		// The maximum number of incoming transactions that may be processed
+		// at the same time. Further transactions are rejected with a 503 until
+		// there is capacity. Defaults to 100.
+		MaxConcurrentTransactions int64 `yaml:"max_concurrent_transactions"`
+		// The maximum number of incoming transactions from a single server that
+		// may be in flight at the same time. They are processed one at a time
+		// in the order in which they arrived, and further transactions from
+		// that server are rejected with a 429. Defaults to 5.
+		MaxConcurrentTransactionsPerOrigin int64 `yaml:"max_concurrent_transactions_per_origin"`
+		// Whether to accept incoming events with missing prev_events using only
+		// the critical state needed to authorise them, fetching the full state
+		// of the room in the background and checking the events against it
+		// once it arrives. Defaults to false.
+		EnablePartialState bool `yaml:"enable_partial_state"`
+		// The maximum number of requests that may be made to a single remote
+		// server at the same time to fetch the missing events and state for
+		// incoming events. Further requests wait until there is capacity.
+		// Defaults to 3.
+		MaxConcurrentFetchesPerServer int64 `yaml:"max_concurrent_fetches_per_server"`
+		// How long remote servers are asked to wait before retrying a
+		// transaction in which some events were skipped because we couldn't
+		// fetch the state before them from the sender. Defaults to 30s.
+		MissingPrevEventsRetryAfter time.Duration `yaml:"missing_prev_events_retry_after"`
+		// The maximum number of prev_events that an incoming event may have if
+		// we are missing any of them. We fetch the state before the event from
+		// the sender in that case, which gets more expensive with each
+		// prev_event, so events with more are skipped. Defaults to 20.
+		MaxPrevEvents int64 `yaml:"max_prev_events"`
+		// The maximum number of distinct rooms that the events in a single
+		// incoming transaction may be in. Each room needs its own work to
+		// process its events, so the events in any further rooms are skipped
+		// and the sender is asked to retry them later. Zero means no limit.
+		// Defaults to 0.
+		MaxRoomsPerTransaction int64 `yaml:"max_rooms_per_transaction"`
+		// The number of consecutive requests to a remote server to fetch the
+		// missing events and state for incoming events which may fail before
+		// we stop making requests to that server for a while. Defaults to 5.
+		FetchFailureThreshold int64 `yaml:"fetch_failure_threshold"`
+		// How long we stop making requests to a remote server for once it has
+		// reached the fetch failure threshold. A single request is then let
+		// through to check whether the server has recovered. Defaults to 1m.
+		FetchFailureCooldown time.Duration `yaml:"fetch_failure_cooldown"`
+		// How far the depth of an incoming event may be beyond the current
+		// depth of its room. Events with a greater depth are rejected, as a
+		// bogus depth would break the ordering of the room's events. This
+		// needs to allow for events that we missed while we couldn't reach
+		// the sender. Defaults to 100000.
+		MaxDepthAhead int64 `yaml:"max_depth_ahead"`
+		// How far the origin_server_ts of an incoming event may be ahead of
+		// or behind our clock. Events outside of that window are logged, as
+		// their timestamps distort anything ordered by time, and rejected if
+		// RejectTimestampSkew is set. Defaults to 24h ahead and 720h behind,
+		// which allows for servers catching up after a long outage.
+		MaxTimestampSkewFuture time.Duration `yaml:"max_timestamp_skew_future"`
+		MaxTimestampSkewPast   time.Duration `yaml:"max_timestamp_skew_past"`
+		// Whether incoming events whose origin_server_ts is outside of the
+		// allowed window are rejected, rather than only logged. Defaults to
+		// false.
+		RejectTimestampSkew bool `yaml:"reject_timestamp_skew"`
+		// How the state before an incoming event is fetched from the sending
+		// server when we are missing its prev_events. One of
+		// "state_ids_then_state", which tries /state_ids and falls back to
+		// /state, "state_only" or "state_ids_only". "state_ids_only" never
+		// downloads a full /state response: if /state_ids fails then the
+		// event is skipped and the sender is asked to retry it later.
+		// Defaults to "state_ids_then_state".
+		StateFetchStrategy string `yaml:"state_fetch_strategy"`
+		// The maximum number of state events, and of auth events, that we
+		// accept in a /state response from another server. Responses with
+		// more are rejected before their signatures are checked. Defaults to
+		// 100000.
+		MaxStateEvents int64 `yaml:"max_state_events"`
+		// The maximum number of distinct state and auth events, combined,
+		// that we accept in a /state_ids response from another server.
+		// Responses with more are rejected before any of the events are
+		// fetched, and we fall back to /state if the state fetch strategy
+		// allows it. Defaults to 100000.
+		MaxStateIDsEvents int64 `yaml:"max_state_ids_events"`
+		// Whether to write an output event to the roomserver output log for
+		// each incoming event that we reject, for example because it fails
+		// auth checks, with the server that sent it and why it was rejected.
+		// This lets moderation tooling audit rejected events. Defaults to
+		// false.
+		EmitRejectedEvents bool `yaml:"emit_rejected_events"`
+		// The maximum number of requests that we make to the sending server
+		// to fill in the gap before a single incoming event, including for
+		// any auth events that we have to process along the way. Once these
+		// are used up the event is skipped, and the sender is asked to retry
+		// it later. Defaults to 1000.
+		MaxFetchesPerEvent int64 `yaml:"max_fetches_per_event"`
+		// How long we spend filling in the gap before a single incoming
+		// event, after which the event is skipped and the sender is asked to
+		// retry it later. Defaults to 2m.
+		MissingStateTimeout time.Duration `yaml:"missing_state_timeout"`
+		// How many events we ask the sender for in each /get_missing_events
+		// request when walking back through the gap before an incoming
+		// event. If the walk runs out of fetches or time then how far it got
+		// is kept, so that the next transaction which needs the gap filled
+		// carries on from there rather than starting again. Zero disables the
+		// walk, so the state before the event is fetched straight away.
+		// Defaults to 0.
+		MissingEventsLimit int64 `yaml:"missing_events_limit"`
+		// How long we spend processing a single event in an incoming
+		// transaction, including filling in the gap before it, after which
+		// the event is skipped so that the rest of the transaction isn't held
+		// up, and the sender is asked to retry it later. Zero means no limit.
+		// Defaults to 0.
+		PDUTimeout time.Duration `yaml:"pdu_timeout"`
+		// How many times we try again in the background to process an
+		// incoming event that was skipped because we couldn't fetch the state
+		// before it from the sender, before giving up on it. Zero disables
+		// these retries. Defaults to 0.
+		MissingPrevEventsRetries int64 `yaml:"missing_prev_events_retries"`
+		// How long we wait before the first of those retries. The wait
+		// doubles before each retry after that. Defaults to 30s.
+		MissingPrevEventsRetryBackoff time.Duration `yaml:"missing_prev_events_retry_backoff"`
+		// Incoming transactions which take at least this long to process are
+		// logged as a warning, along with how much of that time was spent
+		// waiting for other servers and for the roomserver. Zero disables
+		// this. Defaults to 0.
+		SlowTransactionThreshold time.Duration `yaml:"slow_transaction_threshold"`
+		// How many times an incoming event may fail to be processed before it
+		// is quarantined. Quarantined events are skipped without being
+		// processed, so that an event which always fails doesn't fail every
+		// transaction that it is sent in. Only failures which would happen
+		// every time, such as failing auth checks, are counted. The quarantine
+		// is stored in the federation_api database if there is one. Zero means
+		// that events are only quarantined through the admin endpoints.
+		// Defaults to 0.
+		QuarantineAfterFailures int64 `yaml:"quarantine_after_failures"`
+		// The username and password for the admin endpoints of the federation
+		// API, which list quarantined events and add and remove them. The
+		// endpoints are only served if both are set.
+		AdminBasicAuth struct {
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+		} `yaml:"admin_basic_auth"`
+		// The servers which we accept transactions from. Entries are server
+		// names, which may contain "*" and "?" wildcards as in server ACLs,
+		// e.g. "*.example.com". If empty then transactions are accepted from
+		// any server which isn't denied.
+		AllowedOrigins []string `yaml:"allowed_origins"`
+		// The servers which we never accept transactions from, in the same
+		// format as AllowedOrigins. These take precedence over the allowed
+		// origins.
+		DeniedOrigins []string `yaml:"denied_origins"`
+	} `yaml:"federation_api"`
+
+	// The configuration specific to the room server.
+	RoomServer struct {
+		// The sustained number of new events per second that are accepted
+		// into any one room, whether they were sent by local users or over
+		// federation. Events beyond this rate are rejected, so that a single
+		// busy room can't overwhelm the database and the consumers of the
+		// output log. Zero disables the limit. Defaults to 0.
+		MaxEventsPerSecondPerRoom int64 `yaml:"max_events_per_second_per_room"`
+		// The number of new events that may be accepted into a room in a
+		// burst above that rate. Defaults to 100.
+		EventBurstPerRoom int64 `yaml:"event_burst_per_room"`
+	} `yaml:"room_server"`
+
+	// The configuration specific to the sync API.
+	SyncAPI struct {
+		// The most joined rooms that are sent in full in one /sync response.
+		// The rest are sent in the responses which follow, so that an initial
+		// sync for a user in many rooms can't build a huge response. Zero
+		// disables the limit. Defaults to 0.
+		MaxRoomsPerResponse int64 `yaml:"max_rooms_per_response"`
+		// The most state and timeline events of joined rooms that are sent in
+		// one /sync response. The timelines of rooms are shortened, and the
+		// rooms which don't fit are sent in the responses which follow. Zero
+		// disables the limit. Defaults to 0.
+		MaxEventsPerResponse int64 `yaml:"max_events_per_response"`
+		// Message retention, see MSC1763. Rooms with an m.room.retention
+		// state event have the events which are older than the max_lifetime
+		// of its policy purged from the sync API database.
+		Retention struct {
+			// Whether events are purged. Defaults to false.
+			Enabled bool `yaml:"enabled"`
+			// The shortest and longest max_lifetime that we honour. A room's
+			// policy is clamped to these, so that a room can't have its
+			// history purged sooner than MinLifetime, and so that it is
+			// purged after MaxLifetime at the latest. Rooms without a policy
+			// are never purged. Zero disables the clamp. Both default to 0.
+			MinLifetime time.Duration `yaml:"min_lifetime"`
+			MaxLifetime time.Duration `yaml:"max_lifetime"`
+			// How often rooms are purged. Defaults to 1h.
+			PurgeInterval time.Duration `yaml:"purge_interval"`
+		} `yaml:"retention"`
+		// The username and password for the admin endpoints of the sync API,
+		// which export internal state for debugging. The endpoints are only
+		// served if both are set.
+		AdminBasicAuth struct {
+			Username string `yaml:"username"`
+			Password string `yaml:"password"`
+		} `yaml:"admin_basic_auth"`
+	} `yaml:"sync_api"`
+
 	// The configuration to use for Prometheus metrics
 	Metrics struct {
 		// Whether or not the metrics are enabled
@@ -148,6 +383,11 @@ type Dendrite struct {
 		Topics struct {
 			// Topic for roomserver/api.OutputRoomEvent events.
 			OutputRoomEvent Topic `yaml:"output_room_event"`
+			// Extra topics which roomserver/api.OutputRoomEvent events are
+			// also written to, so that other consumers can have topics of
+			// their own. Writing to them is best-effort and happens in the
+			// background, and events are dropped if they fall behind.
+			OutputRoomEventMirrors []Topic `yaml:"output_room_event_mirrors"`
 			// Topic for sending account data from client API to sync API
 			OutputClientData Topic `yaml:"output_client_data"`
 			// Topic for eduserver/api.OutputTypingEvent events.
@@ -186,6 +426,10 @@ type Dendrite struct {
 		// The PublicRoomsAPI database stores information used to compute the public
 		// room directory. It is only accessed by the PublicRoomsAPI server.
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
+		// The FederationAPI database stores the quarantined events. It is only
+		// accessed by the FederationAPI. If it isn't set then the quarantine is
+		// kept in memory, and is cleared on restart.
+		FederationAPI DataSource `yaml:"federation_api,omitempty"`
 		// The Naffka database is used internally by the naffka library, if used.
 		Naffka DataSource `yaml:"naffka,omitempty"`
 		// Maximum open connections to the DB (0 = use default, negative means unlimited)
@@ -491,6 +735,90 @@ func (config *Dendrite) SetDefaults() {
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
 
+	if config.FederationAPI.MaxDecompressedTransactionBytes == 0 {
+		config.FederationAPI.MaxDecompressedTransactionBytes = 10485760
+	}
+
+	if config.FederationAPI.MaxConcurrentEventsPerRoom == 0 {
+		config.FederationAPI.MaxConcurrentEventsPerRoom = 5
+	}
+
+	if config.FederationAPI.RoomEventSlotTimeout == 0 {
+		config.FederationAPI.RoomEventSlotTimeout = 10 * time.Second
+	}
+
+	if config.FederationAPI.MaxConcurrentTransactions == 0 {
+		config.FederationAPI.MaxConcurrentTransactions = 100
+	}
+
+	if config.FederationAPI.MaxConcurrentTransactionsPerOrigin == 0 {
+		config.FederationAPI.MaxConcurrentTransactionsPerOrigin = 5
+	}
+
+	if config.FederationAPI.MaxConcurrentFetchesPerServer == 0 {
+		config.FederationAPI.MaxConcurrentFetchesPerServer = 3
+	}
+
+	if config.FederationAPI.MissingPrevEventsRetryAfter == 0 {
+		config.FederationAPI.MissingPrevEventsRetryAfter = 30 * time.Second
+	}
+
+	if config.FederationAPI.MaxPrevEvents == 0 {
+		config.FederationAPI.MaxPrevEvents = 20
+	}
+
+	if config.FederationAPI.FetchFailureThreshold == 0 {
+		config.FederationAPI.FetchFailureThreshold = 5
+	}
+
+	if config.FederationAPI.FetchFailureCooldown == 0 {
+		config.FederationAPI.FetchFailureCooldown = time.Minute
+	}
+
+	if config.FederationAPI.MaxDepthAhead == 0 {
+		config.FederationAPI.MaxDepthAhead = 100000
+	}
+
+	if config.FederationAPI.MaxTimestampSkewFuture == 0 {
+		config.FederationAPI.MaxTimestampSkewFuture = 24 * time.Hour
+	}
+
+	if config.FederationAPI.MaxTimestampSkewPast == 0 {
+		config.FederationAPI.MaxTimestampSkewPast = 720 * time.Hour
+	}
+
+	if config.FederationAPI.StateFetchStrategy == "" {
+		config.FederationAPI.StateFetchStrategy = StateFetchStateIDsThenState
+	}
+
+	if config.FederationAPI.MaxStateEvents == 0 {
+		config.FederationAPI.MaxStateEvents = 100000
+	}
+
+	if config.FederationAPI.MaxStateIDsEvents == 0 {
+		config.FederationAPI.MaxStateIDsEvents = 100000
+	}
+
+	if config.FederationAPI.MaxFetchesPerEvent == 0 {
+		config.FederationAPI.MaxFetchesPerEvent = 1000
+	}
+
+	if config.FederationAPI.MissingStateTimeout == 0 {
+		config.FederationAPI.MissingStateTimeout = 2 * time.Minute
+	}
+
+	if config.FederationAPI.MissingPrevEventsRetryBackoff == 0 {
+		config.FederationAPI.MissingPrevEventsRetryBackoff = 30 * time.Second
+	}
+
+	if config.RoomServer.EventBurstPerRoom == 0 {
+		config.RoomServer.EventBurstPerRoom = 100
+	}
+
+	if config.SyncAPI.Retention.PurgeInterval == 0 {
+		config.SyncAPI.Retention.PurgeInterval = time.Hour
+	}
+
 	if config.Database.MaxIdleConns == 0 {
 		config.Database.MaxIdleConns = 2
 	}
@@ -579,6 +907,61 @@ func (config *Dendrite) checkMedia(configErrs *configErrors) {
 	}
 }
 
+// checkFederationAPI verifies the parameters federation_api.* are valid.
+func (config *Dendrite) checkFederationAPI(configErrs *configErrors) {
+	checkPositive(configErrs, "federation_api.max_decompressed_transaction_bytes", config.FederationAPI.MaxDecompressedTransactionBytes)
+	checkPositive(configErrs, "federation_api.max_concurrent_events_per_room", config.FederationAPI.MaxConcurrentEventsPerRoom)
+	checkPositive(configErrs, "federation_api.room_event_slot_timeout", int64(config.FederationAPI.RoomEventSlotTimeout))
+	checkPositive(configErrs, "federation_api.max_concurrent_transactions", config.FederationAPI.MaxConcurrentTransactions)
+	checkPositive(configErrs, "federation_api.max_concurrent_transactions_per_origin", config.FederationAPI.MaxConcurrentTransactionsPerOrigin)
+	checkPositive(configErrs, "federation_api.max_concurrent_fetches_per_server", config.FederationAPI.MaxConcurrentFetchesPerServer)
+	checkPositive(configErrs, "federation_api.missing_prev_events_retry_after", int64(config.FederationAPI.MissingPrevEventsRetryAfter))
+	checkPositive(configErrs, "federation_api.max_prev_events", config.FederationAPI.MaxPrevEvents)
+	checkPositive(configErrs, "federation_api.max_rooms_per_transaction", config.FederationAPI.MaxRoomsPerTransaction)
+	checkPositive(configErrs, "federation_api.fetch_failure_threshold", config.FederationAPI.FetchFailureThreshold)
+	checkPositive(configErrs, "federation_api.fetch_failure_cooldown", int64(config.FederationAPI.FetchFailureCooldown))
+	checkPositive(configErrs, "federation_api.max_depth_ahead", config.FederationAPI.MaxDepthAhead)
+	checkPositive(configErrs, "federation_api.max_timestamp_skew_future", int64(config.FederationAPI.MaxTimestampSkewFuture))
+	checkPositive(configErrs, "federation_api.max_timestamp_skew_past", int64(config.FederationAPI.MaxTimestampSkewPast))
+	checkPositive(configErrs, "federation_api.max_state_events", config.FederationAPI.MaxStateEvents)
+	checkPositive(configErrs, "federation_api.max_state_ids_events", config.FederationAPI.MaxStateIDsEvents)
+	checkPositive(configErrs, "federation_api.max_fetches_per_event", config.FederationAPI.MaxFetchesPerEvent)
+	checkPositive(configErrs, "federation_api.missing_state_timeout", int64(config.FederationAPI.MissingStateTimeout))
+	checkPositive(configErrs, "federation_api.missing_events_limit", config.FederationAPI.MissingEventsLimit)
+	checkPositive(configErrs, "federation_api.pdu_timeout", int64(config.FederationAPI.PDUTimeout))
+	checkPositive(configErrs, "federation_api.missing_prev_events_retries", config.FederationAPI.MissingPrevEventsRetries)
+	checkPositive(configErrs, "federation_api.missing_prev_events_retry_backoff", int64(config.FederationAPI.MissingPrevEventsRetryBackoff))
+	checkPositive(configErrs, "federation_api.slow_transaction_threshold", int64(config.FederationAPI.SlowTransactionThreshold))
+	checkPositive(configErrs, "federation_api.quarantine_after_failures", config.FederationAPI.QuarantineAfterFailures)
+	switch config.FederationAPI.StateFetchStrategy {
+	case StateFetchStateIDsThenState, StateFetchStateOnly, StateFetchStateIDsOnly:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "federation_api.state_fetch_strategy", config.FederationAPI.StateFetchStrategy))
+	}
+}
+
+// checkSyncAPI verifies the parameters sync_api.* are valid.
+func (config *Dendrite) checkSyncAPI(configErrs *configErrors) {
+	checkPositive(configErrs, "sync_api.max_rooms_per_response", config.SyncAPI.MaxRoomsPerResponse)
+	checkPositive(configErrs, "sync_api.max_events_per_response", config.SyncAPI.MaxEventsPerResponse)
+	checkPositive(configErrs, "sync_api.retention.min_lifetime", int64(config.SyncAPI.Retention.MinLifetime))
+	checkPositive(configErrs, "sync_api.retention.max_lifetime", int64(config.SyncAPI.Retention.MaxLifetime))
+	checkPositive(configErrs, "sync_api.retention.purge_interval", int64(config.SyncAPI.Retention.PurgeInterval))
+	retention := config.SyncAPI.Retention
+	if retention.MinLifetime > 0 && retention.MaxLifetime > 0 && retention.MinLifetime > retention.MaxLifetime {
+		configErrs.Add(fmt.Sprintf(
+			"invalid value for config key %q: %s is greater than sync_api.retention.max_lifetime %s",
+			"sync_api.retention.min_lifetime", retention.MinLifetime, retention.MaxLifetime,
+		))
+	}
+}
+
+// checkRoomServer verifies the parameters room_server.* are valid.
+func (config *Dendrite) checkRoomServer(configErrs *configErrors) {
+	checkPositive(configErrs, "room_server.max_events_per_second_per_room", config.RoomServer.MaxEventsPerSecondPerRoom)
+	checkPositive(configErrs, "room_server.event_burst_per_room", config.RoomServer.EventBurstPerRoom)
+}
+
 // checkKafka verifies the parameters kafka.* and the related
 // database.naffka are valid.
 func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
@@ -643,6 +1026,9 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkMatrix(&configErrs)
 	config.checkMedia(&configErrs)
 	config.checkTurn(&configErrs)
+	config.checkFederationAPI(&configErrs)
+	config.checkRoomServer(&configErrs)
+	config.checkSyncAPI(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
@@ -0,0 +1,57 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The values of history_visibility in m.room.history_visibility events.
+// https://matrix.org/docs/spec/client_server/r0.6.0#room-history-visibility
+const (
+	HistoryVisibilityWorldReadable = "world_readable"
+	HistoryVisibilityShared        = "shared"
+	HistoryVisibilityInvited       = "invited"
+	HistoryVisibilityJoined        = "joined"
+)
+
+// DefaultHistoryVisibility is the history visibility of a room which has no
+// m.room.history_visibility event, or whose event has a value that we don't
+// understand.
+const DefaultHistoryVisibility = HistoryVisibilityShared
+
+// ResolveHistoryVisibility returns the history visibility of a room given its
+// state, which need only include the m.room.history_visibility event. This is
+// the one place that decides the default and which values are allowed, so that
+// every endpoint which checks history visibility agrees.
+func ResolveHistoryVisibility(roomState []gomatrixserverlib.Event) string {
+	for _, ev := range roomState {
+		if ev.Type() != gomatrixserverlib.MRoomHistoryVisibility || !ev.StateKeyEquals("") {
+			continue
+		}
+		var content HistoryVisibilityContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			return DefaultHistoryVisibility
+		}
+		switch content.HistoryVisibility {
+		case HistoryVisibilityWorldReadable, HistoryVisibilityShared, HistoryVisibilityInvited, HistoryVisibilityJoined:
+			return content.HistoryVisibility
+		}
+		return DefaultHistoryVisibility
+	}
+	return DefaultHistoryVisibility
+}
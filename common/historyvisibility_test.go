@@ -0,0 +1,59 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateStateEvent(t *testing.T, eventType, stateKey, content string) gomatrixserverlib.Event {
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":1,"event_id":"$%s:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!room:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"state_key":%q,"type":%q}`,
+		content, eventType, stateKey, eventType,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func TestResolveHistoryVisibility(t *testing.T) {
+	visibility := func(value string) []gomatrixserverlib.Event {
+		return []gomatrixserverlib.Event{
+			mustCreateStateEvent(t, gomatrixserverlib.MRoomHistoryVisibility, "", fmt.Sprintf(`{"history_visibility":%s}`, value)),
+		}
+	}
+	testCases := []struct {
+		name      string
+		roomState []gomatrixserverlib.Event
+		want      string
+	}{
+		{"world_readable", visibility(`"world_readable"`), HistoryVisibilityWorldReadable},
+		{"shared", visibility(`"shared"`), HistoryVisibilityShared},
+		{"invited", visibility(`"invited"`), HistoryVisibilityInvited},
+		{"joined", visibility(`"joined"`), HistoryVisibilityJoined},
+		{"no event", nil, DefaultHistoryVisibility},
+		{"unknown value", visibility(`"everyone"`), DefaultHistoryVisibility},
+		{"wrong type of value", visibility(`5`), DefaultHistoryVisibility},
+		{"wrong case", visibility(`"World_Readable"`), DefaultHistoryVisibility},
+		{"other state only", []gomatrixserverlib.Event{
+			mustCreateStateEvent(t, gomatrixserverlib.MRoomJoinRules, "", `{"join_rule":"public"}`),
+		}, DefaultHistoryVisibility},
+		{"non-empty state key", []gomatrixserverlib.Event{
+			mustCreateStateEvent(t, gomatrixserverlib.MRoomHistoryVisibility, "nope", `{"history_visibility":"world_readable"}`),
+		}, DefaultHistoryVisibility},
+		{"among other state", append([]gomatrixserverlib.Event{
+			mustCreateStateEvent(t, gomatrixserverlib.MRoomJoinRules, "", `{"join_rule":"public"}`),
+		}, visibility(`"joined"`)...), HistoryVisibilityJoined},
+	}
+	for _, tc := range testCases {
+		if got := ResolveHistoryVisibility(tc.roomState); got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+	if DefaultHistoryVisibility != HistoryVisibilityShared {
+		t.Errorf("the default history visibility is %q, want %q", DefaultHistoryVisibility, HistoryVisibilityShared)
+	}
+}
@@ -42,9 +42,18 @@ type InputTypingEventRequest struct {
 	InputTypingEvent InputTypingEvent `json:"input_typing_event"`
 }
 
-// InputTypingEventResponse is a response to InputTypingEvents
+// InputTypingEventResponse is a response to InputTypingEvent
 type InputTypingEventResponse struct{}
 
+// InputTypingEventsRequest is a request to EDUServerInputAPI to update several
+// typing statuses at once. The updates are applied in order.
+type InputTypingEventsRequest struct {
+	InputTypingEvents []InputTypingEvent `json:"input_typing_events"`
+}
+
+// InputTypingEventsResponse is a response to InputTypingEvents
+type InputTypingEventsResponse struct{}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -52,11 +61,20 @@ type EDUServerInputAPI interface {
 		request *InputTypingEventRequest,
 		response *InputTypingEventResponse,
 	) error
+
+	InputTypingEvents(
+		ctx context.Context,
+		request *InputTypingEventsRequest,
+		response *InputTypingEventsResponse,
+	) error
 }
 
 // EDUServerInputTypingEventPath is the HTTP path for the InputTypingEvent API.
 const EDUServerInputTypingEventPath = "/api/eduserver/input"
 
+// EDUServerInputTypingEventsPath is the HTTP path for the InputTypingEvents API.
+const EDUServerInputTypingEventsPath = "/api/eduserver/inputTypingEvents"
+
 // NewEDUServerInputAPIHTTP creates a EDUServerInputAPI implemented by talking to a HTTP POST API.
 func NewEDUServerInputAPIHTTP(eduServerURL string, httpClient *http.Client) (EDUServerInputAPI, error) {
 	if httpClient == nil {
@@ -82,3 +100,16 @@ func (h *httpEDUServerInputAPI) InputTypingEvent(
 	apiURL := h.eduServerURL + EDUServerInputTypingEventPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// InputTypingEvents implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputTypingEvents(
+	ctx context.Context,
+	request *InputTypingEventsRequest,
+	response *InputTypingEventsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputTypingEvents")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputTypingEventsPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
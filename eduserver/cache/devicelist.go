@@ -0,0 +1,68 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+)
+
+// DeviceListCache maintains the sync position at which the device list of
+// each user last changed, along with a sync position which advances every
+// time any user's device list changes. Only the fact that the devices changed
+// is kept, as clients fetch the devices themselves from /keys/query.
+type DeviceListCache struct {
+	sync.RWMutex
+	latestSyncPosition int64
+	data               map[string]int64
+}
+
+// NewDeviceListCache returns a new DeviceListCache initialised for use.
+func NewDeviceListCache() *DeviceListCache {
+	return &DeviceListCache{data: make(map[string]int64)}
+}
+
+// SetDeviceListChanged records that the device list of a user has changed.
+// Returns the latest sync position for device lists after update.
+func (d *DeviceListCache) SetDeviceListChanged(userID string) int64 {
+	d.Lock()
+	defer d.Unlock()
+
+	d.latestSyncPosition++
+	d.data[userID] = d.latestSyncPosition
+
+	return d.latestSyncPosition
+}
+
+// GetUsersChangedAfter returns the IDs of every user whose device list has
+// changed after the given position.
+func (d *DeviceListCache) GetUsersChangedAfter(position int64) []string {
+	d.RLock()
+	defer d.RUnlock()
+
+	var changed []string
+	for userID, syncPosition := range d.data {
+		if syncPosition > position {
+			changed = append(changed, userID)
+		}
+	}
+	return changed
+}
+
+// GetLatestSyncPosition returns the latest sync position for device lists.
+func (d *DeviceListCache) GetLatestSyncPosition() int64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.latestSyncPosition
+}
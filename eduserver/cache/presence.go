@@ -0,0 +1,86 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Presence is the latest presence state that we know of for a user.
+type Presence struct {
+	UserID       string
+	Presence     string
+	StatusMsg    *string
+	LastActiveTS gomatrixserverlib.Timestamp
+	// The presence sync position at which this state was last updated.
+	syncPosition int64
+}
+
+// PresenceCache maintains the latest presence state of each user, along with
+// a sync position which advances every time any user's presence changes.
+type PresenceCache struct {
+	sync.RWMutex
+	latestSyncPosition int64
+	data               map[string]*Presence
+}
+
+// NewPresenceCache returns a new PresenceCache initialised for use.
+func NewPresenceCache() *PresenceCache {
+	return &PresenceCache{data: make(map[string]*Presence)}
+}
+
+// SetPresence updates the presence state of a user.
+// Returns the latest sync position for presence after update.
+func (p *PresenceCache) SetPresence(
+	userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp,
+) int64 {
+	p.Lock()
+	defer p.Unlock()
+
+	p.latestSyncPosition++
+	p.data[userID] = &Presence{
+		UserID:       userID,
+		Presence:     presence,
+		StatusMsg:    statusMsg,
+		LastActiveTS: lastActiveTS,
+		syncPosition: p.latestSyncPosition,
+	}
+
+	return p.latestSyncPosition
+}
+
+// GetPresenceUpdatedAfter returns the presence state of every user whose
+// presence has changed after the given position.
+func (p *PresenceCache) GetPresenceUpdatedAfter(position int64) []Presence {
+	p.RLock()
+	defer p.RUnlock()
+
+	var updated []Presence
+	for _, presence := range p.data {
+		if presence.syncPosition > position {
+			updated = append(updated, *presence)
+		}
+	}
+	return updated
+}
+
+// GetLatestSyncPosition returns the latest sync position for presence.
+func (p *PresenceCache) GetLatestSyncPosition() int64 {
+	p.RLock()
+	defer p.RUnlock()
+	return p.latestSyncPosition
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Receipt is the latest receipt of a given type that we know of for a user
+// in a room.
+type Receipt struct {
+	RoomID      string
+	ReceiptType string
+	UserID      string
+	EventID     string
+	Timestamp   gomatrixserverlib.Timestamp
+	// The receipt sync position at which this receipt was last updated.
+	syncPosition int64
+}
+
+type receiptKey struct {
+	receiptType string
+	userID      string
+}
+
+// ReceiptCache maintains the latest receipt of each type for each user in
+// each room, along with a sync position which advances every time any
+// receipt changes.
+type ReceiptCache struct {
+	sync.RWMutex
+	latestSyncPosition int64
+	data               map[string]map[receiptKey]*Receipt
+}
+
+// NewReceiptCache returns a new ReceiptCache initialised for use.
+func NewReceiptCache() *ReceiptCache {
+	return &ReceiptCache{data: make(map[string]map[receiptKey]*Receipt)}
+}
+
+// SetReceipt updates the receipt of the given type for a user in a room,
+// replacing any earlier receipt of that type.
+// Returns the latest sync position for receipts after update.
+func (r *ReceiptCache) SetReceipt(
+	roomID, receiptType, userID, eventID string, ts gomatrixserverlib.Timestamp,
+) int64 {
+	r.Lock()
+	defer r.Unlock()
+
+	r.latestSyncPosition++
+	room, ok := r.data[roomID]
+	if !ok {
+		room = make(map[receiptKey]*Receipt)
+		r.data[roomID] = room
+	}
+	room[receiptKey{receiptType, userID}] = &Receipt{
+		RoomID:       roomID,
+		ReceiptType:  receiptType,
+		UserID:       userID,
+		EventID:      eventID,
+		Timestamp:    ts,
+		syncPosition: r.latestSyncPosition,
+	}
+
+	return r.latestSyncPosition
+}
+
+// GetReceiptsUpdatedAfter returns every receipt in the room which has changed
+// after the given position.
+func (r *ReceiptCache) GetReceiptsUpdatedAfter(roomID string, position int64) []Receipt {
+	r.RLock()
+	defer r.RUnlock()
+
+	var updated []Receipt
+	for _, receipt := range r.data[roomID] {
+		if receipt.syncPosition > position {
+			updated = append(updated, *receipt)
+		}
+	}
+	return updated
+}
+
+// GetLatestSyncPosition returns the latest sync position for receipts.
+func (r *ReceiptCache) GetLatestSyncPosition() int64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.latestSyncPosition
+}
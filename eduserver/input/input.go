@@ -42,7 +42,39 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	request *api.InputTypingEventRequest,
 	response *api.InputTypingEventResponse,
 ) error {
-	ite := &request.InputTypingEvent
+	m, err := t.updateTyping(&request.InputTypingEvent)
+	if err != nil {
+		return err
+	}
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
+// InputTypingEvents implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputTypingEvents(
+	ctx context.Context,
+	request *api.InputTypingEventsRequest,
+	response *api.InputTypingEventsResponse,
+) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(request.InputTypingEvents))
+	for i := range request.InputTypingEvents {
+		m, err := t.updateTyping(&request.InputTypingEvents[i])
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, m)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	// The messages are keyed by room ID, so updates for the same room end up
+	// on the same partition in the order that they were given to us.
+	return t.Producer.SendMessages(msgs)
+}
+
+// updateTyping updates our current state of users typing and returns the
+// message to output for the update.
+func (t *EDUServerInputAPI) updateTyping(ite *api.InputTypingEvent) (*sarama.ProducerMessage, error) {
 	if ite.Typing {
 		// user is typing, update our current state of users typing.
 		expireTime := ite.OriginServerTS.Time().Add(
@@ -53,10 +85,10 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 		t.Cache.RemoveUser(ite.UserID, ite.RoomID)
 	}
 
-	return t.sendEvent(ite)
+	return t.typingMessage(ite)
 }
 
-func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
+func (t *EDUServerInputAPI) typingMessage(ite *api.InputTypingEvent) (*sarama.ProducerMessage, error) {
 	ev := &api.TypingEvent{
 		Type:   gomatrixserverlib.MTyping,
 		RoomID: ite.RoomID,
@@ -76,17 +108,14 @@ func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
 
 	eventJSON, err := json.Marshal(ote)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	m := &sarama.ProducerMessage{
+	return &sarama.ProducerMessage{
 		Topic: string(t.OutputTypingEventTopic),
 		Key:   sarama.StringEncoder(ite.RoomID),
 		Value: sarama.ByteEncoder(eventJSON),
-	}
-
-	_, _, err = t.Producer.SendMessage(m)
-	return err
+	}, nil
 }
 
 // SetupHTTP adds the EDUServerInputAPI handlers to the http.ServeMux.
@@ -104,4 +133,17 @@ func (t *EDUServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.EDUServerInputTypingEventsPath,
+		common.MakeInternalAPI("inputTypingEventsBatch", func(req *http.Request) util.JSONResponse {
+			var request api.InputTypingEventsRequest
+			var response api.InputTypingEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputTypingEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
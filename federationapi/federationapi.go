@@ -25,7 +25,9 @@ import (
 	// TODO: Are we really wanting to pull in the producer from clientapi
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/routing"
+	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
 // SetupFederationAPIComponent sets up and registers HTTP handlers for the
@@ -43,9 +45,20 @@ func SetupFederationAPIComponent(
 ) {
 	roomserverProducer := producers.NewRoomserverProducer(rsAPI)
 
+	// The database is optional, and without it the quarantine is only kept
+	// in memory.
+	var federationDB storage.Database
+	if base.Cfg.Database.FederationAPI != "" {
+		var err error
+		federationDB, err = storage.NewDatabase(string(base.Cfg.Database.FederationAPI), base.Cfg.DbProperties())
+		if err != nil {
+			logrus.WithError(err).Panic("failed to connect to federation api db")
+		}
+	}
+
 	routing.Setup(
 		base.APIMux, base.Cfg, rsAPI, asAPI, roomserverProducer,
 		eduProducer, federationSenderAPI, *keyRing,
-		federation, accountsDB, deviceDB,
+		federation, accountsDB, deviceDB, federationDB,
 	)
 }
@@ -0,0 +1,201 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// circuitBreaker stops us from making requests to remote servers which keep
+// failing, so that every incoming event which needs something from a server
+// that is down doesn't have to wait for its own request to time out. Once
+// threshold consecutive requests to a server have failed, the breaker for
+// that server opens and further requests fail immediately with a
+// circuitOpenError. After the cooldown the breaker half-opens and lets a
+// single request through: if it succeeds then the breaker closes again, and
+// if it fails then the breaker opens for another cooldown.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	servers   map[gomatrixserverlib.ServerName]*breakerState
+}
+
+// breakerState is the breaker for a single server. Servers whose breaker is
+// closed and which have no recent failures aren't in the map.
+type breakerState struct {
+	// The number of consecutive failed requests.
+	failures int
+	// When the breaker may next let a request through. Zero if the breaker
+	// is closed.
+	openUntil time.Time
+	// Whether the request which was let through after the cooldown is still
+	// in flight.
+	trial bool
+}
+
+// circuitOpenError is returned instead of making a request to a server whose
+// breaker is open. It is transient: the request can be retried once the
+// breaker lets requests through again.
+type circuitOpenError struct {
+	server gomatrixserverlib.ServerName
+	until  time.Time
+}
+
+func (e circuitOpenError) Error() string {
+	return fmt.Sprintf("not making requests to %q until %s after repeated failures", e.server, e.until.Format(time.RFC3339))
+}
+
+// newCircuitBreaker creates a circuitBreaker which opens after threshold
+// consecutive failures and stays open for the cooldown.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		servers:   make(map[gomatrixserverlib.ServerName]*breakerState),
+	}
+}
+
+// allow returns a circuitOpenError if no request should be made to the server
+// right now. Otherwise the caller must make the request and then call record
+// with its result.
+func (b *circuitBreaker) allow(server gomatrixserverlib.ServerName) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state, ok := b.servers[server]
+	if !ok || state.openUntil.IsZero() {
+		return nil
+	}
+	if state.trial || b.now().Before(state.openUntil) {
+		return circuitOpenError{server, state.openUntil}
+	}
+	// The cooldown has passed, so let this request through to find out
+	// whether the server has recovered.
+	state.trial = true
+	return nil
+}
+
+// openUntil returns when the breaker for the server will next let a request
+// through, and true, if the breaker is open right now. Unlike allow, it
+// doesn't let the trial request through once the cooldown has passed.
+func (b *circuitBreaker) openUntil(server gomatrixserverlib.ServerName) (time.Time, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state, ok := b.servers[server]
+	if !ok || state.openUntil.IsZero() || !b.now().Before(state.openUntil) {
+		return time.Time{}, false
+	}
+	return state.openUntil, true
+}
+
+// record updates the breaker for the server with the result of a request
+// that was allowed.
+func (b *circuitBreaker) record(server gomatrixserverlib.ServerName, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !isServerFailure(err) {
+		delete(b.servers, server)
+		return
+	}
+	state, ok := b.servers[server]
+	if !ok {
+		state = &breakerState{}
+		b.servers[server] = state
+	}
+	state.failures++
+	if state.trial || state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+		state.trial = false
+	}
+}
+
+// do calls fn to make a request to the server, unless the breaker for the
+// server is open.
+func (b *circuitBreaker) do(server gomatrixserverlib.ServerName, fn func() error) error {
+	if err := b.allow(server); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(server, err)
+	return err
+}
+
+// isServerFailure returns true if the error from a request means that the
+// server is unavailable or broken, rather than that it gave us a proper
+// answer such as a 404 or that we gave up on the request ourselves.
+func isServerFailure(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case gomatrix.HTTPError:
+		return e.Code >= 500
+	}
+	return err != context.Canceled
+}
+
+// breakingFederationClient is a txnFederationClient which makes its requests
+// through a circuitBreaker.
+type breakingFederationClient struct {
+	txnFederationClient
+	breaker *circuitBreaker
+}
+
+func (c *breakingFederationClient) LookupState(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (res gomatrixserverlib.RespState, err error) {
+	err = c.breaker.do(s, func() error {
+		res, err = c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+		return err
+	})
+	return
+}
+
+func (c *breakingFederationClient) LookupStateIDs(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string,
+) (res gomatrixserverlib.RespStateIDs, err error) {
+	err = c.breaker.do(s, func() error {
+		res, err = c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+		return err
+	})
+	return
+}
+
+func (c *breakingFederationClient) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (res gomatrixserverlib.Transaction, err error) {
+	err = c.breaker.do(s, func() error {
+		res, err = c.txnFederationClient.GetEvent(ctx, s, eventID)
+		return err
+	})
+	return
+}
+
+func (c *breakingFederationClient) LookupMissingEvents(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (res gomatrixserverlib.RespMissingEvents, err error) {
+	err = c.breaker.do(s, func() error {
+		res, err = c.txnFederationClient.LookupMissingEvents(ctx, s, roomID, missing, roomVersion)
+		return err
+	})
+	return
+}
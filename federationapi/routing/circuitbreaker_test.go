@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// failingFedClient is a txnFederationClient whose /state_ids requests return err, counting how many requests were
+// made to each server.
+type failingFedClient struct {
+	txnFederationClient
+	err   error
+	calls map[gomatrixserverlib.ServerName]int
+}
+
+func (c *failingFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error) {
+	c.calls[s]++
+	return res, c.err
+}
+
+// The purpose of this test is to check that the breaker for a server opens after the configured number of failures,
+// failing further requests without making them, and that after the cooldown it lets a single trial request through
+// which either closes the breaker again or re-opens it.
+func TestCircuitBreaker(t *testing.T) {
+	const threshold = 3
+	const cooldown = time.Minute
+	now := time.Unix(1500000000, 0)
+	breaker := newCircuitBreaker(threshold, cooldown)
+	breaker.now = func() time.Time { return now }
+	fed := &failingFedClient{
+		err:   errors.New("connection refused"),
+		calls: make(map[gomatrixserverlib.ServerName]int),
+	}
+	cli := &breakingFederationClient{fed, breaker}
+	lookup := func(s gomatrixserverlib.ServerName) error {
+		_, err := cli.LookupStateIDs(context.Background(), s, "!room:"+string(s), "$event:"+string(s))
+		return err
+	}
+
+	for i := 0; i < threshold; i++ {
+		if err := lookup("down"); err != fed.err {
+			t.Fatalf("request %d: expected the error from the server, got %v", i, err)
+		}
+	}
+	if err := lookup("down"); err == nil {
+		t.Fatalf("expected an error once the breaker is open")
+	} else if _, ok := err.(circuitOpenError); !ok {
+		t.Fatalf("expected a circuitOpenError once the breaker is open, got %v", err)
+	}
+	if fed.calls["down"] != threshold {
+		t.Errorf("expected no request to be made once the breaker is open, got %d requests", fed.calls["down"])
+	}
+	// Other servers aren't affected.
+	if err := lookup("up"); err != fed.err {
+		t.Errorf("expected a request to another server to be made, got %v", err)
+	}
+
+	// After the cooldown the breaker half-opens: the trial fails, so the
+	// breaker opens again straight away without waiting for more failures.
+	now = now.Add(cooldown)
+	if err := lookup("down"); err != fed.err {
+		t.Fatalf("expected a trial request after the cooldown, got %v", err)
+	}
+	if _, ok := lookup("down").(circuitOpenError); !ok {
+		t.Fatalf("expected the breaker to re-open after the trial request failed")
+	}
+	if fed.calls["down"] != threshold+1 {
+		t.Errorf("expected a single trial request, got %d requests in total", fed.calls["down"])
+	}
+
+	// Only one trial request is let through at a time.
+	now = now.Add(cooldown)
+	if err := breaker.allow("down"); err != nil {
+		t.Fatalf("expected the trial request to be allowed, got %v", err)
+	}
+	if _, ok := breaker.allow("down").(circuitOpenError); !ok {
+		t.Errorf("expected other requests to fail while the trial request is in flight")
+	}
+	// The trial succeeds, so the breaker closes.
+	breaker.record("down", nil)
+	fed.err = nil
+	for i := 0; i < threshold+1; i++ {
+		if err := lookup("down"); err != nil {
+			t.Fatalf("expected requests to be made once the breaker has closed, got %v", err)
+		}
+	}
+}
+
+// The purpose of this test is to check that answers from a server which mean that it is working, such as a 404, and
+// requests which we cancelled ourselves, aren't counted as failures.
+func TestCircuitBreakerIgnoresNonServerFailures(t *testing.T) {
+	breaker := newCircuitBreaker(1, time.Minute)
+	for _, err := range []error{
+		gomatrix.HTTPError{Code: http.StatusNotFound},
+		gomatrix.HTTPError{Code: http.StatusForbidden},
+		context.Canceled,
+	} {
+		breaker.record("remote", err)
+		if allowErr := breaker.allow("remote"); allowErr != nil {
+			t.Errorf("expected the breaker to stay closed after %v, got %v", err, allowErr)
+		}
+	}
+	breaker.record("remote", gomatrix.HTTPError{Code: http.StatusBadGateway})
+	if _, ok := breaker.allow("remote").(circuitOpenError); !ok {
+		t.Errorf("expected the breaker to open after a 502")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// eduTypeReceipt is the type of read receipt EDUs.
+const eduTypeReceipt = "m.receipt"
+
+// eduContentValidators check the content of each type of EDU that we know
+// about before it is processed, so that EDUs which are missing required
+// fields or have values that make no sense are rejected up front rather than
+// being passed on to the EDU server. Fields that we don't know about are
+// allowed, as servers may send fields from newer versions of the spec.
+var eduContentValidators = map[string]func(content []byte) error{
+	gomatrixserverlib.MTyping: validateTypingEDU,
+	eduTypeReceipt:            validateReceiptEDU,
+}
+
+// validateEDUContent returns an error if the content of the EDU isn't valid
+// for its type. EDUs of types without a validator are always valid.
+func validateEDUContent(e gomatrixserverlib.EDU) error {
+	validate, ok := eduContentValidators[e.Type]
+	if !ok {
+		return nil
+	}
+	return validate(e.Content)
+}
+
+// https://matrix.org/docs/spec/server_server/latest#typing-notifications
+func validateTypingEDU(content []byte) error {
+	var typing struct {
+		RoomID *string `json:"room_id"`
+		UserID *string `json:"user_id"`
+		Typing *bool   `json:"typing"`
+	}
+	if err := json.Unmarshal(content, &typing); err != nil {
+		return err
+	}
+	if typing.RoomID == nil {
+		return fmt.Errorf("missing room_id")
+	}
+	if _, _, err := gomatrixserverlib.SplitID('!', *typing.RoomID); err != nil {
+		return fmt.Errorf("invalid room_id: %s", err)
+	}
+	if typing.UserID == nil {
+		return fmt.Errorf("missing user_id")
+	}
+	if _, _, err := gomatrixserverlib.SplitID('@', *typing.UserID); err != nil {
+		return fmt.Errorf("invalid user_id: %s", err)
+	}
+	if typing.Typing == nil {
+		return fmt.Errorf("missing typing")
+	}
+	return nil
+}
+
+// https://matrix.org/docs/spec/server_server/latest#receipts
+func validateReceiptEDU(content []byte) error {
+	// The content maps room IDs to receipt types to user IDs to the receipt.
+	var rooms map[string]map[string]map[string]struct {
+		EventIDs []string `json:"event_ids"`
+		Data     *struct {
+			TS *int64 `json:"ts"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(content, &rooms); err != nil {
+		return err
+	}
+	for roomID, receiptTypes := range rooms {
+		if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+			return fmt.Errorf("invalid room ID %q: %s", roomID, err)
+		}
+		for receiptType, users := range receiptTypes {
+			for userID, receipt := range users {
+				if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+					return fmt.Errorf("invalid user ID %q in %s receipt for room %s: %s", userID, receiptType, roomID, err)
+				}
+				if len(receipt.EventIDs) == 0 {
+					return fmt.Errorf("missing event_ids in %s receipt from %s for room %s", receiptType, userID, roomID)
+				}
+				for _, eventID := range receipt.EventIDs {
+					if eventID == "" || eventID[0] != '$' {
+						return fmt.Errorf("invalid event ID %q in %s receipt from %s for room %s", eventID, receiptType, userID, roomID)
+					}
+				}
+				if receipt.Data == nil || receipt.Data.TS == nil {
+					return fmt.Errorf("missing ts in %s receipt from %s for room %s", receiptType, userID, roomID)
+				}
+				if *receipt.Data.TS < 0 {
+					return fmt.Errorf("negative ts in %s receipt from %s for room %s", receiptType, userID, roomID)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// checkEventJSON checks that event JSON from another server has exactly one
+// canonical form. The JSON is re-encoded in canonical form before its hashes
+// and signatures are checked, and that re-encoding quietly replaces invalid
+// UTF-8 and keeps duplicate keys, so for such JSON the event that we check
+// isn't necessarily the event that the sender signed. Whitespace and the order
+// of keys don't matter, since they don't change the canonical form, and other
+// servers aren't required to send canonical JSON.
+func checkEventJSON(eventJSON []byte) error {
+	if !utf8.Valid(eventJSON) {
+		return errors.New("event JSON isn't valid UTF-8")
+	}
+	if !json.Valid(eventJSON) {
+		return errors.New("event JSON isn't valid JSON")
+	}
+	if err := checkUnicodeEscapes(eventJSON); err != nil {
+		return err
+	}
+	return checkDuplicateKeys(eventJSON)
+}
+
+// checkUnicodeEscapes checks that every \u escape of a UTF-16 surrogate in
+// the strings of the JSON is part of a pair, since a lone surrogate isn't
+// valid UTF-8 once unescaped. The JSON must be valid.
+func checkUnicodeEscapes(eventJSON []byte) error {
+	inString := false
+	for i := 0; i < len(eventJSON); i++ {
+		switch eventJSON[i] {
+		case '"':
+			inString = !inString
+		case '\\':
+			// Backslashes only appear in strings, and always escape something.
+			i++
+			if eventJSON[i] != 'u' {
+				continue
+			}
+			r := unicodeEscape(eventJSON[i+1 : i+5])
+			i += 4
+			if !utf16.IsSurrogate(r) {
+				continue
+			}
+			var next rune
+			if r < 0xDC00 && i+6 < len(eventJSON) && eventJSON[i+1] == '\\' && eventJSON[i+2] == 'u' {
+				next = unicodeEscape(eventJSON[i+3 : i+7])
+			}
+			if utf16.DecodeRune(r, next) == utf8.RuneError {
+				return fmt.Errorf("event JSON has an unpaired UTF-16 surrogate \\u%04x", r)
+			}
+			i += 6
+		}
+	}
+	return nil
+}
+
+// unicodeEscape returns the rune for the four hex digits of a \u escape.
+func unicodeEscape(hex []byte) rune {
+	r, err := strconv.ParseUint(string(hex), 16, 16)
+	if err != nil {
+		return utf8.RuneError
+	}
+	return rune(r)
+}
+
+// checkDuplicateKeys checks that no object in the JSON has the same key more
+// than once. The JSON must be valid.
+func checkDuplicateKeys(eventJSON []byte) error {
+	type container struct {
+		// The keys seen so far if this is an object, or nil for an array.
+		keys map[string]bool
+		// Whether the next token in this object is a key.
+		wantKey bool
+	}
+	// The objects and arrays that the decoder is inside, innermost last.
+	var containers []*container
+	decoder := json.NewDecoder(bytes.NewReader(eventJSON))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var parent *container
+		if len(containers) > 0 {
+			parent = containers[len(containers)-1]
+		}
+		switch token {
+		case json.Delim('}'), json.Delim(']'):
+			containers = containers[:len(containers)-1]
+			continue
+		}
+		if parent != nil && parent.keys != nil {
+			if parent.wantKey {
+				key := token.(string)
+				if parent.keys[key] {
+					return fmt.Errorf("event JSON has duplicate key %q", key)
+				}
+				parent.keys[key] = true
+				parent.wantKey = false
+				continue
+			}
+			parent.wantKey = true
+		}
+		switch token {
+		case json.Delim('{'):
+			containers = append(containers, &container{keys: make(map[string]bool), wantKey: true})
+		case json.Delim('['):
+			containers = append(containers, &container{})
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckEventJSON(t *testing.T) {
+	testCases := []struct {
+		name      string
+		eventJSON string
+		valid     bool
+	}{
+		{"compact", `{"content":{"body":"hi"},"type":"m.room.message"}`, true},
+		{"whitespace", "{ \"content\" : {\n\t\"body\": \"hi\" },\r\n \"type\":\"m.room.message\" }", true},
+		{"unsorted keys", `{"type":"m.room.message","content":{"body":"hi"}}`, true},
+		{"same key in different objects", `{"body":"hi","content":{"body":"hi"},"list":[{"body":1},{"body":2}]}`, true},
+		{"escaped surrogate pair", `{"content":{"body":"\ud83d\ude00"}}`, true},
+		{"escaped backslash before u", `{"content":{"body":"\\ud800"}}`, true},
+		{"invalid UTF-8", "{\"content\":{\"body\":\"\xff\xfe\"}}", false},
+		{"truncated UTF-8", "{\"content\":{\"body\":\"\xe2\x82\"}}", false},
+		{"lone high surrogate", `{"content":{"body":"\ud83d"}}`, false},
+		{"lone low surrogate", `{"content":{"body":"\ude00"}}`, false},
+		{"high surrogate without low", `{"content":{"body":"\ud83dA"}}`, false},
+		{"duplicate key", `{"content":{"body":"hi"},"content":{"body":"bye"}}`, false},
+		{"nested duplicate key", `{"content":{"list":[{"a":1,"a":2}]}}`, false},
+		{"invalid JSON", `{"content":`, false},
+	}
+	for _, tc := range testCases {
+		err := checkEventJSON([]byte(tc.eventJSON))
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected the JSON to be accepted, got %s", tc.name, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("%s: expected the JSON to be rejected", tc.name)
+		}
+	}
+}
+
+// The purpose of this test is to check that an event whose content isn't valid UTF-8 fails the transaction with an
+// unmarshalError, before its hashes or signatures are checked.
+func TestTransactionInvalidUTF8Event(t *testing.T) {
+	pdu := bytes.Replace(testData[len(testData)-1], []byte(`"body":"Test Message"`), []byte("\"body\":\"Test \xc0 Message\""), 1)
+	txn := mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, []json.RawMessage{pdu})
+	_, err := txn.processTransaction()
+	if _, ok := err.(unmarshalError); !ok {
+		t.Fatalf("txn.processTransaction returned %v, want an unmarshalError", err)
+	}
+}
+
+// The purpose of this test is to check that an event which only differs from the signed event by insignificant
+// whitespace is accepted, and is passed to the roomserver exactly as it was signed, rather than with its content
+// redacted because the hashes didn't match.
+func TestTransactionEventWithWhitespace(t *testing.T) {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, testData[len(testData)-1], "", "  "); err != nil {
+		t.Fatalf("failed to indent event JSON: %s", err)
+	}
+	rsAPI := basicStateRoomserverAPI()
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{indented.Bytes()})
+	mustProcessTransaction(t, txn, nil)
+	want := testEvents[len(testEvents)-1]
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Fatalf("wrong number of InputRoomEvents: got %d want 1", len(rsAPI.inputRoomEvents))
+	}
+	if got := rsAPI.inputRoomEvents[0].Event; !bytes.Equal(got.JSON(), want.JSON()) {
+		t.Errorf("wrong event JSON: got %s want %s", string(got.JSON()), string(want.JSON()))
+	}
+}
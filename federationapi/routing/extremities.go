@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// FederationAPIRoomExtremitiesPath is the HTTP path for the internal room
+// extremities API.
+const FederationAPIRoomExtremitiesPath = "/api/federationapi/roomExtremities"
+
+// RoomExtremitiesRequest is a request for the forward extremities of a room.
+type RoomExtremitiesRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+// RoomExtremitiesResponse describes the forward extremities of a room, which
+// are the events that the next event we send in the room will reference.
+type RoomExtremitiesResponse struct {
+	RoomID string `json:"room_id"`
+	// The IDs of the latest events in the room.
+	LatestEventIDs []string `json:"latest_event_ids"`
+	// One greater than the maximum depth of the latest events.
+	Depth int64 `json:"depth"`
+}
+
+// SetupRoomExtremitiesHTTP registers the internal room extremities API with
+// the given ServeMux. It only reads from the roomserver, so it can be used to
+// find out why a room appears to be stuck without changing anything.
+func SetupRoomExtremitiesHTTP(
+	servMux *http.ServeMux,
+	rsAPI api.RoomserverInternalAPI,
+) {
+	servMux.Handle(FederationAPIRoomExtremitiesPath,
+		common.MakeInternalAPI("roomExtremities", func(req *http.Request) util.JSONResponse {
+			var request RoomExtremitiesRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+				}
+			}
+			response, err := roomExtremities(req.Context(), rsAPI, request.RoomID)
+			switch err.(type) {
+			case nil:
+				return util.JSONResponse{Code: http.StatusOK, JSON: response}
+			case roomNotFoundError:
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound(err.Error()),
+				}
+			default:
+				util.GetLogger(req.Context()).WithError(err).Error("roomExtremities failed")
+				return jsonerror.InternalServerError()
+			}
+		}),
+	)
+}
+
+// roomExtremities looks up the forward extremities of the room from the
+// roomserver. Returns a roomNotFoundError if the roomserver doesn't know
+// about the room.
+func roomExtremities(
+	ctx context.Context,
+	rsAPI api.RoomserverInternalAPI,
+	roomID string,
+) (*RoomExtremitiesResponse, error) {
+	// The roomserver returns all of the current state if we don't ask for
+	// anything in particular, so ask for just the create event.
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+		},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	if !res.RoomExists {
+		return nil, roomNotFoundError{roomID}
+	}
+	response := &RoomExtremitiesResponse{
+		RoomID:         roomID,
+		LatestEventIDs: make([]string, 0, len(res.LatestEvents)),
+		Depth:          res.Depth,
+	}
+	for _, ref := range res.LatestEvents {
+		response.LatestEventIDs = append(response.LatestEventIDs, ref.EventID)
+	}
+	return response, nil
+}
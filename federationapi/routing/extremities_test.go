@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that the room extremities API returns the latest events and depth of a room
+// that the roomserver knows about, asking it for as little state as possible, and a 404 for a room that it doesn't.
+func TestRoomExtremities(t *testing.T) {
+	const knownRoomID = "!roomid:kaer.morhen"
+	latest := testEvents[len(testEvents)-1]
+	rsAPI := &testRoomserverAPI{
+		queryLatestEventsAndState: func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+			if len(req.StateToFetch) == 0 {
+				t.Errorf("expected the request to be limited to some state, got a request for all of it")
+			}
+			if req.RoomID != knownRoomID {
+				return api.QueryLatestEventsAndStateResponse{}
+			}
+			return api.QueryLatestEventsAndStateResponse{
+				RoomExists:   true,
+				RoomVersion:  testRoomVersion,
+				LatestEvents: []gomatrixserverlib.EventReference{latest.EventReference()},
+				Depth:        latest.Depth() + 1,
+			}
+		},
+	}
+	servMux := http.NewServeMux()
+	SetupRoomExtremitiesHTTP(servMux, rsAPI)
+
+	roomExtremitiesRequest := func(roomID string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(RoomExtremitiesRequest{RoomID: roomID})
+		if err != nil {
+			t.Fatalf("failed to marshal request: %s", err)
+		}
+		req := httptest.NewRequest(http.MethodPost, FederationAPIRoomExtremitiesPath, bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		servMux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := roomExtremitiesRequest(knownRoomID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status code for a known room: got %d want %d", rec.Code, http.StatusOK)
+	}
+	var res RoomExtremitiesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	want := RoomExtremitiesResponse{
+		RoomID:         knownRoomID,
+		LatestEventIDs: []string{latest.EventID()},
+		Depth:          latest.Depth() + 1,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("wrong response: got %+v want %+v", res, want)
+	}
+
+	rec = roomExtremitiesRequest("!unknown:kaer.morhen")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for an unknown room: got %d want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fetchBudget bounds the number of requests that we make to other servers to
+// fill in the gap before a single incoming event. Filling in the gap can mean
+// processing the auth events in the state before the event, which may have
+// gaps of their own, so without a budget one event could set off an unbounded
+// cascade of requests.
+type fetchBudget struct {
+	mutex     sync.Mutex
+	remaining int
+	max       int
+}
+
+type fetchBudgetContextKey struct{}
+
+type fetchBudgetExhaustedError struct {
+	max int
+}
+
+func (e fetchBudgetExhaustedError) Error() string {
+	return fmt.Sprintf("used up the budget of %d requests to fill in the gap before the event", e.max)
+}
+
+// withFetchBudget returns a context which allows up to max requests through
+// a budgetedFederationClient. If the context already has a budget then it is
+// returned unchanged, so that the whole cascade shares one budget.
+func withFetchBudget(ctx context.Context, max int) context.Context {
+	if fetchBudgetFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, fetchBudgetContextKey{}, &fetchBudget{remaining: max, max: max})
+}
+
+func fetchBudgetFromContext(ctx context.Context) *fetchBudget {
+	budget, _ := ctx.Value(fetchBudgetContextKey{}).(*fetchBudget)
+	return budget
+}
+
+// take uses up one request from the budget. Returns an error if there are
+// none left. If b is nil then there is no limit.
+func (b *fetchBudget) take() error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.remaining <= 0 {
+		return fetchBudgetExhaustedError{b.max}
+	}
+	b.remaining--
+	return nil
+}
+
+// budgetedFederationClient is a txnFederationClient which takes each request
+// from the fetch budget in the request context, if there is one.
+type budgetedFederationClient struct {
+	txnFederationClient
+}
+
+func (c *budgetedFederationClient) LookupState(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespState, error) {
+	if err := fetchBudgetFromContext(ctx).take(); err != nil {
+		return gomatrixserverlib.RespState{}, err
+	}
+	return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *budgetedFederationClient) LookupStateIDs(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string,
+) (gomatrixserverlib.RespStateIDs, error) {
+	if err := fetchBudgetFromContext(ctx).take(); err != nil {
+		return gomatrixserverlib.RespStateIDs{}, err
+	}
+	return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+func (c *budgetedFederationClient) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	if err := fetchBudgetFromContext(ctx).take(); err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	return c.txnFederationClient.GetEvent(ctx, s, eventID)
+}
+
+func (c *budgetedFederationClient) LookupMissingEvents(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespMissingEvents, error) {
+	if err := fetchBudgetFromContext(ctx).take(); err != nil {
+		return gomatrixserverlib.RespMissingEvents{}, err
+	}
+	return c.txnFederationClient.LookupMissingEvents(ctx, s, roomID, missing, roomVersion)
+}
@@ -0,0 +1,102 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fetchCountingFedClient is a txnFederationClient which counts every request made to it.
+type fetchCountingFedClient struct {
+	txnFederationClient
+	calls int
+}
+
+func (c *fetchCountingFedClient) LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespState, err error,
+) {
+	c.calls++
+	return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *fetchCountingFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error) {
+	c.calls++
+	return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+func (c *fetchCountingFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
+	c.calls++
+	return c.txnFederationClient.GetEvent(ctx, s, eventID)
+}
+
+// The purpose of this test is to check that when we are missing all of the state before an event, so that every
+// state event has to be fetched, the total number of requests made to the sender is capped by the fetch budget and
+// the event is skipped as one to retry later, and that a budget big enough for the whole gap lets the event through.
+func TestTransactionFetchBudget(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+		// The roomserver has none of the state, so every state event needs an /event request.
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			return api.QueryEventsByIDResponse{QueryEventsByIDRequest: *req}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	var stateEventIDs []string
+	getEvent := make(map[string]gomatrixserverlib.Transaction)
+	for _, ev := range testStateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+		getEvent[ev.EventID()] = gomatrixserverlib.Transaction{PDUs: []json.RawMessage{ev.JSON()}}
+	}
+	fedClient := &txnFedClient{
+		stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+			inputEvent.EventID(): {
+				StateEventIDs: stateEventIDs,
+				AuthEventIDs:  stateEventIDs,
+			},
+		},
+		getEvent: getEvent,
+	}
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+
+	const budget = 3
+	counter := &fetchCountingFedClient{txnFederationClient: fedClient}
+	txn := mustCreateTransaction(rsAPI, &budgetedFederationClient{counter}, pdus)
+	txn.maxFetchesPerEvent = budget
+	resp, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	if counter.calls != budget {
+		t.Errorf("wrong number of requests: got %d want %d", counter.calls, budget)
+	}
+	result := resp.PDUs[inputEvent.EventID()]
+	if !strings.HasPrefix(result.Error, pduErrorMissingPrevEvents+": ") {
+		t.Errorf("wrong error once the budget was used up: got %q want prefix %s", result.Error, pduErrorMissingPrevEvents)
+	}
+	if !txn.missingPrevEvents {
+		t.Errorf("expected the event to be marked for retrying later")
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+
+	// One /state_ids request and one /event request per state event fits in this budget.
+	counter = &fetchCountingFedClient{txnFederationClient: fedClient}
+	txn = mustCreateTransaction(rsAPI, &budgetedFederationClient{counter}, pdus)
+	txn.maxFetchesPerEvent = 1 + len(stateEventIDs)
+	mustProcessTransaction(t, txn, nil)
+	if counter.calls != 1+len(stateEventIDs) {
+		t.Errorf("wrong number of requests: got %d want %d", counter.calls, 1+len(stateEventIDs))
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fetchLimiter bounds the number of concurrent requests that we make to any
+// one remote server to fill in gaps for incoming events, so that a burst of
+// events with missing prev_events doesn't flood that server with requests.
+// Requests over the limit wait for a free slot. Identical requests which are
+// already in flight are coalesced, so that they are only made once.
+type fetchLimiter struct {
+	mutex    sync.Mutex
+	limit    int
+	servers  map[gomatrixserverlib.ServerName]*serverSlots
+	inFlight map[string]*fetchCall
+}
+
+// serverSlots is the semaphore for a single server. refs counts the requests
+// that are holding or waiting for a slot so that we know when it is safe to
+// remove the server from the map.
+type serverSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// fetchCall is a request which is in flight. done is closed once res and err
+// have been set.
+type fetchCall struct {
+	done chan struct{}
+	res  interface{}
+	err  error
+}
+
+// newFetchLimiter creates a fetchLimiter which allows up to limit requests to
+// each server at the same time.
+func newFetchLimiter(limit int) *fetchLimiter {
+	return &fetchLimiter{
+		limit:    limit,
+		servers:  make(map[gomatrixserverlib.ServerName]*serverSlots),
+		inFlight: make(map[string]*fetchCall),
+	}
+}
+
+// do makes a request to the server by calling fn once a slot for the server
+// is free. If a request with the same key is already in flight then it waits
+// for the result of that request instead.
+func (l *fetchLimiter) do(
+	ctx context.Context, server gomatrixserverlib.ServerName, key string, fn func() (interface{}, error),
+) (interface{}, error) {
+	l.mutex.Lock()
+	if call, ok := l.inFlight[key]; ok {
+		l.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.res, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &fetchCall{done: make(chan struct{})}
+	l.inFlight[key] = call
+	slots, ok := l.servers[server]
+	if !ok {
+		slots = &serverSlots{slots: make(chan struct{}, l.limit)}
+		l.servers[server] = slots
+	}
+	slots.refs++
+	l.mutex.Unlock()
+
+	select {
+	case slots.slots <- struct{}{}:
+		call.res, call.err = fn()
+		<-slots.slots
+	case <-ctx.Done():
+		call.err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	delete(l.inFlight, key)
+	slots.refs--
+	if slots.refs == 0 {
+		delete(l.servers, server)
+	}
+	l.mutex.Unlock()
+	close(call.done)
+	return call.res, call.err
+}
+
+// limitedFederationClient is a txnFederationClient which makes its requests
+// through a fetchLimiter.
+type limitedFederationClient struct {
+	txnFederationClient
+	limiter *fetchLimiter
+}
+
+func (c *limitedFederationClient) LookupState(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespState, error) {
+	res, err := c.limiter.do(ctx, s, "state "+string(s)+" "+eventID, func() (interface{}, error) {
+		return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+	})
+	if err != nil {
+		return gomatrixserverlib.RespState{}, err
+	}
+	return res.(gomatrixserverlib.RespState), nil
+}
+
+func (c *limitedFederationClient) LookupStateIDs(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string,
+) (gomatrixserverlib.RespStateIDs, error) {
+	res, err := c.limiter.do(ctx, s, "state_ids "+string(s)+" "+eventID, func() (interface{}, error) {
+		return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+	})
+	if err != nil {
+		return gomatrixserverlib.RespStateIDs{}, err
+	}
+	return res.(gomatrixserverlib.RespStateIDs), nil
+}
+
+func (c *limitedFederationClient) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	res, err := c.limiter.do(ctx, s, "event "+string(s)+" "+eventID, func() (interface{}, error) {
+		return c.txnFederationClient.GetEvent(ctx, s, eventID)
+	})
+	if err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	return res.(gomatrixserverlib.Transaction), nil
+}
+
+func (c *limitedFederationClient) LookupMissingEvents(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespMissingEvents, error) {
+	key := "get_missing_events " + string(s) + " " + roomID + " " + strings.Join(missing.LatestEvents, ",")
+	res, err := c.limiter.do(ctx, s, key, func() (interface{}, error) {
+		return c.txnFederationClient.LookupMissingEvents(ctx, s, roomID, missing, roomVersion)
+	})
+	if err != nil {
+		return gomatrixserverlib.RespMissingEvents{}, err
+	}
+	return res.(gomatrixserverlib.RespMissingEvents), nil
+}
@@ -0,0 +1,147 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// concurrencyCountingFedClient wraps a txnFedClient, holding each request for a short while and recording the
+// greatest number of requests that were in flight at the same time.
+type concurrencyCountingFedClient struct {
+	txnFederationClient
+	mutex       sync.Mutex
+	calls       int
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *concurrencyCountingFedClient) track() func() {
+	c.mutex.Lock()
+	c.calls++
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	return func() {
+		c.mutex.Lock()
+		c.inFlight--
+		c.mutex.Unlock()
+	}
+}
+
+func (c *concurrencyCountingFedClient) LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespState, err error,
+) {
+	defer c.track()()
+	return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *concurrencyCountingFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error) {
+	defer c.track()()
+	return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+func (c *concurrencyCountingFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
+	defer c.track()()
+	return c.txnFederationClient.GetEvent(ctx, s, eventID)
+}
+
+// The purpose of this test is to check that when several transactions from the same origin contain events with
+// missing prev_events, the requests made to that origin to fill in the gaps never exceed the per-server limit, and
+// that the requests over the limit are queued rather than failed.
+func TestFetchLimiterPerServerCap(t *testing.T) {
+	const numEvents = 6
+	const limit = 2
+	pdus := siblingMessages(numEvents)
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(testEvents[:5])
+	cli := &txnFedClient{
+		// /state_ids is unset, so each event needs two requests: /state_ids and then /state
+		state: make(map[string]gomatrixserverlib.RespState),
+	}
+	for _, pdu := range pdus {
+		var header struct {
+			EventID string `json:"event_id"`
+		}
+		if err := json.Unmarshal(pdu, &header); err != nil {
+			t.Fatalf("failed to unmarshal event ID: %s", err)
+		}
+		cli.state[header.EventID] = gomatrixserverlib.RespState{
+			AuthEvents:  stateEvents,
+			StateEvents: stateEvents,
+		}
+	}
+	counter := &concurrencyCountingFedClient{txnFederationClient: cli}
+	limiter := newFetchLimiter(limit)
+
+	var wg sync.WaitGroup
+	for _, pdu := range pdus {
+		rsAPI := &testRoomserverAPI{
+			queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+				return api.QueryStateAfterEventsResponse{
+					PrevEventsExist: false,
+					RoomExists:      true,
+				}
+			},
+		}
+		txn := mustCreateTransaction(rsAPI, &limitedFederationClient{counter, limiter}, []json.RawMessage{pdu})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mustProcessTransaction(t, txn, nil)
+			if len(rsAPI.inputRoomEvents) != len(stateEvents)+1 {
+				t.Errorf("wrong number of InputRoomEvents: got %d want %d", len(rsAPI.inputRoomEvents), len(stateEvents)+1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter.calls != numEvents*2 {
+		t.Errorf("wrong number of requests: got %d want %d", counter.calls, numEvents*2)
+	}
+	if counter.maxInFlight > limit {
+		t.Errorf("too many concurrent requests to the origin: got %d want at most %d", counter.maxInFlight, limit)
+	}
+}
+
+// The purpose of this test is to check that identical requests which are in flight at the same time are only made
+// once, with every caller getting the same result.
+func TestFetchLimiterCoalescesRequests(t *testing.T) {
+	event := testEvents[len(testEvents)-1]
+	counter := &concurrencyCountingFedClient{txnFederationClient: &txnFedClient{
+		getEvent: map[string]gomatrixserverlib.Transaction{
+			event.EventID(): gomatrixserverlib.Transaction{
+				PDUs: []json.RawMessage{event.JSON()},
+			},
+		},
+	}}
+	cli := &limitedFederationClient{counter, newFetchLimiter(1)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := cli.GetEvent(context.Background(), testOrigin, event.EventID())
+			if err != nil {
+				t.Errorf("GetEvent returned an error: %s", err)
+				return
+			}
+			if len(res.PDUs) != 1 {
+				t.Errorf("wrong number of PDUs: got %d want 1", len(res.PDUs))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter.calls != 1 {
+		t.Errorf("expected identical requests to be coalesced into 1, got %d", counter.calls)
+	}
+}
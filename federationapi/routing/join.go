@@ -152,7 +152,7 @@ func SendJoin(
 		}
 	}
 
-	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
+	event, err := parseUntrustedEvent(httpReq.Context(), request.Content(), verRes.RoomVersion)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -268,6 +268,7 @@ func SendJoin(
 			},
 			cfg.Matrix.ServerName,
 			nil,
+			request.Origin(),
 		)
 		if err != nil {
 			util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
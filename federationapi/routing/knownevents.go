@@ -0,0 +1,82 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// eventReference works out the reference of the event JSON in the given room
+// version without checking the hashes or signatures of the event. The
+// reference hash covers the redacted event, so unlike the event ID in the
+// JSON of events in room versions 1 and 2 it can't be claimed by a different
+// event. ok is false if the JSON isn't a usable event.
+func eventReference(eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion) (gomatrixserverlib.EventReference, bool) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, roomVersion)
+	if err != nil {
+		return gomatrixserverlib.EventReference{}, false
+	}
+	return referenceOfEvent(event)
+}
+
+// referenceOfEvent returns the reference of the event, or false if it can't
+// be worked out.
+func referenceOfEvent(event gomatrixserverlib.Event) (ref gomatrixserverlib.EventReference, ok bool) {
+	// EventReference panics if the JSON of the event isn't valid, since it
+	// expects to be given trusted events.
+	defer func() {
+		if r := recover(); r != nil {
+			ref, ok = gomatrixserverlib.EventReference{}, false
+		}
+	}()
+	ref = event.EventReference()
+	return ref, ref.EventID != ""
+}
+
+// queryKnownEvents asks the roomserver which of the events it already has, so
+// that events which are sent to us again, e.g. while the sender catches up,
+// don't have to be parsed, verified and processed again. An event is only
+// known if the event that the roomserver has with the same ID also has the
+// same reference hash. References without an event ID are ignored. Returns
+// the IDs of the known events.
+func (t *txnReq) queryKnownEvents(ctx context.Context, refs []gomatrixserverlib.EventReference) (map[string]bool, error) {
+	var queryReq api.QueryEventsExistByIDRequest
+	for _, ref := range refs {
+		if ref.EventID != "" {
+			queryReq.EventIDs = append(queryReq.EventIDs, ref.EventID)
+		}
+	}
+	if len(queryReq.EventIDs) == 0 {
+		return nil, nil
+	}
+	var queryRes api.QueryEventsExistByIDResponse
+	if err := t.rsAPI.QueryEventsExistByID(ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	if len(queryRes.ReferenceSHA256) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, ref := range refs {
+		if sha, ok := queryRes.ReferenceSHA256[ref.EventID]; ok && bytes.Equal(sha, ref.EventSHA256) {
+			known[ref.EventID] = true
+		}
+	}
+	return known, nil
+}
@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that events in a transaction which the roomserver already has are reported as
+// processed without being parsed, verified or sent to the roomserver again, and that an event whose ID belongs to a
+// different stored event is still processed as usual.
+func TestTransactionSkipsKnownEvents(t *testing.T) {
+	pdus := siblingMessages(3)
+	var stored []gomatrixserverlib.HeaderedEvent
+	for _, pdu := range pdus[:2] {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(pdu, false, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		stored = append(stored, event.Headered(testRoomVersion))
+	}
+	// The roomserver has an event with the same ID as the last one, but it isn't the same event.
+	forged, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		[]byte(strings.Replace(string(pdus[2]), `"depth":5`, `"depth":7`, 1)), false, testRoomVersion,
+	)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	stored = append(stored, forged.Headered(testRoomVersion))
+
+	rsAPI := basicStateRoomserverAPI()
+	rsAPI.queryEventsByID = func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+		var res api.QueryEventsByIDResponse
+		for _, wantEventID := range req.EventIDs {
+			for _, ev := range stored {
+				if ev.EventID() == wantEventID {
+					res.Events = append(res.Events, ev)
+				}
+			}
+		}
+		res.QueryEventsByIDRequest = *req
+		return res
+	}
+
+	defer func(parse func([]byte, gomatrixserverlib.RoomVersion) (gomatrixserverlib.Event, error)) {
+		newEventFromUntrustedJSON = parse
+	}(newEventFromUntrustedJSON)
+	var parsed []string
+	newEventFromUntrustedJSON = func(eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion) (gomatrixserverlib.Event, error) {
+		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON, roomVersion)
+		parsed = append(parsed, event.EventID())
+		return event, err
+	}
+
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	mustProcessTransaction(t, txn, nil)
+	if len(parsed) != 1 || parsed[0] != forged.EventID() {
+		t.Errorf("expected only %s to be parsed, got %v", forged.EventID(), parsed)
+	}
+	if len(rsAPI.inputRoomEvents) != 1 || rsAPI.inputRoomEvents[0].Event.EventID() != forged.EventID() {
+		t.Errorf("expected only %s to be sent to the roomserver, got %d events", forged.EventID(), len(rsAPI.inputRoomEvents))
+	}
+
+	// Event JSON which can't be parsed is never known, so that it is rejected as usual.
+	if _, ok := eventReference([]byte(`{"event_id":`), testRoomVersion); ok {
+		t.Errorf("expected no reference for invalid event JSON")
+	}
+}
@@ -122,7 +122,7 @@ func SendLeave(
 	}
 
 	// Decode the event JSON from the request.
-	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
+	event, err := parseUntrustedEvent(httpReq.Context(), request.Content(), verRes.RoomVersion)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -196,6 +196,7 @@ func SendLeave(
 		},
 		cfg.Matrix.ServerName,
 		nil,
+		request.Origin(),
 	)
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
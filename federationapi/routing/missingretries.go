@@ -0,0 +1,160 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// maxQueuedMissingPrevEvents is the most events that missingPrevEventsRetries
+// will retry at the same time. Further events are only reported as failed.
+const maxQueuedMissingPrevEvents = 1000
+
+// missingPrevEventsRetries tries again in the background to process events
+// which were skipped because we couldn't fetch the state before them from the
+// sender. Otherwise a brief outage of the sender would lose the event until
+// some later event referred to it. Each event is retried a bounded number of
+// times, with a backoff which doubles each time, and no retry is made while
+// the circuit breaker for the sender is open. The retries are made with a
+// context of their own, so that they can all be stopped at once.
+type missingPrevEventsRetries struct {
+	mutex   sync.Mutex
+	retries int
+	backoff time.Duration
+	breaker *circuitBreaker
+	// The IDs of the events which are waiting to be retried.
+	queued map[string]bool
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newMissingPrevEventsRetries creates a missingPrevEventsRetries which retries
+// each event up to retries times, waiting backoff before the first retry. The
+// breaker may be nil.
+func newMissingPrevEventsRetries(retries int, backoff time.Duration, breaker *circuitBreaker) *missingPrevEventsRetries {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &missingPrevEventsRetries{
+		retries: retries,
+		backoff: backoff,
+		breaker: breaker,
+		queued:  make(map[string]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// queue starts retrying the event from the transaction in the background.
+// Returns false if the event wasn't queued, because it is already queued or
+// too many events are. If r is nil then events are never queued.
+func (r *missingPrevEventsRetries) queue(t *txnReq, e gomatrixserverlib.Event) bool {
+	if r == nil || r.retries <= 0 || r.ctx.Err() != nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.queued[e.EventID()] || len(r.queued) >= maxQueuedMissingPrevEvents {
+		return false
+	}
+	r.queued[e.EventID()] = true
+	// The transaction may still be processing its other events, so the
+	// retries use their own copy of it without the per-transaction caches.
+	retryTxn := *t
+	retryTxn.roomDepths = nil
+	retryTxn.serverACLs = nil
+	retryTxn.verifiedEvents = nil
+	retryTxn.refreshedKeys = nil
+	r.wg.Add(1)
+	go r.retry(&retryTxn, e)
+	return true
+}
+
+// wait blocks until every queued event has finished being retried.
+func (r *missingPrevEventsRetries) wait() {
+	r.wg.Wait()
+}
+
+// stop gives up on the queued events, interrupting any retry which is waiting
+// or in progress, and blocks until they have all finished. No more events are
+// queued afterwards.
+func (r *missingPrevEventsRetries) stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// sleep waits for d. Returns false if the retries were stopped first.
+func (r *missingPrevEventsRetries) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return r.ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-r.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *missingPrevEventsRetries) retry(t *txnReq, e gomatrixserverlib.Event) {
+	defer r.wg.Done()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.queued, e.EventID())
+		r.mutex.Unlock()
+	}()
+	// The transaction will most likely have finished before we do, so don't
+	// use its context.
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "retryMissingPrevEvents")
+	defer span.Finish()
+	span.SetTag("event_id", e.EventID())
+	logger := util.GetLogger(ctx).WithField("event_id", e.EventID()).WithField("origin", t.Origin)
+
+	backoff := r.backoff
+	for attempt := 1; attempt <= r.retries; attempt++ {
+		if !r.sleep(backoff) {
+			logger.Info("Stopped retrying event with missing prev_events")
+			return
+		}
+		backoff *= 2
+		// Don't spend a retry on a sender that we know is failing.
+		if r.breaker != nil {
+			if until, open := r.breaker.openUntil(t.Origin); open && !r.sleep(time.Until(until)) {
+				logger.Info("Stopped retrying event with missing prev_events")
+				return
+			}
+		}
+
+		err := t.processEventAndRecordOutcome(ctx, e, nil)
+		switch err.(type) {
+		case nil:
+			logger.Infof("Processed event with missing prev_events on retry %d", attempt)
+			return
+		case missingPrevEventsError, pduTimeoutError:
+			logger.WithError(err).Warnf("Retry %d of %d for event with missing prev_events failed", attempt, r.retries)
+		default:
+			logger.WithError(err).Warn("Giving up on retrying event with missing prev_events")
+			return
+		}
+	}
+	logger.Errorf("Giving up on event with missing prev_events after %d retries", r.retries)
+}
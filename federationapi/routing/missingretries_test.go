@@ -0,0 +1,155 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// flakyFedClient is a txnFederationClient whose first few requests fail, as if the server was briefly unreachable.
+type flakyFedClient struct {
+	txnFederationClient
+	mutex    sync.Mutex
+	failures int
+}
+
+func (c *flakyFedClient) fail() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return true
+	}
+	return false
+}
+
+func (c *flakyFedClient) LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespState, err error,
+) {
+	if c.fail() {
+		return res, errors.New("flakyFedClient: connection refused")
+	}
+	return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *flakyFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error) {
+	if c.fail() {
+		return res, errors.New("flakyFedClient: connection refused")
+	}
+	return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+func (c *flakyFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
+	if c.fail() {
+		return res, errors.New("flakyFedClient: connection refused")
+	}
+	return c.txnFederationClient.GetEvent(ctx, s, eventID)
+}
+
+// The purpose of this test is to check that an event which is skipped because the state before it can't be fetched
+// from the sender is retried in the background, and is processed once the state can be fetched on the next attempt.
+func TestTransactionRetriesMissingPrevEvents(t *testing.T) {
+	missingStateEvent := testStateEvents[gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomPowerLevels,
+		StateKey:  "",
+	}]
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range testStateEvents {
+					// roomserver is missing the power levels event
+					if wantEventID == missingStateEvent.EventID() {
+						continue
+					}
+					if ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	var stateEventIDs []string
+	for _, ev := range testStateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
+	cli := &flakyFedClient{
+		txnFederationClient: &txnFedClient{
+			stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+				inputEvent.EventID(): {
+					StateEventIDs: stateEventIDs,
+					AuthEventIDs:  stateEventIDs,
+				},
+			},
+			getEvent: map[string]gomatrixserverlib.Transaction{
+				missingStateEvent.EventID(): {
+					PDUs: []json.RawMessage{missingStateEvent.JSON()},
+				},
+			},
+		},
+		// The first attempt makes a /state_ids request and falls back to /state, and both fail.
+		failures: 2,
+	}
+	retries := newMissingPrevEventsRetries(3, time.Millisecond, nil)
+
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.missingPrevEventsRetries = retries
+	resp, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	result := resp.PDUs[inputEvent.EventID()]
+	if !strings.HasPrefix(result.Error, pduErrorMissingPrevEvents+": ") {
+		t.Errorf("wrong error for event with missing prev_events: got %q want prefix %s", result.Error, pduErrorMissingPrevEvents)
+	}
+
+	retries.wait()
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{missingStateEvent, inputEvent})
+}
+
+// The purpose of this test is to check that stopping the retries interrupts an event which is waiting to be retried,
+// without it being processed, and that no more events are queued afterwards.
+func TestMissingPrevEventsRetriesStop(t *testing.T) {
+	rsAPI := &testRoomserverAPI{}
+	retries := newMissingPrevEventsRetries(3, time.Hour, nil)
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+	inputEvent := testEvents[len(testEvents)-1]
+	if !retries.queue(txn, inputEvent.Unwrap()) {
+		t.Fatalf("expected the event to be queued")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		retries.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stop didn't interrupt the retry's backoff")
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+	if retries.queue(txn, inputEvent.Unwrap()) {
+		t.Errorf("expected no events to be queued once the retries were stopped")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// maxMissingEventsWalks is the most rooms that missingEventsWalks keeps an
+// unfinished walk for. Walks in further rooms start again each time.
+const maxMissingEventsWalks = 1000
+
+// maxMissingEventsWalkEvents is the most events that a single walk fetches
+// before giving up on the gap as too large, in which case the state before
+// the incoming event is fetched instead.
+const maxMissingEventsWalkEvents = 1000
+
+// missingEventsWalks keeps the walks back through the gaps before incoming
+// events which were cut short, e.g. because the event ran out of fetches or
+// time, by room ID. The next transaction which has to fill in a gap in the
+// same room, or the background retry of the event, carries on from where the
+// walk stopped rather than fetching the same events again. The walks are only
+// kept in memory, so they are lost on restart.
+type missingEventsWalks struct {
+	mutex sync.Mutex
+	walks map[string]*missingEventsWalk
+}
+
+// missingEventsWalk is how far a walk back through the gap before the events
+// in a room has got.
+type missingEventsWalk struct {
+	// The events fetched so far, including the incoming events that the walk
+	// started from, by event ID.
+	events map[string]gomatrixserverlib.Event
+	// The prev_events of the fetched events which the roomserver already has.
+	known map[string]bool
+	// The backwards extremities of the walk, which are the fetched events
+	// with prev_events that are neither fetched nor known. The next request
+	// carries on from these.
+	extremities []string
+}
+
+func newMissingEventsWalks() *missingEventsWalks {
+	return &missingEventsWalks{walks: make(map[string]*missingEventsWalk)}
+}
+
+// resume takes the unfinished walk in the room, or starts a new one if there
+// isn't one. The walk belongs to the caller until it is saved again, so that
+// concurrent walks in the same room don't share. If w is nil then a new walk
+// is always started.
+func (w *missingEventsWalks) resume(roomID string) *missingEventsWalk {
+	if w != nil {
+		w.mutex.Lock()
+		walk, ok := w.walks[roomID]
+		delete(w.walks, roomID)
+		w.mutex.Unlock()
+		if ok {
+			return walk
+		}
+	}
+	return &missingEventsWalk{
+		events: make(map[string]gomatrixserverlib.Event),
+		known:  make(map[string]bool),
+	}
+}
+
+// save keeps the unfinished walk in the room so that it can be resumed
+// later, replacing any other walk in the room. Returns false if the walk
+// wasn't kept because too many other rooms have one, or if w is nil.
+func (w *missingEventsWalks) save(roomID string, walk *missingEventsWalk) bool {
+	if w == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.walks[roomID]; !ok && len(w.walks) >= maxMissingEventsWalks {
+		return false
+	}
+	w.walks[roomID] = walk
+	return true
+}
+
+// extremitiesIn returns the backwards extremities of the unfinished walk in
+// the room, or nil if there isn't one.
+func (w *missingEventsWalks) extremitiesIn(roomID string) []string {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if walk, ok := w.walks[roomID]; ok {
+		return walk.extremities
+	}
+	return nil
+}
+
+// add adds a fetched event to the walk. Returns false if the walk already
+// had it.
+func (walk *missingEventsWalk) add(e gomatrixserverlib.Event) bool {
+	if _, ok := walk.events[e.EventID()]; ok {
+		return false
+	}
+	walk.events[e.EventID()] = e
+	return true
+}
+
+// unknownPrevEventIDs returns the prev_events of the fetched events which
+// have neither been fetched nor are known to the roomserver.
+func (walk *missingEventsWalk) unknownPrevEventIDs() []string {
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, e := range walk.events {
+		for _, prevEventID := range e.PrevEventIDs() {
+			if _, ok := walk.events[prevEventID]; ok || walk.known[prevEventID] || seen[prevEventID] {
+				continue
+			}
+			seen[prevEventID] = true
+			unknown = append(unknown, prevEventID)
+		}
+	}
+	return unknown
+}
+
+// updateExtremities works out the backwards extremities of the walk from the
+// fetched events.
+func (walk *missingEventsWalk) updateExtremities() {
+	walk.extremities = nil
+	for eventID, e := range walk.events {
+		for _, prevEventID := range e.PrevEventIDs() {
+			if _, ok := walk.events[prevEventID]; !ok && !walk.known[prevEventID] {
+				walk.extremities = append(walk.extremities, eventID)
+				break
+			}
+		}
+	}
+	sort.Strings(walk.extremities)
+}
+
+// sortedEvents returns the fetched events in the order in which they should
+// be processed, oldest first.
+func (walk *missingEventsWalk) sortedEvents() []gomatrixserverlib.Event {
+	events := make([]gomatrixserverlib.Event, 0, len(walk.events))
+	for _, e := range walk.events {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Depth() != events[j].Depth() {
+			return events[i].Depth() < events[j].Depth()
+		}
+		return events[i].EventID() < events[j].EventID()
+	})
+	return events
+}
+
+// walkMissingEvents fills in the gap before the event by walking back through
+// its prev_events with /get_missing_events until it reaches events that the
+// roomserver has, and then processes the fetched events oldest first, ending
+// with the event itself. If a request fails, e.g. because the event ran out of
+// fetches or time, then the walk is saved so that it can be carried on later
+// and a missingPrevEventsError is returned. Returns a gapNotFilledError if the
+// sender can't fill in the gap, in which case the state before the event
+// should be fetched instead.
+func (t *txnReq) walkMissingEvents(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	span, ctx := startEventSpan(ctx, "walkMissingEvents", e)
+	defer span.Finish()
+
+	roomID := e.RoomID()
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"event_id": e.EventID(),
+		"room_id":  roomID,
+	})
+	walk := t.missingEventsWalks.resume(roomID)
+	if len(walk.events) > 0 {
+		logger.WithField("extremities", len(walk.extremities)).Info("Resuming walk through missing events")
+	}
+	walk.add(e)
+
+	for {
+		unknown := walk.unknownPrevEventIDs()
+		if len(unknown) > 0 {
+			var queryRes api.QueryEventsExistByIDResponse
+			if err := t.rsAPI.QueryEventsExistByID(ctx, &api.QueryEventsExistByIDRequest{EventIDs: unknown}, &queryRes); err != nil {
+				t.missingEventsWalks.save(roomID, walk)
+				return err
+			}
+			for eventID := range queryRes.ReferenceSHA256 {
+				walk.known[eventID] = true
+			}
+		}
+		walk.updateExtremities()
+		if len(walk.extremities) == 0 {
+			break
+		}
+		if len(walk.events) >= maxMissingEventsWalkEvents {
+			return gapNotFilledError{e.EventID(), fmt.Sprintf("more than %d events are missing", maxMissingEventsWalkEvents)}
+		}
+
+		latest, err := roomExtremities(ctx, t.rsAPI, roomID)
+		if err != nil {
+			t.missingEventsWalks.save(roomID, walk)
+			return err
+		}
+		res, err := t.federation.LookupMissingEvents(ctx, t.Origin, roomID, gomatrixserverlib.MissingEvents{
+			Limit:          t.missingEventsLimit,
+			EarliestEvents: latest.LatestEventIDs,
+			LatestEvents:   walk.extremities,
+		}, roomVersion)
+		if err != nil {
+			if t.missingEventsWalks.save(roomID, walk) {
+				logger.WithError(err).WithField("extremities", len(walk.extremities)).Warn("Walk through missing events was cut short, saved it to carry on later")
+			}
+			return missingPrevEventsError{e.EventID(), err}
+		}
+
+		var inRoom []gomatrixserverlib.Event
+		for _, missing := range res.Events {
+			if missing.RoomID() == roomID {
+				inRoom = append(inRoom, missing)
+			}
+		}
+		added := 0
+		for i, err := range t.verifyEventSignaturesBatch(ctx, inRoom) {
+			if err != nil {
+				logger.WithError(err).Warnf("Transaction: Couldn't validate signature of missing event %q", inRoom[i].EventID())
+				continue
+			}
+			if walk.add(inRoom[i]) {
+				added++
+			}
+		}
+		if added == 0 {
+			return gapNotFilledError{e.EventID(), "the sender didn't return any new events"}
+		}
+	}
+
+	logger.WithField("events", len(walk.events)).Info("Filled in missing events")
+	for _, missing := range walk.sortedEvents() {
+		stateReq := stateQueryForEvent(missing)
+		var stateResp api.QueryStateAfterEventsResponse
+		if err := t.rsAPI.QueryStateAfterEvents(ctx, &stateReq, &stateResp); err != nil {
+			return err
+		}
+		if !stateResp.RoomExists {
+			return roomNotFoundError{roomID}
+		}
+		if !stateResp.PrevEventsExist {
+			return missingPrevEventsError{e.EventID(), fmt.Errorf("prev_events of missing event %q weren't processed", missing.EventID())}
+		}
+		err := t.processEventWithPrevEvents(ctx, missing, &stateResp)
+		if err != nil && missing.EventID() == e.EventID() {
+			return err
+		} else if err != nil {
+			logger.WithError(err).Warnf("Failed to process missing event %q", missing.EventID())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package routing
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that a walk back through the gap before an event with /get_missing_events
+// which is cut short records how far it got, and that the next transaction carries on from there rather than
+// starting again.
+func TestTransactionResumesMissingEventsWalk(t *testing.T) {
+	// The roomserver has the state events, but none of the messages.
+	have := make(map[string]gomatrixserverlib.HeaderedEvent)
+	for _, ev := range testStateEvents {
+		have[ev.EventID()] = ev
+	}
+	powerLevels := testStateEvents[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	var rsAPI *testRoomserverAPI
+	haveEvent := func(eventID string) bool {
+		if _, ok := have[eventID]; ok {
+			return true
+		}
+		for _, ire := range rsAPI.inputRoomEvents {
+			if ire.Event.EventID() == eventID {
+				return true
+			}
+		}
+		return false
+	}
+	rsAPI = &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			for _, prevEventID := range req.PrevEventIDs {
+				if !haveEvent(prevEventID) {
+					return api.QueryStateAfterEventsResponse{RoomExists: true}
+				}
+			}
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, eventID := range req.EventIDs {
+				if ev, ok := have[eventID]; ok {
+					res.Events = append(res.Events, ev)
+				}
+			}
+			return res
+		},
+		queryLatestEventsAndState: func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+			return api.QueryLatestEventsAndStateResponse{
+				RoomExists:   true,
+				LatestEvents: []gomatrixserverlib.EventReference{powerLevels.EventReference()},
+			}
+		},
+	}
+
+	// The gap before the last message is the two messages before it. The
+	// sender returns one event per request, and the request for the second
+	// one fails the first time around.
+	first, second, inputEvent := testEvents[len(testEvents)-3], testEvents[len(testEvents)-2], testEvents[len(testEvents)-1]
+	fedClient := &txnFedClient{
+		missingEvents: map[string]gomatrixserverlib.RespMissingEvents{
+			inputEvent.EventID(): {Events: []gomatrixserverlib.Event{second.Unwrap()}},
+		},
+	}
+	walks := newMissingEventsWalks()
+	newTxn := func() *txnReq {
+		txn := mustCreateTransaction(rsAPI, fedClient, []json.RawMessage{inputEvent.JSON()})
+		txn.missingEventsLimit = 1
+		txn.missingEventsWalks = walks
+		return txn
+	}
+
+	resp, err := newTxn().processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	if result := resp.PDUs[inputEvent.EventID()]; !strings.HasPrefix(result.Error, pduErrorMissingPrevEvents+": ") {
+		t.Errorf("wrong error for event whose walk was cut short: got %q want prefix %s", result.Error, pduErrorMissingPrevEvents)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Fatalf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+	if got, want := walks.extremitiesIn(inputEvent.RoomID()), []string{second.EventID()}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong extremities saved for the walk: got %v want %v", got, want)
+	}
+
+	// Starting the walk again would ask for the events before the incoming
+	// event, which now fails.
+	fedClient.missingEvents = map[string]gomatrixserverlib.RespMissingEvents{
+		second.EventID(): {Events: []gomatrixserverlib.Event{first.Unwrap()}},
+	}
+	mustProcessTransaction(t, newTxn(), nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{first, second, inputEvent})
+	if got := walks.extremitiesIn(inputEvent.RoomID()); got != nil {
+		t.Errorf("expected the finished walk to be forgotten, got extremities %v", got)
+	}
+}
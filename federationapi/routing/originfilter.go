@@ -0,0 +1,66 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"regexp"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// originFilter decides which servers we accept transactions from, as set by
+// the allowed_origins and denied_origins config options. The entries use the
+// same globs as server ACLs, so "*.example.com" matches every subdomain of
+// example.com.
+type originFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// newOriginFilter compiles the allowed and denied origins from the config.
+func newOriginFilter(allowed, denied []string) *originFilter {
+	f := &originFilter{}
+	for _, glob := range allowed {
+		f.allow = append(f.allow, compileServerACLGlob(glob))
+	}
+	for _, glob := range denied {
+		f.deny = append(f.deny, compileServerACLGlob(glob))
+	}
+	return f
+}
+
+// allowed returns true if transactions from the server should be accepted.
+// The port is ignored. A server is rejected if it matches any of the denied
+// origins, or if there are allowed origins and it doesn't match any of them.
+func (f *originFilter) allowed(serverName gomatrixserverlib.ServerName) bool {
+	host, _, _ := gomatrixserverlib.ParseAndValidateServerName(serverName)
+	if host == "" {
+		return false
+	}
+	for _, glob := range f.deny {
+		if glob.MatchString(host) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, glob := range f.allow {
+		if glob.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that origins are matched by exact server name and by wildcard domain, ignoring
+// the port, that the deny list takes precedence over the allow list, and that empty lists allow every server.
+func TestOriginFilter(t *testing.T) {
+	testCases := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		origin  gomatrixserverlib.ServerName
+		want    bool
+	}{
+		{"empty lists", nil, nil, "kaer.morhen", true},
+		{"exact allowed origin", []string{"kaer.morhen"}, nil, "kaer.morhen", true},
+		{"allowed origin with a port", []string{"kaer.morhen"}, nil, "kaer.morhen:8448", true},
+		{"origin not in the allow list", []string{"kaer.morhen"}, nil, "novigrad", false},
+		{"wildcard allowed origin", []string{"*.kaer.morhen"}, nil, "keep.kaer.morhen", true},
+		{"wildcard doesn't match the bare domain", []string{"*.kaer.morhen"}, nil, "kaer.morhen", false},
+		{"exact denied origin", nil, []string{"novigrad"}, "novigrad", false},
+		{"origin not in the deny list", nil, []string{"novigrad"}, "kaer.morhen", true},
+		{"wildcard denied origin", nil, []string{"*.novigrad"}, "temple.novigrad", false},
+		{"denied origin is also allowed", []string{"*"}, []string{"novigrad"}, "novigrad", false},
+	}
+	for _, tc := range testCases {
+		f := newOriginFilter(tc.allowed, tc.denied)
+		if got := f.allowed(tc.origin); got != tc.want {
+			t.Errorf("%s: allowed(%q) = %t, want %t", tc.name, tc.origin, got, tc.want)
+		}
+	}
+}
+
+// The purpose of this test is to check that Send rejects a transaction from a denied origin with a 403 before doing
+// any work on it.
+func TestSendRejectsDeniedOrigin(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	send := func(origin gomatrixserverlib.ServerName, filter *originFilter) int {
+		request := gomatrixserverlib.NewFederationRequest(http.MethodPut, "kaer.morhen", "/_matrix/federation/v1/send/1")
+		if err = request.Sign(origin, "ed25519:auto", privateKey); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPut, "/_matrix/federation/v1/send/1", nil)
+		// The request has no content, so one that gets past the filter is
+		// rejected as not being JSON without touching anything else.
+		res := Send(httpReq, &request, "1", &config.Dendrite{}, txnDeps{
+			txnLimiter:   newTxnLimiter(1, 1),
+			originFilter: filter,
+		})
+		return res.Code
+	}
+
+	filter := newOriginFilter(nil, []string{"novigrad"})
+	if code := send("novigrad", filter); code != http.StatusForbidden {
+		t.Errorf("wrong status code for a denied origin: got %d want %d", code, http.StatusForbidden)
+	}
+	if code := send("kaer.morhen", filter); code != http.StatusBadRequest {
+		t.Errorf("wrong status code for an allowed origin: got %d want %d", code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// originQueues makes the incoming transactions from each origin server be
+// processed one at a time, in the order in which they arrived, so that the
+// events in a later transaction are never processed before those in an
+// earlier one. Transactions from different origins are processed
+// concurrently.
+type originQueues struct {
+	mutex  sync.Mutex
+	queues map[gomatrixserverlib.ServerName]*originQueue
+}
+
+// originQueue is the queue of transactions from a single origin.
+type originQueue struct {
+	// Closed once the last transaction in the queue has finished.
+	tail chan struct{}
+	// The number of transactions in the queue, including the one being
+	// processed. The queue is removed once this reaches zero.
+	length int
+}
+
+// originTurn is the place of a transaction in the queue for its origin.
+type originTurn struct {
+	queues  *originQueues
+	origin  gomatrixserverlib.ServerName
+	queue   *originQueue
+	prev    chan struct{}
+	done    chan struct{}
+	started bool
+}
+
+func newOriginQueues() *originQueues {
+	return &originQueues{queues: make(map[gomatrixserverlib.ServerName]*originQueue)}
+}
+
+// join adds a transaction from the origin to the end of its queue. The
+// transaction must call wait before it is processed and finish once it has
+// been processed, or if it won't be processed after all. If q is nil then
+// transactions aren't queued.
+func (q *originQueues) join(origin gomatrixserverlib.ServerName) *originTurn {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	queue, ok := q.queues[origin]
+	if !ok {
+		queue = &originQueue{}
+		q.queues[origin] = queue
+	}
+	turn := &originTurn{
+		queues: q,
+		origin: origin,
+		queue:  queue,
+		prev:   queue.tail,
+		done:   make(chan struct{}),
+	}
+	queue.tail = turn.done
+	queue.length++
+	return turn
+}
+
+// wait blocks until every transaction that joined the queue before this one
+// has finished. Returns an error if the context is done first.
+func (t *originTurn) wait(ctx context.Context) error {
+	if t == nil || t.prev == nil {
+		return nil
+	}
+	select {
+	case <-t.prev:
+		t.started = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// finish lets the next transaction in the queue go ahead. If this transaction
+// never got its turn then the next one still waits for the transactions
+// before this one to finish.
+func (t *originTurn) finish() {
+	if t == nil {
+		return
+	}
+	if t.prev != nil && !t.started {
+		go func() {
+			<-t.prev
+			t.release()
+		}()
+		return
+	}
+	t.release()
+}
+
+func (t *originTurn) release() {
+	close(t.done)
+	t.queues.mutex.Lock()
+	defer t.queues.mutex.Unlock()
+	t.queue.length--
+	if t.queue.length == 0 {
+		delete(t.queues.queues, t.origin)
+	}
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitInBackground calls turn.wait in a goroutine and returns a channel which is closed once it has returned.
+func waitInBackground(t *testing.T, turn *originTurn) chan struct{} {
+	started := make(chan struct{})
+	go func() {
+		if err := turn.wait(context.Background()); err != nil {
+			t.Errorf("wait returned an error: %s", err)
+		}
+		close(started)
+	}()
+	return started
+}
+
+// The purpose of this test is to check that two transactions from the same origin are processed one at a time in the
+// order in which they arrived, while a transaction from another origin doesn't have to wait for them.
+func TestOriginQueuesSerialised(t *testing.T) {
+	queues := newOriginQueues()
+	first := queues.join(testOrigin)
+	second := queues.join(testOrigin)
+	other := queues.join("other.server")
+
+	if err := first.wait(context.Background()); err != nil {
+		t.Fatalf("first transaction: wait returned an error: %s", err)
+	}
+	secondStarted := waitInBackground(t, second)
+	otherStarted := waitInBackground(t, other)
+
+	select {
+	case <-otherStarted:
+	case <-time.After(time.Second):
+		t.Fatalf("transaction from another origin waited for the first transaction")
+	}
+	select {
+	case <-secondStarted:
+		t.Fatalf("second transaction started before the first had finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.finish()
+	select {
+	case <-secondStarted:
+	case <-time.After(time.Second):
+		t.Fatalf("second transaction didn't start once the first had finished")
+	}
+	second.finish()
+	other.finish()
+
+	queues.mutex.Lock()
+	defer queues.mutex.Unlock()
+	if len(queues.queues) != 0 {
+		t.Errorf("expected the queues to be removed once empty, got %d", len(queues.queues))
+	}
+}
+
+// The purpose of this test is to check that a transaction which gives up waiting for its turn doesn't let the
+// transaction after it go ahead of the one before it.
+func TestOriginQueuesCancelled(t *testing.T) {
+	queues := newOriginQueues()
+	first := queues.join(testOrigin)
+	cancelled := queues.join(testOrigin)
+	third := queues.join(testOrigin)
+
+	if err := first.wait(context.Background()); err != nil {
+		t.Fatalf("first transaction: wait returned an error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cancelled.wait(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	cancelled.finish()
+
+	thirdStarted := waitInBackground(t, third)
+	select {
+	case <-thirdStarted:
+		t.Fatalf("third transaction started before the first had finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.finish()
+	select {
+	case <-thirdStarted:
+	case <-time.After(time.Second):
+		t.Fatalf("third transaction didn't start once the first had finished")
+	}
+	third.finish()
+}
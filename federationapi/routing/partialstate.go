@@ -0,0 +1,334 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// partialStateRooms keeps track of the rooms for which we have accepted events
+// using only the critical state needed to authorise them, rather than the
+// full state of the room (see MSC3706). Each of those events has to be checked
+// again once the full state has been fetched in the background.
+type partialStateRooms struct {
+	mutex sync.Mutex
+	rooms map[string]*partialStateRoom
+}
+
+type partialStateRoom struct {
+	roomVersion gomatrixserverlib.RoomVersion
+	// The events that were accepted while the room had partial state and
+	// which haven't been checked against the full state yet.
+	events []gomatrixserverlib.Event
+	// Whether a background task is currently fetching the full state.
+	resyncing bool
+}
+
+func newPartialStateRooms() *partialStateRooms {
+	return &partialStateRooms{
+		rooms: make(map[string]*partialStateRoom),
+	}
+}
+
+// markPartial records that the event was accepted using partial state, marking
+// its room as having partial state if it didn't already. Returns true if the
+// caller should start fetching the full state of the room.
+func (p *partialStateRooms) markPartial(roomVersion gomatrixserverlib.RoomVersion, e gomatrixserverlib.Event) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	room, ok := p.rooms[e.RoomID()]
+	if !ok {
+		room = &partialStateRoom{roomVersion: roomVersion}
+		p.rooms[e.RoomID()] = room
+	}
+	room.events = append(room.events, e)
+	return room.startResync()
+}
+
+// record notes that the event was accepted against the current state of its
+// room, if the room has partial state. Returns true if the caller should start
+// fetching the full state of the room.
+func (p *partialStateRooms) record(e gomatrixserverlib.Event) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	room, ok := p.rooms[e.RoomID()]
+	if !ok {
+		return false
+	}
+	room.events = append(room.events, e)
+	return room.startResync()
+}
+
+func (r *partialStateRoom) startResync() bool {
+	if r.resyncing {
+		return false
+	}
+	r.resyncing = true
+	return true
+}
+
+// isPartial returns true if the room has partial state.
+func (p *partialStateRooms) isPartial(roomID string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, ok := p.rooms[roomID]
+	return ok
+}
+
+// reconcile checks every event that was accepted against the partial state of
+// the room using the full state at that event, as returned by fullStateAt.
+// Once all of the events have been checked the room no longer has partial
+// state. Returns the events which are not allowed by the full state. If the
+// full state can't be fetched then the room keeps its partial state, and the
+// events which haven't been checked yet will be checked on the next attempt.
+func (p *partialStateRooms) reconcile(
+	roomID string,
+	fullStateAt func(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) ([]gomatrixserverlib.Event, error),
+) (rejected []gomatrixserverlib.Event, err error) {
+	for {
+		p.mutex.Lock()
+		room, ok := p.rooms[roomID]
+		if !ok {
+			p.mutex.Unlock()
+			return rejected, nil
+		}
+		if len(room.events) == 0 {
+			delete(p.rooms, roomID)
+			p.mutex.Unlock()
+			return rejected, nil
+		}
+		events := room.events
+		room.events = nil
+		p.mutex.Unlock()
+
+		for i, e := range events {
+			var state []gomatrixserverlib.Event
+			state, err = fullStateAt(e, room.roomVersion)
+			if err != nil {
+				p.mutex.Lock()
+				room.events = append(append([]gomatrixserverlib.Event{}, events[i:]...), room.events...)
+				room.resyncing = false
+				p.mutex.Unlock()
+				return rejected, err
+			}
+			if checkAllowedByState(e, state) != nil {
+				rejected = append(rejected, e)
+			}
+		}
+	}
+}
+
+// processEventWithPartialState accepts an event for which we are missing the
+// prev_events using only its auth events as the state, rather than fetching
+// the full state at the event. The room is marked as having partial state and
+// the full state is fetched in the background.
+func (t *txnReq) processEventWithPartialState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	span, ctx := startEventSpan(ctx, "processEventWithPartialState", e)
+	defer span.Finish()
+
+	respState, haveEventIDs, err := t.lookupCriticalState(ctx, e, roomVersion)
+	if err != nil {
+		return err
+	}
+
+	if err = checkAllowedByState(e, respState.StateEvents); err != nil {
+		return err
+	}
+
+	// pass the event along with the state to the roomserver using a background context so we don't
+	// needlessly expire
+	if err = t.producer.SendEventWithState(context.Background(), respState, e.Headered(roomVersion), haveEventIDs, t.Origin, false); err != nil {
+		return err
+	}
+
+	if t.partialState.markPartial(roomVersion, e) {
+		go t.resyncPartialState(e.RoomID())
+	}
+	return nil
+}
+
+// checkAllowedByCriticalState checks that the event is allowed by its auth
+// events, for an event whose prev_events we have in a room with partial state.
+// Any auth events which the roomserver doesn't have yet are stored as outliers
+// so that the roomserver can check the event against them too.
+func (t *txnReq) checkAllowedByCriticalState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	span, ctx := startEventSpan(ctx, "checkAllowedByCriticalState", e)
+	defer span.Finish()
+
+	respState, haveEventIDs, err := t.lookupCriticalState(ctx, e, roomVersion)
+	if err != nil {
+		return err
+	}
+	if err = checkAllowedByState(e, respState.StateEvents); err != nil {
+		return err
+	}
+	return t.sendOutliers(ctx, respState, haveEventIDs, roomVersion)
+}
+
+// lookupCriticalState fetches the auth events of the event, which are the
+// minimal state needed to authorise it, along with their own auth chain so
+// that they can be stored. Events which the roomserver already has are not
+// fetched over federation.
+func (t *txnReq) lookupCriticalState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+	*gomatrixserverlib.RespState, map[string]bool, error) {
+	span, ctx := startEventSpan(ctx, "lookupCriticalState", e)
+	defer span.Finish()
+
+	eventMap := make(map[string]gomatrixserverlib.Event)
+	haveEventIDs := make(map[string]bool)
+
+	wantIDs := e.AuthEventIDs()
+	for len(wantIDs) > 0 {
+		queryReq := api.QueryEventsByIDRequest{
+			EventIDs: wantIDs,
+		}
+		var queryRes api.QueryEventsByIDResponse
+		if err := t.rsAPI.QueryEventsByID(ctx, &queryReq, &queryRes); err != nil {
+			return nil, nil, err
+		}
+		for i := range queryRes.Events {
+			eventMap[queryRes.Events[i].EventID()] = queryRes.Events[i].Unwrap()
+			haveEventIDs[queryRes.Events[i].EventID()] = true
+		}
+
+		var nextIDs []string
+		for _, eventID := range wantIDs {
+			if _, ok := eventMap[eventID]; !ok {
+				txn, err := t.federation.GetEvent(ctx, t.Origin, eventID)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, pdu := range txn.PDUs {
+					if err = checkEventSize(eventID, pdu, roomVersion); err != nil {
+						return nil, nil, err
+					}
+					event, err := parseUntrustedEvent(ctx, pdu, roomVersion)
+					if err != nil {
+						return nil, nil, err
+					}
+					if err = t.verifyEventSignatures(ctx, event); err != nil {
+						return nil, nil, err
+					}
+					eventMap[event.EventID()] = event
+				}
+			}
+			if ev, ok := eventMap[eventID]; ok {
+				for _, authEventID := range ev.AuthEventIDs() {
+					if _, ok := eventMap[authEventID]; !ok {
+						nextIDs = append(nextIDs, authEventID)
+					}
+				}
+			}
+		}
+		wantIDs = nextIDs
+	}
+
+	var respState gomatrixserverlib.RespState
+	stateEventIDs := make(map[string]bool)
+	for _, eventID := range e.AuthEventIDs() {
+		ev, ok := eventMap[eventID]
+		if !ok {
+			return nil, nil, gomatrixserverlib.MissingAuthEventError{
+				AuthEventID: eventID,
+				ForEventID:  e.EventID(),
+			}
+		}
+		respState.StateEvents = append(respState.StateEvents, ev)
+		stateEventIDs[eventID] = true
+	}
+	for eventID, ev := range eventMap {
+		if !stateEventIDs[eventID] {
+			respState.AuthEvents = append(respState.AuthEvents, ev)
+		}
+	}
+	// Check that the returned state is valid.
+	if err := respState.Check(ctx, t.keys); err != nil {
+		return nil, nil, err
+	}
+	return &respState, haveEventIDs, nil
+}
+
+// resyncPartialState fetches the full state of a room with partial state and
+// checks the events which were accepted against the partial state again.
+func (t *txnReq) resyncPartialState(roomID string) {
+	// The transaction will most likely have finished before we do, so don't
+	// use its context.
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), "resyncPartialState")
+	defer span.Finish()
+	span.SetTag("room_id", roomID)
+	logger := util.GetLogger(ctx).WithField("room_id", roomID)
+
+	rejected, err := t.partialState.reconcile(roomID, func(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+		[]gomatrixserverlib.Event, error) {
+		return t.lookupFullState(ctx, e, roomVersion)
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to fetch the full state of a room with partial state")
+		return
+	}
+	// TODO: The roomserver can't replace the state snapshot of an event it
+	// already has, so all we can do for now is to report these events.
+	for _, e := range rejected {
+		logger.WithField("event_id", e.EventID()).Error("Event accepted against partial state is not allowed by the full state")
+	}
+}
+
+// lookupFullState fetches the full state at the event, storing any state
+// events which the roomserver doesn't have yet as outliers.
+func (t *txnReq) lookupFullState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+	[]gomatrixserverlib.Event, error) {
+	respState, haveEventIDs, err := t.lookupStateBeforeEvent(ctx, e, roomVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.sendOutliers(ctx, respState, haveEventIDs, roomVersion); err != nil {
+		return nil, err
+	}
+	return respState.StateEvents, nil
+}
+
+// sendOutliers sends the state and auth events in respState which aren't in
+// haveEventIDs to the roomserver as outliers.
+func (t *txnReq) sendOutliers(
+	ctx context.Context, respState *gomatrixserverlib.RespState, haveEventIDs map[string]bool, roomVersion gomatrixserverlib.RoomVersion,
+) error {
+	outliers, err := respState.Events()
+	if err != nil {
+		return err
+	}
+	var ires []api.InputRoomEvent
+	for _, outlier := range outliers {
+		if haveEventIDs[outlier.EventID()] {
+			continue
+		}
+		ires = append(ires, api.InputRoomEvent{
+			Kind:         api.KindOutlier,
+			Event:        outlier.Headered(roomVersion),
+			AuthEventIDs: outlier.AuthEventIDs(),
+			Origin:       t.Origin,
+		})
+	}
+	if len(ires) > 0 {
+		_, err = t.producer.SendInputRoomEvents(ctx, ires)
+	}
+	return err
+}
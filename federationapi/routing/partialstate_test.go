@@ -0,0 +1,194 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that when partial state is enabled, an event with missing prev_events is
+// accepted using only its auth events rather than the full state of the room, and that the room is marked as having
+// partial state. The roomserver is missing the sender's m.room.member event, which should be fetched via /event and
+// sent before the transaction PDU.
+func TestTransactionPartialState(t *testing.T) {
+	missingAuthEvent := testStateEvents[gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomMember,
+		StateKey:  "@userid:kaer.morhen",
+	}]
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range testStateEvents {
+					if ev.EventID() == wantEventID && wantEventID != missingAuthEvent.EventID() {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
+	}
+	cli := &txnFedClient{
+		// There is no /state_ids or /state, so fetching the full state in the
+		// background fails and the room keeps its partial state.
+		getEvent: map[string]gomatrixserverlib.Transaction{
+			missingAuthEvent.EventID(): gomatrixserverlib.Transaction{
+				PDUs: []json.RawMessage{
+					missingAuthEvent.JSON(),
+				},
+			},
+		},
+	}
+
+	inputEvent := testEvents[len(testEvents)-1]
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.partialState = newPartialStateRooms()
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{missingAuthEvent, inputEvent})
+	if !txn.partialState.isPartial(inputEvent.RoomID()) {
+		t.Errorf("expected room to be marked as having partial state")
+	}
+}
+
+// The purpose of this test is to check that an event for which we have the prev_events isn't rejected because the
+// state of a room with partial state is missing the sender's membership, as long as the event's auth events allow it,
+// and that it is checked again once the full state arrives. The same event in a room with full state is rejected.
+func TestTransactionPartialStateRoomAcceptsProvisionally(t *testing.T) {
+	senderMembership := gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomMember,
+		StateKey:  "@userid:kaer.morhen",
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	for _, partial := range []bool{false, true} {
+		rsAPI := &testRoomserverAPI{
+			queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+				return api.QueryStateAfterEventsResponse{
+					PrevEventsExist: true,
+					RoomExists:      true,
+					StateEvents:     fromStateTuples(req.StateToFetch, []gomatrixserverlib.StateKeyTuple{senderMembership}),
+				}
+			},
+			queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+				var res api.QueryEventsByIDResponse
+				for _, wantEventID := range req.EventIDs {
+					for _, ev := range testStateEvents {
+						if ev.EventID() == wantEventID {
+							res.Events = append(res.Events, ev)
+						}
+					}
+				}
+				res.QueryEventsByIDRequest = *req
+				return res
+			},
+		}
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+			testData[len(testData)-1], // a message event
+		})
+		txn.partialState = newPartialStateRooms()
+		if !partial {
+			mustProcessTransaction(t, txn, []string{inputEvent.EventID()})
+			assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+			continue
+		}
+
+		// An earlier event gave the room partial state and the full state is
+		// already being fetched.
+		txn.partialState.markPartial(testRoomVersion, testEvents[len(testEvents)-2].Unwrap())
+		mustProcessTransaction(t, txn, nil)
+		assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{inputEvent})
+
+		// The event is checked against the full state along with the earlier one.
+		var checked []string
+		_, err := txn.partialState.reconcile(inputEvent.RoomID(), func(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) ([]gomatrixserverlib.Event, error) {
+			checked = append(checked, e.EventID())
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("reconcile returned an error: %s", err)
+		}
+		if len(checked) != 2 || checked[1] != inputEvent.EventID() {
+			t.Errorf("expected %s to be checked against the full state, got %v", inputEvent.EventID(), checked)
+		}
+	}
+}
+
+// The purpose of this test is to check that a room marked as having partial state is reconciled once the full state
+// arrives: events which are allowed by the full state are accepted, events which aren't are reported, and the room no
+// longer has partial state. If the full state can't be fetched then the room should keep its partial state and the
+// events should be checked again on the next attempt.
+func TestPartialStateReconcile(t *testing.T) {
+	allowedEvent := testEvents[len(testEvents)-2].Unwrap()
+	rejectedEvent := testEvents[len(testEvents)-1].Unwrap()
+	roomID := allowedEvent.RoomID()
+
+	var fullState, stateWithoutSender []gomatrixserverlib.Event
+	for tuple, ev := range testStateEvents {
+		fullState = append(fullState, ev.Unwrap())
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			stateWithoutSender = append(stateWithoutSender, ev.Unwrap())
+		}
+	}
+
+	partialState := newPartialStateRooms()
+	if !partialState.markPartial(testRoomVersion, allowedEvent) {
+		t.Fatalf("expected marking the room as partial to start a resync")
+	}
+	if partialState.record(rejectedEvent) {
+		t.Errorf("expected no new resync to be started while one is in progress")
+	}
+	if !partialState.isPartial(roomID) {
+		t.Fatalf("expected room to be marked as having partial state")
+	}
+
+	// The first attempt to fetch the full state fails.
+	_, err := partialState.reconcile(roomID, func(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) ([]gomatrixserverlib.Event, error) {
+		return nil, errors.New("remote server unavailable")
+	})
+	if err == nil {
+		t.Fatalf("expected reconcile to return an error")
+	}
+	if !partialState.isPartial(roomID) {
+		t.Fatalf("expected room to keep its partial state after failing to fetch the full state")
+	}
+	if !partialState.markPartial(testRoomVersion, allowedEvent) {
+		t.Errorf("expected a new resync to be started after the previous one failed")
+	}
+
+	// The full state arrives. At the time of the second event the sender
+	// isn't joined to the room, so that event isn't allowed.
+	checked := make(map[string]int)
+	rejected, err := partialState.reconcile(roomID, func(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) ([]gomatrixserverlib.Event, error) {
+		checked[e.EventID()]++
+		if e.EventID() == rejectedEvent.EventID() {
+			return stateWithoutSender, nil
+		}
+		return fullState, nil
+	})
+	if err != nil {
+		t.Fatalf("reconcile returned an error: %s", err)
+	}
+	if checked[rejectedEvent.EventID()] != 1 {
+		t.Errorf("expected event %s to be checked once, got %d", rejectedEvent.EventID(), checked[rejectedEvent.EventID()])
+	}
+	if checked[allowedEvent.EventID()] != 2 {
+		t.Errorf("expected event %s to be checked twice, got %d", allowedEvent.EventID(), checked[allowedEvent.EventID()])
+	}
+	if len(rejected) != 1 || rejected[0].EventID() != rejectedEvent.EventID() {
+		t.Errorf("wrong rejected events: got %v want [%s]", rejected, rejectedEvent.EventID())
+	}
+	if partialState.isPartial(roomID) {
+		t.Errorf("expected room to no longer have partial state")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/util"
+)
+
+// maxQuarantineTracked is the most events that eventQuarantine counts the
+// failures of, and separately the most events that it quarantines of its own
+// accord. Failures of further events aren't counted.
+const maxQuarantineTracked = 100000
+
+// eventQuarantine keeps the IDs of incoming events which we skip without
+// processing them, so that an event which fails every time, e.g. because it
+// can never pass the auth checks, doesn't fail the transactions which
+// carry it forever. Events are quarantined once they have been rejected the
+// given number of times, or by an admin. The quarantined events are stored in
+// the database if there is one, so that they stay quarantined across restarts.
+// Otherwise they are only kept in memory. The failures are only kept in
+// memory.
+type eventQuarantine struct {
+	mutex     sync.Mutex
+	threshold int
+	// Where the quarantined events are stored, or nil if they are only kept
+	// in memory.
+	db storage.Database
+	// How many times each event has failed to be processed, by event ID.
+	failures map[string]int
+	// The quarantined events, by event ID. The value is true if the event
+	// was quarantined because of its failures rather than by an admin.
+	quarantined map[string]bool
+	// How many of the quarantined events were quarantined because of their
+	// failures.
+	automatic int
+}
+
+// newEventQuarantine creates an eventQuarantine which quarantines events once
+// they have failed threshold times, storing them in db if it isn't nil. If
+// threshold is zero then events are only quarantined by an admin. load must be
+// called before it is used to get the events which are already quarantined.
+func newEventQuarantine(threshold int, db storage.Database) *eventQuarantine {
+	return &eventQuarantine{
+		threshold:   threshold,
+		db:          db,
+		failures:    make(map[string]int),
+		quarantined: make(map[string]bool),
+	}
+}
+
+// load reads the quarantined events from the database, if there is one.
+func (q *eventQuarantine) load(ctx context.Context) error {
+	if q.db == nil {
+		return nil
+	}
+	quarantined, err := q.db.QuarantinedEvents(ctx)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for eventID, automatic := range quarantined {
+		q.quarantined[eventID] = automatic
+		if automatic {
+			q.automatic++
+		}
+	}
+	return nil
+}
+
+// contains returns true if the event is quarantined. If q is nil then no
+// events are.
+func (q *eventQuarantine) contains(eventID string) bool {
+	if q == nil {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, ok := q.quarantined[eventID]
+	return ok
+}
+
+// recordFailure counts a failure to process the event. Returns true if the
+// event has now failed often enough to be quarantined. If the quarantined
+// event can't be stored then it is still quarantined until we restart.
+func (q *eventQuarantine) recordFailure(ctx context.Context, eventID string) bool {
+	if q == nil || q.threshold <= 0 || !q.countFailure(eventID) {
+		return false
+	}
+	if q.db != nil {
+		if err := q.db.QuarantineEvent(ctx, eventID, true); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("event_id", eventID).Error("Failed to store quarantined event")
+		}
+	}
+	return true
+}
+
+// countFailure counts a failure to process the event, and quarantines it in
+// memory if it has now failed often enough. Returns true if it did.
+func (q *eventQuarantine) countFailure(eventID string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.quarantined[eventID]; ok {
+		return false
+	}
+	if _, ok := q.failures[eventID]; !ok && len(q.failures) >= maxQuarantineTracked {
+		return false
+	}
+	q.failures[eventID]++
+	if q.failures[eventID] < q.threshold || q.automatic >= maxQuarantineTracked {
+		return false
+	}
+	delete(q.failures, eventID)
+	q.quarantined[eventID] = true
+	q.automatic++
+	return true
+}
+
+// recordSuccess forgets the failures of an event which has now been
+// processed.
+func (q *eventQuarantine) recordSuccess(eventID string) {
+	if q == nil || q.threshold <= 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.failures, eventID)
+}
+
+// add quarantines the event. Returns an error, and leaves the quarantine as it
+// was, if the event can't be stored.
+func (q *eventQuarantine) add(ctx context.Context, eventID string) error {
+	if q.db != nil {
+		if err := q.db.QuarantineEvent(ctx, eventID, false); err != nil {
+			return err
+		}
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.quarantined[eventID]; !ok {
+		q.quarantined[eventID] = false
+	}
+	delete(q.failures, eventID)
+	return nil
+}
+
+// remove takes the event out of quarantine, and forgets its failures so that
+// it gets the full number of attempts again. Returns false if the event
+// wasn't quarantined, or an error, leaving the event quarantined, if it can't
+// be removed from the database.
+func (q *eventQuarantine) remove(ctx context.Context, eventID string) (bool, error) {
+	if !q.contains(eventID) {
+		return false, nil
+	}
+	if q.db != nil {
+		if err := q.db.UnquarantineEvent(ctx, eventID); err != nil {
+			return false, err
+		}
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	automatic, ok := q.quarantined[eventID]
+	if !ok {
+		return false, nil
+	}
+	delete(q.quarantined, eventID)
+	delete(q.failures, eventID)
+	if automatic {
+		q.automatic--
+	}
+	return true, nil
+}
+
+// eventIDs returns the IDs of the quarantined events, sorted.
+func (q *eventQuarantine) eventIDs() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	eventIDs := make([]string, 0, len(q.quarantined))
+	for eventID := range q.quarantined {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Strings(eventIDs)
+	return eventIDs
+}
+
+type quarantineResponse struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+// Quarantine implements the admin endpoints for the event quarantine.
+// GET /_dendrite/admin/v1/federation/quarantine lists the quarantined events.
+// PUT and DELETE /_dendrite/admin/v1/federation/quarantine/{eventID} add the
+// event to the quarantine and remove it again. Each of them responds with the
+// events which are quarantined afterwards.
+func Quarantine(req *http.Request, q *eventQuarantine, eventID string) util.JSONResponse {
+	switch req.Method {
+	case http.MethodPut:
+		if err := q.add(req.Context(), eventID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("event_id", eventID).Error("Failed to quarantine event")
+			return jsonerror.InternalServerError()
+		}
+		util.GetLogger(req.Context()).WithField("event_id", eventID).Info("Quarantined event")
+	case http.MethodDelete:
+		removed, err := q.remove(req.Context(), eventID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("event_id", eventID).Error("Failed to remove event from quarantine")
+			return jsonerror.InternalServerError()
+		}
+		if !removed {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound(fmt.Sprintf("Event %q is not quarantined", eventID)),
+			}
+		}
+		util.GetLogger(req.Context()).WithField("event_id", eventID).Info("Removed event from quarantine")
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: quarantineResponse{q.eventIDs()},
+	}
+}
@@ -0,0 +1,174 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that an event which keeps being rejected is quarantined once it has failed the
+// configured number of times, that later transactions then skip it without doing any work on it, and that it is
+// processed again once it has been taken out of the quarantine.
+func TestTransactionQuarantinesFailingEvent(t *testing.T) {
+	queries := 0
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			queries++
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				// omit the create event so auth checks fail
+				StateEvents: fromStateTuples(req.StateToFetch, []gomatrixserverlib.StateKeyTuple{
+					{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+				}),
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	quarantine := newEventQuarantine(2, nil)
+	processEvent := func() string {
+		t.Helper()
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{inputEvent.JSON()})
+		txn.quarantine = quarantine
+		resp, err := txn.processTransaction()
+		if err != nil {
+			t.Fatalf("txn.processTransaction returned an error: %s", err)
+		}
+		return resp.PDUs[inputEvent.EventID()].Error
+	}
+
+	for i := 0; i < 2; i++ {
+		if result := processEvent(); !strings.HasPrefix(result, pduErrorNotAllowed+": ") {
+			t.Fatalf("wrong error for failure %d: got %q want prefix %s", i+1, result, pduErrorNotAllowed)
+		}
+	}
+	if !quarantine.contains(inputEvent.EventID()) {
+		t.Fatalf("expected the event to be quarantined after 2 failures")
+	}
+
+	queriesBefore := queries
+	if result := processEvent(); !strings.HasPrefix(result, pduErrorQuarantined+": ") || !strings.Contains(result, "quarantined") {
+		t.Errorf("wrong error for quarantined event: got %q want prefix %s", result, pduErrorQuarantined)
+	}
+	if queries != queriesBefore {
+		t.Errorf("expected the quarantined event to be skipped, but the roomserver was queried %d times", queries-queriesBefore)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+
+	// Once an admin takes it out of the quarantine the event is tried again,
+	// and gets the full number of attempts before it is quarantined again.
+	if removed, err := quarantine.remove(context.Background(), inputEvent.EventID()); err != nil || !removed {
+		t.Fatalf("expected the event to be removed from the quarantine: got %t, %v", removed, err)
+	}
+	if result := processEvent(); !strings.HasPrefix(result, pduErrorNotAllowed+": ") {
+		t.Errorf("wrong error for event taken out of the quarantine: got %q want prefix %s", result, pduErrorNotAllowed)
+	}
+	if quarantine.contains(inputEvent.EventID()) {
+		t.Errorf("expected the event not to be quarantined again after 1 failure")
+	}
+}
+
+// The purpose of this test is to check that failures which may not happen again, such as the prev_events of an event
+// being missing, aren't counted towards quarantining it.
+func TestTransactionDoesNotQuarantineMissingPrevEvents(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	quarantine := newEventQuarantine(1, nil)
+	for i := 0; i < 3; i++ {
+		// /state_ids and /state are both purposefully unset, so the event
+		// always fails.
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{inputEvent.JSON()})
+		txn.quarantine = quarantine
+		resp, err := txn.processTransaction()
+		if err != nil {
+			t.Fatalf("txn.processTransaction returned an error: %s", err)
+		}
+		if result := resp.PDUs[inputEvent.EventID()].Error; !strings.HasPrefix(result, pduErrorMissingPrevEvents+": ") {
+			t.Fatalf("wrong error for failure %d: got %q want prefix %s", i+1, result, pduErrorMissingPrevEvents)
+		}
+	}
+	if quarantine.contains(inputEvent.EventID()) {
+		t.Errorf("expected the event not to be quarantined because of missing prev_events")
+	}
+}
+
+// The purpose of this test is to check that the quarantined events are stored in the database, with whether they
+// were quarantined automatically, so that a new quarantine loads them again, and that removing an event removes it
+// from the database too.
+func TestQuarantineStoredInDatabase(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	quarantine := newEventQuarantine(1, db)
+	if err = quarantine.load(ctx); err != nil {
+		t.Fatalf("failed to load the quarantine: %s", err)
+	}
+	if err = quarantine.add(ctx, "$poison:kaer.morhen"); err != nil {
+		t.Fatalf("failed to quarantine event: %s", err)
+	}
+	if err = quarantine.add(ctx, "$gone:kaer.morhen"); err != nil {
+		t.Fatalf("failed to quarantine event: %s", err)
+	}
+	if !quarantine.recordFailure(ctx, "$bad:kaer.morhen") {
+		t.Fatalf("expected the event to be quarantined after 1 failure")
+	}
+	if removed, err := quarantine.remove(ctx, "$gone:kaer.morhen"); err != nil || !removed {
+		t.Fatalf("expected the event to be removed from the quarantine: got %t, %v", removed, err)
+	}
+
+	loaded := newEventQuarantine(1, db)
+	if err = loaded.load(ctx); err != nil {
+		t.Fatalf("failed to load the quarantine: %s", err)
+	}
+	want := map[string]bool{"$bad:kaer.morhen": true, "$poison:kaer.morhen": false}
+	if !reflect.DeepEqual(loaded.quarantined, want) || loaded.automatic != 1 {
+		t.Errorf("wrong quarantine loaded: got %v with %d automatic, want %v with 1 automatic", loaded.quarantined, loaded.automatic, want)
+	}
+}
+
+// The purpose of this test is to check that the admin endpoints add events to the quarantine, remove them again and
+// list them, and that removing an event which isn't quarantined is an error.
+func TestQuarantineAdmin(t *testing.T) {
+	quarantine := newEventQuarantine(0, nil)
+	request := func(method, eventID string) (int, []string) {
+		t.Helper()
+		res := Quarantine(httptest.NewRequest(method, pathPrefixAdmin+"/federation/quarantine/"+eventID, nil), quarantine, eventID)
+		if res.Code != http.StatusOK {
+			return res.Code, nil
+		}
+		return res.Code, res.JSON.(quarantineResponse).EventIDs
+	}
+
+	if code, got := request(http.MethodGet, ""); code != http.StatusOK || len(got) != 0 {
+		t.Errorf("wrong response for an empty quarantine: got %d %v", code, got)
+	}
+	request(http.MethodPut, "$poison:kaer.morhen")
+	if code, got := request(http.MethodPut, "$bad:kaer.morhen"); code != http.StatusOK || !reflect.DeepEqual(got, []string{"$bad:kaer.morhen", "$poison:kaer.morhen"}) {
+		t.Errorf("wrong response after quarantining events: got %d %v", code, got)
+	}
+	if code, got := request(http.MethodDelete, "$bad:kaer.morhen"); code != http.StatusOK || !reflect.DeepEqual(got, []string{"$poison:kaer.morhen"}) {
+		t.Errorf("wrong response after removing an event: got %d %v", code, got)
+	}
+	if code, _ := request(http.MethodDelete, "$bad:kaer.morhen"); code != http.StatusNotFound {
+		t.Errorf("wrong status code for removing an event which isn't quarantined: got %d want %d", code, http.StatusNotFound)
+	}
+}
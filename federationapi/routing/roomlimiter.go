@@ -0,0 +1,101 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// roomLimiter bounds the number of incoming events for any one room that can
+// be processed at the same time, so that a flood of events for a single room
+// can't monopolise processing for every other room.
+type roomLimiter struct {
+	mutex   sync.Mutex
+	limit   int
+	timeout time.Duration
+	rooms   map[string]*roomSlots
+}
+
+// roomSlots is the semaphore for a single room. refs counts the callers that
+// are holding or waiting for a slot so that we know when it is safe to remove
+// the room from the map.
+type roomSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+// roomBusyError is returned when an event couldn't get a slot for its room
+// within the timeout. It is a transient error: the event may succeed if it
+// is sent again later.
+type roomBusyError struct {
+	roomID string
+}
+
+func (e roomBusyError) Error() string {
+	return fmt.Sprintf("room %q is busy processing other events, try again later", e.roomID)
+}
+
+// newRoomLimiter creates a roomLimiter which allows up to limit events per
+// room to be processed concurrently, waiting up to timeout for a free slot.
+func newRoomLimiter(limit int, timeout time.Duration) *roomLimiter {
+	return &roomLimiter{
+		limit:   limit,
+		timeout: timeout,
+		rooms:   make(map[string]*roomSlots),
+	}
+}
+
+// acquire waits for a free processing slot for the given room. If a slot was
+// acquired then the returned function must be called to release it. Returns a
+// roomBusyError if no slot became free within the timeout.
+func (l *roomLimiter) acquire(ctx context.Context, roomID string) (func(), error) {
+	l.mutex.Lock()
+	room, ok := l.rooms[roomID]
+	if !ok {
+		room = &roomSlots{slots: make(chan struct{}, l.limit)}
+		l.rooms[roomID] = room
+	}
+	room.refs++
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case room.slots <- struct{}{}:
+		return func() {
+			<-room.slots
+			l.unref(roomID, room)
+		}, nil
+	case <-timer.C:
+		l.unref(roomID, room)
+		return nil, roomBusyError{roomID}
+	case <-ctx.Done():
+		l.unref(roomID, room)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *roomLimiter) unref(roomID string, room *roomSlots) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	room.refs--
+	if room.refs == 0 {
+		delete(l.rooms, roomID)
+	}
+}
@@ -0,0 +1,84 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func basicStateRoomserverAPI() *testRoomserverAPI {
+	return &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+	}
+}
+
+// The purpose of this test is to check that saturating the processing slots for one room doesn't stop events for
+// another room from being processed.
+func TestRoomLimiterSaturatedRoomDoesNotBlockOtherRooms(t *testing.T) {
+	limiter := newRoomLimiter(1, 50*time.Millisecond)
+	release, err := limiter.acquire(context.Background(), "!busy:white.orchard")
+	if err != nil {
+		t.Fatalf("failed to acquire slot for busy room: %s", err)
+	}
+	defer release()
+
+	rsAPI := basicStateRoomserverAPI()
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.roomLimiter = limiter
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+}
+
+// The purpose of this test is to check that an event for a room with no free processing slots is skipped with an
+// error once the timeout expires, rather than being processed or failing the whole transaction.
+func TestRoomLimiterSaturatedRoomTimesOut(t *testing.T) {
+	event := testEvents[len(testEvents)-1]
+	limiter := newRoomLimiter(1, 50*time.Millisecond)
+	release, err := limiter.acquire(context.Background(), event.RoomID())
+	if err != nil {
+		t.Fatalf("failed to acquire slot for room: %s", err)
+	}
+	defer release()
+
+	rsAPI := basicStateRoomserverAPI()
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.roomLimiter = limiter
+	mustProcessTransaction(t, txn, []string{event.EventID()})
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that slots are released, and that rooms are forgotten once nobody is using
+// them, so that the limiter doesn't grow forever.
+func TestRoomLimiterRelease(t *testing.T) {
+	limiter := newRoomLimiter(1, 50*time.Millisecond)
+	release, err := limiter.acquire(context.Background(), "!roomid:kaer.morhen")
+	if err != nil {
+		t.Fatalf("failed to acquire slot: %s", err)
+	}
+	if _, err = limiter.acquire(context.Background(), "!roomid:kaer.morhen"); err == nil {
+		t.Fatalf("expected second acquire to time out")
+	}
+	release()
+	release, err = limiter.acquire(context.Background(), "!roomid:kaer.morhen")
+	if err != nil {
+		t.Fatalf("failed to acquire slot after release: %s", err)
+	}
+	release()
+	if len(limiter.rooms) != 0 {
+		t.Errorf("expected no rooms to be tracked, got %d", len(limiter.rooms))
+	}
+}
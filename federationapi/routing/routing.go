@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -24,16 +25,20 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/federationapi/storage"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	pathPrefixV2Keys       = "/_matrix/key/v2"
 	pathPrefixV1Federation = "/_matrix/federation/v1"
 	pathPrefixV2Federation = "/_matrix/federation/v2"
+	pathFederationReady    = "/federationapi/ready"
+	pathPrefixAdmin        = "/_dendrite/admin/v1"
 )
 
 // Setup registers HTTP handlers with the given ServeMux.
@@ -53,11 +58,59 @@ func Setup(
 	federation *gomatrixserverlib.FederationClient,
 	accountDB accounts.Database,
 	deviceDB devices.Database,
+	federationDB storage.Database,
 ) {
 	v2keysmux := apiMux.PathPrefix(pathPrefixV2Keys).Subrouter()
 	v1fedmux := apiMux.PathPrefix(pathPrefixV1Federation).Subrouter()
 	v2fedmux := apiMux.PathPrefix(pathPrefixV2Federation).Subrouter()
 
+	txnLimiter := newTxnLimiter(
+		int(cfg.FederationAPI.MaxConcurrentTransactions),
+		int(cfg.FederationAPI.MaxConcurrentTransactionsPerOrigin),
+	)
+	circuitBreaker := newCircuitBreaker(
+		int(cfg.FederationAPI.FetchFailureThreshold),
+		cfg.FederationAPI.FetchFailureCooldown,
+	)
+	// The dependencies are shared by every transaction that we receive.
+	deps := txnDeps{
+		rsAPI:       rsAPI,
+		producer:    producer,
+		eduProducer: eduProducer,
+		keys:        keys,
+		federation:  federation,
+		roomLimiter: newRoomLimiter(
+			int(cfg.FederationAPI.MaxConcurrentEventsPerRoom),
+			cfg.FederationAPI.RoomEventSlotTimeout,
+		),
+		fetchLimiter: newFetchLimiter(
+			int(cfg.FederationAPI.MaxConcurrentFetchesPerServer),
+		),
+		circuitBreaker: circuitBreaker,
+		stateLookups:   newStateLookups(),
+		missingPrevEventsRetries: newMissingPrevEventsRetries(
+			int(cfg.FederationAPI.MissingPrevEventsRetries),
+			cfg.FederationAPI.MissingPrevEventsRetryBackoff,
+			circuitBreaker,
+		),
+		missingEventsWalks: newMissingEventsWalks(),
+		quarantine: newEventQuarantine(
+			int(cfg.FederationAPI.QuarantineAfterFailures), federationDB,
+		),
+		txnLimiter: txnLimiter,
+		originFilter: newOriginFilter(
+			cfg.FederationAPI.AllowedOrigins,
+			cfg.FederationAPI.DeniedOrigins,
+		),
+		originQueues: newOriginQueues(),
+	}
+	if cfg.FederationAPI.EnablePartialState {
+		deps.partialState = newPartialStateRooms()
+	}
+	if err := deps.quarantine.load(context.Background()); err != nil {
+		logrus.WithError(err).Panic("failed to load the event quarantine")
+	}
+
 	localKeys := common.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
 		return LocalKeys(cfg)
 	})
@@ -70,19 +123,41 @@ func Setup(
 	v2keysmux.Handle("/server/", localKeys).Methods(http.MethodGet)
 	v2keysmux.Handle("/server", localKeys).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/send/{txnID}", common.MakeFedAPI(
+	// Load balancers can poll this to stop sending transactions to an
+	// instance which is already processing as many as it can.
+	apiMux.Handle(pathFederationReady, common.MakeInternalAPI("federation_ready", func(req *http.Request) util.JSONResponse {
+		return Readiness(txnLimiter)
+	})).Methods(http.MethodGet)
+
+	v1fedmux.Handle("/send/{txnID}", DecompressTransactionBody(common.MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, keys,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars, err := common.URLDecodeMapValues(mux.Vars(httpReq))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return Send(
-				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, producer, eduProducer, keys, federation,
-			)
+			return Send(httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]), cfg, deps)
 		},
-	)).Methods(http.MethodPut, http.MethodOptions)
+	), cfg.FederationAPI.MaxDecompressedTransactionBytes)).Methods(http.MethodPut, http.MethodOptions)
+
+	// The admin endpoints are only served if they are protected.
+	adminAuth := common.BasicAuth{
+		Username: cfg.FederationAPI.AdminBasicAuth.Username,
+		Password: cfg.FederationAPI.AdminBasicAuth.Password,
+	}
+	if adminAuth.Username != "" && adminAuth.Password != "" {
+		adminMux := apiMux.PathPrefix(pathPrefixAdmin).Subrouter()
+		adminMux.Handle("/federation/quarantine", common.WrapHandlerInBasicAuth(common.MakeInternalAPI("federation_quarantine", func(req *http.Request) util.JSONResponse {
+			return Quarantine(req, deps.quarantine, "")
+		}), adminAuth)).Methods(http.MethodGet)
+		adminMux.Handle("/federation/quarantine/{eventID}", common.WrapHandlerInBasicAuth(common.MakeInternalAPI("federation_quarantine_event", func(req *http.Request) util.JSONResponse {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return Quarantine(req, deps.quarantine, vars["eventID"])
+		}), adminAuth)).Methods(http.MethodPut, http.MethodDelete)
+	}
 
 	v2fedmux.Handle("/invite/{roomID}/{eventID}", common.MakeFedAPI(
 		"federation_invite", cfg.Matrix.ServerName, keys,
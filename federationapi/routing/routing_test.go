@@ -0,0 +1,54 @@
+package routing
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that Setup wraps /send with the decompression handler, using the configured
+// maximum decompressed size. Bodies over the limit must be rejected before the request is authenticated, whereas
+// bodies within the limit must be passed on to the federation handler, which rejects them as they are unsigned.
+func TestSetupSendDecompressesWithConfiguredLimit(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testDestination
+	cfg.FederationAPI.MaxDecompressedTransactionBytes = 64
+
+	router := mux.NewRouter().UseEncodedPath()
+	Setup(
+		router, cfg, &testRoomserverAPI{}, nil, nil, nil, nil,
+		gomatrixserverlib.KeyRing{}, nil, nil, nil, nil,
+	)
+
+	testCases := []struct {
+		Name     string
+		Body     []byte
+		WantCode int
+	}{
+		{
+			Name:     "over the configured limit",
+			Body:     bytes.Repeat([]byte{'a'}, 65),
+			WantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:     "within the configured limit",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+			WantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodPut, pathPrefixV1Federation+"/send/1", bytes.NewReader(mustGzip(t, tc.Body)))
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tc.WantCode {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.Name, rec.Code, tc.WantCode)
+		}
+	}
+}
@@ -15,17 +15,29 @@
 package routing
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common/config"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -35,59 +47,207 @@ func Send(
 	request *gomatrixserverlib.FederationRequest,
 	txnID gomatrixserverlib.TransactionID,
 	cfg *config.Dendrite,
-	rsAPI api.RoomserverInternalAPI,
-	producer *producers.RoomserverProducer,
-	eduProducer *producers.EDUServerProducer,
-	keys gomatrixserverlib.KeyRing,
-	federation *gomatrixserverlib.FederationClient,
+	deps txnDeps,
 ) util.JSONResponse {
-	t := txnReq{
-		context:     httpReq.Context(),
-		rsAPI:       rsAPI,
-		producer:    producer,
-		eduProducer: eduProducer,
-		keys:        keys,
-		federation:  federation,
+	// Reject transactions from servers that we don't federate with before
+	// doing anything else.
+	if deps.originFilter != nil && !deps.originFilter.allowed(request.Origin()) {
+		util.GetLogger(httpReq.Context()).WithField("origin", request.Origin()).Warnf("Rejecting transaction %q: origin is not allowed", txnID)
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("Transactions from %q are not accepted", request.Origin())),
+		}
 	}
 
-	var txnEvents struct {
-		PDUs []json.RawMessage       `json:"pdus"`
-		EDUs []gomatrixserverlib.EDU `json:"edus"`
+	// Check that we have capacity to process the transaction before doing
+	// any work on it.
+	release, errRes := deps.txnLimiter.acquire(request.Origin())
+	if errRes != nil {
+		util.GetLogger(httpReq.Context()).WithField("origin", request.Origin()).Warnf("Rejecting transaction %q: too many concurrent transactions", txnID)
+		return *errRes
 	}
+	defer release()
 
-	if err := json.Unmarshal(request.Content(), &txnEvents); err != nil {
+	// Take our place in the queue for the origin now, so that transactions
+	// are processed in the order in which they arrived.
+	turn := deps.originQueues.join(request.Origin())
+	defer turn.finish()
+
+	t, err := newTxnReq(httpReq, request, txnID, cfg, deps)
+	switch err.(type) {
+	case nil:
+	case tooManyInTransactionError:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	case missingTxnDependencyError:
+		util.GetLogger(httpReq.Context()).WithError(err).Error("newTxnReq failed")
+		return jsonerror.InternalServerError()
+	default:
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
 
-	// TODO: Really we should have a function to convert FederationRequest to txnReq
+	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
+
+	if err = turn.wait(httpReq.Context()); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Warnf("Gave up waiting for earlier transactions from %q before transaction %q", t.Origin, txnID)
+		return util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("Gave up waiting for earlier transactions to be processed, try again later"),
+		}
+	}
+
+	resp, err := t.processTransaction()
+	// No error? Great! Send back a 200.
+	if err == nil {
+		return t.successResponse(resp)
+	}
+	return transactionErrorResponse(httpReq.Context(), err)
+}
+
+// txnDeps are the dependencies of /send which are shared between all of the
+// transactions that are being processed. The roomserver API, producers and
+// federation client are required. The rest are optional, and leaving them nil
+// disables what they do.
+type txnDeps struct {
+	rsAPI                    api.RoomserverInternalAPI
+	producer                 *producers.RoomserverProducer
+	eduProducer              *producers.EDUServerProducer
+	keys                     gomatrixserverlib.KeyRing
+	federation               *gomatrixserverlib.FederationClient
+	roomLimiter              *roomLimiter
+	partialState             *partialStateRooms
+	fetchLimiter             *fetchLimiter
+	circuitBreaker           *circuitBreaker
+	stateLookups             *stateLookups
+	missingPrevEventsRetries *missingPrevEventsRetries
+	missingEventsWalks       *missingEventsWalks
+	quarantine               *eventQuarantine
+	txnLimiter               *txnLimiter
+	originFilter             *originFilter
+	originQueues             *originQueues
+}
+
+// newTxnReq builds the txnReq for a /send request, decoding the PDUs and
+// EDUs of the transaction from the request content and setting it up from
+// the config and the shared dependencies. Returns a tooManyInTransactionError
+// or a JSON error if the content can't be decoded, or a
+// missingTxnDependencyError if a required dependency is nil.
+func newTxnReq(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	txnID gomatrixserverlib.TransactionID,
+	cfg *config.Dendrite,
+	deps txnDeps,
+) (*txnReq, error) {
+	txnEvents, err := decodeTransaction(request.Content())
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case deps.rsAPI == nil:
+		return nil, missingTxnDependencyError{"roomserver API"}
+	case deps.producer == nil:
+		return nil, missingTxnDependencyError{"roomserver producer"}
+	case deps.eduProducer == nil:
+		return nil, missingTxnDependencyError{"EDU server producer"}
+	case deps.federation == nil:
+		return nil, missingTxnDependencyError{"federation client"}
+	}
+
+	t := &txnReq{
+		context:      httpReq.Context(),
+		rsAPI:        deps.rsAPI,
+		producer:     deps.producer,
+		eduProducer:  deps.eduProducer,
+		keys:         deps.keys,
+		federation:   deps.federation,
+		roomLimiter:  deps.roomLimiter,
+		partialState: deps.partialState,
+		stateLookups: deps.stateLookups,
+		quarantine:   deps.quarantine,
+
+		missingPrevEventsRetryAfter: cfg.FederationAPI.MissingPrevEventsRetryAfter,
+		missingPrevEventsRetries:    deps.missingPrevEventsRetries,
+		maxPrevEvents:               int(cfg.FederationAPI.MaxPrevEvents),
+		maxRoomsPerTransaction:      int(cfg.FederationAPI.MaxRoomsPerTransaction),
+		maxDepthAhead:               cfg.FederationAPI.MaxDepthAhead,
+		maxTimestampSkewFuture:      cfg.FederationAPI.MaxTimestampSkewFuture,
+		maxTimestampSkewPast:        cfg.FederationAPI.MaxTimestampSkewPast,
+		rejectTimestampSkew:         cfg.FederationAPI.RejectTimestampSkew,
+		stateFetchStrategy:          cfg.FederationAPI.StateFetchStrategy,
+		maxStateEvents:              int(cfg.FederationAPI.MaxStateEvents),
+		maxStateIDsEvents:           int(cfg.FederationAPI.MaxStateIDsEvents),
+		emitRejectedEvents:          cfg.FederationAPI.EmitRejectedEvents,
+		maxFetchesPerEvent:          int(cfg.FederationAPI.MaxFetchesPerEvent),
+		missingStateTimeout:         cfg.FederationAPI.MissingStateTimeout,
+		missingEventsLimit:          int(cfg.FederationAPI.MissingEventsLimit),
+		missingEventsWalks:          deps.missingEventsWalks,
+		pduTimeout:                  cfg.FederationAPI.PDUTimeout,
+		slowTransactionThreshold:    cfg.FederationAPI.SlowTransactionThreshold,
+	}
+	// Bound the requests we make to other servers to fill in gaps, across
+	// all of the transactions that are being processed.
+	if deps.fetchLimiter != nil {
+		t.federation = &limitedFederationClient{t.federation, deps.fetchLimiter}
+	}
+	// Fail fast when fetching from servers which keep failing, rather than
+	// queueing behind the limiter to wait for yet another timeout.
+	if deps.circuitBreaker != nil {
+		t.federation = &breakingFederationClient{t.federation, deps.circuitBreaker}
+	}
+	// Count the requests made to fill in the gap before each event against
+	// the budget for that event.
+	t.federation = &budgetedFederationClient{t.federation}
+
 	t.PDUs = txnEvents.PDUs
 	t.EDUs = txnEvents.EDUs
 	t.Origin = request.Origin()
 	t.TransactionID = txnID
 	t.Destination = cfg.Matrix.ServerName
+	return t, nil
+}
 
-	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
-
-	resp, err := t.processTransaction()
+// transactionErrorResponse returns the response to send back for a transaction
+// which failed to process with the given error.
+func transactionErrorResponse(ctx context.Context, err error) util.JSONResponse {
 	switch err.(type) {
-	// No error? Great! Send back a 200.
-	case nil:
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: resp,
-		}
 	// Handle known error cases as we will return a 400 error for these.
 	case roomNotFoundError:
 	case unmarshalError:
 	case verifySigError:
+	// The event failed auth, or we couldn't get the state needed to auth it.
+	// These are normally reported against the event rather than failing the
+	// whole transaction, but if they get this far they are still the fault
+	// of the event rather than of our server.
+	case *gomatrixserverlib.NotAllowed:
+	case missingPrevEventsError:
+	// We couldn't fetch the keys needed to check the signatures of an event.
+	// This is a problem on our side, or with the key servers, rather than a
+	// problem with the event, so ask the sender to try again later.
+	case keyFetchError:
+		util.GetLogger(ctx).WithError(err).Warn("t.processTransaction failed to fetch signing keys")
+		return util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("Unable to fetch the keys needed to verify the transaction, try again later"),
+		}
+	// The EDU server stayed unavailable, so ask the sender to try again later
+	// rather than losing the EDUs.
+	case eduServerUnavailableError:
+		util.GetLogger(ctx).WithError(err).Warn("t.processTransaction failed to send EDUs")
+		return util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: jsonerror.Unknown("Unable to process the EDUs in the transaction, try again later"),
+		}
 	// Handle unknown error cases. Sending 500 errors back should be a last
 	// resort as this can make other homeservers back off sending federation
 	// events.
 	default:
-		util.GetLogger(httpReq.Context()).WithError(err).Error("t.processTransaction failed")
+		util.GetLogger(ctx).WithError(err).Error("t.processTransaction failed")
 		return jsonerror.InternalServerError()
 	}
 	// Return a 400 error for bad requests as fallen through from above.
@@ -97,14 +257,193 @@ func Send(
 	}
 }
 
+// DecompressTransactionBody wraps a handler so that request bodies sent with a
+// "Content-Encoding: gzip" header are transparently decompressed before they
+// reach it. The decompressed body may not exceed maxBytes, which protects us
+// from decompression bombs. Requests using any other content encoding are
+// rejected with a 415.
+func DecompressTransactionBody(h http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if errRes := decompressRequestBody(req, maxBytes); errRes != nil {
+			util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+				return *errRes
+			})).ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// decompressRequestBody replaces the body of the request with its decompressed
+// form, if it was compressed. Returns an error response if the encoding is not
+// supported or if the decompressed body would be larger than maxBytes.
+func decompressRequestBody(req *http.Request, maxBytes int64) *util.JSONResponse {
+	// Content codings are case-insensitive, see RFC 7231 section 3.1.2.1.
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusUnsupportedMediaType,
+			JSON: jsonerror.Unknown(fmt.Sprintf("Unsupported Content-Encoding %q", encoding)),
+		}
+	}
+
+	reader, err := gzip.NewReader(req.Body)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decompressed. " + err.Error()),
+		}
+	}
+	defer reader.Close() // nolint: errcheck
+
+	// Read one byte more than the limit so that we can tell the difference
+	// between a body which is exactly maxBytes and one which is larger.
+	content, err := ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decompressed. " + err.Error()),
+		}
+	}
+	if int64(len(content)) > maxBytes {
+		return &util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.Unknown(fmt.Sprintf("The decompressed request body is larger than the maximum allowed size (%d).", maxBytes)),
+		}
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(content))
+	req.ContentLength = int64(len(content))
+	req.Header.Del("Content-Encoding")
+	return nil
+}
+
 type txnReq struct {
 	gomatrixserverlib.Transaction
 	context     context.Context
 	rsAPI       api.RoomserverInternalAPI
-	producer    *producers.RoomserverProducer
-	eduProducer *producers.EDUServerProducer
+	producer    txnRoomserverProducer
+	eduProducer txnEDUProducer
 	keys        gomatrixserverlib.JSONVerifier
 	federation  txnFederationClient
+	// Bounds how many events per room can be processed concurrently. If nil
+	// then there is no limit.
+	roomLimiter *roomLimiter
+	// Tracks rooms whose events were accepted using partial state. If nil
+	// then the full state is always fetched for events with missing
+	// prev_events.
+	partialState *partialStateRooms
+	// Decides whether EDUs sent by a user in a room should be dropped. If
+	// nil then every EDU is passed on.
+	eduFilter eduFilter
+	// How long the sender should wait before retrying events that we
+	// skipped because we couldn't fetch the state before them. If zero then
+	// no hint is given.
+	missingPrevEventsRetryAfter time.Duration
+	// Set by processTransaction if any event was skipped for that reason.
+	missingPrevEvents bool
+	// Retries the events that were skipped for that reason in the
+	// background. If nil then they aren't retried.
+	missingPrevEventsRetries *missingPrevEventsRetries
+	// The maximum number of prev_events that an event may have if we are
+	// missing any of them. If zero then there is no limit.
+	maxPrevEvents int
+	// The maximum number of distinct rooms that the events in a transaction
+	// may be in. If zero then there is no limit.
+	maxRoomsPerTransaction int
+	// The events which are skipped without being processed, and which
+	// counts the failures of the events that are processed. If nil then no
+	// events are skipped.
+	quarantine *eventQuarantine
+	// How far the depth of an event may be beyond the current depth of its
+	// room. If zero then there is no limit.
+	maxDepthAhead int64
+	// Events whose origin_server_ts is more than maxTimestampSkewFuture ahead
+	// of or maxTimestampSkewPast behind our clock are logged, and rejected if
+	// rejectTimestampSkew is true. If zero then there is no limit that way.
+	maxTimestampSkewFuture time.Duration
+	maxTimestampSkewPast   time.Duration
+	rejectTimestampSkew    bool
+	// Coalesces concurrent lookups of the state before the same event
+	// across transactions. If nil then lookups aren't coalesced.
+	stateLookups *stateLookups
+	// Which endpoints are used to fetch the state before an event, one of
+	// the config.StateFetch* strategies. If empty then /state_ids is tried
+	// before falling back to /state.
+	stateFetchStrategy string
+	// The maximum number of state events, and separately of auth events,
+	// that we accept in a /state response. If zero then there is no limit.
+	maxStateEvents int
+	// The maximum number of distinct state and auth events, combined, that
+	// we accept in a /state_ids response. If zero then there is no limit.
+	maxStateIDsEvents int
+	// Whether to tell the roomserver about the events that we reject, so
+	// that they are written to its output log for auditing.
+	emitRejectedEvents bool
+	// The maximum number of requests that we make to the sender, and the
+	// longest time that we spend, filling in the gap before each incoming
+	// event. The requests are only counted if t.federation is a
+	// budgetedFederationClient. If zero then there is no limit.
+	maxFetchesPerEvent  int
+	missingStateTimeout time.Duration
+	// How many events to ask for in each /get_missing_events request when
+	// walking back through the gap before an incoming event. If zero then
+	// the state before the event is fetched instead.
+	missingEventsLimit int
+	// Keeps the walks through gaps which were cut short, so that later
+	// transactions can carry them on. If nil then they start again.
+	missingEventsWalks *missingEventsWalks
+	// The longest time that we spend processing each event, after which it
+	// is skipped so that the rest of the transaction isn't held up. If zero
+	// then there is no limit.
+	pduTimeout time.Duration
+	// The depth of the next event in the rooms that we have processed
+	// events for, according to the roomserver. Populated by checkEventDepth.
+	roomDepths map[string]int64
+	// The server ACLs of the rooms that we have processed events for, or nil
+	// for rooms without one. Populated by checkServerACL.
+	serverACLs map[string]*serverACL
+	// The SHA-256 hashes of the JSON of the events whose signatures have
+	// already been verified in this transaction, by event ID. Populated by
+	// verifyEventSignatures.
+	verifiedEvents map[string][sha256.Size]byte
+	// The servers whose keys have already been fetched again in this
+	// transaction after an event of theirs failed verification. Populated by
+	// verifyEventSignatures.
+	refreshedKeys map[gomatrixserverlib.ServerName]bool
+	// Transactions which take at least this long to process are logged,
+	// along with the time spent waiting for other servers and for the
+	// roomserver. If zero then nothing is logged.
+	slowTransactionThreshold time.Duration
+}
+
+// successResponse returns the response for a transaction that we processed.
+// If any of its events were skipped because we couldn't fetch the state
+// before them then the response also tells the sender when to try again.
+func (t *txnReq) successResponse(resp *gomatrixserverlib.RespSend) util.JSONResponse {
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+	if t.missingPrevEvents && t.missingPrevEventsRetryAfter > 0 {
+		res.Headers = map[string]string{
+			"Retry-After": strconv.Itoa(int(t.missingPrevEventsRetryAfter.Seconds())),
+		}
+	}
+	return res
+}
+
+// eduFilter is consulted for every EDU that we receive which was sent by a
+// user in a room, so implementations should be cheap to call, e.g. by caching
+// the ignore or mute lists that they consult.
+type eduFilter interface {
+	// ignoreEDU returns true if EDUs sent by the user in the room should be
+	// dropped rather than passed on to the rest of the server.
+	ignoreEDU(ctx context.Context, roomID, userID string) bool
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -114,41 +453,183 @@ type txnFederationClient interface {
 	)
 	LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error)
 	GetEvent(ctx context.Context, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error)
+	LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (
+		res gomatrixserverlib.RespMissingEvents, err error,
+	)
+}
+
+// A subset of RoomserverProducer functionality that txn requires. Useful for testing.
+type txnRoomserverProducer interface {
+	SendEvents(
+		ctx context.Context, events []gomatrixserverlib.HeaderedEvent, sendAsServer gomatrixserverlib.ServerName,
+		txnID *api.TransactionID, origin gomatrixserverlib.ServerName,
+	) (string, error)
+	SendEventWithState(
+		ctx context.Context, state *gomatrixserverlib.RespState, event gomatrixserverlib.HeaderedEvent, haveEventIDs map[string]bool,
+		origin gomatrixserverlib.ServerName, historical bool,
+	) error
+	SendInputRoomEvents(ctx context.Context, ires []api.InputRoomEvent) (eventID string, err error)
+	SendRejectedEvents(ctx context.Context, rejected []api.InputRejectedEvent) error
+}
+
+// A subset of EDUServerProducer functionality that txn requires. Useful for testing.
+type txnEDUProducer interface {
+	SendTyping(ctx context.Context, userID, roomID string, typing bool, timeoutMS int64) error
+	SendTypingBatch(ctx context.Context, events []eduAPI.InputTypingEvent) error
 }
 
 func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
+	span, ctx := opentracing.StartSpanFromContext(t.context, "processTransaction")
+	defer span.Finish()
+	span.SetTag("origin", string(t.Origin))
+	span.SetTag("transaction_id", string(t.TransactionID))
+	defer t.trackSlowTransaction()()
+
+	// The EDUs don't depend on the events, so pass them on while we process
+	// the events rather than making typing notifications wait behind slow
+	// lookups of missing state.
+	eduErrs := make(chan error, 1)
+	go func() {
+		// This isn't the goroutine serving the request, so a panic here would
+		// take down the whole server.
+		defer func() {
+			if r := recover(); r != nil {
+				eduErrs <- fmt.Errorf("panic while processing EDUs: %v", r)
+			}
+		}()
+		eduErrs <- t.processEDUs(t.EDUs)
+	}()
+
+	resp, err := t.processPDUs(ctx)
+	// If the EDU server is down then fail the transaction, so that the sender
+	// tries it again later rather than the EDUs being lost. The roomserver
+	// copes with being sent the events which we have already processed again.
+	if eduErr := <-eduErrs; err == nil && eduErr != nil {
+		return nil, eduErr
+	}
+	return resp, err
+}
+
+// processPDUs processes the events in the transaction, returning the result
+// for each of them.
+func (t *txnReq) processPDUs(ctx context.Context) (*gomatrixserverlib.RespSend, error) {
 	results := make(map[string]gomatrixserverlib.PDUResult)
 
-	var pdus []gomatrixserverlib.HeaderedEvent
-	for _, pdu := range t.PDUs {
+	roomIDs := make([]string, len(t.PDUs))
+	roomVersions := make([]gomatrixserverlib.RoomVersion, len(t.PDUs))
+	refs := make([]gomatrixserverlib.EventReference, len(t.PDUs))
+	skipped := make([]bool, len(t.PDUs))
+	rooms := make(map[string]bool)
+	for i, pdu := range t.PDUs {
 		var header struct {
-			RoomID string `json:"room_id"`
+			RoomID  string `json:"room_id"`
+			EventID string `json:"event_id"`
 		}
 		if err := json.Unmarshal(pdu, &header); err != nil {
-			util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to extract room ID from event")
-			return nil, unmarshalError{err}
+			util.GetLogger(ctx).WithError(err).Warn("Transaction: Failed to extract room ID from event")
+			return nil, unmarshalError{err: err}
 		}
 		verReq := api.QueryRoomVersionForRoomRequest{RoomID: header.RoomID}
 		verRes := api.QueryRoomVersionForRoomResponse{}
-		if err := t.rsAPI.QueryRoomVersionForRoom(t.context, &verReq, &verRes); err != nil {
-			util.GetLogger(t.context).WithError(err).Warn("Transaction: Failed to query room version for room", verReq.RoomID)
+		if err := t.rsAPI.QueryRoomVersionForRoom(ctx, &verReq, &verRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Transaction: Failed to query room version for room", verReq.RoomID)
 			return nil, roomNotFoundError{verReq.RoomID}
 		}
-		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, verRes.RoomVersion)
+		roomIDs[i], roomVersions[i] = header.RoomID, verRes.RoomVersion
+		// We can't parse events in room versions that we don't support, but
+		// that is no reason to fail the other events in the transaction. We
+		// can only tell the sender which event it was if the event has an
+		// event_id, since we don't know how the version derives event IDs.
+		if _, err := roomserverVersion.SupportedRoomVersion(verRes.RoomVersion); err != nil {
+			skipped[i] = true
+			err = unsupportedRoomVersionError{header.EventID, header.RoomID, verRes.RoomVersion}
+			util.GetLogger(ctx).WithError(err).Warn("Transaction: Skipping event in unsupported room version")
+			if header.EventID != "" {
+				results[header.EventID] = gomatrixserverlib.PDUResult{Error: pduResultError(err)}
+			}
+			continue
+		}
+		refs[i], _ = eventReference(pdu, verRes.RoomVersion)
+		// Events which keep failing would fail every transaction that they
+		// are sent in, so skip them once they are quarantined.
+		if refs[i].EventID != "" && t.quarantine.contains(refs[i].EventID) {
+			skipped[i] = true
+			err := quarantinedEventError{refs[i].EventID}
+			util.GetLogger(ctx).WithError(err).Warn("Transaction: Skipping quarantined event")
+			results[refs[i].EventID] = gomatrixserverlib.PDUResult{Error: pduResultError(err)}
+			refs[i] = gomatrixserverlib.EventReference{}
+			continue
+		}
+		// Each room that the transaction touches needs its own state lookups
+		// and maybe requests to the sender, so skip the events in any rooms
+		// beyond the limit. The sender can send them again in a transaction
+		// of their own.
+		if !rooms[header.RoomID] && t.maxRoomsPerTransaction > 0 && len(rooms) >= t.maxRoomsPerTransaction {
+			skipped[i] = true
+			err := tooManyRoomsError{refs[i].EventID, header.RoomID, t.maxRoomsPerTransaction}
+			util.GetLogger(ctx).WithError(err).Warn("Transaction: Skipping event in too many rooms")
+			if refs[i].EventID != "" {
+				results[refs[i].EventID] = gomatrixserverlib.PDUResult{Error: pduResultError(err)}
+			}
+			refs[i] = gomatrixserverlib.EventReference{}
+			continue
+		}
+		rooms[header.RoomID] = true
+	}
+
+	// Senders often send us events again, for example while catching up
+	// after an outage, so skip the events that we already have rather than
+	// verifying their signatures again.
+	known, err := t.queryKnownEvents(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []gomatrixserverlib.Event
+	var eventRoomVersions []gomatrixserverlib.RoomVersion
+	for i, pdu := range t.PDUs {
+		if skipped[i] {
+			continue
+		}
+		if known[refs[i].EventID] {
+			results[refs[i].EventID] = gomatrixserverlib.PDUResult{}
+			continue
+		}
+		event, err := parseUntrustedEvent(ctx, pdu, roomVersions[i])
 		if err != nil {
-			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", event.EventID())
-			return nil, unmarshalError{err}
+			util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"room_id":      roomIDs[i],
+				"room_version": roomVersions[i],
+				"event":        redactedEventJSON(pdu),
+			}).Warn("Transaction: Failed to parse event JSON")
+			return nil, err
 		}
-		if err := gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
-			util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
-			return nil, verifySigError{event.EventID(), err}
+		events = append(events, event)
+		eventRoomVersions = append(eventRoomVersions, roomVersions[i])
+	}
+
+	// Verify the signatures of all of the events together, so that the keys
+	// of each server are only looked up once.
+	var pdus []gomatrixserverlib.HeaderedEvent
+	for i, err := range t.verifyEventSignaturesBatch(ctx, events) {
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", events[i].EventID())
+			return nil, err
 		}
-		pdus = append(pdus, event.Headered(verRes.RoomVersion))
+		pdus = append(pdus, events[i].Headered(eventRoomVersions[i]))
+	}
+
+	// Look up the state needed to authenticate as many of the events as we
+	// can up front, so that we don't need a roomserver query for each one.
+	states, err := t.queryStateForEvents(ctx, pdus)
+	if err != nil {
+		return nil, err
 	}
 
 	// Process the events.
+	var rejected []api.InputRejectedEvent
 	for _, e := range pdus {
-		err := t.processEvent(e.Unwrap())
+		err := t.processEventAndRecordOutcome(ctx, e.Unwrap(), states[e.EventID()])
 		if err != nil {
 			// If the error is due to the event itself being bad then we skip
 			// it and move onto the next event. We report an error so that the
@@ -158,32 +639,61 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			// such as a database being unavailable then we should bail, and
 			// hope that the sender will retry when we are feeling better.
 			//
-			// It is uncertain what we should do if an event fails because
-			// we failed to fetch more information from the sending server.
-			// For example if a request to /state fails.
-			// If we skip the event then we risk missing the event until we
-			// receive another event referencing it.
-			// If we bail and stop processing then we risk wedging incoming
-			// transactions from that server forever.
+			// If an event fails because we couldn't fetch more information
+			// from the sending server, for example if a request to /state
+			// fails, then we skip it. We risk missing the event until we
+			// receive another event referencing it, but if we bailed then we
+			// would risk wedging incoming transactions from that server
+			// forever.
 			switch err.(type) {
 			case roomNotFoundError:
+			case roomBusyError:
+			case serverACLDeniedError:
+			case tooManyPrevEventsError:
+			case eventDepthError:
+			case timestampSkewError:
 			case *gomatrixserverlib.NotAllowed:
+			// The event took too long, so skip it to give the rest of the
+			// transaction a chance. The sender can try it again later.
+			case pduTimeoutError:
+			// We couldn't get the state before the event from the sender.
+			// Skip the event rather than failing the whole transaction so
+			// that we don't wedge transactions from the sender, but tell
+			// them when to try again.
+			case missingPrevEventsError:
+				t.missingPrevEvents = true
+				t.missingPrevEventsRetries.queue(t, e.Unwrap())
 			default:
 				// Any other error should be the result of a temporary error in
 				// our server so we should bail processing the transaction entirely.
 				return nil, err
 			}
 			results[e.EventID()] = gomatrixserverlib.PDUResult{
-				Error: err.Error(),
+				Error: pduResultError(err),
+			}
+			if t.emitRejectedEvents && isRejection(err) {
+				rejected = append(rejected, api.InputRejectedEvent{
+					EventID: e.EventID(),
+					RoomID:  e.RoomID(),
+					Origin:  t.Origin,
+					Reason:  results[e.EventID()].Error,
+				})
 			}
-			util.GetLogger(t.context).WithError(err).WithField("event_id", e.EventID()).Warn("Failed to process incoming federation event, skipping it.")
+			util.GetLogger(ctx).WithError(err).WithField("event_id", e.EventID()).Warn("Failed to process incoming federation event, skipping it.")
 		} else {
 			results[e.EventID()] = gomatrixserverlib.PDUResult{}
 		}
 	}
 
-	t.processEDUs(t.EDUs)
-	util.GetLogger(t.context).Infof("Processed %d PDUs from transaction %q", len(results), t.TransactionID)
+	// The rejected events are only for auditing, so failing to send them
+	// doesn't fail the transaction.
+	if len(rejected) > 0 {
+		if err = t.producer.SendRejectedEvents(ctx, rejected); err != nil {
+			util.GetLogger(ctx).WithError(err).Errorf("Failed to send %d rejected events to the roomserver", len(rejected))
+		}
+	}
+
+	util.GetLogger(ctx).Infof("Processed %d PDUs from transaction %q", len(results), t.TransactionID)
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
@@ -192,56 +702,732 @@ type roomNotFoundError struct {
 }
 type unmarshalError struct {
 	err error
+	// The room version that the event was parsed as, if we got that far.
+	roomVersion gomatrixserverlib.RoomVersion
+	// Whether the event JSON had an event_id field. Only events in room
+	// versions 1 and 2 have one, so this hints at which room version the
+	// sender thought the room was.
+	hasEventID bool
 }
 type verifySigError struct {
 	eventID string
 	err     error
 }
+type keyFetchError struct {
+	eventID string
+	err     error
+}
+type missingPrevEventsError struct {
+	eventID string
+	err     error
+}
+type eduServerUnavailableError struct {
+	eduType string
+	count   int
+	err     error
+}
+type eventTooLargeError struct {
+	eventID string
+	size    int
+	max     int
+}
+type pduTimeoutError struct {
+	eventID string
+	timeout time.Duration
+}
+type timestampSkewError struct {
+	eventID string
+	ts      time.Time
+	skew    time.Duration // positive if ts is in the future
+	max     time.Duration
+}
+type eventDepthError struct {
+	eventID   string
+	depth     int64
+	roomDepth int64
+	max       int64
+}
+type tooManyPrevEventsError struct {
+	eventID string
+	count   int
+	max     int
+}
+type tooManyStateEventsError struct {
+	eventID string
+	kind    string
+	count   int
+	max     int
+}
+type inconsistentStateError struct {
+	eventID string
+	reason  string
+}
+type unsupportedRoomVersionError struct {
+	eventID     string
+	roomID      string
+	roomVersion gomatrixserverlib.RoomVersion
+}
+type tooManyStateIDsError struct {
+	eventID string
+	count   int
+	max     int
+}
+type tooManyRoomsError struct {
+	eventID string
+	roomID  string
+	max     int
+}
+type quarantinedEventError struct {
+	eventID string
+}
+type missingTxnDependencyError struct {
+	name string
+}
+type gapNotFilledError struct {
+	eventID string
+	reason  string
+}
+
+// newEventUnmarshalError returns an unmarshalError for event JSON that
+// couldn't be parsed as the given room version.
+func newEventUnmarshalError(err error, eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion) unmarshalError {
+	var fields map[string]json.RawMessage
+	_ = json.Unmarshal(eventJSON, &fields)
+	_, hasEventID := fields["event_id"]
+	return unmarshalError{err: err, roomVersion: roomVersion, hasEventID: hasEventID}
+}
+
+// redactedEventJSON returns the event JSON with its content and signatures
+// removed, so that it can be logged without leaking anything that users have
+// sent. If the JSON isn't an object then only its length is returned.
+func redactedEventJSON(eventJSON []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(eventJSON, &fields); err != nil {
+		return fmt.Sprintf("<%d bytes of invalid JSON>", len(eventJSON))
+	}
+	for _, key := range []string{"content", "signatures", "unsigned"} {
+		if _, ok := fields[key]; ok {
+			fields[key] = json.RawMessage(`"<redacted>"`)
+		}
+	}
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes of invalid JSON>", len(eventJSON))
+	}
+	return string(redacted)
+}
+
+// newEventFromUntrustedJSON parses event JSON. Replaced in tests.
+var newEventFromUntrustedJSON = gomatrixserverlib.NewEventFromUntrustedJSON
+
+// parseUntrustedEvent parses event JSON that we received from another server,
+// returning an unmarshalError if it isn't a valid event or doesn't have exactly
+// one canonical form. The parser wasn't written with crafted input in mind, so
+// a panic while parsing is recovered and treated like any other invalid event
+// rather than taking down the handler.
+func parseUntrustedEvent(
+	ctx context.Context, eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion,
+) (event gomatrixserverlib.Event, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			util.GetLogger(ctx).WithField("event", redactedEventJSON(eventJSON)).Errorf("Panic while parsing event JSON: %v", r)
+			event = gomatrixserverlib.Event{}
+			err = newEventUnmarshalError(fmt.Errorf("panic while parsing event: %v", r), eventJSON, roomVersion)
+		}
+	}()
+	if err = checkEventJSON(eventJSON); err != nil {
+		return event, newEventUnmarshalError(err, eventJSON, roomVersion)
+	}
+	event, err = newEventFromUntrustedJSON(eventJSON, roomVersion)
+	if err != nil {
+		return event, newEventUnmarshalError(err, eventJSON, roomVersion)
+	}
+	return event, nil
+}
+
+// keyDownloadFailure is the start of the error that gomatrixserverlib reports
+// for a signature when none of the key fetchers could provide the key.
+const keyDownloadFailure = "gomatrixserverlib: could not download key"
+
+// recordingVerifier wraps a JSONVerifier and remembers whether verification
+// itself failed, e.g. because the key database couldn't be queried, as
+// opposed to one of the messages being badly signed.
+type recordingVerifier struct {
+	gomatrixserverlib.JSONVerifier
+	err error
+}
+
+func (v *recordingVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results, err := v.JSONVerifier.VerifyJSONs(ctx, requests)
+	v.err = err
+	return results, err
+}
+
+// verifyEventSignatures checks the signatures of an event. It returns a
+// verifySigError if the event isn't correctly signed, or a keyFetchError if
+// we couldn't get hold of the keys needed to check it, in which case the
+// event may well be fine and the sender should try again later. The same
+// event can be fetched more than once while looking up missing state, so the
+// signatures of each event are only checked once per transaction.
+//
+// The keys are looked up for every check, but a long transaction can span a
+// key rotation by the sending server, during which the keys that we fetch
+// can briefly be missing or still be the old ones. So if an event fails
+// verification then the keys of its sender's server are fetched again, at
+// most once per server per transaction so that badly signed events can't
+// make us fetch keys over and over.
+func (t *txnReq) verifyEventSignatures(ctx context.Context, event gomatrixserverlib.Event) error {
+	if t.alreadyVerified(event) {
+		return nil
+	}
+	err := t.checkEventSignatures(ctx, event)
+	if err != nil {
+		_, serverName, splitErr := gomatrixserverlib.SplitID('@', event.Sender())
+		if splitErr != nil || t.refreshedKeys[serverName] {
+			return err
+		}
+		if t.refreshedKeys == nil {
+			t.refreshedKeys = make(map[gomatrixserverlib.ServerName]bool)
+		}
+		t.refreshedKeys[serverName] = true
+		util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).Warn(
+			"Failed to verify event, fetching the keys of the server again in case they were rotated",
+		)
+		if err = t.checkEventSignatures(ctx, event); err != nil {
+			return err
+		}
+	}
+	t.markVerified(event)
+	return nil
+}
+
+// verifyEventSignaturesBatch verifies the signatures of all of the events in
+// one go, returning an error for each event in the same way as
+// verifyEventSignatures. The key ring looks up the keys of each server that
+// signed any of the events once for the whole batch, rather than once for
+// each event, which saves round trips to the key servers when a transaction
+// holds many events from a few servers. Events which fail are verified again
+// on their own with verifyEventSignatures, which refreshes rotated keys and
+// tells a key fetch failure apart from a bad signature.
+func (t *txnReq) verifyEventSignaturesBatch(ctx context.Context, events []gomatrixserverlib.Event) []error {
+	errs := make([]error, len(events))
+	var toVerify []gomatrixserverlib.Event
+	var indexes []int
+	for i, event := range events {
+		if !t.alreadyVerified(event) {
+			toVerify = append(toVerify, event)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(toVerify) == 0 {
+		return errs
+	}
+	verificationErrors, err := gomatrixserverlib.VerifyEventSignatures(ctx, toVerify, t.keys)
+	for j, event := range toVerify {
+		if err == nil && verificationErrors[j] == nil {
+			t.markVerified(event)
+			continue
+		}
+		errs[indexes[j]] = t.verifyEventSignatures(ctx, event)
+	}
+	return errs
+}
+
+// alreadyVerified returns true if the signatures of exactly the same event
+// JSON have already been verified in this transaction. The event ID isn't
+// derived from the content of the event in every room version, so matching
+// the event ID isn't enough.
+func (t *txnReq) alreadyVerified(event gomatrixserverlib.Event) bool {
+	verified, ok := t.verifiedEvents[event.EventID()]
+	return ok && verified == sha256.Sum256(event.JSON())
+}
+
+// markVerified records that the signatures of the event have been verified.
+func (t *txnReq) markVerified(event gomatrixserverlib.Event) {
+	if t.verifiedEvents == nil {
+		t.verifiedEvents = make(map[string][sha256.Size]byte)
+	}
+	t.verifiedEvents[event.EventID()] = sha256.Sum256(event.JSON())
+}
+
+// checkEventSignatures checks the signatures of an event against the keys
+// that t.keys looks up for it, returning the errors of verifyEventSignatures.
+func (t *txnReq) checkEventSignatures(ctx context.Context, event gomatrixserverlib.Event) error {
+	verifier := &recordingVerifier{JSONVerifier: t.keys}
+	verificationErrors, err := gomatrixserverlib.VerifyEventSignatures(
+		ctx, []gomatrixserverlib.Event{event}, verifier,
+	)
+	if err != nil {
+		if verifier.err != nil {
+			return keyFetchError{event.EventID(), err}
+		}
+		return verifySigError{event.EventID(), err}
+	}
+	if err = verificationErrors[0]; err != nil {
+		if strings.HasPrefix(err.Error(), keyDownloadFailure) {
+			return keyFetchError{event.EventID(), err}
+		}
+		return verifySigError{event.EventID(), err}
+	}
+	return nil
+}
+
+// Stable prefixes for PDUResult errors, so that remote servers can tell why
+// an event was rejected without having to parse the rest of the message.
+const (
+	pduErrorRoomNotFound      = "M_ROOM_NOT_FOUND"
+	pduErrorBadJSON           = "M_BAD_JSON"
+	pduErrorSignatureFailed   = "M_SIGNATURE_FAILED"
+	pduErrorNotAllowed        = "M_NOT_ALLOWED"
+	pduErrorMissingAuth       = "M_MISSING_AUTH_EVENT"
+	pduErrorRoomBusy          = "M_LIMIT_EXCEEDED"
+	pduErrorMissingPrevEvents = "M_MISSING_PREV_EVENTS"
+	pduErrorForbidden         = "M_FORBIDDEN"
+	pduErrorTooManyPrevEvents = "M_TOO_MANY_PREV_EVENTS"
+	pduErrorBadDepth          = "M_INVALID_PARAM"
+	pduErrorBadTimestamp      = "M_INVALID_PARAM"
+	pduErrorRoomVersion       = "M_UNSUPPORTED_ROOM_VERSION"
+	pduErrorTooManyRooms      = "M_LIMIT_EXCEEDED"
+	pduErrorQuarantined       = "M_QUARANTINED"
+	pduErrorUnknown           = "M_UNKNOWN"
+)
+
+// pduResultError converts an error from processing an event into the error
+// string for its PDUResult, prefixed with a code derived from the error type.
+func pduResultError(err error) string {
+	var code string
+	switch err.(type) {
+	case roomNotFoundError:
+		code = pduErrorRoomNotFound
+	case unmarshalError:
+		code = pduErrorBadJSON
+	case verifySigError:
+		code = pduErrorSignatureFailed
+	case *gomatrixserverlib.NotAllowed:
+		code = pduErrorNotAllowed
+	case gomatrixserverlib.MissingAuthEventError:
+		code = pduErrorMissingAuth
+	case roomBusyError:
+		code = pduErrorRoomBusy
+	case missingPrevEventsError:
+		code = pduErrorMissingPrevEvents
+	case serverACLDeniedError:
+		code = pduErrorForbidden
+	case tooManyPrevEventsError:
+		code = pduErrorTooManyPrevEvents
+	case eventDepthError:
+		code = pduErrorBadDepth
+	case timestampSkewError:
+		code = pduErrorBadTimestamp
+	case unsupportedRoomVersionError:
+		code = pduErrorRoomVersion
+	case tooManyRoomsError:
+		code = pduErrorTooManyRooms
+	case quarantinedEventError:
+		code = pduErrorQuarantined
+	default:
+		code = pduErrorUnknown
+	}
+	return code + ": " + err.Error()
+}
+
+// isRejection returns whether an error from processing an event means that
+// the event itself was rejected, rather than that we couldn't process it at
+// the moment.
+func isRejection(err error) bool {
+	switch err.(type) {
+	case roomNotFoundError, serverACLDeniedError, tooManyPrevEventsError, eventDepthError, timestampSkewError, *gomatrixserverlib.NotAllowed:
+		return true
+	default:
+		return false
+	}
+}
 
 func (e roomNotFoundError) Error() string { return fmt.Sprintf("room %q not found", e.roomID) }
-func (e unmarshalError) Error() string    { return fmt.Sprintf("unable to parse event: %s", e.err) }
+func (e unmarshalError) Error() string {
+	if e.roomVersion == "" {
+		return fmt.Sprintf("unable to parse event: %s", e.err)
+	}
+	hint := "has no event_id, as in room versions 3 and later"
+	if e.hasEventID {
+		hint = "has an event_id, as in room versions 1 and 2"
+	}
+	return fmt.Sprintf("unable to parse event as room version %s (the event %s): %s", e.roomVersion, hint, e.err)
+}
 func (e verifySigError) Error() string {
 	return fmt.Sprintf("unable to verify signature of event %q: %s", e.eventID, e.err)
 }
+func (e keyFetchError) Error() string {
+	return fmt.Sprintf("unable to fetch keys to verify event %q: %s", e.eventID, e.err)
+}
+func (e missingPrevEventsError) Error() string {
+	return fmt.Sprintf("unable to fetch the state before event %q: %s", e.eventID, e.err)
+}
+func (e eduServerUnavailableError) Error() string {
+	return fmt.Sprintf("unable to send %d %s EDUs to the EDU server: %s", e.count, e.eduType, e.err)
+}
+func (e eventTooLargeError) Error() string {
+	return fmt.Sprintf("event %q is too large: %d bytes > maximum %d bytes", e.eventID, e.size, e.max)
+}
+func (e pduTimeoutError) Error() string {
+	return fmt.Sprintf("gave up processing event %q after %s", e.eventID, e.timeout)
+}
+func (e timestampSkewError) Error() string {
+	if e.skew > 0 {
+		return fmt.Sprintf("event %q has origin_server_ts %s, %s in the future, more than the maximum %s", e.eventID, e.ts, e.skew, e.max)
+	}
+	return fmt.Sprintf("event %q has origin_server_ts %s, %s in the past, more than the maximum %s", e.eventID, e.ts, -e.skew, e.max)
+}
+func (e eventDepthError) Error() string {
+	return fmt.Sprintf("event %q has depth %d, more than %d beyond the depth %d of its room", e.eventID, e.depth, e.max, e.roomDepth)
+}
+func (e tooManyPrevEventsError) Error() string {
+	return fmt.Sprintf("event %q has too many prev_events to fetch the state before it: %d > maximum %d", e.eventID, e.count, e.max)
+}
+func (e tooManyStateEventsError) Error() string {
+	return fmt.Sprintf("/state response for event %q has too many %s events: %d > maximum %d", e.eventID, e.kind, e.count, e.max)
+}
+func (e inconsistentStateError) Error() string {
+	return fmt.Sprintf("/state response for event %q is inconsistent: %s", e.eventID, e.reason)
+}
+func (e unsupportedRoomVersionError) Error() string {
+	return fmt.Sprintf("event %q is in room %s, whose room version %q is not supported by this server", e.eventID, e.roomID, e.roomVersion)
+}
+func (e tooManyRoomsError) Error() string {
+	return fmt.Sprintf("event %q is in room %s, beyond the maximum of %d rooms per transaction", e.eventID, e.roomID, e.max)
+}
+func (e quarantinedEventError) Error() string {
+	return fmt.Sprintf("event %q is quarantined", e.eventID)
+}
+func (e missingTxnDependencyError) Error() string {
+	return fmt.Sprintf("can't process transaction without a %s", e.name)
+}
+func (e tooManyStateIDsError) Error() string {
+	return fmt.Sprintf("/state_ids response for event %q has too many state and auth events: %d > maximum %d", e.eventID, e.count, e.max)
+}
+func (e gapNotFilledError) Error() string {
+	return fmt.Sprintf("couldn't fill in the gap before event %q with /get_missing_events: %s", e.eventID, e.reason)
+}
+
+// maxEventSize returns the maximum size in bytes of the JSON of an event,
+// including its signatures, in the given room version. Every room version
+// that we support has the same limit. Returns an error if the room version
+// isn't supported.
+func maxEventSize(roomVersion gomatrixserverlib.RoomVersion) (int, error) {
+	if _, err := roomVersion.EventFormat(); err != nil {
+		return 0, err
+	}
+	return 65536, nil
+}
+
+// checkEventSize returns an error if the JSON of the event with the given ID,
+// as received from a remote server, is too large for the room version. This
+// is cheap, so it should be done before the JSON is parsed.
+func checkEventSize(eventID string, eventJSON []byte, roomVersion gomatrixserverlib.RoomVersion) error {
+	max, err := maxEventSize(roomVersion)
+	if err != nil {
+		return err
+	}
+	if len(eventJSON) > max {
+		return eventTooLargeError{eventID, len(eventJSON), max}
+	}
+	return nil
+}
+
+var processedEDUs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "received_edus_total",
+		Help:      "The number of EDUs received over federation",
+	},
+	// Takes two labels:
+	//   type:
+	//      The type of the EDU.
+	//   outcome:
+	//      processed -> The EDU was passed on to the rest of the server.
+	//      failed -> The EDU was of a type that we handle but couldn't be processed.
+	//      ignored -> The EDU was sent by a user whose EDUs are being ignored in that room.
+	//      invalid -> The EDU had no type or content, or its content was missing a required field.
+	//      dropped -> The EDU was of a type that we don't handle, so it was ignored.
+	[]string{"type", "outcome"},
+)
 
-func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
+func init() {
+	prometheus.MustRegister(processedEDUs)
+}
+
+// maxEDUSendAttempts is the number of times that we try to send the EDUs from
+// a transaction to the EDU server before failing the transaction.
+const maxEDUSendAttempts = 3
+
+// eduSendBackoff is how long we wait before trying to send EDUs to the EDU
+// server again. It doubles after each attempt. Replaced in tests.
+var eduSendBackoff = 100 * time.Millisecond
+
+// processEDUs passes the EDUs from a transaction on to the rest of the server.
+// EDUs which are invalid or which we don't handle are skipped. Returns an
+// eduServerUnavailableError if the EDU server still couldn't be reached after
+// retrying.
+func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) error {
+	var typingEvents []eduAPI.InputTypingEvent
 	for _, e := range edus {
+		if e.Type == "" || eduContentMissing(e.Content) {
+			util.GetLogger(t.context).WithField("type", e.Type).Warn("Skipping EDU with no type or content")
+			processedEDUs.WithLabelValues(e.Type, "invalid").Inc()
+			continue
+		}
+		if err := validateEDUContent(e); err != nil {
+			util.GetLogger(t.context).WithError(err).WithField("type", e.Type).Warn("Skipping EDU with invalid content")
+			processedEDUs.WithLabelValues(e.Type, "invalid").Inc()
+			continue
+		}
+		outcome := "processed"
 		switch e.Type {
 		case gomatrixserverlib.MTyping:
 			// https://matrix.org/docs/spec/server_server/latest#typing-notifications
 			var typingPayload struct {
 				RoomID string `json:"room_id"`
 				UserID string `json:"user_id"`
-				Typing bool   `json:"typing"`
+				Typing *bool  `json:"typing"`
 			}
 			if err := json.Unmarshal(e.Content, &typingPayload); err != nil {
 				util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal typing event")
-				continue
+				outcome = "failed"
+				break
 			}
-			if err := t.eduProducer.SendTyping(t.context, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
-				util.GetLogger(t.context).WithError(err).Error("Failed to send typing event to edu server")
+			if t.eduFilter != nil && t.eduFilter.ignoreEDU(t.context, typingPayload.RoomID, typingPayload.UserID) {
+				outcome = "ignored"
+				break
 			}
+			// Typing EDUs are sent to the EDU server together once we have
+			// looked at them all, and counted then.
+			typingEvents = append(typingEvents, eduAPI.InputTypingEvent{
+				UserID:    typingPayload.UserID,
+				RoomID:    typingPayload.RoomID,
+				Typing:    *typingPayload.Typing,
+				TimeoutMS: 30 * 1000,
+			})
+			continue
 		default:
 			util.GetLogger(t.context).WithField("type", e.Type).Warn("unhandled edu")
+			outcome = "dropped"
 		}
+		processedEDUs.WithLabelValues(e.Type, outcome).Inc()
 	}
+	return t.sendTypingEvents(typingEvents)
 }
 
-func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
-	prevEventIDs := e.PrevEventIDs()
+// eduContentMissing returns true if the content of an EDU is empty or null.
+func eduContentMissing(content []byte) bool {
+	content = bytes.TrimSpace(content)
+	return len(content) == 0 || bytes.Equal(content, []byte("null"))
+}
+
+// sendTypingEvents sends the typing updates from a transaction to the EDU
+// server in the order they appeared in the transaction. If there are several
+// of them then they are sent as a single batch.
+func (t *txnReq) sendTypingEvents(typingEvents []eduAPI.InputTypingEvent) error {
+	if len(typingEvents) == 0 {
+		return nil
+	}
+	err := t.retryEDUSend(func() error {
+		if len(typingEvents) == 1 {
+			ev := typingEvents[0]
+			return t.eduProducer.SendTyping(t.context, ev.UserID, ev.RoomID, ev.Typing, ev.TimeoutMS)
+		}
+		return t.eduProducer.SendTypingBatch(t.context, typingEvents)
+	})
+	if err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to send typing events to edu server")
+		processedEDUs.WithLabelValues(gomatrixserverlib.MTyping, "failed").Add(float64(len(typingEvents)))
+		return eduServerUnavailableError{gomatrixserverlib.MTyping, len(typingEvents), err}
+	}
+	processedEDUs.WithLabelValues(gomatrixserverlib.MTyping, "processed").Add(float64(len(typingEvents)))
+	return nil
+}
 
-	// Fetch the state needed to authenticate the event.
+// retryEDUSend calls send until it succeeds, up to maxEDUSendAttempts times,
+// so that a brief outage of the EDU server doesn't fail the transaction.
+// Returns the error from the last attempt if none of them succeeded.
+func (t *txnReq) retryEDUSend(send func() error) (err error) {
+	backoff := eduSendBackoff
+	for attempt := 1; ; attempt++ {
+		if err = send(); err == nil || attempt == maxEDUSendAttempts {
+			return err
+		}
+		util.GetLogger(t.context).WithError(err).Warnf(
+			"Failed to send EDUs to the EDU server on attempt %d of %d, retrying", attempt, maxEDUSendAttempts,
+		)
+		select {
+		case <-time.After(backoff):
+		case <-t.context.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// startEventSpan starts a tracing span for processing the event, as a child of
+// any span on the context.
+func startEventSpan(ctx context.Context, operationName string, e gomatrixserverlib.Event) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	span.SetTag("event_id", e.EventID())
+	span.SetTag("room_id", e.RoomID())
+	return span, ctx
+}
+
+// stateQueryForEvent returns the query for the state needed to authenticate
+// the event.
+func stateQueryForEvent(e gomatrixserverlib.Event) api.QueryStateAfterEventsRequest {
 	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
-	stateReq := api.QueryStateAfterEventsRequest{
+	return api.QueryStateAfterEventsRequest{
 		RoomID:       e.RoomID(),
-		PrevEventIDs: prevEventIDs,
+		PrevEventIDs: e.PrevEventIDs(),
 		StateToFetch: needed.Tuples(),
 	}
-	var stateResp api.QueryStateAfterEventsResponse
-	if err := t.rsAPI.QueryStateAfterEvents(t.context, &stateReq, &stateResp); err != nil {
+}
+
+// queryStateForEvents looks up the state needed to authenticate the events in
+// a single roomserver query, returning the responses by event ID. Events with
+// prev_events in the same transaction are left out, as the state after those
+// isn't known until the earlier events have been processed.
+func (t *txnReq) queryStateForEvents(ctx context.Context, pdus []gomatrixserverlib.HeaderedEvent) (
+	map[string]*api.QueryStateAfterEventsResponse, error) {
+	inTransaction := make(map[string]bool, len(pdus))
+	for _, e := range pdus {
+		inTransaction[e.EventID()] = true
+	}
+
+	var batchReq api.QueryStateAfterEventsBatchRequest
+	var eventIDs []string
+NextEvent:
+	for _, e := range pdus {
+		for _, prevEventID := range e.PrevEventIDs() {
+			if inTransaction[prevEventID] {
+				continue NextEvent
+			}
+		}
+		batchReq.Queries = append(batchReq.Queries, stateQueryForEvent(e.Unwrap()))
+		eventIDs = append(eventIDs, e.EventID())
+	}
+	if len(batchReq.Queries) == 0 {
+		return nil, nil
+	}
+
+	var batchRes api.QueryStateAfterEventsBatchResponse
+	if err := t.rsAPI.QueryStateAfterEventsBatch(ctx, &batchReq, &batchRes); err != nil {
+		return nil, err
+	}
+	if len(batchRes.Responses) != len(batchReq.Queries) {
+		return nil, fmt.Errorf("expected %d responses to QueryStateAfterEventsBatch, got %d", len(batchReq.Queries), len(batchRes.Responses))
+	}
+	states := make(map[string]*api.QueryStateAfterEventsResponse, len(eventIDs))
+	for i, eventID := range eventIDs {
+		states[eventID] = &batchRes.Responses[i]
+	}
+	return states, nil
+}
+
+// checkEventDepth returns an eventDepthError if the depth of the event is
+// more than maxDepthAhead beyond the current depth of its room. The depth is
+// only looked up once per room for each transaction, which is fine as a
+// transaction can only move the depth on by a few events.
+func (t *txnReq) checkEventDepth(ctx context.Context, e gomatrixserverlib.Event) error {
+	if t.maxDepthAhead <= 0 {
+		return nil
+	}
+	roomDepth, ok := t.roomDepths[e.RoomID()]
+	if !ok {
+		req := api.QueryLatestEventsAndStateRequest{
+			RoomID: e.RoomID(),
+			// We only want the depth, so ask for as little state as possible.
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+			},
+		}
+		var res api.QueryLatestEventsAndStateResponse
+		if err := t.rsAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+			return err
+		}
+		if !res.RoomExists {
+			return nil
+		}
+		roomDepth = res.Depth
+		if t.roomDepths == nil {
+			t.roomDepths = make(map[string]int64)
+		}
+		t.roomDepths[e.RoomID()] = roomDepth
+	}
+	if e.Depth() > roomDepth && e.Depth()-roomDepth > t.maxDepthAhead {
+		return eventDepthError{e.EventID(), e.Depth(), roomDepth, t.maxDepthAhead}
+	}
+	return nil
+}
+
+// checkEventTimestamp returns a timestampSkewError if the origin_server_ts of
+// the event is too far ahead of or behind our clock. The event is only logged
+// rather than rejected unless rejectTimestampSkew is set, since the sender's
+// clock may simply be wrong.
+func (t *txnReq) checkEventTimestamp(ctx context.Context, e gomatrixserverlib.Event) error {
+	ts := e.OriginServerTS().Time()
+	skew := time.Until(ts)
+	var err error
+	if t.maxTimestampSkewFuture > 0 && skew > t.maxTimestampSkewFuture {
+		err = timestampSkewError{e.EventID(), ts, skew, t.maxTimestampSkewFuture}
+	} else if t.maxTimestampSkewPast > 0 && -skew > t.maxTimestampSkewPast {
+		err = timestampSkewError{e.EventID(), ts, skew, t.maxTimestampSkewPast}
+	}
+	if err == nil {
+		return nil
+	}
+	util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+		"event_id": e.EventID(),
+		"room_id":  e.RoomID(),
+		"origin":   t.Origin,
+	}).Warn("Incoming event has a skewed origin_server_ts")
+	if !t.rejectTimestampSkew {
+		return nil
+	}
+	return err
+}
+
+// processEvent processes an incoming event. If the state needed to
+// authenticate it has already been looked up then it can be passed in as
+// prefetched, otherwise it should be nil.
+func (t *txnReq) processEvent(ctx context.Context, e gomatrixserverlib.Event, prefetched *api.QueryStateAfterEventsResponse) error {
+	span, ctx := startEventSpan(ctx, "processEvent", e)
+	defer span.Finish()
+
+	if t.roomLimiter != nil {
+		release, err := t.roomLimiter.acquire(ctx, e.RoomID())
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	// Servers that have been denied by the room's server ACL can't send
+	// events into it, however well formed they are.
+	if err := t.checkServerACL(ctx, e.RoomID()); err != nil {
 		return err
 	}
 
+	// Fetch the state needed to authenticate the event. The state after a
+	// set of events never changes, so a prefetched response can be used as
+	// long as the prev_events existed at the time. Otherwise they may have
+	// arrived since, so ask again.
+	stateResp := prefetched
+	if stateResp == nil || !stateResp.RoomExists || !stateResp.PrevEventsExist {
+		stateReq := stateQueryForEvent(e)
+		stateResp = &api.QueryStateAfterEventsResponse{}
+		if err := t.rsAPI.QueryStateAfterEvents(ctx, &stateReq, stateResp); err != nil {
+			return err
+		}
+	}
+
 	if !stateResp.RoomExists {
 		// TODO: When synapse receives a message for a room it is not in it
 		// asks the remote server for the state of the room so that it can
@@ -252,17 +1438,41 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 		return roomNotFoundError{e.RoomID()}
 	}
 
+	// A bogus depth would break the ordering of the room's events, so reject
+	// events which claim to be far beyond the rest of the room.
+	if err := t.checkEventDepth(ctx, e); err != nil {
+		return err
+	}
+
+	// A bogus timestamp would distort anything which is ordered by time.
+	if err := t.checkEventTimestamp(ctx, e); err != nil {
+		return err
+	}
+
 	if !stateResp.PrevEventsExist {
-		return t.processEventWithMissingState(e, stateResp.RoomVersion)
+		return t.processEventWithBoundedMissingState(ctx, e, stateResp.RoomVersion)
 	}
+	return t.processEventWithPrevEvents(ctx, e, stateResp)
+}
 
+// processEventWithPrevEvents checks the event against the state after its
+// prev_events, which the roomserver has, and sends it to the roomserver.
+func (t *txnReq) processEventWithPrevEvents(ctx context.Context, e gomatrixserverlib.Event, stateResp *api.QueryStateAfterEventsResponse) error {
 	// Check that the event is allowed by the state at the event.
 	var events []gomatrixserverlib.Event
 	for _, headeredEvent := range stateResp.StateEvents {
 		events = append(events, headeredEvent.Unwrap())
 	}
 	if err := checkAllowedByState(e, events); err != nil {
-		return err
+		// If the room only has partial state then the state may be missing
+		// whatever allows the event, so accept it if its auth events allow
+		// it. It is checked again once the full state has arrived.
+		if t.partialState == nil || !t.partialState.isPartial(e.RoomID()) {
+			return err
+		}
+		if err = t.checkAllowedByCriticalState(ctx, e, stateResp.RoomVersion); err != nil {
+			return err
+		}
 	}
 
 	// TODO: Check that the roomserver has a copy of all of the auth_events.
@@ -270,14 +1480,30 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 
 	// pass the event to the roomserver
 	_, err := t.producer.SendEvents(
-		t.context,
+		ctx,
 		[]gomatrixserverlib.HeaderedEvent{
 			e.Headered(stateResp.RoomVersion),
 		},
 		api.DoNotSendToOtherServers,
 		nil,
+		t.Origin,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// The event may have changed the server ACL, so look it up again for any
+	// later events in the room.
+	if e.Type() == mRoomServerACL {
+		delete(t.serverACLs, e.RoomID())
+	}
+
+	// If the room only has partial state then the state we checked the event
+	// against may be incomplete, so it needs to be checked again later.
+	if t.partialState != nil && t.partialState.record(e) {
+		go t.resyncPartialState(e.RoomID())
+	}
+	return nil
 }
 
 func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserverlib.Event) error {
@@ -291,7 +1517,83 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 	return gomatrixserverlib.Allowed(e, &authUsingState)
 }
 
-func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+// processEventAndRecordOutcome processes the event with
+// processEventWithTimeout, and counts a failure towards quarantining the
+// event, or forgets its failures once it has been processed.
+func (t *txnReq) processEventAndRecordOutcome(ctx context.Context, e gomatrixserverlib.Event, prefetched *api.QueryStateAfterEventsResponse) error {
+	err := t.processEventWithTimeout(ctx, e, prefetched)
+	// Only count rejections towards quarantining the event, as they happen
+	// every time that the event is processed. Other failures, such as the
+	// room being busy or running out of time, may well not happen again.
+	if err != nil && isRejection(err) {
+		if t.quarantine.recordFailure(ctx, e.EventID()) {
+			util.GetLogger(ctx).WithError(err).WithField("event_id", e.EventID()).Warn("Quarantined event which keeps failing to be processed")
+		}
+	} else if err == nil {
+		t.quarantine.recordSuccess(e.EventID())
+	}
+	return err
+}
+
+// processEventWithTimeout processes the event, giving up on it if it takes
+// longer than the per-PDU timeout. Errors which mean that the event itself was
+// rejected, or that the sender should retry it, are returned as usual even if
+// the event ran out of time.
+func (t *txnReq) processEventWithTimeout(ctx context.Context, e gomatrixserverlib.Event, prefetched *api.QueryStateAfterEventsResponse) error {
+	if t.pduTimeout <= 0 {
+		return t.processEvent(ctx, e, prefetched)
+	}
+	pduCtx, cancel := context.WithTimeout(ctx, t.pduTimeout)
+	defer cancel()
+	err := t.processEvent(pduCtx, e, prefetched)
+	if _, ok := err.(missingPrevEventsError); ok || err == nil || isRejection(err) {
+		return err
+	}
+	// Running out of time shouldn't fail the whole transaction, unless the
+	// transaction itself was cancelled.
+	if pduCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return pduTimeoutError{e.EventID(), t.pduTimeout}
+	}
+	return err
+}
+
+// processEventWithBoundedMissingState fills in the gap before the event, and
+// before any auth events that have to be processed along the way, within the
+// fetch budget and deadline for a single event. If either runs out then the
+// event is skipped and the sender is asked to retry it later.
+func (t *txnReq) processEventWithBoundedMissingState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) error {
+	boundedCtx := ctx
+	if t.maxFetchesPerEvent > 0 {
+		boundedCtx = withFetchBudget(boundedCtx, t.maxFetchesPerEvent)
+	}
+	if t.missingStateTimeout > 0 {
+		var cancel context.CancelFunc
+		boundedCtx, cancel = context.WithTimeout(boundedCtx, t.missingStateTimeout)
+		defer cancel()
+	}
+	err := t.processEventWithMissingState(boundedCtx, e, roomVersion, false)
+	if _, ok := err.(missingPrevEventsError); ok || err == nil {
+		return err
+	}
+	// Running out of time part of the way through shouldn't fail the whole
+	// transaction, unless the transaction itself was cancelled.
+	if boundedCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return missingPrevEventsError{e.EventID(), boundedCtx.Err()}
+	}
+	return err
+}
+
+// processEventWithMissingState fetches the state before the event from the
+// sender and sends the event to the roomserver with it. If historical is true
+// then the event isn't one from the transaction, but one that we found while
+// filling in the gap before one, so it is marked as not to cause
+// notifications.
+func (t *txnReq) processEventWithMissingState(
+	ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion, historical bool,
+) error {
+	span, ctx := startEventSpan(ctx, "processEventWithMissingState", e)
+	defer span.Finish()
+
 	// We are missing the previous events for this events.
 	// This means that there is a gap in our view of the history of the
 	// room. There two ways that we can handle such a gap:
@@ -306,15 +1608,39 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, roomVer
 	// event ids and then use /event to fetch the individual events.
 	// However not all version of synapse support /state_ids so you may
 	// need to fallback to /state.
-	// TODO: Attempt to fill in the gap using /get_missing_events
 
-	// Attempt to fetch the missing state using /state_ids and /events
-	respState, haveEventIDs, err := t.lookupMissingStateViaStateIDs(e, roomVersion)
+	// Working out the state before an event gets more expensive with each
+	// of its prev_events, and legitimate events rarely have more than a
+	// handful, so don't let the sender make us do an unbounded amount of
+	// work for one event.
+	if count := len(e.PrevEventIDs()); t.maxPrevEvents > 0 && count > t.maxPrevEvents {
+		return tooManyPrevEventsError{e.EventID(), count, t.maxPrevEvents}
+	}
+
+	// Try to fill in the gap using /get_missing_events first, unless the
+	// event is an auth event from the state that we are already fetching.
+	if t.missingEventsLimit > 0 && !historical {
+		err := t.walkMissingEvents(ctx, e, roomVersion)
+		if _, ok := err.(gapNotFilledError); !ok {
+			return err
+		}
+		util.GetLogger(ctx).WithError(err).Info("Falling back to fetching the state before the event")
+	}
+
+	// If partial state is enabled then accept the event using just its auth
+	// events and fetch the full state in the background.
+	if t.partialState != nil {
+		return t.processEventWithPartialState(ctx, e, roomVersion)
+	}
+
+	respState, haveEventIDs, err := t.lookupStateBeforeEvent(ctx, e, roomVersion)
 	if err != nil {
-		// Fallback to /state
-		util.GetLogger(t.context).WithError(err).Warn("processEventWithMissingState failed to /state_ids, falling back to /state")
-		respState, err = t.lookupMissingStateViaState(e, roomVersion)
-		if err != nil {
+		return missingPrevEventsError{e.EventID(), err}
+	}
+	if haveEventIDs == nil {
+		// /state returns every event in full, but in a large room the
+		// roomserver will already have most of them.
+		if haveEventIDs, err = t.haveEventIDsForState(ctx, respState); err != nil {
 			return err
 		}
 	}
@@ -329,7 +1655,7 @@ retryAllowedState:
 				if s.EventID() != missing.AuthEventID {
 					continue
 				}
-				err = t.processEventWithMissingState(s, roomVersion)
+				err = t.processEventWithMissingState(ctx, s, roomVersion, true)
 				// If there was no error retrieving the event from federation then
 				// we assume that it succeeded, so retry the original state check
 				if err == nil {
@@ -343,30 +1669,161 @@ retryAllowedState:
 
 	// pass the event along with the state to the roomserver using a background context so we don't
 	// needlessly expire
-	return t.producer.SendEventWithState(context.Background(), respState, e.Headered(roomVersion), haveEventIDs)
+	return t.producer.SendEventWithState(context.Background(), respState, e.Headered(roomVersion), haveEventIDs, t.Origin, historical)
 }
 
-func (t *txnReq) lookupMissingStateViaState(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+// lookupStateBeforeEvent fetches the state before the event from the sending
+// server, sharing the result with any other transaction which is looking up
+// the state before the same event at the same time. haveEventIDs is nil if
+// the state was fetched using /state. The results must not be modified.
+func (t *txnReq) lookupStateBeforeEvent(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+	*gomatrixserverlib.RespState, map[string]bool, error) {
+	return t.stateLookups.do(ctx, e.RoomID(), e.EventID(), func() (*gomatrixserverlib.RespState, map[string]bool, error) {
+		return t.fetchStateBeforeEvent(ctx, e, roomVersion)
+	})
+}
+
+// fetchStateBeforeEvent fetches the state before the event from the sending
+// server using /state_ids, /state or both, as set by the state fetch strategy.
+// haveEventIDs is nil if the state was fetched using /state.
+func (t *txnReq) fetchStateBeforeEvent(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+	respState *gomatrixserverlib.RespState, haveEventIDs map[string]bool, err error) {
+	switch t.stateFetchStrategy {
+	case config.StateFetchStateOnly:
+		respState, err = t.lookupMissingStateViaState(ctx, e, roomVersion)
+		return respState, nil, err
+	case config.StateFetchStateIDsOnly:
+		return t.lookupMissingStateViaStateIDs(ctx, e, roomVersion)
+	default:
+		// Attempt to fetch the missing state using /state_ids and /events
+		respState, haveEventIDs, err = t.lookupMissingStateViaStateIDs(ctx, e, roomVersion)
+		if err == nil {
+			return respState, haveEventIDs, nil
+		}
+		// Fallback to /state
+		util.GetLogger(ctx).WithError(err).Warn("fetchStateBeforeEvent failed to /state_ids, falling back to /state")
+		respState, err = t.lookupMissingStateViaState(ctx, e, roomVersion)
+		return respState, nil, err
+	}
+}
+
+func (t *txnReq) lookupMissingStateViaState(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
 	respState *gomatrixserverlib.RespState, err error) {
-	state, err := t.federation.LookupState(t.context, t.Origin, e.RoomID(), e.EventID(), roomVersion)
+	span, ctx := startEventSpan(ctx, "lookupMissingStateViaState", e)
+	defer span.Finish()
+
+	state, err := t.federation.LookupState(ctx, t.Origin, e.RoomID(), e.EventID(), roomVersion)
 	if err != nil {
 		return nil, err
 	}
+	// Refuse huge responses before checking the signatures of every event in
+	// them, since a room can't plausibly need that much state.
+	if t.maxStateEvents > 0 {
+		if count := len(state.StateEvents); count > t.maxStateEvents {
+			return nil, tooManyStateEventsError{e.EventID(), "state", count, t.maxStateEvents}
+		}
+		if count := len(state.AuthEvents); count > t.maxStateEvents {
+			return nil, tooManyStateEventsError{e.EventID(), "auth", count, t.maxStateEvents}
+		}
+	}
+	// Check that the state hangs together before checking the signatures of
+	// every event in it.
+	if err := checkStateConsistency(e, &state); err != nil {
+		return nil, err
+	}
 	// Check that the returned state is valid.
-	if err := state.Check(t.context, t.keys); err != nil {
+	if err := state.Check(ctx, t.keys); err != nil {
 		return nil, err
 	}
 	return &state, nil
 }
 
-func (t *txnReq) lookupMissingStateViaStateIDs(e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
+// checkStateConsistency checks that the state before the event, as returned
+// by the sending server, could be the state of the event's room: every event
+// is in that room, no two state events have the same type and state key, and
+// the auth_events of every event are in the response.
+func checkStateConsistency(e gomatrixserverlib.Event, respState *gomatrixserverlib.RespState) error {
+	eventIDs := make(map[string]bool, len(respState.StateEvents)+len(respState.AuthEvents))
+	for _, events := range [][]gomatrixserverlib.Event{respState.StateEvents, respState.AuthEvents} {
+		for i := range events {
+			if events[i].RoomID() != e.RoomID() {
+				return inconsistentStateError{e.EventID(), fmt.Sprintf(
+					"event %q is in room %s, not %s", events[i].EventID(), events[i].RoomID(), e.RoomID(),
+				)}
+			}
+			eventIDs[events[i].EventID()] = true
+		}
+	}
+
+	tuples := make(map[gomatrixserverlib.StateKeyTuple]string, len(respState.StateEvents))
+	for i := range respState.StateEvents {
+		ev := &respState.StateEvents[i]
+		if ev.StateKey() == nil {
+			return inconsistentStateError{e.EventID(), fmt.Sprintf("state event %q has no state key", ev.EventID())}
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}
+		if other, ok := tuples[tuple]; ok {
+			return inconsistentStateError{e.EventID(), fmt.Sprintf(
+				"state events %q and %q both have type %q and state key %q", other, ev.EventID(), tuple.EventType, tuple.StateKey,
+			)}
+		}
+		tuples[tuple] = ev.EventID()
+	}
+
+	for _, events := range [][]gomatrixserverlib.Event{respState.StateEvents, respState.AuthEvents} {
+		for i := range events {
+			for _, authEventID := range events[i].AuthEventIDs() {
+				if !eventIDs[authEventID] {
+					return inconsistentStateError{e.EventID(), fmt.Sprintf(
+						"auth event %q of event %q is not in the response", authEventID, events[i].EventID(),
+					)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// haveEventIDsForState asks the roomserver which of the state and auth events
+// in the response it already has, so that only the others are sent to it.
+func (t *txnReq) haveEventIDsForState(ctx context.Context, respState *gomatrixserverlib.RespState) (map[string]bool, error) {
+	haveEventIDs := make(map[string]bool)
+	for _, events := range [][]gomatrixserverlib.Event{respState.StateEvents, respState.AuthEvents} {
+		queryReq := api.QueryEventsByIDRequest{
+			EventIDs: make([]string, len(events)),
+		}
+		for i := range events {
+			queryReq.EventIDs[i] = events[i].EventID()
+		}
+		var queryRes api.QueryEventsByIDResponse
+		if err := t.rsAPI.QueryEventsByID(ctx, &queryReq, &queryRes); err != nil {
+			return nil, err
+		}
+		for i := range queryRes.Events {
+			haveEventIDs[queryRes.Events[i].EventID()] = true
+		}
+	}
+	return haveEventIDs, nil
+}
+
+func (t *txnReq) lookupMissingStateViaStateIDs(ctx context.Context, e gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (
 	*gomatrixserverlib.RespState, map[string]bool, error) {
+	span, ctx := startEventSpan(ctx, "lookupMissingStateViaStateIDs", e)
+	defer span.Finish()
 
 	// fetch the state event IDs at the time of the event
-	stateIDs, err := t.federation.LookupStateIDs(t.context, t.Origin, e.RoomID(), e.EventID())
+	stateIDs, err := t.federation.LookupStateIDs(ctx, t.Origin, e.RoomID(), e.EventID())
 	if err != nil {
 		return nil, nil, err
 	}
+	// Refuse huge responses before fetching and holding on to every event
+	// in them. The state and auth events mostly overlap, so count them
+	// together.
+	if t.maxStateIDsEvents > 0 {
+		if count := countDistinctEventIDs(stateIDs); count > t.maxStateIDsEvents {
+			return nil, nil, tooManyStateIDsError{e.EventID(), count, t.maxStateIDsEvents}
+		}
+	}
 
 	// fetch as many as we can from the roomserver, do them as 2 calls rather than
 	// 1 to try to reduce the number of parameters in the bulk query this will use
@@ -377,7 +1834,7 @@ func (t *txnReq) lookupMissingStateViaStateIDs(e gomatrixserverlib.Event, roomVe
 			EventIDs: eventList,
 		}
 		var queryRes api.QueryEventsByIDResponse
-		if err = t.rsAPI.QueryEventsByID(t.context, &queryReq, &queryRes); err != nil {
+		if err = t.rsAPI.QueryEventsByID(ctx, &queryReq, &queryRes); err != nil {
 			return nil, nil, err
 		}
 		// allow indexing of current state by event ID
@@ -395,7 +1852,7 @@ func (t *txnReq) lookupMissingStateViaStateIDs(e gomatrixserverlib.Event, roomVe
 			missing[sid] = true
 		}
 	}
-	util.GetLogger(t.context).WithFields(logrus.Fields{
+	util.GetLogger(ctx).WithFields(logrus.Fields{
 		"missing":           len(missing),
 		"event_id":          e.EventID(),
 		"room_id":           e.RoomID(),
@@ -406,31 +1863,47 @@ func (t *txnReq) lookupMissingStateViaStateIDs(e gomatrixserverlib.Event, roomVe
 
 	for missingEventID := range missing {
 		var txn gomatrixserverlib.Transaction
-		txn, err = t.federation.GetEvent(t.context, t.Origin, missingEventID)
+		txn, err = t.federation.GetEvent(ctx, t.Origin, missingEventID)
 		if err != nil {
-			util.GetLogger(t.context).WithError(err).WithField("event_id", missingEventID).Warn("failed to get missing /event for event ID")
+			util.GetLogger(ctx).WithError(err).WithField("event_id", missingEventID).Warn("failed to get missing /event for event ID")
 			return nil, nil, err
 		}
 		for _, pdu := range txn.PDUs {
+			if err = checkEventSize(missingEventID, pdu, roomVersion); err != nil {
+				util.GetLogger(ctx).WithError(err).Warn("Transaction: Rejecting missing state event")
+				return nil, nil, err
+			}
 			var event gomatrixserverlib.Event
-			event, err = gomatrixserverlib.NewEventFromUntrustedJSON(pdu, roomVersion)
+			event, err = parseUntrustedEvent(ctx, pdu, roomVersion)
 			if err != nil {
-				util.GetLogger(t.context).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", event.EventID())
-				return nil, nil, unmarshalError{err}
+				util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %q", missingEventID)
+				return nil, nil, err
 			}
-			if err = gomatrixserverlib.VerifyAllEventSignatures(t.context, []gomatrixserverlib.Event{event}, t.keys); err != nil {
-				util.GetLogger(t.context).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
-				return nil, nil, verifySigError{event.EventID(), err}
+			if err = t.verifyEventSignatures(ctx, event); err != nil {
+				util.GetLogger(ctx).WithError(err).Warnf("Transaction: Couldn't validate signature of event %q", event.EventID())
+				return nil, nil, err
 			}
 			h := event.Headered(roomVersion)
 			haveEventMap[event.EventID()] = &h
 		}
 	}
-	resp, err := t.createRespStateFromStateIDs(stateIDs, haveEventMap)
+	resp, err := t.createRespStateFromStateIDs(ctx, stateIDs, haveEventMap)
 	return resp, haveEventIDs, err
 }
 
-func (t *txnReq) createRespStateFromStateIDs(stateIDs gomatrixserverlib.RespStateIDs, haveEventMap map[string]*gomatrixserverlib.HeaderedEvent) (
+// countDistinctEventIDs returns the number of different events referred to
+// by the state and auth event IDs in a /state_ids response.
+func countDistinctEventIDs(stateIDs gomatrixserverlib.RespStateIDs) int {
+	eventIDs := make(map[string]struct{}, len(stateIDs.StateEventIDs))
+	for _, eventList := range [][]string{stateIDs.StateEventIDs, stateIDs.AuthEventIDs} {
+		for _, eventID := range eventList {
+			eventIDs[eventID] = struct{}{}
+		}
+	}
+	return len(eventIDs)
+}
+
+func (t *txnReq) createRespStateFromStateIDs(ctx context.Context, stateIDs gomatrixserverlib.RespStateIDs, haveEventMap map[string]*gomatrixserverlib.HeaderedEvent) (
 	*gomatrixserverlib.RespState, error) {
 	// create a RespState response using the response to /state_ids as a guide
 	respState := gomatrixserverlib.RespState{
@@ -453,7 +1926,7 @@ func (t *txnReq) createRespStateFromStateIDs(stateIDs gomatrixserverlib.RespStat
 		respState.AuthEvents[i] = ev.Unwrap()
 	}
 	// Check that the returned state is valid.
-	if err := respState.Check(t.context, t.keys); err != nil {
+	if err := respState.Check(ctx, t.keys); err != nil {
 		return nil, err
 	}
 	return &respState, nil
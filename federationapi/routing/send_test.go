@@ -1,19 +1,32 @@
 package routing
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common/config"
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 )
 
 const (
@@ -64,9 +77,79 @@ func (t *testNopJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatr
 	return result, nil
 }
 
+// testCountingJSONVerifier verifies nothing, like testNopJSONVerifier, but counts the number of JSON messages that it
+// was asked to verify.
+type testCountingJSONVerifier struct {
+	testNopJSONVerifier
+	verified int
+}
+
+func (t *testCountingJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	t.verified += len(requests)
+	return t.testNopJSONVerifier.VerifyJSONs(ctx, requests)
+}
+
+// testRotatingJSONVerifier verifies nothing, like testNopJSONVerifier, except that every signature is rejected in the
+// calls listed in stale, as if the verifier had been given the old keys of a server that was rotating its keys. Calls
+// are numbered from 1.
+type testRotatingJSONVerifier struct {
+	testNopJSONVerifier
+	stale map[int]bool
+	calls int
+}
+
+func (t *testRotatingJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	t.calls++
+	results, err := t.testNopJSONVerifier.VerifyJSONs(ctx, requests)
+	if t.stale[t.calls] {
+		for i := range results {
+			results[i].Error = errors.New("testRotatingJSONVerifier: bad signature")
+		}
+	}
+	return results, err
+}
+
+// testKeyFetcher is used both as an empty key database and as a key fetcher. If err is set then fetching fails, as it
+// would if the key server was unreachable. Otherwise the given key is returned for every request.
+type testKeyFetcher struct {
+	key ed25519.PublicKey
+	err error
+}
+
+func (f *testKeyFetcher) FetcherName() string {
+	return "testKeyFetcher"
+}
+
+func (f *testKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	if f.key == nil {
+		return results, nil
+	}
+	for req := range requests {
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(f.key)},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return results, nil
+}
+
+func (f *testKeyFetcher) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
 type testEDUProducer struct {
-	// this producer keeps track of calls to InputTypingEvent
-	invocations []eduAPI.InputTypingEventRequest
+	// this producer keeps track of calls to InputTypingEvent and InputTypingEvents
+	invocations      []eduAPI.InputTypingEventRequest
+	batchInvocations []eduAPI.InputTypingEventsRequest
 }
 
 func (p *testEDUProducer) InputTypingEvent(
@@ -78,10 +161,27 @@ func (p *testEDUProducer) InputTypingEvent(
 	return nil
 }
 
+func (p *testEDUProducer) InputTypingEvents(
+	ctx context.Context,
+	request *eduAPI.InputTypingEventsRequest,
+	response *eduAPI.InputTypingEventsResponse,
+) error {
+	p.batchInvocations = append(p.batchInvocations, *request)
+	return nil
+}
+
 type testRoomserverAPI struct {
 	inputRoomEvents       []api.InputRoomEvent
+	inputRejectedEvents   []api.InputRejectedEvent
 	queryStateAfterEvents func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
 	queryEventsByID       func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse
+	// If nil then QueryLatestEventsAndState returns an empty response.
+	queryLatestEventsAndState func(*api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse
+	// The number of calls made to QueryStateAfterEvents and QueryStateAfterEventsBatch.
+	stateQueries      int
+	batchStateQueries int
+	// The versions of rooms which aren't testRoomVersion.
+	roomVersions map[string]gomatrixserverlib.RoomVersion
 }
 
 func (t *testRoomserverAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSenderInternalAPI) {}
@@ -92,6 +192,15 @@ func (t *testRoomserverAPI) InputRoomEvents(
 	response *api.InputRoomEventsResponse,
 ) error {
 	t.inputRoomEvents = append(t.inputRoomEvents, request.InputRoomEvents...)
+	t.inputRejectedEvents = append(t.inputRejectedEvents, request.InputRejectedEvents...)
+	return nil
+}
+
+func (t *testRoomserverAPI) ReplayOutputEvent(
+	ctx context.Context,
+	request *api.ReplayOutputEventRequest,
+	response *api.ReplayOutputEventResponse,
+) error {
 	return nil
 }
 
@@ -117,6 +226,9 @@ func (t *testRoomserverAPI) QueryLatestEventsAndState(
 	request *api.QueryLatestEventsAndStateRequest,
 	response *api.QueryLatestEventsAndStateResponse,
 ) error {
+	if t.queryLatestEventsAndState != nil {
+		*response = t.queryLatestEventsAndState(request)
+	}
 	return nil
 }
 
@@ -126,13 +238,35 @@ func (t *testRoomserverAPI) QueryStateAfterEvents(
 	request *api.QueryStateAfterEventsRequest,
 	response *api.QueryStateAfterEventsResponse,
 ) error {
+	t.stateQueries++
+	t.queryStateAfterEventsInto(request, response)
+	return nil
+}
+
+// Query the state after several lists of events from the room server.
+func (t *testRoomserverAPI) QueryStateAfterEventsBatch(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsBatchRequest,
+	response *api.QueryStateAfterEventsBatchResponse,
+) error {
+	t.batchStateQueries++
+	response.Responses = make([]api.QueryStateAfterEventsResponse, len(request.Queries))
+	for i := range request.Queries {
+		t.queryStateAfterEventsInto(&request.Queries[i], &response.Responses[i])
+	}
+	return nil
+}
+
+func (t *testRoomserverAPI) queryStateAfterEventsInto(
+	request *api.QueryStateAfterEventsRequest,
+	response *api.QueryStateAfterEventsResponse,
+) {
 	response.RoomVersion = testRoomVersion
 	response.QueryStateAfterEventsRequest = *request
 	res := t.queryStateAfterEvents(request)
 	response.PrevEventsExist = res.PrevEventsExist
 	response.RoomExists = res.RoomExists
 	response.StateEvents = res.StateEvents
-	return nil
 }
 
 // Query a list of events by event ID.
@@ -141,8 +275,28 @@ func (t *testRoomserverAPI) QueryEventsByID(
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
-	res := t.queryEventsByID(request)
-	response.Events = res.Events
+	if t.queryEventsByID != nil {
+		res := t.queryEventsByID(request)
+		response.Events = res.Events
+	}
+	return nil
+}
+
+// Query which of a list of events exist by event ID.
+func (t *testRoomserverAPI) QueryEventsExistByID(
+	ctx context.Context,
+	request *api.QueryEventsExistByIDRequest,
+	response *api.QueryEventsExistByIDResponse,
+) error {
+	response.ReferenceSHA256 = make(map[string][]byte)
+	if t.queryEventsByID != nil {
+		res := t.queryEventsByID(&api.QueryEventsByIDRequest{EventIDs: request.EventIDs})
+		for i := range res.Events {
+			if ref, ok := referenceOfEvent(res.Events[i].Unwrap()); ok {
+				response.ReferenceSHA256[ref.EventID] = ref.EventSHA256
+			}
+		}
+	}
 	return nil
 }
 
@@ -227,6 +381,18 @@ func (t *testRoomserverAPI) QueryRoomVersionForRoom(
 	response *api.QueryRoomVersionForRoomResponse,
 ) error {
 	response.RoomVersion = testRoomVersion
+	if roomVersion, ok := t.roomVersions[request.RoomID]; ok {
+		response.RoomVersion = roomVersion
+	}
+	return nil
+}
+
+// Asks which server sent us an event over federation.
+func (t *testRoomserverAPI) QueryEventOrigin(
+	ctx context.Context,
+	request *api.QueryEventOriginRequest,
+	response *api.QueryEventOriginResponse,
+) error {
 	return nil
 }
 
@@ -279,6 +445,8 @@ type txnFedClient struct {
 	state    map[string]gomatrixserverlib.RespState    // event_id to response
 	stateIDs map[string]gomatrixserverlib.RespStateIDs // event_id to response
 	getEvent map[string]gomatrixserverlib.Transaction  // event_id to response
+	// comma separated latest_events to response
+	missingEvents map[string]gomatrixserverlib.RespMissingEvents
 }
 
 func (c *txnFedClient) LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
@@ -310,6 +478,17 @@ func (c *txnFedClient) GetEvent(ctx context.Context, s gomatrixserverlib.ServerN
 	res = r
 	return
 }
+func (c *txnFedClient) LookupMissingEvents(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespMissingEvents, err error,
+) {
+	r, ok := c.missingEvents[strings.Join(missing.LatestEvents, ",")]
+	if !ok {
+		err = fmt.Errorf("txnFedClient: no /get_missing_events for latest events %v", missing.LatestEvents)
+		return
+	}
+	res = r
+	return
+}
 
 func mustCreateTransaction(rsAPI api.RoomserverInternalAPI, fedClient txnFederationClient, pdus []json.RawMessage) *txnReq {
 	t := &txnReq{
@@ -399,6 +578,416 @@ func TestBasicTransaction(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// siblingMessages returns n message events which all have the same prev_events, so none of them depend on each other.
+func siblingMessages(n int) (pdus []json.RawMessage) {
+	template := string(testData[len(testData)-3]) // the first message event
+	for i := 0; i < n; i++ {
+		pdus = append(pdus, []byte(strings.Replace(
+			template, "$gl2T9l3qm0kUbiIJ:kaer.morhen", fmt.Sprintf("$sibling%d:kaer.morhen", i), 1,
+		)))
+	}
+	return
+}
+
+// The purpose of this test is to check that the state needed to authenticate the events in a transaction is fetched
+// from the roomserver in a single batched query, apart from events whose prev_events are in the same transaction,
+// which are looked up individually once the events before them have been processed.
+func TestTransactionBatchesStateQueries(t *testing.T) {
+	rsAPI := basicStateRoomserverAPI()
+	pdus := append(
+		siblingMessages(3),
+		testData[len(testData)-2], // prev_events not in the transaction
+		testData[len(testData)-1], // prev_events is the message before
+	)
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	mustProcessTransaction(t, txn, nil)
+	if len(rsAPI.inputRoomEvents) != len(pdus) {
+		t.Errorf("wrong number of InputRoomEvents: got %d want %d", len(rsAPI.inputRoomEvents), len(pdus))
+	}
+	if rsAPI.batchStateQueries != 1 {
+		t.Errorf("wrong number of batched state queries: got %d want 1", rsAPI.batchStateQueries)
+	}
+	if rsAPI.stateQueries != 1 {
+		t.Errorf("wrong number of individual state queries: got %d want 1", rsAPI.stateQueries)
+	}
+}
+
+// BenchmarkTransaction20PDUsSingleRoom measures processing a transaction of 20 events for a single room, and reports
+// the number of roomserver state queries needed for each transaction.
+func BenchmarkTransaction20PDUsSingleRoom(b *testing.B) {
+	pdus := siblingMessages(20)
+	for i := 0; i < b.N; i++ {
+		rsAPI := basicStateRoomserverAPI()
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+		if _, err := txn.processTransaction(); err != nil {
+			b.Fatalf("txn.processTransaction returned an error: %s", err)
+		}
+		b.ReportMetric(float64(rsAPI.stateQueries+rsAPI.batchStateQueries), "queries/op")
+	}
+}
+
+// The purpose of this test is to check that when we can't fetch the keys needed to verify an event, e.g. because the
+// key server is unreachable, the transaction fails with a transient error rather than rejecting the event outright.
+func TestTransactionKeyServerUnreachable(t *testing.T) {
+	txn := mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.keys = &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{&testKeyFetcher{err: errors.New("connection refused")}},
+		KeyDatabase: &testKeyFetcher{},
+	}
+	_, err := txn.processTransaction()
+	if _, ok := err.(keyFetchError); !ok {
+		t.Fatalf("expected keyFetchError, got %T: %v", err, err)
+	}
+}
+
+// The purpose of this test is to check that an event which can't be parsed as the room's version is rejected with an
+// error which says which room version was attempted and hints at the format that the event was sent in.
+func TestTransactionUnparseableEvent(t *testing.T) {
+	// The depth of an event must be a number in every room version.
+	pdu := bytes.Replace(testData[len(testData)-1], []byte(`"depth":7`), []byte(`"depth":"seven"`), 1)
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, []json.RawMessage{pdu})
+	_, err := txn.processTransaction()
+	unmarshalErr, ok := err.(unmarshalError)
+	if !ok {
+		t.Fatalf("txn.processTransaction returned %v, want an unmarshalError", err)
+	}
+	if unmarshalErr.roomVersion != testRoomVersion {
+		t.Errorf("wrong room version in error: got %q want %q", unmarshalErr.roomVersion, testRoomVersion)
+	}
+	if !unmarshalErr.hasEventID {
+		t.Errorf("expected the error to record that the event has an event_id")
+	}
+	want := fmt.Sprintf("unable to parse event as room version %s (the event has an event_id, as in room versions 1 and 2): ", testRoomVersion)
+	if !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("wrong error message: got %q want prefix %q", err.Error(), want)
+	}
+}
+
+func TestRedactedEventJSON(t *testing.T) {
+	got := redactedEventJSON([]byte(`{"content":{"body":"secret"},"event_id":"$event:kaer.morhen","signatures":{"kaer.morhen":{}}}`))
+	want := `{"content":"<redacted>","event_id":"$event:kaer.morhen","signatures":"<redacted>"}`
+	if got != want {
+		t.Errorf("wrong redacted JSON: got %s want %s", got, want)
+	}
+	if got = redactedEventJSON([]byte(`{"content":`)); got != "<11 bytes of invalid JSON>" {
+		t.Errorf("wrong redacted JSON for invalid JSON: got %s", got)
+	}
+}
+
+// The purpose of this test is to check that malformed event JSON is rejected with an unmarshalError rather than
+// panicking, and that a panic in the parser itself is recovered and rejected the same way.
+func TestParseUntrustedEvent(t *testing.T) {
+	testCases := []struct {
+		name      string
+		eventJSON []byte
+	}{
+		{"empty", nil},
+		{"truncated", testData[len(testData)-1][:100]},
+		{"not an object", []byte(`[1,2,3]`)},
+		{"null", []byte(`null`)},
+		{"wrong types", []byte(`{"type":5,"room_id":[],"sender":{},"depth":"deep","prev_events":"none","auth_events":7}`)},
+		{"deeply nested", []byte(`{"content":` + strings.Repeat(`[`, 10000) + strings.Repeat(`]`, 10000) + `}`)},
+		{"invalid UTF-8", []byte("{\"type\":\"\xff\xfe\"}")},
+	}
+	for _, tc := range testCases {
+		_, err := parseUntrustedEvent(context.Background(), tc.eventJSON, testRoomVersion)
+		if _, ok := err.(unmarshalError); !ok {
+			t.Errorf("%s: expected an unmarshalError, got %v", tc.name, err)
+		}
+	}
+
+	defer func(parse func([]byte, gomatrixserverlib.RoomVersion) (gomatrixserverlib.Event, error)) {
+		newEventFromUntrustedJSON = parse
+	}(newEventFromUntrustedJSON)
+	newEventFromUntrustedJSON = func([]byte, gomatrixserverlib.RoomVersion) (gomatrixserverlib.Event, error) {
+		panic("crafted input")
+	}
+	_, err := parseUntrustedEvent(context.Background(), testData[len(testData)-1], testRoomVersion)
+	if _, ok := err.(unmarshalError); !ok {
+		t.Fatalf("expected a panic to be returned as an unmarshalError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "crafted input") {
+		t.Errorf("expected the error to include the panic, got %q", err.Error())
+	}
+}
+
+// The purpose of this test is to check that an event in a room whose version we don't support is reported as failed
+// with an error naming the version, without failing the transaction or the other events in it.
+func TestTransactionUnsupportedRoomVersion(t *testing.T) {
+	const futureRoomID = "!future:kaer.morhen"
+	const futureEventID = "$future:kaer.morhen"
+	rsAPI := basicStateRoomserverAPI()
+	rsAPI.roomVersions = map[string]gomatrixserverlib.RoomVersion{
+		futureRoomID: "org.example.future",
+	}
+	futurePDU := strings.NewReplacer(
+		"$MYSbs8m4rEbsCWXD:kaer.morhen", futureEventID,
+		"!roomid:kaer.morhen", futureRoomID,
+	).Replace(string(testData[len(testData)-1]))
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		[]byte(futurePDU),
+		testData[len(testData)-1], // a message event
+	})
+	resp, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	if res := txn.successResponse(resp); res.Code != http.StatusOK {
+		t.Errorf("wrong response code: got %d want %d", res.Code, http.StatusOK)
+	}
+	result := resp.PDUs[futureEventID]
+	if !strings.HasPrefix(result.Error, pduErrorRoomVersion+": ") || !strings.Contains(result.Error, `"org.example.future"`) {
+		t.Errorf("wrong error for event in unsupported room version: got %q", result.Error)
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	if result := resp.PDUs[inputEvent.EventID()]; result.Error != "" {
+		t.Errorf("event in supported room version failed: %s", result.Error)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{inputEvent})
+}
+
+// The purpose of this test is to check that the events in rooms beyond the limit on rooms per transaction are skipped
+// as a temporary failure without being processed, and that events in the rooms within the limit are still processed,
+// wherever they are in the transaction.
+func TestTransactionTooManyRooms(t *testing.T) {
+	rsAPI := basicStateRoomserverAPI()
+	inRoom := siblingMessages(2)
+	var otherEventIDs []string
+	pdus := []json.RawMessage{inRoom[0]}
+	for i := 0; i < 2; i++ {
+		eventID := fmt.Sprintf("$elsewhere%d:kaer.morhen", i)
+		otherEventIDs = append(otherEventIDs, eventID)
+		pdus = append(pdus, []byte(strings.NewReplacer(
+			"$N5x9WJkl9ClPrAEg:kaer.morhen", eventID,
+			"!roomid:kaer.morhen", fmt.Sprintf("!elsewhere%d:kaer.morhen", i),
+		).Replace(string(testData[len(testData)-1]))))
+	}
+	pdus = append(pdus, inRoom[1])
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.maxRoomsPerTransaction = 1
+	resp, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	if len(resp.PDUs) != len(pdus) {
+		t.Errorf("wrong number of PDU results: got %d want %d", len(resp.PDUs), len(pdus))
+	}
+	for _, eventID := range otherEventIDs {
+		result := resp.PDUs[eventID]
+		if !strings.HasPrefix(result.Error, pduErrorTooManyRooms+": ") {
+			t.Errorf("wrong error for event in a room beyond the limit: got %q want prefix %s", result.Error, pduErrorTooManyRooms)
+		}
+	}
+	var want []gomatrixserverlib.HeaderedEvent
+	for _, pdu := range inRoom {
+		e, err := gomatrixserverlib.NewEventFromTrustedJSON(pdu, false, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to load event: %s", err)
+		}
+		if result := resp.PDUs[e.EventID()]; result.Error != "" {
+			t.Errorf("event in a room within the limit failed: %s", result.Error)
+		}
+		want = append(want, e.Headered(testRoomVersion))
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, want)
+}
+
+// The purpose of this test is to check that an event with a forged signature is still rejected as badly signed.
+func TestTransactionForgedSignature(t *testing.T) {
+	forgedKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	txn := mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.keys = &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{&testKeyFetcher{key: forgedKey}},
+		KeyDatabase: &testKeyFetcher{},
+	}
+	_, err = txn.processTransaction()
+	if _, ok := err.(verifySigError); !ok {
+		t.Fatalf("expected verifySigError, got %T: %v", err, err)
+	}
+}
+
+// The purpose of this test is to check that the signatures of an event are only checked once per transaction, however
+// many times the event is verified, but are checked again by a new transaction or if the JSON of the event changes.
+func TestVerifyEventSignaturesCache(t *testing.T) {
+	ctx := context.Background()
+	event := testEvents[len(testEvents)-1].Unwrap()
+	keys := &testCountingJSONVerifier{}
+	txn := mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, nil)
+	txn.keys = keys
+	for i := 0; i < 3; i++ {
+		if err := txn.verifyEventSignatures(ctx, event); err != nil {
+			t.Fatalf("verifyEventSignatures returned %s", err)
+		}
+	}
+	if keys.verified != 1 {
+		t.Errorf("expected the signatures to be checked once, got %d", keys.verified)
+	}
+
+	// An event with the same ID but different JSON, which is possible in room versions where the event ID isn't
+	// derived from the content of the event, must not hit the cache.
+	altered, err := gomatrixserverlib.NewEventFromTrustedJSON(
+		bytes.Replace(testData[len(testData)-1], []byte(`"body":"Test Message"`), []byte(`"body":"Altered Message"`), 1),
+		false, testRoomVersion,
+	)
+	if err != nil {
+		t.Fatalf("failed to create altered event: %s", err)
+	}
+	if altered.EventID() != event.EventID() {
+		t.Fatalf("expected the altered event to have ID %s, got %s", event.EventID(), altered.EventID())
+	}
+	if err = txn.verifyEventSignatures(ctx, altered); err != nil {
+		t.Fatalf("verifyEventSignatures returned %s", err)
+	}
+	if keys.verified != 2 {
+		t.Errorf("expected the signatures of the altered event to be checked, got %d checks", keys.verified)
+	}
+
+	// The cache must not be shared with other transactions.
+	txn = mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, nil)
+	txn.keys = keys
+	if err = txn.verifyEventSignatures(ctx, event); err != nil {
+		t.Fatalf("verifyEventSignatures returned %s", err)
+	}
+	if keys.verified != 3 {
+		t.Errorf("expected the signatures to be checked again by a new transaction, got %d checks", keys.verified)
+	}
+}
+
+// countingKeyFetcher is a key fetcher which returns key for every request, counting the requests for each server.
+type countingKeyFetcher struct {
+	testKeyFetcher
+	requests map[gomatrixserverlib.ServerName]int
+}
+
+func (f *countingKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	for req := range requests {
+		f.requests[req.ServerName]++
+	}
+	return f.testKeyFetcher.FetchKeys(ctx, requests)
+}
+
+// The purpose of this test is to check that verifying the events of a transaction from two servers together fetches
+// the keys of each server once, and that an event with a bad signature gets its own error without failing the others.
+func TestVerifyEventSignaturesBatch(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	buildEvent := func(server gomatrixserverlib.ServerName, i int, key ed25519.PrivateKey) gomatrixserverlib.Event {
+		b := gomatrixserverlib.EventBuilder{
+			Sender:  fmt.Sprintf("@geralt:%s", server),
+			RoomID:  "!roomid:kaer.morhen",
+			Type:    "m.room.message",
+			Content: []byte(fmt.Sprintf(`{"body":"message %d"}`, i)),
+			Depth:   int64(i + 1),
+		}
+		e, err := b.Build(time.Now(), server, "ed25519:auto", key, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		return e
+	}
+	var events []gomatrixserverlib.Event
+	for i := 0; i < 6; i++ {
+		server := gomatrixserverlib.ServerName("kaer.morhen")
+		if i%2 == 1 {
+			server = "novigrad"
+		}
+		events = append(events, buildEvent(server, i, privateKey))
+	}
+
+	fetcher := &countingKeyFetcher{
+		testKeyFetcher: testKeyFetcher{key: publicKey},
+		requests:       make(map[gomatrixserverlib.ServerName]int),
+	}
+	txn := mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, nil)
+	txn.keys = &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{fetcher},
+		KeyDatabase: &testKeyFetcher{},
+	}
+	for i, err := range txn.verifyEventSignaturesBatch(context.Background(), events) {
+		if err != nil {
+			t.Errorf("event %d failed verification: %s", i, err)
+		}
+	}
+	want := map[gomatrixserverlib.ServerName]int{"kaer.morhen": 1, "novigrad": 1}
+	if !reflect.DeepEqual(fetcher.requests, want) {
+		t.Errorf("wrong key requests: got %v want %v", fetcher.requests, want)
+	}
+
+	// An event signed with the wrong key fails on its own.
+	events = []gomatrixserverlib.Event{
+		buildEvent("kaer.morhen", 10, privateKey),
+		buildEvent("novigrad", 11, otherPrivateKey),
+		buildEvent("kaer.morhen", 12, privateKey),
+	}
+	txn = mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, nil)
+	txn.keys = &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{&testKeyFetcher{key: publicKey}},
+		KeyDatabase: &testKeyFetcher{},
+	}
+	errs := txn.verifyEventSignaturesBatch(context.Background(), events)
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("expected the correctly signed events to be verified, got errors %v and %v", errs[0], errs[2])
+	}
+	if _, ok := errs[1].(verifySigError); !ok {
+		t.Errorf("expected verifySigError for the badly signed event, got %T: %v", errs[1], errs[1])
+	}
+}
+
+// The purpose of this test is to check that an event which fails verification because the sending server rotated its
+// keys partway through a transaction is verified again with freshly fetched keys rather than being rejected, and that
+// the keys of a server are only fetched again once per transaction.
+func TestTransactionRefreshesRotatedKeys(t *testing.T) {
+	pdus := siblingMessages(2)
+	rsAPI := basicStateRoomserverAPI()
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	// The events are verified together with stale keys, then each event is verified again on its own, and the first
+	// of those still uses the stale keys.
+	keys := &testRotatingJSONVerifier{stale: map[int]bool{1: true, 2: true}}
+	txn.keys = keys
+	mustProcessTransaction(t, txn, nil)
+	if keys.calls != 4 {
+		t.Errorf("expected the first event to be verified again twice and the second once, got %d verifications in total", keys.calls)
+	}
+	if len(rsAPI.inputRoomEvents) != len(pdus) {
+		t.Errorf("wrong number of InputRoomEvents: got %d want %d", len(rsAPI.inputRoomEvents), len(pdus))
+	}
+
+	// Badly signed events only make us fetch the keys of their server again once.
+	ctx := context.Background()
+	txn = mustCreateTransaction(basicStateRoomserverAPI(), &txnFedClient{}, nil)
+	keys = &testRotatingJSONVerifier{stale: map[int]bool{1: true, 2: true, 3: true}}
+	txn.keys = keys
+	for _, pdu := range pdus {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(pdu, false, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to create event: %s", err)
+		}
+		if err = txn.verifyEventSignatures(ctx, event); err == nil {
+			t.Fatalf("expected verifyEventSignatures to fail for a badly signed event")
+		} else if _, ok := err.(verifySigError); !ok {
+			t.Fatalf("expected verifySigError, got %T: %v", err, err)
+		}
+	}
+	if keys.calls != 3 {
+		t.Errorf("expected the keys to be fetched again once, got %d verifications in total", keys.calls)
+	}
+}
+
 // The purpose of this test is to check that if the event received fails auth checks the transaction is failed.
 func TestTransactionFailAuthChecks(t *testing.T) {
 	rsAPI := &testRoomserverAPI{
@@ -424,6 +1013,47 @@ func TestTransactionFailAuthChecks(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil) // expect no messages to be sent to the roomserver
 }
 
+// The purpose of this test is to check that an event which fails auth checks is reported to the roomserver as a
+// rejected event exactly once, with the server that sent it and why it was rejected, but only if that is enabled.
+func TestTransactionEmitsRejectedEvents(t *testing.T) {
+	for _, emit := range []bool{false, true} {
+		rsAPI := &testRoomserverAPI{
+			queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+				return api.QueryStateAfterEventsResponse{
+					PrevEventsExist: true,
+					RoomExists:      true,
+					// omit the create event so auth checks fail
+					StateEvents: fromStateTuples(req.StateToFetch, []gomatrixserverlib.StateKeyTuple{
+						{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+					}),
+				}
+			},
+		}
+		inputEvent := testEvents[len(testEvents)-1]
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{testData[len(testData)-1]})
+		txn.emitRejectedEvents = emit
+		mustProcessTransaction(t, txn, []string{inputEvent.EventID()})
+		assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+
+		if !emit {
+			if len(rsAPI.inputRejectedEvents) != 0 {
+				t.Errorf("expected no rejected events when disabled, got %d", len(rsAPI.inputRejectedEvents))
+			}
+			continue
+		}
+		if len(rsAPI.inputRejectedEvents) != 1 {
+			t.Fatalf("expected 1 rejected event, got %d", len(rsAPI.inputRejectedEvents))
+		}
+		got := rsAPI.inputRejectedEvents[0]
+		if got.EventID != inputEvent.EventID() || got.RoomID != inputEvent.RoomID() || got.Origin != testOrigin {
+			t.Errorf("wrong rejected event: got %+v", got)
+		}
+		if !strings.HasPrefix(got.Reason, pduErrorNotAllowed+": ") {
+			t.Errorf("expected reason to start with %q, got %q", pduErrorNotAllowed, got.Reason)
+		}
+	}
+}
+
 // The purpose of this test is to check that when there are missing prev_events that state is fetched via /state_ids
 // and /event and not /state. It works by setting PrevEventsExist=false in the roomserver query response, resulting in
 // a call to /state_ids which returns the whole room state. It should attempt to fetch as many of these events from the
@@ -492,50 +1122,173 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{missingStateEvent, inputEvent})
 }
 
-// The purpose of this test is to check that when there are missing prev_events and /state_ids fails, that we fallback to
-// calling /state which returns the entire room state at that event. It works by setting PrevEventsExist=false in the
-// roomserver query response, resulting in a call to /state_ids which fails (unset). It should then fetch via /state.
-func TestTransactionFetchMissingStateByFallbackState(t *testing.T) {
+// The purpose of this test is to check that an event from a transaction which is sent to the roomserver with the state
+// fetched from the sender is a live event, while one which we only found while filling in a gap is marked as historical
+// so that it doesn't cause notifications.
+func TestProcessEventWithMissingStateHistorical(t *testing.T) {
 	rsAPI := &testRoomserverAPI{
 		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
 			return api.QueryStateAfterEventsResponse{
-				// setting this to false should trigger a call to /state_ids
 				PrevEventsExist: false,
 				RoomExists:      true,
-				StateEvents:     nil,
 			}
 		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range testStateEvents {
+					if ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
 	}
 	inputEvent := testEvents[len(testEvents)-1]
-	// first 5 events are the state events, in auth event order.
-	stateEvents := testEvents[:5]
-
+	var stateEventIDs []string
+	for _, ev := range testStateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
 	cli := &txnFedClient{
-		// /state_ids purposefully unset
-		stateIDs: nil,
-		// /state returns the state at that event (which is the current state)
-		state: map[string]gomatrixserverlib.RespState{
-			inputEvent.EventID(): gomatrixserverlib.RespState{
-				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
-				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+		stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+			inputEvent.EventID(): {
+				StateEventIDs: stateEventIDs,
+				AuthEventIDs:  stateEventIDs,
 			},
 		},
 	}
 
-	pdus := []json.RawMessage{
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{
 		testData[len(testData)-1], // a message event
-	}
-	txn := mustCreateTransaction(rsAPI, cli, pdus)
+	})
 	mustProcessTransaction(t, txn, nil)
-	// the roomserver should get all state events and the new input event
-	// TODO: it should really be only giving the missing ones
-	got := rsAPI.inputRoomEvents
-	if len(got) != len(stateEvents)+1 {
-		t.Fatalf("wrong number of InputRoomEvents: got %d want %d", len(got), len(stateEvents)+1)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{inputEvent})
+	if len(rsAPI.inputRoomEvents) == 1 && rsAPI.inputRoomEvents[0].Historical {
+		t.Errorf("expected the event from the transaction not to be historical")
 	}
-	last := got[len(got)-1]
-	if last.Event.EventID() != inputEvent.EventID() {
-		t.Errorf("last event should be the input event but it wasn't. got %s want %s", last.Event.EventID(), inputEvent.EventID())
+
+	rsAPI.inputRoomEvents = nil
+	txn = mustCreateTransaction(rsAPI, cli, nil)
+	if err := txn.processEventWithMissingState(context.Background(), inputEvent.Unwrap(), testRoomVersion, true); err != nil {
+		t.Fatalf("processEventWithMissingState returned an error: %s", err)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{inputEvent})
+	if len(rsAPI.inputRoomEvents) == 1 && !rsAPI.inputRoomEvents[0].Historical {
+		t.Errorf("expected the event found while filling in a gap to be historical")
+	}
+}
+
+// The purpose of this test is to check that a missing state event which is fetched via /event is rejected if its JSON
+// is larger than the room version allows, rather than being parsed and sent to the roomserver.
+func TestTransactionRejectsOversizedMissingStateEvent(t *testing.T) {
+	missingStateEvent := testStateEvents[gomatrixserverlib.StateKeyTuple{
+		EventType: gomatrixserverlib.MRoomPowerLevels,
+		StateKey:  "",
+	}]
+	rsAPI := &testRoomserverAPI{
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range testStateEvents {
+					if wantEventID != missingStateEvent.EventID() && ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	var stateEventIDs []string
+	for _, ev := range testStateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
+	// Whitespace is valid JSON, so the event would otherwise parse fine.
+	eventJSON := missingStateEvent.JSON()
+	oversized := append([]byte{'{'}, bytes.Repeat([]byte{' '}, 65536)...)
+	oversized = append(oversized, eventJSON[1:]...)
+	cli := &txnFedClient{
+		stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+			inputEvent.EventID(): gomatrixserverlib.RespStateIDs{
+				StateEventIDs: stateEventIDs,
+				AuthEventIDs:  stateEventIDs,
+			},
+		},
+		getEvent: map[string]gomatrixserverlib.Transaction{
+			missingStateEvent.EventID(): gomatrixserverlib.Transaction{
+				PDUs: []json.RawMessage{oversized},
+			},
+		},
+	}
+
+	txn := mustCreateTransaction(rsAPI, cli, nil)
+	_, _, err := txn.lookupMissingStateViaStateIDs(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+	if _, ok := err.(eventTooLargeError); !ok {
+		t.Fatalf("lookupMissingStateViaStateIDs returned %v, want an eventTooLargeError", err)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+}
+
+func TestCheckEventSize(t *testing.T) {
+	if err := checkEventSize("$small", make([]byte, 65536), testRoomVersion); err != nil {
+		t.Errorf("checkEventSize rejected an event at the limit: %s", err)
+	}
+	if err := checkEventSize("$large", make([]byte, 65537), testRoomVersion); err == nil {
+		t.Errorf("checkEventSize accepted an event over the limit")
+	}
+	if err := checkEventSize("$unknown", nil, gomatrixserverlib.RoomVersion("unknown")); err == nil {
+		t.Errorf("checkEventSize accepted an event in an unsupported room version")
+	}
+}
+
+// The purpose of this test is to check that when there are missing prev_events and /state_ids fails, that we fallback to
+// calling /state which returns the entire room state at that event. It works by setting PrevEventsExist=false in the
+// roomserver query response, resulting in a call to /state_ids which fails (unset). It should then fetch via /state.
+func TestTransactionFetchMissingStateByFallbackState(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				// setting this to false should trigger a call to /state_ids
+				PrevEventsExist: false,
+				RoomExists:      true,
+				StateEvents:     nil,
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+
+	cli := &txnFedClient{
+		// /state_ids purposefully unset
+		stateIDs: nil,
+		// /state returns the state at that event (which is the current state)
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+
+	pdus := []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	}
+	txn := mustCreateTransaction(rsAPI, cli, pdus)
+	mustProcessTransaction(t, txn, nil)
+	// the roomserver doesn't have any of the state, so it should get all state events and the new input event
+	got := rsAPI.inputRoomEvents
+	if len(got) != len(stateEvents)+1 {
+		t.Fatalf("wrong number of InputRoomEvents: got %d want %d", len(got), len(stateEvents)+1)
+	}
+	last := got[len(got)-1]
+	if last.Event.EventID() != inputEvent.EventID() {
+		t.Errorf("last event should be the input event but it wasn't. got %s want %s", last.Event.EventID(), inputEvent.EventID())
 	}
 	gots := make([]string, len(stateEvents))
 	wants := make([]string, len(stateEvents))
@@ -549,3 +1302,1406 @@ func TestTransactionFetchMissingStateByFallbackState(t *testing.T) {
 		t.Errorf("state events returned mismatch, got (sorted): %+v want %+v", gots, wants)
 	}
 }
+
+// The purpose of this test is to check that when the state before an event is fetched via /state, the state events
+// which the roomserver already has aren't sent to it again, while the new event still references the complete state.
+func TestTransactionFetchMissingStateByFallbackStateSendsDelta(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+	// the roomserver already has the create and join events
+	knownEvents := stateEvents[:2]
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range knownEvents {
+					if ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			return res
+		},
+	}
+	cli := &txnFedClient{
+		// /state_ids purposefully unset
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	mustProcessTransaction(t, txn, nil)
+	got := rsAPI.inputRoomEvents
+	wantOutliers := stateEvents[len(knownEvents):]
+	if len(got) != len(wantOutliers)+1 {
+		t.Fatalf("wrong number of InputRoomEvents: got %d want %d", len(got), len(wantOutliers)+1)
+	}
+	for _, ire := range got[:len(got)-1] {
+		for _, known := range knownEvents {
+			if ire.Event.EventID() == known.EventID() {
+				t.Errorf("state event %s which the roomserver already has was sent again", known.EventID())
+			}
+		}
+	}
+	last := got[len(got)-1]
+	if last.Event.EventID() != inputEvent.EventID() {
+		t.Fatalf("last event should be the input event but it wasn't. got %s want %s", last.Event.EventID(), inputEvent.EventID())
+	}
+	if len(last.StateEventIDs) != len(stateEvents) {
+		t.Errorf("input event should reference the complete state: got %d state events want %d", len(last.StateEventIDs), len(stateEvents))
+	}
+}
+
+// The purpose of this test is to check that when there are missing prev_events and neither /state_ids nor /state
+// succeed, the event is skipped with a missing prev_events error rather than failing the whole transaction, and the
+// response tells the sender when to retry.
+func TestTransactionMissingPrevEventsRetryAfter(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	// /state_ids and /state are both purposefully unset
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.missingPrevEventsRetryAfter = 30 * time.Second
+
+	resp, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	result := resp.PDUs[inputEvent.EventID()]
+	if !strings.HasPrefix(result.Error, pduErrorMissingPrevEvents+": ") {
+		t.Errorf("wrong error for event with missing prev_events: got %q want prefix %s", result.Error, pduErrorMissingPrevEvents)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+
+	res := txn.successResponse(resp)
+	if res.Code != http.StatusOK {
+		t.Errorf("wrong status code: got %d want %d", res.Code, http.StatusOK)
+	}
+	if got := res.Headers["Retry-After"]; got != "30" {
+		t.Errorf("wrong Retry-After header: got %q want %q", got, "30")
+	}
+
+	// A transaction without any such failures gets no hint.
+	txn = mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.missingPrevEventsRetryAfter = 30 * time.Second
+	mustProcessTransaction(t, txn, nil)
+	if res = txn.successResponse(&gomatrixserverlib.RespSend{}); res.Headers != nil {
+		t.Errorf("expected no headers, got %v", res.Headers)
+	}
+}
+
+// The purpose of this test is to check that an event with missing prev_events is skipped with a descriptive error,
+// without asking the sender for any state, if it has more prev_events than the limit, and that an event within the
+// limit is still processed as normal.
+func TestTransactionTooManyPrevEvents(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	stateEvents := testEvents[:5]
+	cli := &txnFedClient{
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+
+	// A message event which references three of the messages before it.
+	overCap, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[["$0ok8ynDp7kjc95e3:kaer.morhen",{"sha256":"sWCi6Ckp9rDimQON+MrUlNRkyfZ2tjbPbWfg2NMB18Q"}],["$LEwEu0kxrtu5fOiS:kaer.morhen",{"sha256":"1aKajq6DWHru1R1HJjvdWMEavkJJHGaTmPvfuERUXaA"}]],"content":{"body":"Test Message"},"depth":8,"event_id":"$fanin:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$gl2T9l3qm0kUbiIJ:kaer.morhen",{"sha256":""}],["$MYSbs8m4rEbsCWXD:kaer.morhen",{"sha256":""}],["$N5x9WJkl9ClPrAEg:kaer.morhen",{"sha256":""}]],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"type":"m.room.message"}`), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	txn := mustCreateTransaction(rsAPI, cli, nil)
+	txn.maxPrevEvents = 2
+	err = txn.processEvent(context.Background(), overCap, nil)
+	if _, ok := err.(tooManyPrevEventsError); !ok {
+		t.Fatalf("expected tooManyPrevEventsError, got %T: %v", err, err)
+	}
+	if !strings.HasPrefix(pduResultError(err), pduErrorTooManyPrevEvents+": ") {
+		t.Errorf("wrong PDU error: got %q want prefix %s", pduResultError(err), pduErrorTooManyPrevEvents)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+
+	// The last message has a single prev_event so it is processed using the state from /state.
+	txn = mustCreateTransaction(rsAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.maxPrevEvents = 2
+	mustProcessTransaction(t, txn, nil)
+	if got := rsAPI.inputRoomEvents; len(got) != len(stateEvents)+1 || got[len(got)-1].Event.EventID() != inputEvent.EventID() {
+		t.Errorf("expected the state events and the input event to be sent to the roomserver, got %d events", len(got))
+	}
+}
+
+// The purpose of this test is to check that an event whose depth is within the window beyond the room's current depth
+// is processed, while an event with an absurdly large depth is rejected before it reaches the roomserver.
+func TestTransactionEventDepth(t *testing.T) {
+	rsAPI := basicStateRoomserverAPI()
+	latestQueries := 0
+	rsAPI.queryLatestEventsAndState = func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+		latestQueries++
+		return api.QueryLatestEventsAndStateResponse{RoomExists: true, Depth: 7}
+	}
+
+	// The last message has depth 7, so it is in range.
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.maxDepthAhead = 100
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+
+	// A message event with a depth of 2^62.
+	deep, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[["$0ok8ynDp7kjc95e3:kaer.morhen",{"sha256":"sWCi6Ckp9rDimQON+MrUlNRkyfZ2tjbPbWfg2NMB18Q"}],["$LEwEu0kxrtu5fOiS:kaer.morhen",{"sha256":"1aKajq6DWHru1R1HJjvdWMEavkJJHGaTmPvfuERUXaA"}]],"content":{"body":"Test Message"},"depth":4611686018427387904,"event_id":"$deep:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$N5x9WJkl9ClPrAEg:kaer.morhen",{"sha256":""}]],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"type":"m.room.message"}`), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	rsAPI.inputRoomEvents = nil
+	err = txn.processEvent(context.Background(), deep, nil)
+	if _, ok := err.(eventDepthError); !ok {
+		t.Fatalf("expected eventDepthError, got %T: %v", err, err)
+	}
+	if !strings.HasPrefix(pduResultError(err), pduErrorBadDepth+": ") {
+		t.Errorf("wrong PDU error: got %q want prefix %s", pduResultError(err), pduErrorBadDepth)
+	}
+	if len(rsAPI.inputRoomEvents) != 0 {
+		t.Errorf("expected no events to be sent to the roomserver, got %d", len(rsAPI.inputRoomEvents))
+	}
+	// The depth of the room is only looked up once per transaction.
+	if latestQueries != 1 {
+		t.Errorf("expected the depth of the room to be looked up once, got %d lookups", latestQueries)
+	}
+}
+
+// The purpose of this test is to check that an event whose origin_server_ts is within the allowed clock skew is
+// accepted, and that events far in the future or the past are logged, and only rejected if that is enabled.
+func TestTransactionEventTimestampSkew(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	defer hook.Reset()
+
+	now := time.Now()
+	testCases := []struct {
+		name     string
+		ts       time.Time
+		wantSkew bool
+	}{
+		{"in window", now.Add(-time.Minute), false},
+		{"far future", now.Add(48 * time.Hour), true},
+		{"far past", now.Add(-60 * 24 * time.Hour), true},
+	}
+	for _, reject := range []bool{false, true} {
+		for _, tc := range testCases {
+			eventJSON := strings.Replace(
+				string(testData[len(testData)-1]), `"origin_server_ts":0`,
+				fmt.Sprintf(`"origin_server_ts":%d`, gomatrixserverlib.AsTimestamp(tc.ts)), 1,
+			)
+			event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, testRoomVersion)
+			if err != nil {
+				t.Fatalf("failed to create event: %s", err)
+			}
+			hook.Reset()
+			rsAPI := basicStateRoomserverAPI()
+			txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+			txn.maxTimestampSkewFuture = 24 * time.Hour
+			txn.maxTimestampSkewPast = 30 * 24 * time.Hour
+			txn.rejectTimestampSkew = reject
+
+			err = txn.processEvent(context.Background(), event, nil)
+			var warnings int
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "Incoming event has a skewed origin_server_ts" {
+					warnings++
+				}
+			}
+			if tc.wantSkew && warnings != 1 {
+				t.Errorf("%s (reject %v): expected 1 warning, got %d", tc.name, reject, warnings)
+			} else if !tc.wantSkew && warnings != 0 {
+				t.Errorf("%s (reject %v): expected no warnings, got %d", tc.name, reject, warnings)
+			}
+			if tc.wantSkew && reject {
+				if _, ok := err.(timestampSkewError); !ok {
+					t.Errorf("%s: expected timestampSkewError, got %T: %v", tc.name, err, err)
+				}
+				if len(rsAPI.inputRoomEvents) != 0 {
+					t.Errorf("%s: expected no events to be sent to the roomserver, got %d", tc.name, len(rsAPI.inputRoomEvents))
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s (reject %v): processEvent returned %s", tc.name, reject, err)
+			}
+			if len(rsAPI.inputRoomEvents) != 1 {
+				t.Errorf("%s (reject %v): expected the event to be sent to the roomserver, got %d events", tc.name, reject, len(rsAPI.inputRoomEvents))
+			}
+		}
+	}
+}
+
+// slowEventProducer is a txnRoomserverProducer which blocks sending one event to the roomserver until its context is
+// done, as if the event was stuck behind a pathological amount of work.
+type slowEventProducer struct {
+	txnRoomserverProducer
+	slowEventID string
+}
+
+func (p *slowEventProducer) SendEvents(
+	ctx context.Context, events []gomatrixserverlib.HeaderedEvent, sendAsServer gomatrixserverlib.ServerName,
+	txnID *api.TransactionID, origin gomatrixserverlib.ServerName,
+) (string, error) {
+	for _, e := range events {
+		if e.EventID() == p.slowEventID {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(10 * time.Second):
+				return "", fmt.Errorf("context of event %s was never done", e.EventID())
+			}
+		}
+	}
+	return p.txnRoomserverProducer.SendEvents(ctx, events, sendAsServer, txnID, origin)
+}
+
+// The purpose of this test is to check that an event which takes longer than the per-PDU timeout is given up on and
+// reported as failed, without being treated as rejected, while the other events in the transaction are still
+// processed.
+func TestTransactionPDUTimeout(t *testing.T) {
+	rsAPI := basicStateRoomserverAPI()
+	pdus := siblingMessages(4)
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	slowEventID := "$sibling1:kaer.morhen"
+	txn.producer = &slowEventProducer{txn.producer, slowEventID}
+	txn.pduTimeout = 50 * time.Millisecond
+	txn.emitRejectedEvents = true
+
+	start := time.Now()
+	res, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("transaction took too long: %s", elapsed)
+	}
+	if len(res.PDUs) != len(pdus) {
+		t.Fatalf("wrong number of PDU results: got %d want %d", len(res.PDUs), len(pdus))
+	}
+	for eventID, result := range res.PDUs {
+		if eventID == slowEventID {
+			if !strings.Contains(result.Error, "gave up processing event") {
+				t.Errorf("expected %s to time out, got %q", eventID, result.Error)
+			}
+		} else if result.Error != "" {
+			t.Errorf("expected %s to succeed, got %q", eventID, result.Error)
+		}
+	}
+	if len(rsAPI.inputRoomEvents) != len(pdus)-1 {
+		t.Errorf("wrong number of InputRoomEvents: got %d want %d", len(rsAPI.inputRoomEvents), len(pdus)-1)
+	}
+	// Running out of time isn't the fault of the event.
+	if len(rsAPI.inputRejectedEvents) != 0 {
+		t.Errorf("expected no rejected events, got %d", len(rsAPI.inputRejectedEvents))
+	}
+}
+
+// The purpose of this test is to check that newTxnReq decodes the transaction from the request, sets up the txnReq
+// from the config and the dependencies, and refuses to build one without the required dependencies.
+func TestNewTxnReq(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	newRequest := func(content interface{}) *gomatrixserverlib.FederationRequest {
+		request := gomatrixserverlib.NewFederationRequest(http.MethodPut, testDestination, "/_matrix/federation/v1/send/1")
+		if err = request.SetContent(content); err != nil {
+			t.Fatalf("failed to set request content: %s", err)
+		}
+		if err = request.Sign(testOrigin, "ed25519:auto", privateKey); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		return &request
+	}
+	httpReq := httptest.NewRequest(http.MethodPut, "/_matrix/federation/v1/send/1", nil)
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testDestination
+	cfg.FederationAPI.MaxPrevEvents = 7
+	cfg.FederationAPI.MissingStateTimeout = time.Minute
+	cfg.FederationAPI.StateFetchStrategy = config.StateFetchStateIDsOnly
+	rsAPI := &testRoomserverAPI{}
+	deps := txnDeps{
+		rsAPI:          rsAPI,
+		producer:       producers.NewRoomserverProducer(rsAPI),
+		eduProducer:    producers.NewEDUServerProducer(&testEDUProducer{}),
+		federation:     gomatrixserverlib.NewFederationClient(testDestination, "ed25519:auto", privateKey),
+		fetchLimiter:   newFetchLimiter(1),
+		circuitBreaker: newCircuitBreaker(1, time.Minute),
+		stateLookups:   newStateLookups(),
+	}
+	request := newRequest(map[string]interface{}{
+		"pdus": []json.RawMessage{testData[len(testData)-1]},
+		"edus": []gomatrixserverlib.EDU{{Type: gomatrixserverlib.MTyping}},
+	})
+
+	txn, err := newTxnReq(httpReq, request, "1", cfg, deps)
+	if err != nil {
+		t.Fatalf("newTxnReq returned an error: %s", err)
+	}
+	if txn.TransactionID != "1" || txn.Origin != testOrigin || txn.Destination != testDestination {
+		t.Errorf("wrong transaction: got ID %q from %q to %q", txn.TransactionID, txn.Origin, txn.Destination)
+	}
+	if len(txn.PDUs) != 1 || !bytes.Equal(txn.PDUs[0], testData[len(testData)-1]) {
+		t.Errorf("wrong PDUs: got %d", len(txn.PDUs))
+	}
+	if len(txn.EDUs) != 1 || txn.EDUs[0].Type != gomatrixserverlib.MTyping {
+		t.Errorf("wrong EDUs: got %+v", txn.EDUs)
+	}
+	if txn.context != httpReq.Context() || txn.rsAPI != rsAPI || txn.stateLookups != deps.stateLookups {
+		t.Errorf("dependencies weren't set")
+	}
+	if txn.maxPrevEvents != 7 || txn.missingStateTimeout != time.Minute || txn.stateFetchStrategy != config.StateFetchStateIDsOnly {
+		t.Errorf("config wasn't applied: got max prev events %d, missing state timeout %s, state fetch strategy %q",
+			txn.maxPrevEvents, txn.missingStateTimeout, txn.stateFetchStrategy)
+	}
+	// The federation client makes its requests through the fetch limiter and
+	// the circuit breaker, counted against the fetch budget.
+	budgeted, ok := txn.federation.(*budgetedFederationClient)
+	if !ok {
+		t.Fatalf("federation client isn't budgeted: got %T", txn.federation)
+	}
+	breaking, ok := budgeted.txnFederationClient.(*breakingFederationClient)
+	if !ok || breaking.breaker != deps.circuitBreaker {
+		t.Fatalf("federation client doesn't go through the circuit breaker: got %T", budgeted.txnFederationClient)
+	}
+	if limited, ok := breaking.txnFederationClient.(*limitedFederationClient); !ok || limited.limiter != deps.fetchLimiter {
+		t.Errorf("federation client doesn't go through the fetch limiter: got %T", breaking.txnFederationClient)
+	}
+
+	noRoomserver := deps
+	noRoomserver.rsAPI = nil
+	if _, err = newTxnReq(httpReq, request, "1", cfg, noRoomserver); err == nil {
+		t.Errorf("expected an error without a roomserver API")
+	} else if _, ok = err.(missingTxnDependencyError); !ok {
+		t.Errorf("wrong error without a roomserver API: got %T %s", err, err)
+	}
+	if _, err = newTxnReq(httpReq, newRequest("not a transaction"), "1", cfg, deps); err == nil {
+		t.Errorf("expected an error for content which isn't a transaction")
+	}
+}
+
+// The purpose of this test is to check that the server which sent us a transaction is passed on to the roomserver
+// with each of its events, both when we have the prev_events and when the event is sent along with the state
+// fetched from that server, so that it can be stored alongside the events.
+func TestTransactionRecordsOrigin(t *testing.T) {
+	rsAPI := basicStateRoomserverAPI()
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	mustProcessTransaction(t, txn, nil)
+
+	inputEvent := testEvents[len(testEvents)-1]
+	stateEvents := testEvents[:5]
+	missingStateRSAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+	}
+	cli := &txnFedClient{
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+	txn = mustCreateTransaction(missingStateRSAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	mustProcessTransaction(t, txn, nil)
+
+	got := append(rsAPI.inputRoomEvents, missingStateRSAPI.inputRoomEvents...)
+	if len(got) != len(stateEvents)+2 {
+		t.Fatalf("wrong number of InputRoomEvents: got %d want %d", len(got), len(stateEvents)+2)
+	}
+	for _, ire := range got {
+		if ire.Origin != testOrigin {
+			t.Errorf("InputRoomEvent %s has wrong origin: got %q want %q", ire.Event.EventID(), ire.Origin, testOrigin)
+		}
+	}
+}
+
+// The purpose of this test is to check that processing a transaction creates a tracing span for the transaction and
+// child spans for each step of processing its events, tagged with the event and room IDs. It uses an event with missing
+// prev_events where /state_ids fails so that both of the federation lookups are made.
+func TestTransactionTracingSpans(t *testing.T) {
+	tracer := mocktracer.New()
+	prevTracer := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(prevTracer)
+
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+	}
+	inputEvent := testEvents[len(testEvents)-1]
+	stateEvents := testEvents[:5]
+	cli := &txnFedClient{
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): gomatrixserverlib.RespState{
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+	txn := mustCreateTransaction(rsAPI, cli, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	mustProcessTransaction(t, txn, nil)
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	txnSpan, ok := spans["processTransaction"]
+	if !ok {
+		t.Fatalf("no span was created for processTransaction")
+	}
+	if txnSpan.ParentID != 0 {
+		t.Errorf("processTransaction span should have no parent, got %d", txnSpan.ParentID)
+	}
+	if got := txnSpan.Tag("origin"); got != string(testOrigin) {
+		t.Errorf("processTransaction span has wrong origin tag: got %v want %s", got, testOrigin)
+	}
+
+	// Each span is a child of the one before it.
+	parent := txnSpan
+	for _, name := range []string{"processEvent", "processEventWithMissingState", "lookupMissingStateViaStateIDs"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no span was created for %s", name)
+		}
+		if span.ParentID != parent.SpanContext.SpanID {
+			t.Errorf("%s span has wrong parent: got %d want %d", name, span.ParentID, parent.SpanContext.SpanID)
+		}
+		parent = span
+	}
+	stateSpan, ok := spans["lookupMissingStateViaState"]
+	if !ok {
+		t.Fatalf("no span was created for lookupMissingStateViaState")
+	}
+	if stateSpan.ParentID != spans["processEventWithMissingState"].SpanContext.SpanID {
+		t.Errorf("lookupMissingStateViaState span should be a child of processEventWithMissingState")
+	}
+
+	for _, name := range []string{"processEvent", "processEventWithMissingState", "lookupMissingStateViaStateIDs", "lookupMissingStateViaState"} {
+		span := spans[name]
+		if got := span.Tag("event_id"); got != inputEvent.EventID() {
+			t.Errorf("%s span has wrong event_id tag: got %v want %s", name, got, inputEvent.EventID())
+		}
+		if got := span.Tag("room_id"); got != inputEvent.RoomID() {
+			t.Errorf("%s span has wrong room_id tag: got %v want %s", name, got, inputEvent.RoomID())
+		}
+	}
+}
+
+// typingCall is the arguments of a call to txnEDUProducer.SendTyping.
+type typingCall struct {
+	userID    string
+	roomID    string
+	typing    bool
+	timeoutMS int64
+}
+
+// stubEDUProducer is a txnEDUProducer which records the typing updates that it is asked to send.
+type stubEDUProducer struct {
+	typingCalls []typingCall
+	batches     [][]eduAPI.InputTypingEvent
+	// The number of sends which fail, as if the EDU server was down, before sends start to succeed.
+	failures int
+	// The number of sends attempted, including those which failed.
+	attempts int
+}
+
+func (p *stubEDUProducer) fail() error {
+	p.attempts++
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("stubEDUProducer: EDU server unavailable")
+	}
+	return nil
+}
+
+func (p *stubEDUProducer) SendTyping(ctx context.Context, userID, roomID string, typing bool, timeoutMS int64) error {
+	if err := p.fail(); err != nil {
+		return err
+	}
+	p.typingCalls = append(p.typingCalls, typingCall{userID, roomID, typing, timeoutMS})
+	return nil
+}
+
+func (p *stubEDUProducer) SendTypingBatch(ctx context.Context, events []eduAPI.InputTypingEvent) error {
+	if err := p.fail(); err != nil {
+		return err
+	}
+	p.batches = append(p.batches, events)
+	return nil
+}
+
+// The purpose of this test is to check that processEDUs passes a typing EDU on to the EDU producer with the user, room
+// and typing state from the EDU and the default timeout.
+func TestProcessEDUsSendsTyping(t *testing.T) {
+	producer := &stubEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producer
+	err := txn.processEDUs([]gomatrixserverlib.EDU{{
+		Type:    gomatrixserverlib.MTyping,
+		Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`),
+	}})
+	if err != nil {
+		t.Fatalf("processEDUs returned %s", err)
+	}
+
+	want := []typingCall{{"@userid:kaer.morhen", "!roomid:kaer.morhen", true, 30 * 1000}}
+	if !reflect.DeepEqual(producer.typingCalls, want) {
+		t.Errorf("wrong calls to SendTyping: got %+v want %+v", producer.typingCalls, want)
+	}
+	if len(producer.batches) != 0 {
+		t.Errorf("expected no calls to SendTypingBatch, got %d", len(producer.batches))
+	}
+}
+
+// The purpose of this test is to check that a typing EDU which fails to send because the EDU server is briefly down is
+// sent again, and is passed on once the EDU server is back.
+func TestProcessEDUsRetriesTyping(t *testing.T) {
+	defer func(backoff time.Duration) { eduSendBackoff = backoff }(eduSendBackoff)
+	eduSendBackoff = time.Millisecond
+	producer := &stubEDUProducer{failures: maxEDUSendAttempts - 1}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producer
+	err := txn.processEDUs([]gomatrixserverlib.EDU{{
+		Type:    gomatrixserverlib.MTyping,
+		Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`),
+	}})
+	if err != nil {
+		t.Fatalf("processEDUs returned %s", err)
+	}
+	if producer.attempts != maxEDUSendAttempts {
+		t.Errorf("wrong number of attempts to send: got %d want %d", producer.attempts, maxEDUSendAttempts)
+	}
+	want := []typingCall{{"@userid:kaer.morhen", "!roomid:kaer.morhen", true, 30 * 1000}}
+	if !reflect.DeepEqual(producer.typingCalls, want) {
+		t.Errorf("wrong calls to SendTyping: got %+v want %+v", producer.typingCalls, want)
+	}
+}
+
+// The purpose of this test is to check that if the EDU server stays down then the transaction fails with a 503, so
+// that the sender tries it again later rather than its EDUs being lost.
+func TestTransactionEDUServerUnavailable(t *testing.T) {
+	defer func(backoff time.Duration) { eduSendBackoff = backoff }(eduSendBackoff)
+	eduSendBackoff = time.Millisecond
+	producer := &stubEDUProducer{failures: maxEDUSendAttempts}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producer
+	txn.EDUs = []gomatrixserverlib.EDU{{
+		Type:    gomatrixserverlib.MTyping,
+		Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`),
+	}}
+	_, err := txn.processTransaction()
+	if _, ok := err.(eduServerUnavailableError); !ok {
+		t.Fatalf("txn.processTransaction returned %v, want an eduServerUnavailableError", err)
+	}
+	if producer.attempts != maxEDUSendAttempts {
+		t.Errorf("wrong number of attempts to send: got %d want %d", producer.attempts, maxEDUSendAttempts)
+	}
+	if res := transactionErrorResponse(context.Background(), err); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong response code: got %d want %d", res.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// signallingEDUProducer is a stubEDUProducer which signals each time that typing updates are sent.
+type signallingEDUProducer struct {
+	stubEDUProducer
+	sent chan struct{}
+}
+
+func (p *signallingEDUProducer) SendTyping(ctx context.Context, userID, roomID string, typing bool, timeoutMS int64) error {
+	err := p.stubEDUProducer.SendTyping(ctx, userID, roomID, typing, timeoutMS)
+	p.sent <- struct{}{}
+	return err
+}
+
+// The purpose of this test is to check that the EDUs in a transaction are sent on while its events are still being
+// processed, rather than waiting for slow events to finish, and that the transaction still waits for both.
+func TestTransactionSendsEDUsWithoutWaitingForPDUs(t *testing.T) {
+	release := make(chan struct{})
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			// The events are stuck until the EDUs have been sent.
+			<-release
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+	}
+	producer := &signallingEDUProducer{sent: make(chan struct{}, 1)}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.eduProducer = producer
+	txn.EDUs = []gomatrixserverlib.EDU{{
+		Type:    gomatrixserverlib.MTyping,
+		Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`),
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mustProcessTransaction(t, txn, nil)
+	}()
+	select {
+	case <-producer.sent:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("the EDUs weren't sent while the events were being processed")
+	}
+	select {
+	case <-done:
+		t.Fatalf("the transaction finished before its events were processed")
+	default:
+	}
+	close(release)
+	<-done
+	if len(rsAPI.inputRoomEvents) != 1 {
+		t.Errorf("wrong number of InputRoomEvents: got %d want 1", len(rsAPI.inputRoomEvents))
+	}
+}
+
+// The purpose of this test is to check that EDUs are counted by type and outcome, and in particular that EDUs of a type
+// we don't handle are counted as dropped rather than processed.
+func TestTransactionCountsEDUs(t *testing.T) {
+	const unhandledType = "org.example.unhandled"
+	dropped := processedEDUs.WithLabelValues(unhandledType, "dropped")
+	typing := processedEDUs.WithLabelValues(gomatrixserverlib.MTyping, "processed")
+	droppedBefore := testutil.ToFloat64(dropped)
+	typingBefore := testutil.ToFloat64(typing)
+
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.EDUs = []gomatrixserverlib.EDU{
+		{
+			Type:    unhandledType,
+			Content: []byte(`{}`),
+		},
+		{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`),
+		},
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	if got := testutil.ToFloat64(dropped) - droppedBefore; got != 1 {
+		t.Errorf("wrong number of dropped EDUs of type %s: got %v want 1", unhandledType, got)
+	}
+	if got := testutil.ToFloat64(typing) - typingBefore; got != 1 {
+		t.Errorf("wrong number of processed EDUs of type %s: got %v want 1", gomatrixserverlib.MTyping, got)
+	}
+}
+
+// ignoredUsersFilter is an eduFilter which ignores EDUs from the given users in every room.
+type ignoredUsersFilter map[string]bool
+
+func (f ignoredUsersFilter) ignoreEDU(ctx context.Context, roomID, userID string) bool {
+	return f[userID]
+}
+
+// The purpose of this test is to check that typing EDUs from users that the EDU filter ignores are dropped, while
+// typing EDUs from anyone else are still passed on to the EDU server.
+func TestTransactionFiltersEDUs(t *testing.T) {
+	const ignoredUser = "@ignored:kaer.morhen"
+	const normalUser = "@userid:kaer.morhen"
+	eduServer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producers.NewEDUServerProducer(eduServer)
+	txn.eduFilter = ignoredUsersFilter{ignoredUser: true}
+	for _, userID := range []string{ignoredUser, normalUser} {
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(fmt.Sprintf(`{"room_id":"!roomid:kaer.morhen","user_id":"%s","typing":true}`, userID)),
+		})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(eduServer.invocations) != 1 {
+		t.Fatalf("wrong number of typing events sent to the EDU server: got %d want 1", len(eduServer.invocations))
+	}
+	if eduServer.invocations[0].InputTypingEvent.UserID != normalUser {
+		t.Errorf("wrong user for typing event: got %s want %s", eduServer.invocations[0].InputTypingEvent.UserID, normalUser)
+	}
+}
+
+// The purpose of this test is to check that when a transaction carries several typing EDUs, they are sent to the EDU
+// server in a single batch, in the order that they appeared in the transaction.
+func TestTransactionBatchesTypingEDUs(t *testing.T) {
+	updates := []struct {
+		userID string
+		typing bool
+	}{
+		{"@userid:kaer.morhen", true},
+		{"@other:kaer.morhen", true},
+		{"@userid:kaer.morhen", false},
+	}
+	eduServer := &testEDUProducer{}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+	txn.eduProducer = producers.NewEDUServerProducer(eduServer)
+	for _, u := range updates {
+		txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(fmt.Sprintf(`{"room_id":"!roomid:kaer.morhen","user_id":"%s","typing":%t}`, u.userID, u.typing)),
+		})
+	}
+	mustProcessTransaction(t, txn, nil)
+
+	if len(eduServer.invocations) != 0 {
+		t.Errorf("expected no individual typing events to be sent to the EDU server, got %d", len(eduServer.invocations))
+	}
+	if len(eduServer.batchInvocations) != 1 {
+		t.Fatalf("wrong number of batches sent to the EDU server: got %d want 1", len(eduServer.batchInvocations))
+	}
+	got := eduServer.batchInvocations[0].InputTypingEvents
+	if len(got) != len(updates) {
+		t.Fatalf("wrong number of typing events in batch: got %d want %d", len(got), len(updates))
+	}
+	for i, u := range updates {
+		if got[i].UserID != u.userID || got[i].Typing != u.typing || got[i].RoomID != "!roomid:kaer.morhen" {
+			t.Errorf("wrong typing event at position %d: got %+v want user %s typing %t", i, got[i], u.userID, u.typing)
+		}
+	}
+}
+
+// The purpose of this test is to check that EDUs with no type or content, and EDUs whose content is missing a required
+// field or has a value that makes no sense, are skipped and counted as invalid rather than being passed on to the EDU
+// server.
+func TestTransactionSkipsInvalidEDUs(t *testing.T) {
+	testCases := []struct {
+		name string
+		edu  gomatrixserverlib.EDU
+	}{
+		{
+			name: "typing EDU with empty content",
+			edu:  gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping},
+		},
+		{
+			name: "typing EDU with null content",
+			edu:  gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: []byte(` null `)},
+		},
+		{
+			name: "typing EDU without a room ID",
+			edu:  gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: []byte(`{"user_id":"@userid:kaer.morhen","typing":true}`)},
+		},
+		{
+			name: "typing EDU without typing",
+			edu:  gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen"}`)},
+		},
+		{
+			name: "typing EDU with a malformed room ID",
+			edu:  gomatrixserverlib.EDU{Type: gomatrixserverlib.MTyping, Content: []byte(`{"room_id":"roomid","user_id":"@userid:kaer.morhen","typing":true}`)},
+		},
+		{
+			name: "receipt EDU with a malformed ts",
+			edu: gomatrixserverlib.EDU{Type: eduTypeReceipt, Content: []byte(`{"!roomid:kaer.morhen":{"m.read":{"@userid:kaer.morhen":{` +
+				`"event_ids":["$eventid:kaer.morhen"],"data":{"ts":"yesterday"}}}}}`)},
+		},
+		{
+			name: "receipt EDU with a negative ts",
+			edu: gomatrixserverlib.EDU{Type: eduTypeReceipt, Content: []byte(`{"!roomid:kaer.morhen":{"m.read":{"@userid:kaer.morhen":{` +
+				`"event_ids":["$eventid:kaer.morhen"],"data":{"ts":-1}}}}}`)},
+		},
+		{
+			name: "receipt EDU without event IDs",
+			edu: gomatrixserverlib.EDU{Type: eduTypeReceipt, Content: []byte(`{"!roomid:kaer.morhen":{"m.read":{"@userid:kaer.morhen":{` +
+				`"data":{"ts":1500000000000}}}}}`)},
+		},
+		{
+			name: "EDU without a type",
+			edu:  gomatrixserverlib.EDU{Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":true}`)},
+		},
+	}
+	for _, tc := range testCases {
+		invalid := processedEDUs.WithLabelValues(tc.edu.Type, "invalid")
+		invalidBefore := testutil.ToFloat64(invalid)
+		eduServer := &testEDUProducer{}
+		txn := mustCreateTransaction(&testRoomserverAPI{}, &txnFedClient{}, nil)
+		txn.eduProducer = producers.NewEDUServerProducer(eduServer)
+		txn.EDUs = []gomatrixserverlib.EDU{tc.edu}
+		mustProcessTransaction(t, txn, nil)
+
+		if len(eduServer.invocations) != 0 || len(eduServer.batchInvocations) != 0 {
+			t.Errorf("%s: expected nothing to be sent to the EDU server", tc.name)
+		}
+		if got := testutil.ToFloat64(invalid) - invalidBefore; got != 1 {
+			t.Errorf("%s: wrong number of invalid EDUs: got %v want 1", tc.name, got)
+		}
+	}
+}
+
+// The purpose of this test is to check that well-formed EDUs pass validation, including ones with fields that we don't
+// know about, and that EDUs of types without a validator are left for processEDUs to deal with.
+func TestValidateEDUContentAcceptsValidEDUs(t *testing.T) {
+	for _, edu := range []gomatrixserverlib.EDU{
+		{Type: gomatrixserverlib.MTyping, Content: []byte(`{"room_id":"!roomid:kaer.morhen","user_id":"@userid:kaer.morhen","typing":false,"unknown":1}`)},
+		{Type: eduTypeReceipt, Content: []byte(`{"!roomid:kaer.morhen":{"m.read":{"@userid:kaer.morhen":{` +
+			`"event_ids":["$eventid:kaer.morhen"],"data":{"ts":1500000000000}}}}}`)},
+		{Type: "m.unknown", Content: []byte(`[]`)},
+	} {
+		if err := validateEDUContent(edu); err != nil {
+			t.Errorf("expected %s EDU %s to be valid, got %s", edu.Type, edu.Content, err)
+		}
+	}
+}
+
+func mustGzip(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to gzip data: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to gzip data: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// The purpose of this test is to check that a gzipped transaction body is decompressed before it is passed on to the
+// federation handler, and that the Content-Encoding header is removed so that the body is treated as plain JSON.
+// Content codings are case-insensitive and "x-gzip" is an alias of "gzip", and a body which decompresses to exactly
+// the allowed size must still be accepted.
+func TestDecompressTransactionBodyGzip(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Encoding string
+		Body     []byte
+	}{
+		{
+			Name:     "gzip",
+			Encoding: "gzip",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+		},
+		{
+			Name:     "upper case gzip",
+			Encoding: " GZIP ",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+		},
+		{
+			Name:     "x-gzip",
+			Encoding: "x-gzip",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+		},
+		{
+			Name:     "exactly the maximum size",
+			Encoding: "gzip",
+			Body:     bytes.Repeat([]byte{'a'}, 1024),
+		},
+	}
+	for _, tc := range testCases {
+		var gotBody []byte
+		var gotEncoding string
+		h := DecompressTransactionBody(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotBody, _ = ioutil.ReadAll(req.Body)
+			gotEncoding = req.Header.Get("Content-Encoding")
+			w.WriteHeader(http.StatusOK)
+		}), 1024)
+
+		req := httptest.NewRequest(http.MethodPut, "/send/1", bytes.NewReader(mustGzip(t, tc.Body)))
+		req.Header.Set("Content-Encoding", tc.Encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.Name, rec.Code, http.StatusOK)
+			continue
+		}
+		if !bytes.Equal(gotBody, tc.Body) {
+			t.Errorf("%s: wrong decompressed body: got %s want %s", tc.Name, string(gotBody), string(tc.Body))
+		}
+		if gotEncoding != "" {
+			t.Errorf("%s: Content-Encoding header should have been removed, got %q", tc.Name, gotEncoding)
+		}
+	}
+}
+
+// The purpose of this test is to check that a gzipped body which decompresses to more than the allowed size is
+// rejected without being passed on, that corrupt gzip data is rejected with a 400, and that unsupported encodings
+// are rejected with a 415.
+func TestDecompressTransactionBodyRejected(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Encoding string
+		Body     []byte
+		WantCode int
+	}{
+		{
+			Name:     "oversized decompression",
+			Encoding: "gzip",
+			Body:     mustGzip(t, bytes.Repeat([]byte{'a'}, 1025)),
+			WantCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:     "invalid gzip data",
+			Encoding: "gzip",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "truncated gzip data",
+			Encoding: "gzip",
+			Body:     mustGzip(t, bytes.Repeat([]byte{'a'}, 512))[:20],
+			WantCode: http.StatusBadRequest,
+		},
+		{
+			Name:     "unsupported encoding",
+			Encoding: "br",
+			Body:     []byte(`{"pdus":[],"edus":[]}`),
+			WantCode: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tc := range testCases {
+		called := false
+		h := DecompressTransactionBody(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			called = true
+			w.WriteHeader(http.StatusOK)
+		}), 1024)
+
+		req := httptest.NewRequest(http.MethodPut, "/send/1", bytes.NewReader(tc.Body))
+		req.Header.Set("Content-Encoding", tc.Encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.WantCode {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.Name, rec.Code, tc.WantCode)
+		}
+		if called {
+			t.Errorf("%s: request should not have been passed on to the handler", tc.Name)
+		}
+	}
+}
+
+// The purpose of this test is to check that each kind of error from processing an event is reported in its
+// PDUResult with a stable, machine-readable prefix.
+func TestPDUResultError(t *testing.T) {
+	testCases := []struct {
+		Err  error
+		Want string
+	}{
+		{
+			Err:  roomNotFoundError{"!roomid:kaer.morhen"},
+			Want: `M_ROOM_NOT_FOUND: room "!roomid:kaer.morhen" not found`,
+		},
+		{
+			Err:  unmarshalError{err: fmt.Errorf("bad")},
+			Want: "M_BAD_JSON: unable to parse event: bad",
+		},
+		{
+			Err:  verifySigError{"$event:kaer.morhen", fmt.Errorf("bad signature")},
+			Want: `M_SIGNATURE_FAILED: unable to verify signature of event "$event:kaer.morhen": bad signature`,
+		},
+		{
+			Err:  &gomatrixserverlib.NotAllowed{Message: "not allowed"},
+			Want: "M_NOT_ALLOWED: eventauth: not allowed",
+		},
+		{
+			Err:  gomatrixserverlib.MissingAuthEventError{AuthEventID: "$auth:kaer.morhen", ForEventID: "$event:kaer.morhen"},
+			Want: "M_MISSING_AUTH_EVENT: gomatrixserverlib: missing auth event with ID $auth:kaer.morhen for event $event:kaer.morhen",
+		},
+		{
+			Err:  roomBusyError{"!roomid:kaer.morhen"},
+			Want: `M_LIMIT_EXCEEDED: room "!roomid:kaer.morhen" is busy processing other events, try again later`,
+		},
+		{
+			Err:  missingPrevEventsError{"$event:kaer.morhen", fmt.Errorf("no /state")},
+			Want: `M_MISSING_PREV_EVENTS: unable to fetch the state before event "$event:kaer.morhen": no /state`,
+		},
+		{
+			Err:  serverACLDeniedError{"!roomid:kaer.morhen", "kaer.morhen"},
+			Want: `M_FORBIDDEN: server "kaer.morhen" is denied by the server ACL of room "!roomid:kaer.morhen"`,
+		},
+		{
+			Err:  tooManyPrevEventsError{"$event:kaer.morhen", 30, 20},
+			Want: `M_TOO_MANY_PREV_EVENTS: event "$event:kaer.morhen" has too many prev_events to fetch the state before it: 30 > maximum 20`,
+		},
+		{
+			Err:  eventDepthError{"$event:kaer.morhen", 200, 10, 100},
+			Want: `M_INVALID_PARAM: event "$event:kaer.morhen" has depth 200, more than 100 beyond the depth 10 of its room`,
+		},
+		{
+			Err:  fmt.Errorf("something else"),
+			Want: "M_UNKNOWN: something else",
+		},
+	}
+	for _, tc := range testCases {
+		if got := pduResultError(tc.Err); got != tc.Want {
+			t.Errorf("pduResultError(%T): got %q want %q", tc.Err, got, tc.Want)
+		}
+	}
+}
+
+// The purpose of this test is to check that each kind of error which can make a whole transaction fail gets the
+// right status code, so that events which are at fault get a 400 and only problems on our side get a 5xx.
+func TestTransactionErrorResponse(t *testing.T) {
+	testCases := []struct {
+		Err  error
+		Want int
+	}{
+		{roomNotFoundError{"!roomid:kaer.morhen"}, http.StatusBadRequest},
+		{unmarshalError{err: fmt.Errorf("bad")}, http.StatusBadRequest},
+		{verifySigError{"$event:kaer.morhen", fmt.Errorf("bad signature")}, http.StatusBadRequest},
+		{&gomatrixserverlib.NotAllowed{Message: "not allowed"}, http.StatusBadRequest},
+		{missingPrevEventsError{"$event:kaer.morhen", fmt.Errorf("no /state")}, http.StatusBadRequest},
+		{keyFetchError{"$event:kaer.morhen", fmt.Errorf("no keys")}, http.StatusServiceUnavailable},
+		{fmt.Errorf("database is down"), http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		if got := transactionErrorResponse(context.Background(), tc.Err).Code; got != tc.Want {
+			t.Errorf("transactionErrorResponse(%T): got status %d want %d", tc.Err, got, tc.Want)
+		}
+	}
+}
+
+// countingFedClient is a txnFedClient which counts the /state and /state_ids requests made to it.
+type countingFedClient struct {
+	*txnFedClient
+	stateCalls    int
+	stateIDsCalls int
+}
+
+func (c *countingFedClient) LookupState(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (
+	res gomatrixserverlib.RespState, err error,
+) {
+	c.stateCalls++
+	return c.txnFedClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *countingFedClient) LookupStateIDs(ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error) {
+	c.stateIDsCalls++
+	return c.txnFedClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+// The purpose of this test is to check that the state before an event is fetched using only the endpoints allowed by
+// the configured strategy, in the right order, when the sender fails to serve one of them.
+func TestLookupStateBeforeEventStrategy(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+	var stateEventIDs []string
+	for _, ev := range stateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
+	rsAPI := &testRoomserverAPI{
+		// The roomserver has all of the state, so /state_ids doesn't need /event.
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range stateEvents {
+					if ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
+	}
+	workingState := map[string]gomatrixserverlib.RespState{
+		inputEvent.EventID(): {
+			AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+		},
+	}
+	workingStateIDs := map[string]gomatrixserverlib.RespStateIDs{
+		inputEvent.EventID(): {
+			StateEventIDs: stateEventIDs,
+			AuthEventIDs:  stateEventIDs,
+		},
+	}
+
+	testCases := []struct {
+		name          string
+		strategy      string
+		stateFails    bool
+		stateIDsFails bool
+		wantErr       bool
+		wantState     int
+		wantStateIDs  int
+	}{
+		{"default falls back to /state", "", false, true, false, 1, 1},
+		{"default prefers /state_ids", "", true, false, false, 0, 1},
+		{"state_ids_then_state falls back to /state", config.StateFetchStateIDsThenState, false, true, false, 1, 1},
+		{"state_ids_then_state fails if both fail", config.StateFetchStateIDsThenState, true, true, true, 1, 1},
+		{"state_only uses /state", config.StateFetchStateOnly, false, true, false, 1, 0},
+		{"state_only doesn't use /state_ids", config.StateFetchStateOnly, true, false, true, 1, 0},
+		{"state_ids_only uses /state_ids", config.StateFetchStateIDsOnly, true, false, false, 0, 1},
+		{"state_ids_only doesn't use /state", config.StateFetchStateIDsOnly, false, true, true, 0, 1},
+	}
+	for _, tc := range testCases {
+		cli := &countingFedClient{txnFedClient: &txnFedClient{}}
+		if !tc.stateFails {
+			cli.state = workingState
+		}
+		if !tc.stateIDsFails {
+			cli.stateIDs = workingStateIDs
+		}
+		txn := mustCreateTransaction(rsAPI, cli, nil)
+		txn.stateFetchStrategy = tc.strategy
+		respState, _, err := txn.lookupStateBeforeEvent(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%s: lookupStateBeforeEvent returned %s", tc.name, err)
+		} else if !tc.wantErr && len(respState.StateEvents) != len(stateEvents) {
+			t.Errorf("%s: got %d state events, want %d", tc.name, len(respState.StateEvents), len(stateEvents))
+		}
+		if cli.stateCalls != tc.wantState || cli.stateIDsCalls != tc.wantStateIDs {
+			t.Errorf("%s: got %d /state and %d /state_ids requests, want %d and %d",
+				tc.name, cli.stateCalls, cli.stateIDsCalls, tc.wantState, tc.wantStateIDs)
+		}
+	}
+}
+
+// The purpose of this test is to check that a /state response with more state events than we accept is rejected,
+// and that one at the limit is accepted.
+func TestLookupMissingStateViaStateTooManyEvents(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+	cli := &txnFedClient{
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): {
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+	}
+	txn := mustCreateTransaction(&testRoomserverAPI{}, cli, nil)
+
+	txn.maxStateEvents = len(stateEvents) - 1
+	_, err := txn.lookupMissingStateViaState(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+	if _, ok := err.(tooManyStateEventsError); !ok {
+		t.Errorf("expected tooManyStateEventsError, got %v", err)
+	}
+
+	txn.maxStateEvents = len(stateEvents)
+	if _, err = txn.lookupMissingStateViaState(context.Background(), inputEvent.Unwrap(), testRoomVersion); err != nil {
+		t.Errorf("lookupMissingStateViaState returned %s", err)
+	}
+}
+
+// The purpose of this test is to check that a /state response which isn't internally consistent is rejected before
+// its signatures are checked: one with two state events for the same type and state key, one where an event's auth
+// event isn't in the response, and one with an event from another room.
+func TestLookupMissingStateViaStateInconsistent(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order. The first is the create event.
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(testEvents[:5])
+	otherRoom, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(strings.Replace(
+		string(stateEvents[1].JSON()), "!roomid:kaer.morhen", "!otherroom:kaer.morhen", 1,
+	)), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+
+	testCases := []struct {
+		name      string
+		state     gomatrixserverlib.RespState
+		wantError string
+	}{
+		{"consistent", gomatrixserverlib.RespState{
+			AuthEvents: stateEvents, StateEvents: stateEvents,
+		}, ""},
+		{"duplicate state tuple", gomatrixserverlib.RespState{
+			AuthEvents: stateEvents, StateEvents: append(append([]gomatrixserverlib.Event{}, stateEvents...), stateEvents[2]),
+		}, "both have type"},
+		{"dangling auth event", gomatrixserverlib.RespState{
+			AuthEvents: stateEvents[1:], StateEvents: stateEvents[1:],
+		}, "is not in the response"},
+		{"event from another room", gomatrixserverlib.RespState{
+			AuthEvents: stateEvents, StateEvents: append(append([]gomatrixserverlib.Event{}, stateEvents...), otherRoom),
+		}, "is in room !otherroom:kaer.morhen"},
+	}
+	for _, tc := range testCases {
+		cli := &txnFedClient{
+			state: map[string]gomatrixserverlib.RespState{inputEvent.EventID(): tc.state},
+		}
+		txn := mustCreateTransaction(&testRoomserverAPI{}, cli, nil)
+		_, err := txn.lookupMissingStateViaState(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+		if tc.wantError == "" {
+			if err != nil {
+				t.Errorf("%s: lookupMissingStateViaState returned %s", tc.name, err)
+			}
+			continue
+		}
+		if _, ok := err.(inconsistentStateError); !ok {
+			t.Errorf("%s: expected inconsistentStateError, got %v", tc.name, err)
+		} else if !strings.Contains(err.Error(), tc.wantError) {
+			t.Errorf("%s: got error %q, want it to contain %q", tc.name, err, tc.wantError)
+		}
+	}
+}
+
+// The purpose of this test is to check that a /state_ids response which refers to more state and auth events combined
+// than we accept is rejected before any events are fetched, even if neither list is too long by itself, and that the
+// state is then fetched using /state instead.
+func TestLookupMissingStateViaStateIDsTooManyEvents(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+	var stateEventIDs []string
+	for _, ev := range stateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
+	cli := &countingFedClient{txnFedClient: &txnFedClient{
+		state: map[string]gomatrixserverlib.RespState{
+			inputEvent.EventID(): {
+				AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+				StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateEvents),
+			},
+		},
+		stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+			inputEvent.EventID(): {
+				StateEventIDs: stateEventIDs[:3],
+				AuthEventIDs:  stateEventIDs[3:],
+			},
+		},
+	}}
+	// The roomserver has none of the events, so fetching them would fail.
+	rsAPI := &testRoomserverAPI{
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			t.Errorf("unexpected QueryEventsByID for %v", req.EventIDs)
+			return api.QueryEventsByIDResponse{QueryEventsByIDRequest: *req}
+		},
+	}
+	txn := mustCreateTransaction(rsAPI, cli, nil)
+	txn.maxStateIDsEvents = len(stateEventIDs) - 1
+
+	_, _, err := txn.lookupMissingStateViaStateIDs(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+	if _, ok := err.(tooManyStateIDsError); !ok {
+		t.Errorf("expected tooManyStateIDsError, got %v", err)
+	}
+
+	respState, haveEventIDs, err := txn.lookupStateBeforeEvent(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+	if err != nil {
+		t.Fatalf("lookupStateBeforeEvent returned %s", err)
+	}
+	if haveEventIDs != nil {
+		t.Errorf("expected the state to be fetched using /state")
+	}
+	if len(respState.StateEvents) != len(stateEvents) {
+		t.Errorf("got %d state events, want %d", len(respState.StateEvents), len(stateEvents))
+	}
+	if cli.stateIDsCalls != 2 || cli.stateCalls != 1 {
+		t.Errorf("got %d /state_ids and %d /state requests, want 2 and 1", cli.stateIDsCalls, cli.stateCalls)
+	}
+}
+
+// The purpose of this test is to check that a knock from a remote user is rejected by the auth checks, even in a room
+// whose join rule is "knock", as none of the room versions that we support allow knocking. A join by the same user
+// into the public test room is checked too, to show that the knock isn't rejected for some unrelated reason.
+func TestProcessEventKnock(t *testing.T) {
+	mustMemberEvent := func(membership string) gomatrixserverlib.Event {
+		eventJSON := fmt.Sprintf(`{"auth_events":[],"content":{"membership":%q},"depth":5,"event_id":"$%s:novigrad","hashes":{"sha256":""},"origin":"novigrad","origin_server_ts":0,"prev_events":[["$6F1yGIbO0J7TM93h:kaer.morhen",{"sha256":""}]],"room_id":"!roomid:kaer.morhen","sender":"@geralt:novigrad","signatures":{},"state_key":"@geralt:novigrad","type":"m.room.member"}`, membership, membership)
+		e, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to create %s event: %s", membership, err)
+		}
+		return e
+	}
+	knockJoinRules, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"join_rule":"knock"},"depth":4,"event_id":"$knockrules:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"state_key":"","type":"m.room.join_rules"}`), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create join rules event: %s", err)
+	}
+
+	testCases := []struct {
+		name      string
+		event     gomatrixserverlib.Event
+		knockable bool
+		wantErr   bool
+	}{
+		{"knock into a knockable room", mustMemberEvent("knock"), true, true},
+		{"knock into a public room", mustMemberEvent("knock"), false, true},
+		{"join into a public room", mustMemberEvent("join"), false, false},
+	}
+	for _, tc := range testCases {
+		var joinRules *gomatrixserverlib.HeaderedEvent
+		if tc.knockable {
+			h := knockJoinRules.Headered(testRoomVersion)
+			joinRules = &h
+		}
+		rsAPI := &testRoomserverAPI{
+			queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+				res := api.QueryStateAfterEventsResponse{
+					PrevEventsExist: true,
+					RoomExists:      true,
+				}
+				for _, ev := range fromStateTuples(req.StateToFetch, nil) {
+					if joinRules != nil && ev.Type() == gomatrixserverlib.MRoomJoinRules {
+						continue
+					}
+					res.StateEvents = append(res.StateEvents, ev)
+				}
+				if joinRules != nil {
+					res.StateEvents = append(res.StateEvents, *joinRules)
+				}
+				return res
+			},
+		}
+		txn := mustCreateTransaction(rsAPI, &txnFedClient{}, nil)
+		err := txn.processEvent(context.Background(), tc.event, nil)
+		if !tc.wantErr {
+			if err != nil {
+				t.Errorf("%s: processEvent returned %s", tc.name, err)
+			}
+			continue
+		}
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok {
+			t.Errorf("%s: expected *gomatrixserverlib.NotAllowed, got %v", tc.name, err)
+		}
+		if len(rsAPI.inputRoomEvents) != 0 {
+			t.Errorf("%s: expected no events to be sent to the roomserver, got %d", tc.name, len(rsAPI.inputRoomEvents))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// mRoomServerACL is the type of the state event which controls which servers
+// may participate in a room.
+const mRoomServerACL = "m.room.server_acl"
+
+// serverACL is a parsed m.room.server_acl event.
+//
+// See https://matrix.org/docs/spec/client_server/r0.6.1#m-room-server-acl
+type serverACL struct {
+	allowIPLiterals bool
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+}
+
+// serverACLDeniedError is returned when an event was sent by a server which
+// is denied by the server ACL of the room.
+type serverACLDeniedError struct {
+	roomID string
+	origin gomatrixserverlib.ServerName
+}
+
+func (e serverACLDeniedError) Error() string {
+	return fmt.Sprintf("server %q is denied by the server ACL of room %q", e.origin, e.roomID)
+}
+
+// newServerACL parses the content of an m.room.server_acl event. Like other
+// servers we are lenient about the content: an allow or deny that isn't a list
+// is treated as empty, entries that aren't strings are skipped, and an
+// allow_ip_literals that isn't a boolean is treated as the default of true.
+func newServerACL(content []byte) (*serverACL, error) {
+	var fields struct {
+		AllowIPLiterals json.RawMessage `json:"allow_ip_literals"`
+		Allow           json.RawMessage `json:"allow"`
+		Deny            json.RawMessage `json:"deny"`
+	}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	acl := &serverACL{allowIPLiterals: true}
+	var allowIPLiterals bool
+	if err := json.Unmarshal(fields.AllowIPLiterals, &allowIPLiterals); err == nil {
+		acl.allowIPLiterals = allowIPLiterals
+	}
+	acl.allow = serverACLGlobs(fields.Allow)
+	acl.deny = serverACLGlobs(fields.Deny)
+	return acl, nil
+}
+
+// serverACLGlobs compiles the string entries of a JSON list of globs.
+func serverACLGlobs(list json.RawMessage) []*regexp.Regexp {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(list, &entries); err != nil {
+		return nil
+	}
+	globs := make([]*regexp.Regexp, 0, len(entries))
+	for _, entry := range entries {
+		var glob string
+		if err := json.Unmarshal(entry, &glob); err != nil {
+			continue
+		}
+		globs = append(globs, compileServerACLGlob(glob))
+	}
+	return globs
+}
+
+// compileServerACLGlob converts a glob, in which "*" matches zero or more
+// characters and "?" matches exactly one, into a regular expression which
+// matches the whole of a server name case-insensitively.
+func compileServerACLGlob(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?is)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
+
+// allowed returns true if the ACL allows the given server to participate in
+// the room. The port is ignored, IP literals are denied unless the ACL allows
+// them, and otherwise the server is denied if it matches any of the deny
+// globs or if it doesn't match any of the allow globs.
+func (acl *serverACL) allowed(serverName gomatrixserverlib.ServerName) bool {
+	host, _, _ := gomatrixserverlib.ParseAndValidateServerName(serverName)
+	if host == "" {
+		return false
+	}
+	if !acl.allowIPLiterals && (strings.HasPrefix(host, "[") || net.ParseIP(host) != nil) {
+		return false
+	}
+	for _, glob := range acl.deny {
+		if glob.MatchString(host) {
+			return false
+		}
+	}
+	for _, glob := range acl.allow {
+		if glob.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServerACL returns a serverACLDeniedError if the origin of the
+// transaction is denied by the current server ACL of the room. Rooms without
+// a server ACL, and rooms that we don't know about, allow every server. The
+// ACL is only looked up once per room for each transaction.
+func (t *txnReq) checkServerACL(ctx context.Context, roomID string) error {
+	acl, ok := t.serverACLs[roomID]
+	if !ok {
+		var err error
+		if acl, err = t.queryServerACL(ctx, roomID); err != nil {
+			return err
+		}
+		if t.serverACLs == nil {
+			t.serverACLs = make(map[string]*serverACL)
+		}
+		t.serverACLs[roomID] = acl
+	}
+	if acl != nil && !acl.allowed(t.Origin) {
+		return serverACLDeniedError{roomID, t.Origin}
+	}
+	return nil
+}
+
+// queryServerACL asks the roomserver for the current server ACL of the room.
+// Returns nil if the room doesn't have one.
+func (t *txnReq) queryServerACL(ctx context.Context, roomID string) (*serverACL, error) {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: mRoomServerACL, StateKey: ""},
+		},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := t.rsAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	for _, ev := range res.StateEvents {
+		if ev.Type() != mRoomServerACL || ev.StateKey() == nil || *ev.StateKey() != "" {
+			continue
+		}
+		acl, err := newServerACL(ev.Content())
+		if err != nil {
+			// The content isn't a JSON object so there is nothing that we
+			// can enforce. Don't fail every event for the room because of it.
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Warn("Ignoring invalid server ACL")
+			return nil, nil
+		}
+		return acl, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,119 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// mustServerACLEvent returns an m.room.server_acl event in the test room with the given content.
+func mustServerACLEvent(t *testing.T, content string) gomatrixserverlib.HeaderedEvent {
+	eventJSON := fmt.Sprintf(`{"auth_events":[],"content":%s,"depth":8,"event_id":"$acl:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"state_key":"","type":"m.room.server_acl"}`, content)
+	e, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to create server ACL event: %s", err)
+	}
+	return e.Headered(testRoomVersion)
+}
+
+// serverACLRoomserverAPI returns a roomserver which has the state for the test room, with the given server ACL as its
+// current state.
+func serverACLRoomserverAPI(acl gomatrixserverlib.HeaderedEvent) *testRoomserverAPI {
+	rsAPI := basicStateRoomserverAPI()
+	rsAPI.queryLatestEventsAndState = func(req *api.QueryLatestEventsAndStateRequest) api.QueryLatestEventsAndStateResponse {
+		return api.QueryLatestEventsAndStateResponse{
+			QueryLatestEventsAndStateRequest: *req,
+			RoomExists:                       true,
+			RoomVersion:                      testRoomVersion,
+			StateEvents:                      []gomatrixserverlib.HeaderedEvent{acl},
+		}
+	}
+	return rsAPI
+}
+
+// The purpose of this test is to check that an event from a server which is allowed by the server ACL of the room is
+// passed on to the roomserver.
+func TestTransactionServerACLAllowed(t *testing.T) {
+	rsAPI := serverACLRoomserverAPI(mustServerACLEvent(t, `{"allow":["kaer.*"],"deny":["evil.example.com"]}`))
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	mustProcessTransaction(t, txn, nil)
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+}
+
+// The purpose of this test is to check that an event from a server which is denied by the server ACL of the room is
+// skipped with an M_FORBIDDEN error, without failing the rest of the transaction.
+func TestTransactionServerACLDenied(t *testing.T) {
+	rsAPI := serverACLRoomserverAPI(mustServerACLEvent(t, `{"allow":["*"],"deny":["*.MORHEN"]}`))
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	res, err := txn.processTransaction()
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %s", err)
+	}
+	result := res.PDUs[testEvents[len(testEvents)-1].EventID()]
+	if !strings.HasPrefix(result.Error, pduErrorForbidden+": ") {
+		t.Errorf("expected an %s error for the event, got %q", pduErrorForbidden, result.Error)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that servers named by an IP literal are denied when the server ACL of the
+// room doesn't allow IP literals, even if they match the allow list.
+func TestTransactionServerACLIPLiterals(t *testing.T) {
+	rsAPI := serverACLRoomserverAPI(mustServerACLEvent(t, `{"allow":["*"],"allow_ip_literals":false}`))
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.Origin = "1.2.3.4:8448"
+	mustProcessTransaction(t, txn, []string{testEvents[len(testEvents)-1].EventID()})
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+func TestServerACLAllowed(t *testing.T) {
+	testCases := []struct {
+		Content string
+		Server  gomatrixserverlib.ServerName
+		Want    bool
+	}{
+		// Servers must match an allow glob.
+		{`{"allow":["kaer.morhen"]}`, "kaer.morhen", true},
+		{`{"allow":["kaer.morhen"]}`, "white.orchard", false},
+		{`{}`, "kaer.morhen", false},
+		// Deny globs take precedence over allow globs.
+		{`{"allow":["*"],"deny":["kaer.morhen"]}`, "kaer.morhen", false},
+		{`{"allow":["*"],"deny":["kaer.morhen"]}`, "white.orchard", true},
+		// Globs match the whole name, case-insensitively, ignoring the port.
+		{`{"allow":["*.morhen"]}`, "KAER.MORHEN:8448", true},
+		{`{"allow":["*.morhen"]}`, "kaer.morhen.example.com", false},
+		{`{"allow":["kaer.morhe?"]}`, "kaer.morhen", true},
+		{`{"allow":["kaer.morhe?"]}`, "kaer.morhe", false},
+		{`{"allow":["kaer.morhen"]}`, "kaerXmorhen", false},
+		// IP literals are allowed by default.
+		{`{"allow":["*"]}`, "1.2.3.4", true},
+		{`{"allow":["*"]}`, "[::1]:8448", true},
+		{`{"allow":["*"],"allow_ip_literals":false}`, "1.2.3.4", false},
+		{`{"allow":["*"],"allow_ip_literals":false}`, "[::1]:8448", false},
+		{`{"allow":["*"],"allow_ip_literals":false}`, "kaer.morhen", true},
+		// Invalid fields are treated leniently.
+		{`{"allow":["*"],"allow_ip_literals":"no"}`, "1.2.3.4", true},
+		{`{"allow":"*"}`, "kaer.morhen", false},
+		{`{"allow":[1,"kaer.morhen"]}`, "kaer.morhen", true},
+		{`{"allow":["*"],"deny":{"kaer.morhen":true}}`, "kaer.morhen", true},
+	}
+	for _, tc := range testCases {
+		acl, err := newServerACL([]byte(tc.Content))
+		if err != nil {
+			t.Fatalf("newServerACL(%s) returned %s", tc.Content, err)
+		}
+		if got := acl.allowed(tc.Server); got != tc.Want {
+			t.Errorf("server ACL %s allowed %q: got %v want %v", tc.Content, tc.Server, got, tc.Want)
+		}
+	}
+}
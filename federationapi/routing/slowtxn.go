@@ -0,0 +1,191 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// txnTimings adds up the time that a transaction spends waiting for other
+// servers and for the roomserver, so that slow transactions can say where
+// their time went. Events are processed concurrently, so the totals may add
+// up to more than the duration of the transaction.
+type txnTimings struct {
+	federation int64 // nanoseconds, accessed atomically
+	roomserver int64 // nanoseconds, accessed atomically
+}
+
+func (t *txnTimings) addFederation(start time.Time) {
+	atomic.AddInt64(&t.federation, int64(time.Since(start)))
+}
+
+func (t *txnTimings) addRoomserver(start time.Time) {
+	atomic.AddInt64(&t.roomserver, int64(time.Since(start)))
+}
+
+// trackSlowTransaction times the requests that the transaction makes to other
+// servers and to the roomserver. The returned function logs a warning with
+// those timings if the transaction took longer than the slow transaction
+// threshold, and should be called once the transaction has been processed.
+// Nothing is timed if there is no threshold.
+func (t *txnReq) trackSlowTransaction() func() {
+	if t.slowTransactionThreshold <= 0 {
+		return func() {}
+	}
+	timings := &txnTimings{}
+	t.federation = &timedFederationClient{t.federation, timings}
+	t.rsAPI = &timedRoomserverAPI{t.rsAPI, timings}
+	t.producer = &timedRoomserverProducer{t.producer, timings}
+	start := time.Now()
+	return func() {
+		duration := time.Since(start)
+		if duration < t.slowTransactionThreshold {
+			return
+		}
+		util.GetLogger(t.context).WithFields(logrus.Fields{
+			"transaction_id": t.TransactionID,
+			"origin":         t.Origin,
+			"pdus":           len(t.PDUs),
+			"edus":           len(t.EDUs),
+			"duration":       duration,
+			"federation":     time.Duration(atomic.LoadInt64(&timings.federation)),
+			"roomserver":     time.Duration(atomic.LoadInt64(&timings.roomserver)),
+		}).Warn("Slow transaction")
+	}
+}
+
+// timedFederationClient is a txnFederationClient which adds the time spent in
+// each request to the transaction's timings.
+type timedFederationClient struct {
+	txnFederationClient
+	timings *txnTimings
+}
+
+func (c *timedFederationClient) LookupState(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespState, error) {
+	defer c.timings.addFederation(time.Now())
+	return c.txnFederationClient.LookupState(ctx, s, roomID, eventID, roomVersion)
+}
+
+func (c *timedFederationClient) LookupStateIDs(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, eventID string,
+) (gomatrixserverlib.RespStateIDs, error) {
+	defer c.timings.addFederation(time.Now())
+	return c.txnFederationClient.LookupStateIDs(ctx, s, roomID, eventID)
+}
+
+func (c *timedFederationClient) GetEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	defer c.timings.addFederation(time.Now())
+	return c.txnFederationClient.GetEvent(ctx, s, eventID)
+}
+
+func (c *timedFederationClient) LookupMissingEvents(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.RespMissingEvents, error) {
+	defer c.timings.addFederation(time.Now())
+	return c.txnFederationClient.LookupMissingEvents(ctx, s, roomID, missing, roomVersion)
+}
+
+// timedRoomserverAPI is a RoomserverInternalAPI which adds the time spent in
+// each of the queries made while processing a transaction to its timings.
+type timedRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	timings *txnTimings
+}
+
+func (a *timedRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryLatestEventsAndState(ctx, req, res)
+}
+
+func (a *timedRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryStateAfterEvents(ctx, req, res)
+}
+
+func (a *timedRoomserverAPI) QueryStateAfterEventsBatch(
+	ctx context.Context, req *api.QueryStateAfterEventsBatchRequest, res *api.QueryStateAfterEventsBatchResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryStateAfterEventsBatch(ctx, req, res)
+}
+
+func (a *timedRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryEventsByID(ctx, req, res)
+}
+
+func (a *timedRoomserverAPI) QueryEventsExistByID(
+	ctx context.Context, req *api.QueryEventsExistByIDRequest, res *api.QueryEventsExistByIDResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryEventsExistByID(ctx, req, res)
+}
+
+func (a *timedRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	defer a.timings.addRoomserver(time.Now())
+	return a.RoomserverInternalAPI.QueryRoomVersionForRoom(ctx, req, res)
+}
+
+// timedRoomserverProducer is a txnRoomserverProducer which adds the time spent
+// sending events to the roomserver to the transaction's timings.
+type timedRoomserverProducer struct {
+	txnRoomserverProducer
+	timings *txnTimings
+}
+
+func (p *timedRoomserverProducer) SendEvents(
+	ctx context.Context, events []gomatrixserverlib.HeaderedEvent, sendAsServer gomatrixserverlib.ServerName,
+	txnID *api.TransactionID, origin gomatrixserverlib.ServerName,
+) (string, error) {
+	defer p.timings.addRoomserver(time.Now())
+	return p.txnRoomserverProducer.SendEvents(ctx, events, sendAsServer, txnID, origin)
+}
+
+func (p *timedRoomserverProducer) SendEventWithState(
+	ctx context.Context, state *gomatrixserverlib.RespState, event gomatrixserverlib.HeaderedEvent, haveEventIDs map[string]bool,
+	origin gomatrixserverlib.ServerName, historical bool,
+) error {
+	defer p.timings.addRoomserver(time.Now())
+	return p.txnRoomserverProducer.SendEventWithState(ctx, state, event, haveEventIDs, origin, historical)
+}
+
+func (p *timedRoomserverProducer) SendInputRoomEvents(ctx context.Context, ires []api.InputRoomEvent) (string, error) {
+	defer p.timings.addRoomserver(time.Now())
+	return p.txnRoomserverProducer.SendInputRoomEvents(ctx, ires)
+}
+
+func (p *timedRoomserverProducer) SendRejectedEvents(ctx context.Context, rejected []api.InputRejectedEvent) error {
+	defer p.timings.addRoomserver(time.Now())
+	return p.txnRoomserverProducer.SendRejectedEvents(ctx, rejected)
+}
@@ -0,0 +1,80 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// slowRoomserverAPI is a testRoomserverAPI whose room version queries take a while, as if the roomserver was busy.
+type slowRoomserverAPI struct {
+	*testRoomserverAPI
+	delay time.Duration
+}
+
+func (a *slowRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	time.Sleep(a.delay)
+	return a.testRoomserverAPI.QueryRoomVersionForRoom(ctx, req, res)
+}
+
+// The purpose of this test is to check that a transaction which takes longer than the slow transaction threshold is
+// logged once with its details and the time spent waiting for the roomserver, and that faster transactions aren't.
+func TestSlowTransactionIsLogged(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	rsAPI := &slowRoomserverAPI{basicStateRoomserverAPI(), 20 * time.Millisecond}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{
+		testData[len(testData)-1], // a message event
+	})
+	txn.slowTransactionThreshold = 10 * time.Millisecond
+	mustProcessTransaction(t, txn, nil)
+
+	var entries []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Slow transaction" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 slow transaction warning, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != logrus.WarnLevel {
+		t.Errorf("wrong level: got %s want %s", entry.Level, logrus.WarnLevel)
+	}
+	if entry.Data["transaction_id"] != txn.TransactionID || entry.Data["origin"] != testOrigin {
+		t.Errorf("wrong transaction in warning: %v", entry.Data)
+	}
+	if entry.Data["pdus"] != 1 || entry.Data["edus"] != 0 {
+		t.Errorf("wrong counts in warning: got %v PDUs and %v EDUs", entry.Data["pdus"], entry.Data["edus"])
+	}
+	if duration, _ := entry.Data["duration"].(time.Duration); duration < 20*time.Millisecond {
+		t.Errorf("duration too short: got %v", entry.Data["duration"])
+	}
+	if roomserver, _ := entry.Data["roomserver"].(time.Duration); roomserver < 20*time.Millisecond {
+		t.Errorf("roomserver time too short: got %v", entry.Data["roomserver"])
+	}
+	if entry.Data["federation"] != time.Duration(0) {
+		t.Errorf("expected no time waiting for other servers, got %v", entry.Data["federation"])
+	}
+
+	// The same transaction is quick enough with a higher threshold.
+	hook.Reset()
+	rsAPI = &slowRoomserverAPI{basicStateRoomserverAPI(), 20 * time.Millisecond}
+	txn = mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{testData[len(testData)-1]})
+	txn.slowTransactionThreshold = time.Hour
+	mustProcessTransaction(t, txn, nil)
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Slow transaction" {
+			t.Errorf("unexpected slow transaction warning: %v", entry.Data)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// stateLookups coalesces concurrent lookups of the state before the same
+// event, across all of the transactions that are being processed. Looking up
+// the state takes several requests to the sender and queries to the
+// roomserver, and a burst of transactions often needs the state before the
+// same event, so only the first lookup is made and the others share its
+// result.
+//
+// The fetchLimiter already coalesces identical requests to other servers,
+// but that only covers a single request, not the whole lookup.
+type stateLookups struct {
+	mutex    sync.Mutex
+	inFlight map[stateLookupKey]*stateLookup
+}
+
+type stateLookupKey struct {
+	roomID  string
+	eventID string
+}
+
+// stateLookup is a lookup which is in flight. done is closed once the result
+// has been set. The result is shared between everyone who was waiting for it,
+// so it must not be modified.
+type stateLookup struct {
+	done         chan struct{}
+	respState    *gomatrixserverlib.RespState
+	haveEventIDs map[string]bool
+	err          error
+}
+
+func newStateLookups() *stateLookups {
+	return &stateLookups{inFlight: make(map[stateLookupKey]*stateLookup)}
+}
+
+// do looks up the state before the event by calling fn, unless a lookup for
+// the same event is already in flight, in which case it waits for the result
+// of that lookup instead. If l is nil then fn is always called.
+//
+// The lookup is made with the context of whoever started it. If that context
+// is cancelled, e.g. because its transaction timed out, then the others who
+// were waiting for it try again, making the lookup themselves if nobody else
+// has started one by then, rather than failing with an error which isn't
+// their own.
+func (l *stateLookups) do(
+	ctx context.Context, roomID, eventID string,
+	fn func() (*gomatrixserverlib.RespState, map[string]bool, error),
+) (*gomatrixserverlib.RespState, map[string]bool, error) {
+	if l == nil {
+		return fn()
+	}
+	key := stateLookupKey{roomID, eventID}
+	l.mutex.Lock()
+	for {
+		lookup, ok := l.inFlight[key]
+		if !ok {
+			break
+		}
+		l.mutex.Unlock()
+		select {
+		case <-lookup.done:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if !isContextError(lookup.err) || ctx.Err() != nil {
+			return lookup.respState, lookup.haveEventIDs, lookup.err
+		}
+		l.mutex.Lock()
+	}
+	lookup := &stateLookup{done: make(chan struct{})}
+	l.inFlight[key] = lookup
+	l.mutex.Unlock()
+
+	lookup.respState, lookup.haveEventIDs, lookup.err = fn()
+
+	l.mutex.Lock()
+	delete(l.inFlight, key)
+	l.mutex.Unlock()
+	close(lookup.done)
+	return lookup.respState, lookup.haveEventIDs, lookup.err
+}
+
+// isContextError returns true if err is, or wraps, the error of a context
+// which was cancelled or which timed out.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,122 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that when two transactions look up the state before the same event at the same
+// time, the state is only fetched from the sender once and both transactions get it.
+func TestStateLookupsCoalesced(t *testing.T) {
+	inputEvent := testEvents[len(testEvents)-1]
+	// first 5 events are the state events, in auth event order.
+	stateEvents := testEvents[:5]
+	var stateEventIDs []string
+	for _, ev := range stateEvents {
+		stateEventIDs = append(stateEventIDs, ev.EventID())
+	}
+	rsAPI := &testRoomserverAPI{
+		// The roomserver has all of the state, so /state_ids doesn't need /event.
+		queryEventsByID: func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+			var res api.QueryEventsByIDResponse
+			for _, wantEventID := range req.EventIDs {
+				for _, ev := range stateEvents {
+					if ev.EventID() == wantEventID {
+						res.Events = append(res.Events, ev)
+					}
+				}
+			}
+			res.QueryEventsByIDRequest = *req
+			return res
+		},
+	}
+	counter := &concurrencyCountingFedClient{txnFederationClient: &txnFedClient{
+		stateIDs: map[string]gomatrixserverlib.RespStateIDs{
+			inputEvent.EventID(): {
+				StateEventIDs: stateEventIDs,
+				AuthEventIDs:  stateEventIDs,
+			},
+		},
+	}}
+	lookups := newStateLookups()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		txn := mustCreateTransaction(rsAPI, counter, nil)
+		txn.stateLookups = lookups
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			respState, _, err := txn.lookupStateBeforeEvent(context.Background(), inputEvent.Unwrap(), testRoomVersion)
+			if err != nil {
+				t.Errorf("lookupStateBeforeEvent returned an error: %s", err)
+				return
+			}
+			if len(respState.StateEvents) != len(stateEvents) {
+				t.Errorf("wrong number of state events: got %d want %d", len(respState.StateEvents), len(stateEvents))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter.calls != 1 {
+		t.Errorf("expected concurrent lookups to be coalesced into 1 request, got %d", counter.calls)
+	}
+
+	// Once the lookup has finished, the next one fetches the state again.
+	txn := mustCreateTransaction(rsAPI, counter, nil)
+	txn.stateLookups = lookups
+	if _, _, err := txn.lookupStateBeforeEvent(context.Background(), inputEvent.Unwrap(), testRoomVersion); err != nil {
+		t.Fatalf("lookupStateBeforeEvent returned an error: %s", err)
+	}
+	if counter.calls != 2 {
+		t.Errorf("expected a new request once the first lookup had finished, got %d requests", counter.calls)
+	}
+}
+
+// The purpose of this test is to check that when the transaction which started a lookup times out, a transaction which
+// was waiting for the same lookup makes the lookup itself rather than failing with the other transaction's error.
+func TestStateLookupsWaiterRetriesAfterLeaderCancelled(t *testing.T) {
+	lookups := newStateLookups()
+	release := make(chan struct{})
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, _, err := lookups.do(context.Background(), "!room:kaer.morhen", "$event:kaer.morhen", func() (*gomatrixserverlib.RespState, map[string]bool, error) {
+			<-release
+			return nil, nil, fmt.Errorf("lookupMissingStateViaStateIDs: %w", context.DeadlineExceeded)
+		})
+		leaderErr <- err
+	}()
+	// Give the leader time to start its lookup, then start waiting for it.
+	time.Sleep(50 * time.Millisecond)
+	waiterCalls := 0
+	waiterErr := make(chan error, 1)
+	go func() {
+		respState, _, err := lookups.do(context.Background(), "!room:kaer.morhen", "$event:kaer.morhen", func() (*gomatrixserverlib.RespState, map[string]bool, error) {
+			waiterCalls++
+			return &gomatrixserverlib.RespState{}, nil, nil
+		})
+		if err == nil && respState == nil {
+			err = fmt.Errorf("no state returned")
+		}
+		waiterErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-leaderErr; err == nil {
+		t.Errorf("expected the leader to get its own error")
+	}
+	if err := <-waiterErr; err != nil {
+		t.Fatalf("expected the waiter to make the lookup itself, got error %s", err)
+	}
+	if waiterCalls != 1 {
+		t.Errorf("expected the waiter to make the lookup once, got %d", waiterCalls)
+	}
+}
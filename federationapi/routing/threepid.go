@@ -92,7 +92,7 @@ func CreateInvitesFrom3PIDInvites(
 	}
 
 	// Send all the events
-	if _, err := producer.SendEvents(req.Context(), evs, cfg.Matrix.ServerName, nil); err != nil {
+	if _, err := producer.SendEvents(req.Context(), evs, cfg.Matrix.ServerName, nil, ""); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -183,6 +183,7 @@ func ExchangeThirdPartyInvite(
 		},
 		cfg.Matrix.ServerName,
 		nil,
+		request.Origin(),
 	); err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
 		return jsonerror.InternalServerError()
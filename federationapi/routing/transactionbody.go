@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// maxTransactionPDUs is the most PDUs that a transaction may contain.
+	// https://matrix.org/docs/spec/server_server/latest#transactions
+	maxTransactionPDUs = 50
+	// maxTransactionEDUs is the most EDUs that a transaction may contain.
+	maxTransactionEDUs = 100
+)
+
+// transactionBody is the content of a /send request.
+type transactionBody struct {
+	PDUs []json.RawMessage
+	EDUs []gomatrixserverlib.EDU
+}
+
+// tooManyInTransactionError is returned when a transaction contains more PDUs
+// or EDUs than it is allowed to.
+type tooManyInTransactionError struct {
+	kind string
+	max  int
+}
+
+func (e tooManyInTransactionError) Error() string {
+	return fmt.Sprintf("transaction contains more than the maximum of %d %s", e.max, e.kind)
+}
+
+// decodeTransaction parses the PDUs and EDUs out of the content of a /send
+// request one at a time. A transaction with too many PDUs or EDUs is rejected
+// as soon as the limit is passed, without parsing or allocating space for the
+// rest of it. Keys other than "pdus" and "edus" are skipped over.
+func decodeTransaction(content []byte) (*transactionBody, error) {
+	var body transactionBody
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case "pdus":
+			body.PDUs = nil
+			err = decodeArray(dec, "PDUs", maxTransactionPDUs, func() error {
+				var pdu json.RawMessage
+				if err := dec.Decode(&pdu); err != nil {
+					return err
+				}
+				body.PDUs = append(body.PDUs, pdu)
+				return nil
+			})
+		case "edus":
+			body.EDUs = nil
+			err = decodeArray(dec, "EDUs", maxTransactionEDUs, func() error {
+				var edu gomatrixserverlib.EDU
+				if err := dec.Decode(&edu); err != nil {
+					return err
+				}
+				body.EDUs = append(body.EDUs, edu)
+				return nil
+			})
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the end of the transaction")
+	}
+	return &body, nil
+}
+
+// decodeArray calls decodeElement for each element of the JSON array which is
+// next in the decoder, failing if there are more than max elements. A null is
+// treated as an empty array, as it would be by json.Unmarshal.
+func decodeArray(dec *json.Decoder, kind string, max int, decodeElement func() error) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected %s to be an array", kind)
+	}
+	for count := 0; dec.More(); count++ {
+		if count == max {
+			return tooManyInTransactionError{kind, max}
+		}
+		if err = decodeElement(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token from the decoder, failing if it isn't the
+// given delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %q but got %v", delim, token)
+	}
+	return nil
+}
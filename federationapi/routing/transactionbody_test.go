@@ -0,0 +1,127 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// makeTransactionContent returns the content of a transaction with the given number of PDUs and EDUs.
+func makeTransactionContent(pdus, edus int) []byte {
+	var b strings.Builder
+	b.WriteString(`{"origin":"kaer.morhen","origin_server_ts":1234567890,"pdus":[`)
+	for i := 0; i < pdus; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"room_id":"!room:kaer.morhen","type":"m.room.message","content":{"body":"message %d"}}`, i)
+	}
+	b.WriteString(`],"edus":[`)
+	for i := 0; i < edus; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"edu_type":"m.typing","content":{"room_id":"!room:kaer.morhen","user_id":"@user%d:kaer.morhen","typing":true}}`, i)
+	}
+	b.WriteString(`]}`)
+	return []byte(b.String())
+}
+
+// The purpose of this test is to check that a transaction with as many PDUs and EDUs as it is allowed is parsed the
+// same way as by json.Unmarshal.
+func TestDecodeTransactionLarge(t *testing.T) {
+	content := makeTransactionContent(maxTransactionPDUs, maxTransactionEDUs)
+	body, err := decodeTransaction(content)
+	if err != nil {
+		t.Fatalf("decodeTransaction failed: %s", err)
+	}
+	var want struct {
+		PDUs []json.RawMessage       `json:"pdus"`
+		EDUs []gomatrixserverlib.EDU `json:"edus"`
+	}
+	if err = json.Unmarshal(content, &want); err != nil {
+		t.Fatalf("json.Unmarshal failed: %s", err)
+	}
+	if len(body.PDUs) != maxTransactionPDUs || len(body.EDUs) != maxTransactionEDUs {
+		t.Fatalf("got %d PDUs and %d EDUs, want %d and %d", len(body.PDUs), len(body.EDUs), maxTransactionPDUs, maxTransactionEDUs)
+	}
+	if !reflect.DeepEqual(body.PDUs, want.PDUs) {
+		t.Errorf("PDUs don't match those parsed by json.Unmarshal")
+	}
+	if !reflect.DeepEqual(body.EDUs, want.EDUs) {
+		t.Errorf("EDUs don't match those parsed by json.Unmarshal")
+	}
+}
+
+// The purpose of this test is to check that transactions with too many PDUs or EDUs are rejected, and that content
+// which isn't a valid transaction is rejected without being mistaken for one with too many.
+func TestDecodeTransactionRejected(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content []byte
+		tooMany bool
+	}{
+		{"too many PDUs", makeTransactionContent(maxTransactionPDUs+1, 0), true},
+		{"too many EDUs", makeTransactionContent(0, maxTransactionEDUs+1), true},
+		{"empty content", nil, false},
+		{"not an object", []byte(`[]`), false},
+		{"pdus is not an array", []byte(`{"pdus":{}}`), false},
+		{"truncated", makeTransactionContent(2, 0)[:40], false},
+		{"trailing data", []byte(`{"pdus":[]} {}`), false},
+	}
+	for _, tc := range testCases {
+		_, err := decodeTransaction(tc.content)
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if _, ok := err.(tooManyInTransactionError); ok != tc.tooMany {
+			t.Errorf("%s: got error %q, want tooManyInTransactionError %t", tc.name, err, tc.tooMany)
+		}
+	}
+
+	// A null is the same as an empty array, and other keys are ignored.
+	body, err := decodeTransaction([]byte(`{"pdus":null,"edus":[],"origin":"kaer.morhen"}`))
+	if err != nil {
+		t.Fatalf("decodeTransaction failed: %s", err)
+	}
+	if len(body.PDUs) != 0 || len(body.EDUs) != 0 {
+		t.Errorf("expected no PDUs or EDUs, got %d and %d", len(body.PDUs), len(body.EDUs))
+	}
+}
+
+// BenchmarkDecodeTransaction compares the allocations made by decodeTransaction with those made by the json.Unmarshal
+// that it replaced, for a transaction of the maximum size and for one which is far over it.
+func BenchmarkDecodeTransaction(b *testing.B) {
+	for _, size := range []struct {
+		name       string
+		pdus, edus int
+	}{
+		{"max", maxTransactionPDUs, maxTransactionEDUs},
+		{"oversized", 20 * maxTransactionPDUs, 0},
+	} {
+		content := makeTransactionContent(size.pdus, size.edus)
+		b.Run(size.name+"/Unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var body struct {
+					PDUs []json.RawMessage       `json:"pdus"`
+					EDUs []gomatrixserverlib.EDU `json:"edus"`
+				}
+				if err := json.Unmarshal(content, &body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(size.name+"/Decoder", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = decodeTransaction(content)
+			}
+		})
+	}
+}
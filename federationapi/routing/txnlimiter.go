@@ -0,0 +1,122 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// txnLimitRetryAfter is how long we ask remote servers to wait before
+// retrying a transaction that was rejected because we were too busy.
+const txnLimitRetryAfter = 5 * time.Second
+
+// txnLimiter bounds the number of incoming transactions that are processed at
+// the same time, both in total and for each origin server, so that a burst of
+// transactions can't exhaust our resources and a single server can't crowd
+// out all of the others.
+type txnLimiter struct {
+	mutex        sync.Mutex
+	maxGlobal    int
+	maxPerOrigin int
+	global       int
+	perOrigin    map[gomatrixserverlib.ServerName]int
+}
+
+// newTxnLimiter creates a txnLimiter. A limit of zero means that there is no
+// limit.
+func newTxnLimiter(maxGlobal, maxPerOrigin int) *txnLimiter {
+	return &txnLimiter{
+		maxGlobal:    maxGlobal,
+		maxPerOrigin: maxPerOrigin,
+		perOrigin:    make(map[gomatrixserverlib.ServerName]int),
+	}
+}
+
+// acquire reserves a processing slot for a transaction from the given origin.
+// If a slot was reserved then the returned function must be called to release
+// it once the transaction has been processed. Otherwise an error response is
+// returned: a 429 if the origin has too many transactions in flight, or a 503
+// if we are processing too many transactions overall. If l is nil then there
+// is no limit.
+func (l *txnLimiter) acquire(origin gomatrixserverlib.ServerName) (func(), *util.JSONResponse) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.maxPerOrigin > 0 && l.perOrigin[origin] >= l.maxPerOrigin {
+		return nil, &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded(
+				fmt.Sprintf("Too many concurrent transactions from %q", origin),
+				txnLimitRetryAfter.Nanoseconds()/int64(time.Millisecond),
+			),
+		}
+	}
+	if l.maxGlobal > 0 && l.global >= l.maxGlobal {
+		return nil, &util.JSONResponse{
+			Code:    http.StatusServiceUnavailable,
+			JSON:    jsonerror.Unknown("Too many concurrent transactions, try again later"),
+			Headers: map[string]string{"Retry-After": strconv.Itoa(int(txnLimitRetryAfter.Seconds()))},
+		}
+	}
+
+	l.global++
+	l.perOrigin[origin]++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.global--
+		l.perOrigin[origin]--
+		if l.perOrigin[origin] == 0 {
+			delete(l.perOrigin, origin)
+		}
+	}, nil
+}
+
+// ready returns false if we are already processing as many transactions as
+// the global limit allows, in which case any further transactions will be
+// rejected until one of them has finished.
+func (l *txnLimiter) ready() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.maxGlobal <= 0 || l.global < l.maxGlobal
+}
+
+// Readiness implements the federation API readiness check. It responds with a
+// 503 while the limiter is at capacity so that load balancers can send
+// transactions to other instances until we have caught up.
+func Readiness(l *txnLimiter) util.JSONResponse {
+	ready := l.ready()
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	return util.JSONResponse{
+		Code: code,
+		JSON: struct {
+			Ready bool `json:"ready"`
+		}{ready},
+	}
+}
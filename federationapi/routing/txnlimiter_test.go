@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that an origin which already has the maximum number of transactions in
+// flight is rejected with a 429, without affecting other origins, and that it is allowed again once one of its
+// transactions has finished.
+func TestTxnLimiterPerOriginCap(t *testing.T) {
+	limiter := newTxnLimiter(10, 2)
+	busy := gomatrixserverlib.ServerName("busy.server")
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, errRes := limiter.acquire(busy)
+		if errRes != nil {
+			t.Fatalf("acquire %d: unexpected rejection with status %d", i, errRes.Code)
+		}
+		releases = append(releases, release)
+	}
+
+	_, errRes := limiter.acquire(busy)
+	if errRes == nil {
+		t.Fatalf("expected transaction over the per-origin limit to be rejected")
+	}
+	if errRes.Code != http.StatusTooManyRequests {
+		t.Errorf("wrong status code: got %d want %d", errRes.Code, http.StatusTooManyRequests)
+	}
+
+	release, errRes := limiter.acquire(testOrigin)
+	if errRes != nil {
+		t.Fatalf("expected another origin to be allowed, got status %d", errRes.Code)
+	}
+	release()
+
+	releases[0]()
+	if _, errRes = limiter.acquire(busy); errRes != nil {
+		t.Errorf("expected origin to be allowed after releasing a slot, got status %d", errRes.Code)
+	}
+}
+
+// The purpose of this test is to check that once the global limit is reached, transactions from any origin are
+// rejected with a 503 and a Retry-After header.
+func TestTxnLimiterGlobalCap(t *testing.T) {
+	limiter := newTxnLimiter(2, 2)
+	for _, origin := range []gomatrixserverlib.ServerName{"a.server", "b.server"} {
+		if _, errRes := limiter.acquire(origin); errRes != nil {
+			t.Fatalf("unexpected rejection for %s with status %d", origin, errRes.Code)
+		}
+	}
+
+	_, errRes := limiter.acquire("c.server")
+	if errRes == nil {
+		t.Fatalf("expected transaction over the global limit to be rejected")
+	}
+	if errRes.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code: got %d want %d", errRes.Code, http.StatusServiceUnavailable)
+	}
+	if errRes.Headers["Retry-After"] == "" {
+		t.Errorf("expected a Retry-After header, got %v", errRes.Headers)
+	}
+}
+
+// The purpose of this test is to check that the readiness check fails while the limiter is saturated and recovers
+// once a transaction has finished.
+func TestTxnLimiterReadiness(t *testing.T) {
+	limiter := newTxnLimiter(2, 2)
+	if res := Readiness(limiter); res.Code != http.StatusOK {
+		t.Fatalf("expected an idle limiter to be ready, got status %d", res.Code)
+	}
+
+	var releases []func()
+	for _, origin := range []gomatrixserverlib.ServerName{"a.server", "b.server"} {
+		release, errRes := limiter.acquire(origin)
+		if errRes != nil {
+			t.Fatalf("unexpected rejection for %s with status %d", origin, errRes.Code)
+		}
+		releases = append(releases, release)
+		if origin == "a.server" && !limiter.ready() {
+			t.Errorf("expected the limiter to be ready below the global limit")
+		}
+	}
+	if res := Readiness(limiter); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a saturated limiter not to be ready, got status %d", res.Code)
+	}
+
+	releases[0]()
+	if res := Readiness(limiter); res.Code != http.StatusOK {
+		t.Errorf("expected the limiter to be ready after releasing a slot, got status %d", res.Code)
+	}
+
+	// Without a global limit we are always ready.
+	if !newTxnLimiter(0, 2).ready() {
+		t.Errorf("expected a limiter without a global limit to be ready")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// FederationAPIValidateEventPath is the HTTP path for the internal event
+// validation API.
+const FederationAPIValidateEventPath = "/api/federationapi/validateEvent"
+
+// ValidateEventRequest is a request to validate a single PDU.
+type ValidateEventRequest struct {
+	// The room version that the event should be parsed with.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The event JSON, as it would appear in a federation transaction.
+	Event json.RawMessage `json:"event"`
+}
+
+// ValidateEventResponse is the verdict for a validated PDU.
+type ValidateEventResponse struct {
+	EventID string `json:"event_id"`
+	// True if the signatures on the event were verified successfully.
+	SignaturesOK bool `json:"signatures_ok"`
+	// The reason that signature verification failed, if it did.
+	SignatureError string `json:"signature_error,omitempty"`
+	// True if the event is allowed by the state before the event.
+	Allowed bool `json:"allowed"`
+	// The auth rule that the event failed, or the reason that the auth
+	// checks could not be run, if the event is not allowed.
+	AuthError string `json:"auth_error,omitempty"`
+	// The auth_events of the event which the roomserver doesn't have.
+	MissingAuthEvents []string `json:"missing_auth_events"`
+	// The prev_events of the event which the roomserver doesn't have.
+	MissingPrevEvents []string `json:"missing_prev_events"`
+}
+
+// SetupValidateEventHTTP registers the internal event validation API with the
+// given ServeMux. The handler runs the same signature and auth checks as an
+// incoming transaction would, but never passes the event to the roomserver.
+func SetupValidateEventHTTP(
+	servMux *http.ServeMux,
+	rsAPI api.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+) {
+	servMux.Handle(FederationAPIValidateEventPath,
+		common.MakeInternalAPI("validateEvent", func(req *http.Request) util.JSONResponse {
+			var request ValidateEventRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+				}
+			}
+			response, err := validateEvent(req.Context(), rsAPI, keys, &request)
+			switch err.(type) {
+			case nil:
+				return util.JSONResponse{Code: http.StatusOK, JSON: response}
+			case unmarshalError:
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.BadJSON(err.Error()),
+				}
+			case roomNotFoundError:
+				return util.JSONResponse{
+					Code: http.StatusNotFound,
+					JSON: jsonerror.NotFound(err.Error()),
+				}
+			default:
+				util.GetLogger(req.Context()).WithError(err).Error("validateEvent failed")
+				return jsonerror.InternalServerError()
+			}
+		}),
+	)
+}
+
+// validateEvent checks the signatures of the event and whether it is allowed
+// by the state before it. It only ever queries the roomserver, so it has no
+// side effects.
+func validateEvent(
+	ctx context.Context,
+	rsAPI api.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	request *ValidateEventRequest,
+) (*ValidateEventResponse, error) {
+	e, err := parseUntrustedEvent(ctx, request.Event, request.RoomVersion)
+	if err != nil {
+		return nil, err
+	}
+	response := &ValidateEventResponse{
+		EventID:           e.EventID(),
+		MissingAuthEvents: []string{},
+		MissingPrevEvents: []string{},
+	}
+
+	if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []gomatrixserverlib.Event{e}, keys); err != nil {
+		response.SignatureError = err.Error()
+	} else {
+		response.SignaturesOK = true
+	}
+
+	if response.MissingAuthEvents, err = missingEvents(ctx, rsAPI, e.AuthEventIDs()); err != nil {
+		return nil, err
+	}
+	if response.MissingPrevEvents, err = missingEvents(ctx, rsAPI, e.PrevEventIDs()); err != nil {
+		return nil, err
+	}
+
+	needed := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{e})
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       e.RoomID(),
+		PrevEventIDs: e.PrevEventIDs(),
+		StateToFetch: needed.Tuples(),
+	}
+	var stateResp api.QueryStateAfterEventsResponse
+	if err = rsAPI.QueryStateAfterEvents(ctx, &stateReq, &stateResp); err != nil {
+		return nil, err
+	}
+	if !stateResp.RoomExists {
+		return nil, roomNotFoundError{e.RoomID()}
+	}
+	if !stateResp.PrevEventsExist {
+		// We would have to ask the sending server for the state in order to
+		// check the event, which isn't something we want to do here.
+		response.AuthError = "the state before the event is unknown as prev_events are missing"
+		return response, nil
+	}
+
+	var events []gomatrixserverlib.Event
+	for _, headeredEvent := range stateResp.StateEvents {
+		events = append(events, headeredEvent.Unwrap())
+	}
+	if err = checkAllowedByState(e, events); err != nil {
+		response.AuthError = err.Error()
+		return response, nil
+	}
+	response.Allowed = true
+	return response, nil
+}
+
+// missingEvents returns the subset of eventIDs which the roomserver doesn't
+// have a copy of.
+func missingEvents(
+	ctx context.Context,
+	rsAPI api.RoomserverInternalAPI,
+	eventIDs []string,
+) ([]string, error) {
+	missing := []string{}
+	if len(eventIDs) == 0 {
+		return missing, nil
+	}
+	var res api.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: eventIDs}, &res); err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(res.Events))
+	for _, ev := range res.Events {
+		have[ev.EventID()] = true
+	}
+	for _, eventID := range eventIDs {
+		if !have[eventID] {
+			missing = append(missing, eventID)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,172 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testFailingJSONVerifier struct {
+	// this verifier fails every request
+}
+
+func (t *testFailingJSONVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	result := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i := range result {
+		result[i].Error = errors.New("bad signature")
+	}
+	return result, nil
+}
+
+func mustValidateEvent(
+	t *testing.T, rsAPI api.RoomserverInternalAPI, keys gomatrixserverlib.JSONVerifier, pdu json.RawMessage,
+) *ValidateEventResponse {
+	res, err := validateEvent(context.Background(), rsAPI, keys, &ValidateEventRequest{
+		RoomVersion: testRoomVersion,
+		Event:       pdu,
+	})
+	if err != nil {
+		t.Fatalf("validateEvent returned an error: %s", err)
+	}
+	return res
+}
+
+// queryEventsByIDExcept returns a QueryEventsByID implementation which knows about all of the test events other than
+// those listed in omitEventIDs.
+func queryEventsByIDExcept(omitEventIDs ...string) func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+	return func(req *api.QueryEventsByIDRequest) api.QueryEventsByIDResponse {
+		var res api.QueryEventsByIDResponse
+	NextEventID:
+		for _, wantEventID := range req.EventIDs {
+			for _, omitEventID := range omitEventIDs {
+				if wantEventID == omitEventID {
+					continue NextEventID
+				}
+			}
+			for _, ev := range testEvents {
+				if ev.EventID() == wantEventID {
+					res.Events = append(res.Events, ev)
+				}
+			}
+		}
+		return res
+	}
+}
+
+// The purpose of this test is to check that a valid event is reported as such, and that validating it doesn't
+// send anything to the roomserver.
+func TestValidateEventAllowed(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				StateEvents:     fromStateTuples(req.StateToFetch, nil),
+			}
+		},
+		queryEventsByID: queryEventsByIDExcept(),
+	}
+	res := mustValidateEvent(t, rsAPI, &testNopJSONVerifier{}, testData[len(testData)-1])
+	if !res.SignaturesOK || !res.Allowed {
+		t.Errorf("expected event to be valid, got %+v", res)
+	}
+	if res.SignatureError != "" || res.AuthError != "" {
+		t.Errorf("expected no errors, got %+v", res)
+	}
+	if len(res.MissingAuthEvents) != 0 || len(res.MissingPrevEvents) != 0 {
+		t.Errorf("expected no missing events, got %+v", res)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that an event which fails auth checks against the state is reported as
+// not allowed, along with the reason, without sending anything to the roomserver.
+func TestValidateEventRejectedByState(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				// omit the create event so auth checks fail
+				StateEvents: fromStateTuples(req.StateToFetch, []gomatrixserverlib.StateKeyTuple{
+					{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+				}),
+			}
+		},
+		queryEventsByID: queryEventsByIDExcept(),
+	}
+	res := mustValidateEvent(t, rsAPI, &testNopJSONVerifier{}, testData[len(testData)-1])
+	if !res.SignaturesOK || res.SignatureError != "" {
+		t.Errorf("expected signatures to be valid, got %+v", res)
+	}
+	if res.Allowed {
+		t.Errorf("expected event to be rejected by state, got %+v", res)
+	}
+	if res.AuthError == "" {
+		t.Errorf("expected a reason for the rejection, got %+v", res)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that a failure to verify signatures doesn't hide the result of the auth
+// checks, so that both are reported.
+func TestValidateEventReportsSignatureAndAuthErrors(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: true,
+				RoomExists:      true,
+				// omit the create event so auth checks fail
+				StateEvents: fromStateTuples(req.StateToFetch, []gomatrixserverlib.StateKeyTuple{
+					{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+				}),
+			}
+		},
+		queryEventsByID: queryEventsByIDExcept(),
+	}
+	res := mustValidateEvent(t, rsAPI, &testFailingJSONVerifier{}, testData[len(testData)-1])
+	if res.SignaturesOK || res.SignatureError == "" {
+		t.Errorf("expected signatures to be rejected, got %+v", res)
+	}
+	if res.Allowed || res.AuthError == "" {
+		t.Errorf("expected event to be rejected by state, got %+v", res)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
+// The purpose of this test is to check that auth and prev events which the roomserver doesn't have are reported,
+// and that when the prev events are missing the event is not reported as allowed, as the state before it is
+// unknown.
+func TestValidateEventMissingEvents(t *testing.T) {
+	event := testEvents[len(testEvents)-1]
+	missingAuthEventID := event.AuthEventIDs()[0]
+	missingPrevEventIDs := event.PrevEventIDs()
+	rsAPI := &testRoomserverAPI{
+		queryStateAfterEvents: func(req *api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse {
+			return api.QueryStateAfterEventsResponse{
+				PrevEventsExist: false,
+				RoomExists:      true,
+			}
+		},
+		queryEventsByID: queryEventsByIDExcept(append([]string{missingAuthEventID}, missingPrevEventIDs...)...),
+	}
+	res := mustValidateEvent(t, rsAPI, &testNopJSONVerifier{}, testData[len(testData)-1])
+	if !res.SignaturesOK {
+		t.Errorf("expected signatures to be valid, got %+v", res)
+	}
+	if res.Allowed || res.AuthError == "" {
+		t.Errorf("expected event not to be allowed without the state before it, got %+v", res)
+	}
+	if !reflect.DeepEqual(res.MissingAuthEvents, []string{missingAuthEventID}) {
+		t.Errorf("wrong missing auth events: got %v want %v", res.MissingAuthEvents, []string{missingAuthEventID})
+	}
+	if !reflect.DeepEqual(res.MissingPrevEvents, missingPrevEventIDs) {
+		t.Errorf("wrong missing prev events: got %v want %v", res.MissingPrevEvents, missingPrevEventIDs)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
@@ -0,0 +1,32 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+)
+
+// Database stores information needed by the federation API.
+type Database interface {
+	// QuarantineEvent stores that the event is quarantined. automatic is true
+	// if it was quarantined because it kept failing rather than by an admin.
+	// Does nothing if the event is already quarantined.
+	QuarantineEvent(ctx context.Context, eventID string, automatic bool) error
+	// UnquarantineEvent removes the event from the quarantine.
+	UnquarantineEvent(ctx context.Context, eventID string) error
+	// QuarantinedEvents returns the quarantined events, mapping each event ID
+	// to whether it was quarantined automatically.
+	QuarantinedEvents(ctx context.Context) (map[string]bool, error)
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const quarantineSchema = `
+-- Stores the incoming events which are skipped without being processed.
+CREATE TABLE IF NOT EXISTS federationapi_quarantined_events (
+    -- The ID of the quarantined event.
+    event_id TEXT PRIMARY KEY,
+    -- Whether the event was quarantined because it kept failing to be
+    -- processed, rather than by an admin.
+    automatic BOOLEAN NOT NULL
+);
+`
+
+const insertQuarantinedEventSQL = "" +
+	"INSERT INTO federationapi_quarantined_events (event_id, automatic) VALUES ($1, $2)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteQuarantinedEventSQL = "" +
+	"DELETE FROM federationapi_quarantined_events WHERE event_id = $1"
+
+const selectQuarantinedEventsSQL = "" +
+	"SELECT event_id, automatic FROM federationapi_quarantined_events"
+
+type quarantineStatements struct {
+	insertQuarantinedEventStmt  *sql.Stmt
+	deleteQuarantinedEventStmt  *sql.Stmt
+	selectQuarantinedEventsStmt *sql.Stmt
+}
+
+func (s *quarantineStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(quarantineSchema)
+	if err != nil {
+		return
+	}
+
+	if s.insertQuarantinedEventStmt, err = db.Prepare(insertQuarantinedEventSQL); err != nil {
+		return
+	}
+	if s.deleteQuarantinedEventStmt, err = db.Prepare(deleteQuarantinedEventSQL); err != nil {
+		return
+	}
+	if s.selectQuarantinedEventsStmt, err = db.Prepare(selectQuarantinedEventsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *quarantineStatements) insertQuarantinedEvent(
+	ctx context.Context, eventID string, automatic bool,
+) error {
+	_, err := s.insertQuarantinedEventStmt.ExecContext(ctx, eventID, automatic)
+	return err
+}
+
+func (s *quarantineStatements) deleteQuarantinedEvent(
+	ctx context.Context, eventID string,
+) error {
+	_, err := s.deleteQuarantinedEventStmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *quarantineStatements) selectQuarantinedEvents(
+	ctx context.Context,
+) (map[string]bool, error) {
+	rows, err := s.selectQuarantinedEventsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectQuarantinedEvents: rows.close() failed")
+
+	events := make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		var automatic bool
+		if err = rows.Scan(&eventID, &automatic); err != nil {
+			return nil, err
+		}
+		events[eventID] = automatic
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// Database stores information needed by the federation API
+type Database struct {
+	quarantineStatements
+	db *sql.DB
+}
+
+// NewDatabase opens a new database
+func NewDatabase(dataSourceName string) (*Database, error) {
+	var result Database
+	var err error
+	if result.db, err = sqlutil.Open(common.SQLiteDriverName(), dataSourceName, nil); err != nil {
+		return nil, err
+	}
+	if err = result.quarantineStatements.prepare(result.db); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// QuarantineEvent implements storage.Database
+func (d *Database) QuarantineEvent(ctx context.Context, eventID string, automatic bool) error {
+	return d.insertQuarantinedEvent(ctx, eventID, automatic)
+}
+
+// UnquarantineEvent implements storage.Database
+func (d *Database) UnquarantineEvent(ctx context.Context, eventID string) error {
+	return d.deleteQuarantinedEvent(ctx, eventID)
+}
+
+// QuarantinedEvents implements storage.Database
+func (d *Database) QuarantinedEvents(ctx context.Context) (map[string]bool, error) {
+	return d.selectQuarantinedEvents(ctx)
+}
@@ -18,6 +18,16 @@ type RoomserverInternalAPI interface {
 		response *InputRoomEventsResponse,
 	) error
 
+	// Write the output event for an event which was stored by an earlier call
+	// to InputRoomEvents but never made it to the output log, e.g. because
+	// Kafka was unavailable. Does nothing if the event has already been
+	// written to the output log.
+	ReplayOutputEvent(
+		ctx context.Context,
+		request *ReplayOutputEventRequest,
+		response *ReplayOutputEventResponse,
+	) error
+
 	PerformJoin(
 		ctx context.Context,
 		req *PerformJoinRequest,
@@ -44,6 +54,14 @@ type RoomserverInternalAPI interface {
 		response *QueryStateAfterEventsResponse,
 	) error
 
+	// Query the state after several lists of events, possibly in different
+	// rooms, in a single call to the room server.
+	QueryStateAfterEventsBatch(
+		ctx context.Context,
+		request *QueryStateAfterEventsBatchRequest,
+		response *QueryStateAfterEventsBatchResponse,
+	) error
+
 	// Query a list of events by event ID.
 	QueryEventsByID(
 		ctx context.Context,
@@ -51,6 +69,14 @@ type RoomserverInternalAPI interface {
 		response *QueryEventsByIDResponse,
 	) error
 
+	// Query which of a list of event IDs the roomserver has, without loading
+	// the events. Much cheaper than QueryEventsByID for existence checks.
+	QueryEventsExistByID(
+		ctx context.Context,
+		request *QueryEventsExistByIDRequest,
+		response *QueryEventsExistByIDResponse,
+	) error
+
 	// Query the membership event for an user for a room.
 	QueryMembershipForUser(
 		ctx context.Context,
@@ -116,6 +142,13 @@ type RoomserverInternalAPI interface {
 		response *QueryRoomVersionForRoomResponse,
 	) error
 
+	// Asks which server sent us an event over federation.
+	QueryEventOrigin(
+		ctx context.Context,
+		request *QueryEventOriginRequest,
+		response *QueryEventOriginResponse,
+	) error
+
 	// Set a room alias
 	SetRoomAlias(
 		ctx context.Context,
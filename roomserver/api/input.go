@@ -17,6 +17,7 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	commonHTTP "github.com/matrix-org/dendrite/common/http"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -71,6 +72,15 @@ type InputRoomEvent struct {
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// The server that sent us this event over federation, or empty if the
+	// event didn't arrive over federation. This isn't part of the event
+	// itself, but is stored alongside it so that we can tell later on which
+	// server gave us the event.
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+	// Whether the event is part of the history of the room that we only
+	// found out about while filling in a gap, rather than a live event.
+	// Historical events shouldn't cause notifications.
+	Historical bool `json:"historical"`
 }
 
 // TransactionID contains the transaction ID sent by a client when sending an
@@ -91,10 +101,23 @@ type InputInviteEvent struct {
 	TransactionID   *TransactionID                            `json:"transaction_id"`
 }
 
+// InputRejectedEvent is an event received over federation which was rejected
+// before it reached the roomserver. It isn't stored, but it is written to the
+// output log so that consumers can audit the events we reject.
+type InputRejectedEvent struct {
+	EventID string `json:"event_id"`
+	RoomID  string `json:"room_id"`
+	// The server that sent us the event.
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+	// Why the event was rejected.
+	Reason string `json:"reason"`
+}
+
 // InputRoomEventsRequest is a request to InputRoomEvents
 type InputRoomEventsRequest struct {
-	InputRoomEvents   []InputRoomEvent   `json:"input_room_events"`
-	InputInviteEvents []InputInviteEvent `json:"input_invite_events"`
+	InputRoomEvents     []InputRoomEvent     `json:"input_room_events"`
+	InputInviteEvents   []InputInviteEvent   `json:"input_invite_events"`
+	InputRejectedEvents []InputRejectedEvent `json:"input_rejected_events"`
 }
 
 // InputRoomEventsResponse is a response to InputRoomEvents
@@ -102,6 +125,18 @@ type InputRoomEventsResponse struct {
 	EventID string `json:"event_id"`
 }
 
+// RoomRateLimitedError is returned by InputRoomEvents when a new event is
+// rejected because its room has exceeded the configured rate of new events.
+// The event wasn't stored, so it can be sent again later.
+type RoomRateLimitedError struct {
+	RoomID  string
+	EventID string
+}
+
+func (e RoomRateLimitedError) Error() string {
+	return fmt.Sprintf("room %q is receiving too many events, rejected event %q", e.RoomID, e.EventID)
+}
+
 // RoomserverInputRoomEventsPath is the HTTP path for the InputRoomEvents API.
 const RoomserverInputRoomEventsPath = "/api/roomserver/inputRoomEvents"
 
@@ -117,3 +152,31 @@ func (h *httpRoomserverInternalAPI) InputRoomEvents(
 	apiURL := h.roomserverURL + RoomserverInputRoomEventsPath
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// ReplayOutputEventRequest is a request to ReplayOutputEvent
+type ReplayOutputEventRequest struct {
+	// The ID of the event to write to the output log.
+	EventID string `json:"event_id"`
+}
+
+// ReplayOutputEventResponse is a response to ReplayOutputEvent
+type ReplayOutputEventResponse struct {
+	// Whether the roomserver has the event.
+	EventFound bool `json:"event_found"`
+}
+
+// RoomserverReplayOutputEventPath is the HTTP path for the ReplayOutputEvent API.
+const RoomserverReplayOutputEventPath = "/api/roomserver/replayOutputEvent"
+
+// ReplayOutputEvent implements RoomserverInputAPI
+func (h *httpRoomserverInternalAPI) ReplayOutputEvent(
+	ctx context.Context,
+	request *ReplayOutputEventRequest,
+	response *ReplayOutputEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ReplayOutputEvent")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverReplayOutputEventPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -28,6 +28,8 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRejectedEvent indicates that the event is an OutputRejectedEvent
+	OutputTypeRejectedEvent OutputType = "rejected_event"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +43,8 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeRejectedEvent
+	RejectedEvent *OutputRejectedEvent `json:"rejected_event,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -110,6 +114,14 @@ type OutputNewRoomEvent struct {
 	// The transaction ID of the send request if sent by a local user and one
 	// was specified
 	TransactionID *TransactionID `json:"transaction_id"`
+	// The server that sent us this event over federation, or empty if the
+	// event didn't arrive over federation.
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+	// Whether the event is part of the history of the room that we only
+	// found out about while filling in a gap, rather than a live event.
+	// Consumers shouldn't send push notifications or count the event as
+	// unread for it.
+	Historical bool `json:"historical"`
 }
 
 // An OutputNewInviteEvent is written whenever an invite becomes active.
@@ -138,3 +150,17 @@ type OutputRetireInviteEvent struct {
 	// "leave" or "ban".
 	Membership string
 }
+
+// An OutputRejectedEvent is written when an event received over federation is
+// rejected, for example because it fails auth checks, so that it can be
+// audited. The event itself isn't included, as it may not even be valid.
+type OutputRejectedEvent struct {
+	// The ID of the rejected event.
+	EventID string `json:"event_id"`
+	// The room that the event claimed to be in.
+	RoomID string `json:"room_id"`
+	// The server that sent us the event.
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+	// Why the event was rejected.
+	Reason string `json:"reason"`
+}
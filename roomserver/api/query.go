@@ -85,6 +85,19 @@ type QueryStateAfterEventsResponse struct {
 	StateEvents []gomatrixserverlib.HeaderedEvent `json:"state_events"`
 }
 
+// QueryStateAfterEventsBatchRequest is a request to QueryStateAfterEventsBatch
+type QueryStateAfterEventsBatchRequest struct {
+	// The queries to run. Each one is handled in the same way as a call to
+	// QueryStateAfterEvents.
+	Queries []QueryStateAfterEventsRequest `json:"queries"`
+}
+
+// QueryStateAfterEventsBatchResponse is a response to QueryStateAfterEventsBatch
+type QueryStateAfterEventsBatchResponse struct {
+	// The responses to the queries, in the same order as in the request.
+	Responses []QueryStateAfterEventsResponse `json:"responses"`
+}
+
 // QueryEventsByIDRequest is a request to QueryEventsByID
 type QueryEventsByIDRequest struct {
 	// The event IDs to look up.
@@ -105,6 +118,24 @@ type QueryEventsByIDResponse struct {
 	Events []gomatrixserverlib.HeaderedEvent `json:"events"`
 }
 
+// QueryEventsExistByIDRequest is a request to QueryEventsExistByID
+type QueryEventsExistByIDRequest struct {
+	// The event IDs to look up.
+	EventIDs []string `json:"event_ids"`
+}
+
+// QueryEventsExistByIDResponse is a response to QueryEventsExistByID
+type QueryEventsExistByIDResponse struct {
+	// Copy of the request for debugging.
+	QueryEventsExistByIDRequest
+	// The SHA-256 reference hashes of the events with the requested IDs that
+	// the roomserver has, by event ID. Event IDs which the roomserver doesn't
+	// have are left out, so the keys are the set of present events. The
+	// hashes let callers check that the stored event is the same event as
+	// theirs, rather than a different event claiming the same ID.
+	ReferenceSHA256 map[string][]byte `json:"reference_sha256"`
+}
+
 // QueryMembershipForUserRequest is a request to QueryMembership
 type QueryMembershipForUserRequest struct {
 	// ID of the room to fetch membership from
@@ -261,15 +292,33 @@ type QueryRoomVersionForRoomResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 }
 
+// QueryEventOriginRequest asks which server sent us an event over federation
+type QueryEventOriginRequest struct {
+	EventID string `json:"event_id"`
+}
+
+// QueryEventOriginResponse is a response to QueryEventOriginRequest
+type QueryEventOriginResponse struct {
+	// The server that sent us the event, or empty if the event didn't arrive
+	// over federation or we don't have it.
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+}
+
 // RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
 const RoomserverQueryLatestEventsAndStatePath = "/api/roomserver/queryLatestEventsAndState"
 
 // RoomserverQueryStateAfterEventsPath is the HTTP path for the QueryStateAfterEvents API.
 const RoomserverQueryStateAfterEventsPath = "/api/roomserver/queryStateAfterEvents"
 
+// RoomserverQueryStateAfterEventsBatchPath is the HTTP path for the QueryStateAfterEventsBatch API.
+const RoomserverQueryStateAfterEventsBatchPath = "/api/roomserver/queryStateAfterEventsBatch"
+
 // RoomserverQueryEventsByIDPath is the HTTP path for the QueryEventsByID API.
 const RoomserverQueryEventsByIDPath = "/api/roomserver/queryEventsByID"
 
+// RoomserverQueryEventsExistByIDPath is the HTTP path for the QueryEventsExistByID API.
+const RoomserverQueryEventsExistByIDPath = "/api/roomserver/queryEventsExistByID"
+
 // RoomserverQueryMembershipForUserPath is the HTTP path for the QueryMembershipForUser API.
 const RoomserverQueryMembershipForUserPath = "/api/roomserver/queryMembershipForUser"
 
@@ -297,6 +346,9 @@ const RoomserverQueryRoomVersionCapabilitiesPath = "/api/roomserver/queryRoomVer
 // RoomserverQueryRoomVersionForRoomPath is the HTTP path for the QueryRoomVersionForRoom API
 const RoomserverQueryRoomVersionForRoomPath = "/api/roomserver/queryRoomVersionForRoom"
 
+// RoomserverQueryEventOriginPath is the HTTP path for the QueryEventOrigin API
+const RoomserverQueryEventOriginPath = "/api/roomserver/queryEventOrigin"
+
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -323,6 +375,19 @@ func (h *httpRoomserverInternalAPI) QueryStateAfterEvents(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryStateAfterEventsBatch implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryStateAfterEventsBatch(
+	ctx context.Context,
+	request *QueryStateAfterEventsBatchRequest,
+	response *QueryStateAfterEventsBatchResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryStateAfterEventsBatch")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryStateAfterEventsBatchPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryEventsByID implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryEventsByID(
 	ctx context.Context,
@@ -336,6 +401,19 @@ func (h *httpRoomserverInternalAPI) QueryEventsByID(
 	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryEventsExistByID implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryEventsExistByID(
+	ctx context.Context,
+	request *QueryEventsExistByIDRequest,
+	response *QueryEventsExistByIDResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventsExistByID")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventsExistByIDPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMembershipForUser implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMembershipForUser(
 	ctx context.Context,
@@ -461,3 +539,16 @@ func (h *httpRoomserverInternalAPI) QueryRoomVersionForRoom(
 	}
 	return err
 }
+
+// QueryEventOrigin implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryEventOrigin(
+	ctx context.Context,
+	request *QueryEventOriginRequest,
+	response *QueryEventOriginResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryEventOrigin")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryEventOriginPath
+	return commonHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
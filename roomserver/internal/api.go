@@ -18,16 +18,18 @@ import (
 
 // RoomserverInternalAPI is an implementation of api.RoomserverInternalAPI
 type RoomserverInternalAPI struct {
-	DB                   storage.Database
-	Cfg                  *config.Dendrite
-	Producer             sarama.SyncProducer
-	ImmutableCache       caching.ImmutableCache
-	ServerName           gomatrixserverlib.ServerName
-	KeyRing              gomatrixserverlib.JSONVerifier
-	FedClient            *gomatrixserverlib.FederationClient
-	OutputRoomEventTopic string     // Kafka topic for new output room events
-	mutex                sync.Mutex // Protects calls to processRoomEvent
-	fsAPI                fsAPI.FederationSenderInternalAPI
+	DB                    storage.Database
+	Cfg                   *config.Dendrite
+	Producer              sarama.SyncProducer
+	ImmutableCache        caching.ImmutableCache
+	ServerName            gomatrixserverlib.ServerName
+	KeyRing               gomatrixserverlib.JSONVerifier
+	FedClient             *gomatrixserverlib.FederationClient
+	OutputRoomEventTopic  string             // Kafka topic for new output room events
+	OutputRoomEventMirror *OutputEventMirror // Writes output room events to other topics too, best-effort, if not nil
+	RoomRateLimiter       *RoomRateLimiter   // Limits the rate of new events in each room, if not nil
+	mutex                 sync.Mutex         // Protects calls to processRoomEvent
+	fsAPI                 fsAPI.FederationSenderInternalAPI
 }
 
 // SetupHTTP adds the RoomserverInternalAPI handlers to the http.ServeMux.
@@ -46,6 +48,19 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.RoomserverReplayOutputEventPath,
+		common.MakeInternalAPI("replayOutputEvent", func(req *http.Request) util.JSONResponse {
+			var request api.ReplayOutputEventRequest
+			var response api.ReplayOutputEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.ReplayOutputEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(api.RoomserverPerformJoinPath,
 		common.MakeInternalAPI("performJoin", func(req *http.Request) util.JSONResponse {
 			var request api.PerformJoinRequest
@@ -100,6 +115,20 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryStateAfterEventsBatchPath,
+		common.MakeInternalAPI("queryStateAfterEventsBatch", func(req *http.Request) util.JSONResponse {
+			var request api.QueryStateAfterEventsBatchRequest
+			var response api.QueryStateAfterEventsBatchResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryStateAfterEventsBatch(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryEventsByIDPath,
 		common.MakeInternalAPI("queryEventsByID", func(req *http.Request) util.JSONResponse {
@@ -114,6 +143,20 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryEventsExistByIDPath,
+		common.MakeInternalAPI("queryEventsExistByID", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventsExistByIDRequest
+			var response api.QueryEventsExistByIDResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryEventsExistByID(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryMembershipForUserPath,
 		common.MakeInternalAPI("QueryMembershipForUser", func(req *http.Request) util.JSONResponse {
@@ -240,6 +283,20 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryEventOriginPath,
+		common.MakeInternalAPI("QueryEventOrigin", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventOriginRequest
+			var response api.QueryEventOriginResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryEventOrigin(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverSetRoomAliasPath,
 		common.MakeInternalAPI("setRoomAlias", func(req *http.Request) util.JSONResponse {
@@ -18,9 +18,12 @@ package internal
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
 
 	fsAPI "github.com/matrix-org/dendrite/federationsender/api"
 )
@@ -32,21 +35,91 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.fsAPI = fsAPI
 }
 
-// WriteOutputEvents implements OutputRoomEventWriter
-func (r *RoomserverInternalAPI) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
-	messages := make([]*sarama.ProducerMessage, len(updates))
+// maxOutputEventWriteAttempts is the number of times that we try to write
+// output events to the output log before giving up.
+const maxOutputEventWriteAttempts = 3
+
+// outputEventWriteBackoff is how long we wait before trying to write output
+// events to the output log again. It doubles after each attempt. Replaced in
+// tests.
+var outputEventWriteBackoff = 100 * time.Millisecond
+
+// processInputRoomEvent processes a single event from InputRoomEvents.
+// Replaced in tests.
+var processInputRoomEvent = processRoomEvent
+
+// WriteOutputEvents implements OutputRoomEventWriter. If the context has
+// already been cancelled then nothing is written. Failed writes are retried
+// with a backoff, which stops as soon as the context is cancelled. A single
+// write which has already started is not interrupted, as we would have no way
+// of knowing whether the events made it to the output log.
+//
+// Once the events have been written to the output log they are queued to be
+// written to the mirror topics in the background, so that other consumers
+// can't hold up the roomserver.
+func (r *RoomserverInternalAPI) WriteOutputEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("WriteOutputEvents: %w", err)
+	}
+	values := make([][]byte, len(updates))
 	for i := range updates {
 		value, err := json.Marshal(updates[i])
 		if err != nil {
 			return err
 		}
+		values[i] = value
+	}
+	if err := r.sendOutputMessages(ctx, outputMessages(r.OutputRoomEventTopic, roomID, values)); err != nil {
+		return err
+	}
+	r.OutputRoomEventMirror.write(roomID, values)
+	return nil
+}
+
+// sendOutputMessages writes the messages to the output log, trying again up
+// to maxOutputEventWriteAttempts times if that fails. Only the messages which
+// failed are written again, so that consumers don't see the others twice.
+// Returns an error wrapping the context's error if it is cancelled while
+// waiting to try again.
+func (r *RoomserverInternalAPI) sendOutputMessages(ctx context.Context, messages []*sarama.ProducerMessage) error {
+	backoff := outputEventWriteBackoff
+	for attempt := 1; ; attempt++ {
+		err := r.Producer.SendMessages(messages)
+		if err == nil {
+			return nil
+		}
+		if attempt >= maxOutputEventWriteAttempts {
+			return err
+		}
+		if producerErrs, ok := err.(sarama.ProducerErrors); ok && len(producerErrs) > 0 {
+			failed := make([]*sarama.ProducerMessage, 0, len(producerErrs))
+			for _, producerErr := range producerErrs {
+				failed = append(failed, producerErr.Msg)
+			}
+			messages = failed
+		}
+		util.GetLogger(ctx).WithError(err).Warnf("Failed to write %d output events, trying again in %s", len(messages), backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("WriteOutputEvents: stopped retrying after %d attempts: %w", attempt, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func outputMessages(topic, roomID string, values [][]byte) []*sarama.ProducerMessage {
+	messages := make([]*sarama.ProducerMessage, len(values))
+	for i := range values {
 		messages[i] = &sarama.ProducerMessage{
-			Topic: r.OutputRoomEventTopic,
+			Topic: topic,
 			Key:   sarama.StringEncoder(roomID),
-			Value: sarama.ByteEncoder(value),
+			Value: sarama.ByteEncoder(values[i]),
 		}
 	}
-	return r.Producer.SendMessages(messages)
+	return messages
 }
 
 // InputRoomEvents implements api.RoomserverInternalAPI
@@ -59,6 +132,9 @@ func (r *RoomserverInternalAPI) InputRoomEvents(
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	for i := range request.InputInviteEvents {
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("InputRoomEvents: stopped after %d of %d invite events: %w", i, len(request.InputInviteEvents), err)
+		}
 		var loopback *api.InputRoomEvent
 		if loopback, err = processInviteEvent(ctx, r.DB, r, request.InputInviteEvents[i]); err != nil {
 			return err
@@ -70,10 +146,72 @@ func (r *RoomserverInternalAPI) InputRoomEvents(
 			request.InputRoomEvents = append(request.InputRoomEvents, *loopback)
 		}
 	}
+	if len(request.InputRejectedEvents) > 0 {
+		if err = writeRejectedEvents(ctx, r, request.InputRejectedEvents); err != nil {
+			return err
+		}
+	}
 	for i := range request.InputRoomEvents {
-		if response.EventID, err = processRoomEvent(ctx, r.DB, r, request.InputRoomEvents[i]); err != nil {
+		// Stop between events if we are shutting down or the caller has gone
+		// away, rather than carrying on with the rest of the batch.
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("InputRoomEvents: stopped after %d of %d events: %w", i, len(request.InputRoomEvents), err)
+		}
+		if response.EventID, err = processInputRoomEvent(ctx, r.DB, r, r.RoomRateLimiter, request.InputRoomEvents[i]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// ReplayOutputEvent implements api.RoomserverInternalAPI. The output event is
+// derived by updating the latest events of the room with the stored event,
+// just as InputRoomEvents would have done, so the event is also marked as
+// sent. Events that have already been sent are skipped, which makes it safe
+// to replay an event more than once.
+//
+// The transaction ID that the event was sent with isn't stored, so it isn't
+// included in the output event. Neither is whether the event was historical,
+// so the replayed output event is never marked as historical.
+func (r *RoomserverInternalAPI) ReplayOutputEvent(
+	ctx context.Context,
+	request *api.ReplayOutputEventRequest,
+	response *api.ReplayOutputEventResponse,
+) error {
+	// We lock as updateLatestEvents can only be called once at a time
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	events, err := r.DB.EventsFromIDs(ctx, []string{request.EventID})
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	response.EventFound = true
+	event := events[0].Event
+
+	roomNID, err := r.DB.RoomNID(ctx, event.RoomID())
+	if err != nil {
+		return err
+	}
+	// Outliers don't have any state, so they are never written to the output
+	// log and will fail here.
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{request.EventID})
+	if err != nil {
+		return fmt.Errorf("ReplayOutputEvent: failed to get state at event %q: %w", request.EventID, err)
+	}
+	origin, err := r.DB.EventOrigin(ctx, request.EventID)
+	if err != nil {
+		return err
+	}
+	// Only events that we created ourselves are sent to other servers.
+	sendAsServer := api.DoNotSendToOtherServers
+	if event.Origin() == r.ServerName {
+		sendAsServer = string(r.ServerName)
+	}
+	return updateLatestEvents(
+		ctx, r.DB, r, roomNID, stateAtEvents[0], event, sendAsServer, nil, origin, false,
+	)
+}
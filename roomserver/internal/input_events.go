@@ -34,7 +34,7 @@ import (
 // OutputRoomEventWriter has the APIs needed to write an event to the output logs.
 type OutputRoomEventWriter interface {
 	// Write a list of events for a room
-	WriteOutputEvents(roomID string, updates []api.OutputEvent) error
+	WriteOutputEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error
 }
 
 // processRoomEvent can only be called once at a time
@@ -46,12 +46,22 @@ func processRoomEvent(
 	ctx context.Context,
 	db storage.Database,
 	ow OutputRoomEventWriter,
+	rateLimiter *RoomRateLimiter,
 	input api.InputRoomEvent,
 ) (eventID string, err error) {
 	// Parse and validate the event JSON
 	headered := input.Event
 	event := headered.Unwrap()
 
+	// Reject new events in rooms which are receiving too many of them. Other
+	// kinds of event are part of filling in the history of the room, such as
+	// the state fetched when joining, so they aren't limited.
+	if input.Kind == api.KindNew && !rateLimiter.Allow(event.RoomID()) {
+		err = api.RoomRateLimitedError{RoomID: event.RoomID(), EventID: event.EventID()}
+		logrus.WithError(err).Warn("processRoomEvent rejected event")
+		return
+	}
+
 	// Check that the event passes authentication checks and work out the numeric IDs for the auth events.
 	authEventNIDs, err := checkAuthEvents(ctx, db, headered, input.AuthEventIDs)
 	if err != nil {
@@ -76,6 +86,13 @@ func processRoomEvent(
 		return
 	}
 
+	// Remember which server sent us the event, if it came over federation.
+	if input.Origin != "" {
+		if err = db.StoreEventOrigin(ctx, event.EventID(), input.Origin); err != nil {
+			return
+		}
+	}
+
 	if input.Kind == api.KindOutlier {
 		// For outliers we can stop after we've stored the event itself as it
 		// doesn't have any associated state to store and we don't need to
@@ -95,7 +112,8 @@ func processRoomEvent(
 
 	// Update the extremities of the event graph for the room
 	return event.EventID(), updateLatestEvents(
-		ctx, db, ow, roomNID, stateAtEvent, event, input.SendAsServer, input.TransactionID,
+		ctx, db, ow, roomNID, stateAtEvent, event, input.SendAsServer, input.TransactionID, input.Origin,
+		input.Historical,
 	)
 }
 
@@ -130,6 +148,30 @@ func calculateAndSetState(
 	return db.SetState(ctx, stateAtEvent.EventNID, stateAtEvent.BeforeStateSnapshotNID)
 }
 
+// writeRejectedEvents writes an output event for each of the rejected events,
+// keyed by the room that the event claimed to be in. Nothing is stored.
+func writeRejectedEvents(
+	ctx context.Context,
+	ow OutputRoomEventWriter,
+	rejected []api.InputRejectedEvent,
+) error {
+	for _, ev := range rejected {
+		output := api.OutputEvent{
+			Type: api.OutputTypeRejectedEvent,
+			RejectedEvent: &api.OutputRejectedEvent{
+				EventID: ev.EventID,
+				RoomID:  ev.RoomID,
+				Origin:  ev.Origin,
+				Reason:  ev.Reason,
+			},
+		}
+		if err := ow.WriteOutputEvents(ctx, ev.RoomID, []api.OutputEvent{output}); err != nil {
+			return fmt.Errorf("writeRejectedEvents: failed to write event %q: %w", ev.EventID, err)
+		}
+	}
+	return nil
+}
+
 func processInviteEvent(
 	ctx context.Context,
 	db storage.Database,
@@ -229,7 +271,7 @@ func processInviteEvent(
 		return nil, err
 	}
 
-	if err = ow.WriteOutputEvents(roomID, outputUpdates); err != nil {
+	if err = ow.WriteOutputEvents(ctx, roomID, outputUpdates); err != nil {
 		return nil, err
 	}
 
@@ -280,6 +322,7 @@ func buildInviteStrippedState(
 	for _, t := range []string{
 		gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias,
 		gomatrixserverlib.MRoomAliases, gomatrixserverlib.MRoomJoinRules,
+		"m.room.avatar",
 	} {
 		stateWanted = append(stateWanted, gomatrixserverlib.StateKeyTuple{
 			EventType: t,
@@ -308,7 +351,6 @@ func buildInviteStrippedState(
 	inviteState := []gomatrixserverlib.InviteV2StrippedState{
 		gomatrixserverlib.NewInviteV2StrippedState(&input.Event.Event),
 	}
-	stateEvents = append(stateEvents, types.Event{Event: input.Event.Unwrap()})
 	for _, event := range stateEvents {
 		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(&event.Event))
 	}
@@ -55,6 +55,8 @@ func updateLatestEvents(
 	event gomatrixserverlib.Event,
 	sendAsServer string,
 	transactionID *api.TransactionID,
+	origin gomatrixserverlib.ServerName,
+	historical bool,
 ) (err error) {
 	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
 	if err != nil {
@@ -71,7 +73,7 @@ func updateLatestEvents(
 	u := latestEventsUpdater{
 		ctx: ctx, db: db, updater: updater, ow: ow, roomNID: roomNID,
 		stateAtEvent: stateAtEvent, event: event, sendAsServer: sendAsServer,
-		transactionID: transactionID,
+		transactionID: transactionID, origin: origin, historical: historical,
 	}
 	if err = u.doUpdateLatestEvents(); err != nil {
 		return err
@@ -96,6 +98,10 @@ type latestEventsUpdater struct {
 	transactionID *api.TransactionID
 	// Which server to send this event as.
 	sendAsServer string
+	// Which server sent us this event over federation, if any.
+	origin gomatrixserverlib.ServerName
+	// Whether the event was found while filling in a gap in the room.
+	historical bool
 	// The eventID of the event that was processed before this one.
 	lastEventIDSent string
 	// The latest events in the room after processing this event.
@@ -166,7 +172,7 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	// send the event asynchronously but we would need to ensure that 1) the events are written to the log in
 	// the correct order, 2) that pending writes are resent across restarts. In order to avoid writing all the
 	// necessary bookkeeping we'll keep the event sending synchronous for now.
-	if err = u.ow.WriteOutputEvents(u.event.RoomID(), updates); err != nil {
+	if err = u.ow.WriteOutputEvents(u.ctx, u.event.RoomID(), updates); err != nil {
 		return err
 	}
 
@@ -260,6 +266,8 @@ func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error)
 		LastSentEventID: u.lastEventIDSent,
 		LatestEventIDs:  latestEventIDs,
 		TransactionID:   u.transactionID,
+		Origin:          u.origin,
+		Historical:      u.historical,
 	}
 
 	var stateEventNIDs []types.EventNID
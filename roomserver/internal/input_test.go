@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// used to implement sarama.SyncProducer to count the messages written
+type countingProducer struct {
+	sent int
+}
+
+func (p *countingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent++
+	return 0, 0, nil
+}
+
+func (p *countingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.sent += len(msgs)
+	return nil
+}
+
+func (p *countingProducer) Close() error {
+	return nil
+}
+
+// The purpose of this test is to check that a cancelled context stops a batch of input events from being processed
+// and returns promptly with an error wrapping context.Canceled. The roomserver has no database here, so the test
+// would panic if any of the events were processed.
+func TestInputRoomEventsCancelled(t *testing.T) {
+	r := &RoomserverInternalAPI{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	request := api.InputRoomEventsRequest{
+		InputRoomEvents: make([]api.InputRoomEvent, 3),
+	}
+	var response api.InputRoomEventsResponse
+	err := r.InputRoomEvents(ctx, &request, &response)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+	}
+}
+
+// The purpose of this test is to check that cancelling the context while a batch of input events is being processed
+// stops the batch after the event in progress, without processing the rest of the events, and returns an error
+// wrapping context.Canceled.
+func TestInputRoomEventsCancelledMidBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var processed []string
+	processInputRoomEvent = func(
+		ctx context.Context, db storage.Database, ow OutputRoomEventWriter, rateLimiter *RoomRateLimiter, input api.InputRoomEvent,
+	) (string, error) {
+		processed = append(processed, input.SendAsServer)
+		// Shut down while the first event is being processed.
+		cancel()
+		return input.SendAsServer, nil
+	}
+	defer func() { processInputRoomEvent = processRoomEvent }()
+
+	r := &RoomserverInternalAPI{}
+	request := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{SendAsServer: "first"}, {SendAsServer: "second"}, {SendAsServer: "third"}},
+	}
+	var response api.InputRoomEventsResponse
+	err := r.InputRoomEvents(ctx, &request, &response)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+	}
+	if !reflect.DeepEqual(processed, []string{"first"}) {
+		t.Errorf("expected only the first event to be processed, got %v", processed)
+	}
+}
+
+// used to implement sarama.SyncProducer to fail every write, cancelling the context after the first failure
+type failingProducer struct {
+	countingProducer
+	attempts int
+	cancel   context.CancelFunc
+}
+
+func (p *failingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.attempts++
+	if p.cancel != nil {
+		p.cancel()
+	}
+	errs := make(sarama.ProducerErrors, len(msgs))
+	for i := range msgs {
+		errs[i] = &sarama.ProducerError{Msg: msgs[i], Err: errors.New("broker unavailable")}
+	}
+	return errs
+}
+
+// The purpose of this test is to check that failed writes to the output log are retried with a backoff, and that
+// cancelling the context stops the retries straight away with an error wrapping context.Canceled.
+func TestWriteOutputEventsRetries(t *testing.T) {
+	outputEventWriteBackoff = time.Millisecond
+	defer func() { outputEventWriteBackoff = 100 * time.Millisecond }()
+
+	producer := &failingProducer{}
+	r := &RoomserverInternalAPI{Producer: producer}
+	err := r.WriteOutputEvents(context.Background(), "!roomid:kaer.morhen", make([]api.OutputEvent, 1))
+	if err == nil {
+		t.Fatalf("expected an error when the output log is unavailable")
+	}
+	if producer.attempts != maxOutputEventWriteAttempts {
+		t.Errorf("wrong number of attempts: got %d want %d", producer.attempts, maxOutputEventWriteAttempts)
+	}
+
+	// The backoff is long enough that the test would time out if the retry
+	// didn't stop when the context was cancelled.
+	outputEventWriteBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	producer = &failingProducer{cancel: cancel}
+	r.Producer = producer
+	err = r.WriteOutputEvents(ctx, "!roomid:kaer.morhen", make([]api.OutputEvent, 1))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+	}
+	if producer.attempts != 1 {
+		t.Errorf("expected no more attempts after cancelling, got %d", producer.attempts)
+	}
+}
+
+// The purpose of this test is to check that output events aren't written once the context has been cancelled.
+func TestWriteOutputEventsCancelled(t *testing.T) {
+	producer := &countingProducer{}
+	r := &RoomserverInternalAPI{Producer: producer}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := r.WriteOutputEvents(ctx, "!roomid:kaer.morhen", make([]api.OutputEvent, 1)); err != nil {
+		t.Fatalf("WriteOutputEvents returned an error: %s", err)
+	}
+	if producer.sent != 1 {
+		t.Fatalf("expected 1 message to be sent, got %d", producer.sent)
+	}
+
+	cancel()
+	err := r.WriteOutputEvents(ctx, "!roomid:kaer.morhen", make([]api.OutputEvent, 1))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected error wrapping context.Canceled, got %v", err)
+	}
+	if producer.sent != 1 {
+		t.Errorf("expected no more messages to be sent after cancelling, got %d", producer.sent)
+	}
+}
+
+// used to implement sarama.SyncProducer to record the topics that messages are written to, failing to write to any
+// topic in failTopics
+type topicProducer struct {
+	countingProducer
+	topics     []string
+	failTopics map[string]bool
+}
+
+func (p *topicProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	for _, msg := range msgs {
+		if p.failTopics[msg.Topic] {
+			return errors.New("topic unavailable")
+		}
+		p.topics = append(p.topics, msg.Topic)
+	}
+	return p.countingProducer.SendMessages(msgs)
+}
+
+// The purpose of this test is to check that output events are written to the output log straight away and then to
+// each of the mirror topics in the background, that failing to write to one mirror topic doesn't stop the others, and
+// that nothing is mirrored if the write to the output log fails.
+func TestWriteOutputEventsMirrorTopics(t *testing.T) {
+	producer := &topicProducer{failTopics: map[string]bool{"broken": true}}
+	mirror := NewOutputEventMirror(producer, []string{"analytics", "broken", "antiabuse"}, 10)
+	r := &RoomserverInternalAPI{
+		Producer:              producer,
+		OutputRoomEventTopic:  "output",
+		OutputRoomEventMirror: mirror,
+	}
+	if err := r.WriteOutputEvents(context.Background(), "!roomid:kaer.morhen", make([]api.OutputEvent, 1)); err != nil {
+		t.Fatalf("WriteOutputEvents returned an error: %s", err)
+	}
+	mirror.stop()
+	want := []string{"output", "analytics", "antiabuse"}
+	if !reflect.DeepEqual(producer.topics, want) {
+		t.Errorf("wrong topics: got %v want %v", producer.topics, want)
+	}
+
+	// Nothing is written to the mirror topics if the write to the output log fails.
+	outputEventWriteBackoff = time.Millisecond
+	defer func() { outputEventWriteBackoff = 100 * time.Millisecond }()
+	producer = &topicProducer{failTopics: map[string]bool{"output": true}}
+	mirror = NewOutputEventMirror(producer, []string{"analytics"}, 10)
+	r.Producer = producer
+	r.OutputRoomEventMirror = mirror
+	if err := r.WriteOutputEvents(context.Background(), "!roomid:kaer.morhen", make([]api.OutputEvent, 1)); err == nil {
+		t.Fatalf("expected an error when the output log is unavailable")
+	}
+	mirror.stop()
+	if len(producer.topics) != 0 {
+		t.Errorf("expected nothing to be written, got %v", producer.topics)
+	}
+}
+
+// used to implement sarama.SyncProducer to block writes to the mirror topics until released
+type blockingProducer struct {
+	countingProducer
+	release chan struct{}
+}
+
+func (p *blockingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if len(msgs) > 0 && msgs[0].Topic != "output" {
+		<-p.release
+	}
+	return nil
+}
+
+// The purpose of this test is to check that writing output events doesn't wait for slow mirror topics, and that
+// events are dropped and counted once the mirror's queue is full.
+func TestWriteOutputEventsMirrorQueueFull(t *testing.T) {
+	producer := &blockingProducer{release: make(chan struct{})}
+	mirror := NewOutputEventMirror(producer, []string{"analytics"}, 1)
+	r := &RoomserverInternalAPI{
+		Producer:              producer,
+		OutputRoomEventTopic:  "output",
+		OutputRoomEventMirror: mirror,
+	}
+	before := testutil.ToFloat64(mirrorOutputEventsDropped)
+
+	// The first batch is taken off the queue and blocks in the producer, the
+	// second fills the queue, and the third is dropped.
+	if err := r.WriteOutputEvents(context.Background(), "!roomid:kaer.morhen", make([]api.OutputEvent, 1)); err != nil {
+		t.Fatalf("WriteOutputEvents returned an error: %s", err)
+	}
+	for len(mirror.queue) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.WriteOutputEvents(context.Background(), "!roomid:kaer.morhen", make([]api.OutputEvent, 2)); err != nil {
+			t.Fatalf("WriteOutputEvents returned an error: %s", err)
+		}
+	}
+	if got := testutil.ToFloat64(mirrorOutputEventsDropped) - before; got != 2 {
+		t.Errorf("wrong number of dropped events: got %v want 2", got)
+	}
+	close(producer.release)
+	mirror.stop()
+}
+
+// The purpose of this test is to check that a rejected event is written to the output log as exactly one message.
+// The roomserver has no database here, so the test would panic if it tried to store anything.
+func TestInputRoomEventsRejectedEvent(t *testing.T) {
+	producer := &countingProducer{}
+	r := &RoomserverInternalAPI{Producer: producer}
+	request := api.InputRoomEventsRequest{
+		InputRejectedEvents: []api.InputRejectedEvent{{
+			EventID: "$rejected:kaer.morhen",
+			RoomID:  "!roomid:kaer.morhen",
+			Origin:  "kaer.morhen",
+			Reason:  "M_NOT_ALLOWED: not allowed",
+		}},
+	}
+	var response api.InputRoomEventsResponse
+	if err := r.InputRoomEvents(context.Background(), &request, &response); err != nil {
+		t.Fatalf("InputRoomEvents returned an error: %s", err)
+	}
+	if producer.sent != 1 {
+		t.Errorf("expected 1 message to be sent, got %d", producer.sent)
+	}
+}
+
+// used to implement storage.Database for ReplayOutputEvent, with a single message event which has been stored but
+// not sent to the output log
+type replayDB struct {
+	storage.Database
+	event        types.Event
+	stateAtEvent types.StateAtEvent
+	updater      *replayUpdater
+}
+
+func (d *replayDB) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var events []types.Event
+	for _, eventID := range eventIDs {
+		if eventID == d.event.EventID() {
+			events = append(events, d.event)
+		}
+	}
+	return events, nil
+}
+
+func (d *replayDB) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
+	return 1, nil
+}
+
+func (d *replayDB) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return []types.StateAtEvent{d.stateAtEvent}, nil
+}
+
+func (d *replayDB) EventOrigin(ctx context.Context, eventID string) (gomatrixserverlib.ServerName, error) {
+	return "kaer.morhen", nil
+}
+
+func (d *replayDB) GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error) {
+	return d.updater, nil
+}
+
+func (d *replayDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	return nil, nil
+}
+
+func (d *replayDB) EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	return map[types.EventNID]string{}, nil
+}
+
+func (d *replayDB) GetRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error) {
+	return gomatrixserverlib.RoomVersionV1, nil
+}
+
+type replayUpdater struct {
+	types.RoomRecentEventsUpdater
+	latest   []types.StateAtEventAndReference
+	stateNID types.StateSnapshotNID
+	sent     map[types.EventNID]bool
+}
+
+func (u *replayUpdater) LatestEvents() []types.StateAtEventAndReference { return u.latest }
+func (u *replayUpdater) LastEventIDSent() string                        { return "" }
+func (u *replayUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID {
+	return u.stateNID
+}
+func (u *replayUpdater) StorePreviousEvents(types.EventNID, []gomatrixserverlib.EventReference) error {
+	return nil
+}
+func (u *replayUpdater) IsReferenced(gomatrixserverlib.EventReference) (bool, error) {
+	return false, nil
+}
+func (u *replayUpdater) SetLatestEvents(
+	roomNID types.RoomNID, latest []types.StateAtEventAndReference, lastEventNIDSent types.EventNID,
+	currentStateSnapshotNID types.StateSnapshotNID,
+) error {
+	u.latest = latest
+	u.stateNID = currentStateSnapshotNID
+	return nil
+}
+func (u *replayUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
+	return u.sent[eventNID], nil
+}
+func (u *replayUpdater) MarkEventAsSent(eventNID types.EventNID) error {
+	u.sent[eventNID] = true
+	return nil
+}
+func (u *replayUpdater) Commit() error   { return nil }
+func (u *replayUpdater) Rollback() error { return nil }
+
+// The purpose of this test is to check that replaying an event which was stored but never sent to the output log
+// writes exactly one message, that replaying it again writes nothing more, and that replaying an unknown event is
+// reported as such.
+func TestReplayOutputEvent(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"body":"Test Message"},"depth":5,"event_id":"$gl2T9l3qm0kUbiIJ:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$UKNe10XzYzG0TeA9:kaer.morhen",{"sha256":""}]],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"type":"m.room.message"}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	producer := &countingProducer{}
+	r := &RoomserverInternalAPI{
+		DB: &replayDB{
+			event: types.Event{EventNID: 5, Event: event},
+			stateAtEvent: types.StateAtEvent{
+				BeforeStateSnapshotNID: 4,
+				StateEntry:             types.StateEntry{EventNID: 5},
+			},
+			updater: &replayUpdater{stateNID: 4, sent: make(map[types.EventNID]bool)},
+		},
+		Producer: producer,
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		request := api.ReplayOutputEventRequest{EventID: event.EventID()}
+		var response api.ReplayOutputEventResponse
+		if err = r.ReplayOutputEvent(ctx, &request, &response); err != nil {
+			t.Fatalf("ReplayOutputEvent %d returned an error: %s", i, err)
+		}
+		if !response.EventFound {
+			t.Errorf("ReplayOutputEvent %d: expected the event to be found", i)
+		}
+		if producer.sent != 1 {
+			t.Errorf("ReplayOutputEvent %d: expected 1 message to have been sent, got %d", i, producer.sent)
+		}
+	}
+
+	request := api.ReplayOutputEventRequest{EventID: "$unknown:kaer.morhen"}
+	var response api.ReplayOutputEventResponse
+	if err = r.ReplayOutputEvent(ctx, &request, &response); err != nil {
+		t.Fatalf("ReplayOutputEvent returned an error for an unknown event: %s", err)
+	}
+	if response.EventFound {
+		t.Errorf("expected an unknown event not to be found")
+	}
+	if producer.sent != 1 {
+		t.Errorf("expected no more messages to be sent for an unknown event, got %d", producer.sent)
+	}
+}
+
+// used to implement OutputRoomEventWriter to record the output events written
+type recordingWriter struct {
+	updates []api.OutputEvent
+}
+
+func (w *recordingWriter) WriteOutputEvents(ctx context.Context, roomID string, updates []api.OutputEvent) error {
+	w.updates = append(w.updates, updates...)
+	return nil
+}
+
+// The purpose of this test is to check that an event which was found while filling in a gap is marked as historical in
+// its output event, so that it doesn't cause notifications, while a live event isn't.
+func TestUpdateLatestEventsHistorical(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"body":"Test Message"},"depth":5,"event_id":"$gl2T9l3qm0kUbiIJ:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[["$UKNe10XzYzG0TeA9:kaer.morhen",{"sha256":""}]],"room_id":"!roomid:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"type":"m.room.message"}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	stateAtEvent := types.StateAtEvent{
+		BeforeStateSnapshotNID: 4,
+		StateEntry:             types.StateEntry{EventNID: 5},
+	}
+	for _, historical := range []bool{false, true} {
+		db := &replayDB{
+			event:        types.Event{EventNID: 5, Event: event},
+			stateAtEvent: stateAtEvent,
+			updater:      &replayUpdater{stateNID: 4, sent: make(map[types.EventNID]bool)},
+		}
+		writer := &recordingWriter{}
+		err = updateLatestEvents(
+			context.Background(), db, writer, 1, stateAtEvent, event, api.DoNotSendToOtherServers, nil, "kaer.morhen", historical,
+		)
+		if err != nil {
+			t.Fatalf("updateLatestEvents returned an error: %s", err)
+		}
+		if len(writer.updates) != 1 || writer.updates[0].NewRoomEvent == nil {
+			t.Fatalf("expected 1 new room event to be written, got %+v", writer.updates)
+		}
+		if got := writer.updates[0].NewRoomEvent.Historical; got != historical {
+			t.Errorf("wrong historical flag in output event: got %t want %t", got, historical)
+		}
+	}
+}
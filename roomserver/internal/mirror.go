@@ -0,0 +1,111 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxQueuedMirrorBatches is the default number of batches of output events
+// that an OutputEventMirror holds while they wait to be written.
+const MaxQueuedMirrorBatches = 1000
+
+var mirrorOutputEventsDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "mirror_output_events_dropped_total",
+		Help:      "Number of output room events which weren't written to the mirror topics because the queue was full",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(mirrorOutputEventsDropped)
+}
+
+// OutputEventMirror writes output room events to the mirror topics in the
+// background, so that writing to them never holds up the roomserver. Batches
+// of events are queued and written in order by a single goroutine. If the
+// queue is full, e.g. because the mirror topics are slow, then the batch is
+// dropped and counted in mirrorOutputEventsDropped. Writing to the mirror
+// topics is best-effort, so failures are only logged.
+type OutputEventMirror struct {
+	producer sarama.SyncProducer
+	topics   []string
+	queue    chan mirrorBatch
+	wg       sync.WaitGroup
+}
+
+type mirrorBatch struct {
+	roomID string
+	values [][]byte
+}
+
+// NewOutputEventMirror creates an OutputEventMirror which writes to the given
+// topics, holding up to queueSize batches of events which are waiting to be
+// written, and starts writing them. Returns nil if there are no topics.
+func NewOutputEventMirror(producer sarama.SyncProducer, topics []string, queueSize int) *OutputEventMirror {
+	if len(topics) == 0 {
+		return nil
+	}
+	m := &OutputEventMirror{
+		producer: producer,
+		topics:   topics,
+		queue:    make(chan mirrorBatch, queueSize),
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// write queues the events to be written to the mirror topics. The events must
+// not be modified afterwards. If m is nil then nothing is written.
+func (m *OutputEventMirror) write(roomID string, values [][]byte) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.queue <- mirrorBatch{roomID, values}:
+	default:
+		mirrorOutputEventsDropped.Add(float64(len(values)))
+		logrus.WithField("room_id", roomID).Warnf(
+			"Dropped %d output events for the mirror topics as the queue is full", len(values),
+		)
+	}
+}
+
+// stop waits for the queued events to be written and then stops writing. No
+// more events may be written afterwards.
+func (m *OutputEventMirror) stop() {
+	close(m.queue)
+	m.wg.Wait()
+}
+
+func (m *OutputEventMirror) run() {
+	defer m.wg.Done()
+	for batch := range m.queue {
+		for _, topic := range m.topics {
+			if err := m.producer.SendMessages(outputMessages(topic, batch.roomID, batch.values)); err != nil {
+				logrus.WithError(err).WithField("topic", topic).Errorf(
+					"Failed to write %d output events to mirror topic", len(batch.values),
+				)
+			}
+		}
+	}
+}
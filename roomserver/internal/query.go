@@ -147,6 +147,21 @@ func (r *RoomserverInternalAPI) QueryStateAfterEvents(
 	return nil
 }
 
+// QueryStateAfterEventsBatch implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryStateAfterEventsBatch(
+	ctx context.Context,
+	request *api.QueryStateAfterEventsBatchRequest,
+	response *api.QueryStateAfterEventsBatchResponse,
+) error {
+	response.Responses = make([]api.QueryStateAfterEventsResponse, len(request.Queries))
+	for i := range request.Queries {
+		if err := r.QueryStateAfterEvents(ctx, &request.Queries[i], &response.Responses[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // QueryEventsByID implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryEventsByID(
 	ctx context.Context,
@@ -182,6 +197,28 @@ func (r *RoomserverInternalAPI) QueryEventsByID(
 	return nil
 }
 
+// QueryEventsExistByID implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryEventsExistByID(
+	ctx context.Context,
+	request *api.QueryEventsExistByIDRequest,
+	response *api.QueryEventsExistByIDResponse,
+) error {
+	response.QueryEventsExistByIDRequest = *request
+	response.ReferenceSHA256 = make(map[string][]byte)
+	if len(request.EventIDs) == 0 {
+		return nil
+	}
+
+	references, err := r.DB.EventReferencesByID(ctx, request.EventIDs)
+	if err != nil {
+		return err
+	}
+	for _, ref := range references {
+		response.ReferenceSHA256[ref.EventID] = ref.EventSHA256
+	}
+	return nil
+}
+
 func (r *RoomserverInternalAPI) loadStateEvents(
 	ctx context.Context, stateEntries []types.StateEntry,
 ) ([]gomatrixserverlib.Event, error) {
@@ -965,3 +1002,17 @@ func (r *RoomserverInternalAPI) QueryRoomVersionForRoom(
 	r.ImmutableCache.StoreRoomVersion(request.RoomID, response.RoomVersion)
 	return nil
 }
+
+// QueryEventOrigin implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryEventOrigin(
+	ctx context.Context,
+	request *api.QueryEventOriginRequest,
+	response *api.QueryEventOriginResponse,
+) error {
+	origin, err := r.DB.EventOrigin(ctx, request.EventID)
+	if err != nil {
+		return err
+	}
+	response.Origin = origin
+	return nil
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -261,7 +262,7 @@ func joinEventsFromHistoryVisibility(
 		events[i] = stateEvents[i].Event
 	}
 	visibility := auth.HistoryVisibilityForRoom(events)
-	if visibility != "shared" {
+	if visibility != common.HistoryVisibilityShared {
 		logrus.Infof("ServersAtEvent history visibility not shared: %s", visibility)
 		return nil, nil
 	}
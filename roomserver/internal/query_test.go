@@ -15,11 +15,16 @@
 package internal
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/matrix-org/dendrite/common/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -155,3 +160,147 @@ func TestGetAuthChainMultiple(t *testing.T) {
 		t.Fatalf("returnedIDs got '%v', expected '%v'", returnedIDs, expectedIDs)
 	}
 }
+
+// used to implement storage.Database for QueryEventsByID and QueryEventsExistByID, with events keyed by event ID
+type storedEventsDB struct {
+	storage.Database
+	events map[string]types.Event
+}
+
+func createStoredEventsDB(count int) (*storedEventsDB, error) {
+	db := &storedEventsDB{events: make(map[string]types.Event)}
+	for i := 0; i < count; i++ {
+		eventJSON := []byte(fmt.Sprintf(
+			`{"event_id":"$%d:kaer.morhen","room_id":"!room:kaer.morhen","type":"m.room.message","content":{"body":"%d"}}`, i, i,
+		))
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			return nil, err
+		}
+		db.events[event.EventID()] = types.Event{EventNID: types.EventNID(i + 1), Event: event}
+	}
+	return db, nil
+}
+
+// referenceSHA256 stands in for the reference hash stored with the event.
+func referenceSHA256(event types.Event) []byte {
+	sha := sha256.Sum256(event.JSON())
+	return sha[:]
+}
+
+func (db *storedEventsDB) EventReferencesByID(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.EventReference, error) {
+	var refs []gomatrixserverlib.EventReference
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			refs = append(refs, gomatrixserverlib.EventReference{EventID: eventID, EventSHA256: referenceSHA256(event)})
+		}
+	}
+	return refs, nil
+}
+
+func (db *storedEventsDB) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	nids := make(map[string]types.EventNID)
+	for _, eventID := range eventIDs {
+		if event, ok := db.events[eventID]; ok {
+			nids[eventID] = event.EventNID
+		}
+	}
+	return nids, nil
+}
+
+func (db *storedEventsDB) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var events []types.Event
+	for _, nid := range eventNIDs {
+		for _, event := range db.events {
+			if event.EventNID == nid {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+func (db *storedEventsDB) GetRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error) {
+	return gomatrixserverlib.RoomVersionV1, nil
+}
+
+// queryEventIDs returns the IDs of the first present events in the database followed by absent events.
+func queryEventIDs(present, absent int) []string {
+	var eventIDs []string
+	for i := 0; i < present; i++ {
+		eventIDs = append(eventIDs, fmt.Sprintf("$%d:kaer.morhen", i))
+	}
+	for i := 0; i < absent; i++ {
+		eventIDs = append(eventIDs, fmt.Sprintf("$missing%d:kaer.morhen", i))
+	}
+	return eventIDs
+}
+
+func TestQueryEventsExistByID(t *testing.T) {
+	db, err := createStoredEventsDB(3)
+	if err != nil {
+		t.Fatalf("Failed to add events to db: %v", err)
+	}
+	r := &RoomserverInternalAPI{DB: db}
+
+	request := api.QueryEventsExistByIDRequest{EventIDs: queryEventIDs(2, 2)}
+	var response api.QueryEventsExistByIDResponse
+	if err = r.QueryEventsExistByID(context.TODO(), &request, &response); err != nil {
+		t.Fatalf("QueryEventsExistByID failed: %v", err)
+	}
+
+	if len(response.ReferenceSHA256) != 2 {
+		t.Fatalf("expected 2 events to exist, got %v", response.ReferenceSHA256)
+	}
+	for _, eventID := range request.EventIDs[:2] {
+		if !bytes.Equal(response.ReferenceSHA256[eventID], referenceSHA256(db.events[eventID])) {
+			t.Errorf("wrong reference hash for %s: %x", eventID, response.ReferenceSHA256[eventID])
+		}
+	}
+	for _, eventID := range request.EventIDs[2:] {
+		if _, ok := response.ReferenceSHA256[eventID]; ok {
+			t.Errorf("expected %s not to exist", eventID)
+		}
+	}
+
+	// Nothing exists if nothing is asked for.
+	response = api.QueryEventsExistByIDResponse{}
+	if err = r.QueryEventsExistByID(context.TODO(), &api.QueryEventsExistByIDRequest{}, &response); err != nil {
+		t.Fatalf("QueryEventsExistByID failed: %v", err)
+	}
+	if response.ReferenceSHA256 == nil || len(response.ReferenceSHA256) != 0 {
+		t.Errorf("expected an empty map, got %v", response.ReferenceSHA256)
+	}
+}
+
+func BenchmarkQueryEventsExistByID(b *testing.B) {
+	db, err := createStoredEventsDB(100)
+	if err != nil {
+		b.Fatalf("Failed to add events to db: %v", err)
+	}
+	r := &RoomserverInternalAPI{DB: db}
+	request := api.QueryEventsExistByIDRequest{EventIDs: queryEventIDs(50, 50)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var response api.QueryEventsExistByIDResponse
+		if err := r.QueryEventsExistByID(context.TODO(), &request, &response); err != nil {
+			b.Fatalf("QueryEventsExistByID failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkQueryEventsByID(b *testing.B) {
+	db, err := createStoredEventsDB(100)
+	if err != nil {
+		b.Fatalf("Failed to add events to db: %v", err)
+	}
+	r := &RoomserverInternalAPI{DB: db}
+	request := api.QueryEventsByIDRequest{EventIDs: queryEventIDs(50, 50)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var response api.QueryEventsByIDResponse
+		if err := r.QueryEventsByID(context.TODO(), &request, &response); err != nil {
+			b.Fatalf("QueryEventsByID failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// maxIdleRoomBuckets is the number of rooms above which the buckets of rooms
+// that have been idle long enough to refill completely are forgotten.
+const maxIdleRoomBuckets = 10000
+
+// RoomRateLimiter limits the sustained rate of new events in each room using
+// a token bucket per room, so that a single busy room can't overwhelm the
+// database and the consumers of the output log.
+type RoomRateLimiter struct {
+	mutex sync.Mutex
+	// Tokens added to each bucket per second.
+	rate float64
+	// The most tokens that a bucket can hold.
+	burst float64
+	now   func() time.Time
+	rooms map[string]*roomBucket
+}
+
+type roomBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRoomRateLimiter creates a RoomRateLimiter which allows rate events per
+// second into each room, with bursts of up to burst events. Returns nil,
+// which allows every event, if rate isn't positive.
+func NewRoomRateLimiter(rate, burst int) *RoomRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RoomRateLimiter{
+		rate:  float64(rate),
+		burst: float64(burst),
+		now:   time.Now,
+		rooms: make(map[string]*roomBucket),
+	}
+}
+
+// Allow takes a token from the bucket for the room, returning false if there
+// are none left. If l is nil then every event is allowed.
+func (l *RoomRateLimiter) Allow(roomID string) bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	bucket, ok := l.rooms[roomID]
+	if !ok {
+		if len(l.rooms) >= maxIdleRoomBuckets {
+			l.forgetFullBuckets(now)
+		}
+		bucket = &roomBucket{tokens: l.burst, last: now}
+		l.rooms[roomID] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// forgetFullBuckets removes the buckets which would have refilled by now,
+// since a new bucket for those rooms would be the same.
+func (l *RoomRateLimiter) forgetFullBuckets(now time.Time) {
+	for roomID, bucket := range l.rooms {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.rooms, roomID)
+		}
+	}
+}
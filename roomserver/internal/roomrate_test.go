@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that once a room has used up its burst of events, further new events in it are
+// rejected with a RoomRateLimitedError until its bucket refills, and that another room is unaffected meanwhile. The
+// roomserver has no database here, so the test would panic if a rejected event was processed.
+func TestRoomRateLimiter(t *testing.T) {
+	const busyRoomID = "!busy:kaer.morhen"
+	const quietRoomID = "!quiet:kaer.morhen"
+	now := time.Unix(1000, 0)
+	limiter := NewRoomRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(busyRoomID) {
+			t.Fatalf("event %d within the burst was not allowed", i)
+		}
+	}
+	if limiter.Allow(busyRoomID) {
+		t.Fatalf("event beyond the burst was allowed")
+	}
+
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"auth_events":[],"content":{"body":"Test Message"},"depth":5,"event_id":"$gl2T9l3qm0kUbiIJ:kaer.morhen","hashes":{"sha256":""},"origin":"kaer.morhen","origin_server_ts":0,"prev_events":[],"room_id":"!busy:kaer.morhen","sender":"@userid:kaer.morhen","signatures":{},"type":"m.room.message"}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	input := api.InputRoomEvent{Kind: api.KindNew, Event: event.Headered(gomatrixserverlib.RoomVersionV1)}
+	_, err = processRoomEvent(context.Background(), nil, nil, limiter, input)
+	var rateErr api.RoomRateLimitedError
+	if !errors.As(err, &rateErr) {
+		t.Fatalf("expected a RoomRateLimitedError, got %v", err)
+	}
+	if rateErr.RoomID != busyRoomID || rateErr.EventID != event.EventID() {
+		t.Errorf("wrong RoomRateLimitedError: got %+v", rateErr)
+	}
+
+	// The busy room doesn't affect a different room.
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow(quietRoomID) {
+			t.Fatalf("event %d in another room was not allowed", i)
+		}
+	}
+
+	// After a second the busy room has 2 more tokens.
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow(busyRoomID) {
+			t.Fatalf("event %d after refilling was not allowed", i)
+		}
+	}
+	if limiter.Allow(busyRoomID) {
+		t.Errorf("event beyond the sustained rate was allowed")
+	}
+
+	// Without a rate there is no limiter, and every event is allowed.
+	if NewRoomRateLimiter(0, 3) != nil {
+		t.Errorf("expected no limiter without a rate")
+	}
+}
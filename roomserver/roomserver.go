@@ -40,15 +40,25 @@ func SetupRoomServerComponent(
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
 
+	var mirrorTopics []string
+	for _, topic := range base.Cfg.Kafka.Topics.OutputRoomEventMirrors {
+		mirrorTopics = append(mirrorTopics, string(topic))
+	}
+
 	internalAPI := internal.RoomserverInternalAPI{
-		DB:                   roomserverDB,
-		Cfg:                  base.Cfg,
-		Producer:             base.KafkaProducer,
-		OutputRoomEventTopic: string(base.Cfg.Kafka.Topics.OutputRoomEvent),
-		ImmutableCache:       base.ImmutableCache,
-		ServerName:           base.Cfg.Matrix.ServerName,
-		FedClient:            fedClient,
-		KeyRing:              keyRing,
+		DB:                    roomserverDB,
+		Cfg:                   base.Cfg,
+		Producer:              base.KafkaProducer,
+		OutputRoomEventTopic:  string(base.Cfg.Kafka.Topics.OutputRoomEvent),
+		OutputRoomEventMirror: internal.NewOutputEventMirror(base.KafkaProducer, mirrorTopics, internal.MaxQueuedMirrorBatches),
+		ImmutableCache:        base.ImmutableCache,
+		ServerName:            base.Cfg.Matrix.ServerName,
+		FedClient:             fedClient,
+		KeyRing:               keyRing,
+		RoomRateLimiter: internal.NewRoomRateLimiter(
+			int(base.Cfg.RoomServer.MaxEventsPerSecondPerRoom),
+			int(base.Cfg.RoomServer.EventBurstPerRoom),
+		),
 	}
 
 	internalAPI.SetupHTTP(http.DefaultServeMux)
@@ -67,10 +67,19 @@ type Database interface {
 	StateEntriesForEventIDs(ctx context.Context, eventIDs []string) ([]types.StateEntry, error)
 	EventStateKeys(ctx context.Context, eventStateKeyNIDs []types.EventStateKeyNID) (map[types.EventStateKeyNID]string, error)
 	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	// Look up the references of the events with the given IDs, without loading
+	// their JSON. Event IDs which aren't stored are left out.
+	EventReferencesByID(ctx context.Context, eventIDs []string) ([]gomatrixserverlib.EventReference, error)
 	SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
 	GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error)
 	GetTransactionEventID(ctx context.Context, transactionID string, sessionID int64, userID string) (string, error)
+	// Record which server sent us an event over federation. Only the first
+	// origin recorded for an event is kept.
+	StoreEventOrigin(ctx context.Context, eventID string, origin gomatrixserverlib.ServerName) error
+	// Look up which server sent us an event over federation. Returns an empty
+	// server name if the event didn't arrive over federation or is unknown.
+	EventOrigin(ctx context.Context, eventID string) (gomatrixserverlib.ServerName, error)
 	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
 	// RoomNIDExcludingStubs is a special variation of RoomNID that will return 0 as if the room
 	// does not exist if the room has no latest events. This can happen when we've received an
@@ -107,6 +107,9 @@ const bulkSelectStateAtEventAndReferenceSQL = "" +
 const bulkSelectEventReferenceSQL = "" +
 	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const bulkSelectEventReferenceByIDSQL = "" +
+	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_id = ANY($1)"
+
 const bulkSelectEventIDSQL = "" +
 	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid = ANY($1)"
 
@@ -130,6 +133,7 @@ type eventStatements struct {
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
+	bulkSelectEventReferenceByIDStmt       *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
@@ -153,6 +157,7 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
+		{&s.bulkSelectEventReferenceByIDStmt, bulkSelectEventReferenceByIDSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
@@ -366,6 +371,28 @@ func (s *eventStatements) bulkSelectEventReference(
 	return results, nil
 }
 
+// bulkSelectEventReferenceByID returns the references of the events with the
+// given string event IDs. If an event ID is not in the database then it is
+// omitted from the results.
+func (s *eventStatements) bulkSelectEventReferenceByID(
+	ctx context.Context, eventIDs []string,
+) ([]gomatrixserverlib.EventReference, error) {
+	rows, err := s.bulkSelectEventReferenceByIDStmt.QueryContext(ctx, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "bulkSelectEventReferenceByID: rows.close() failed")
+	results := make([]gomatrixserverlib.EventReference, 0, len(eventIDs))
+	for rows.Next() {
+		var result gomatrixserverlib.EventReference
+		if err = rows.Scan(&result.EventID, &result.EventSHA256); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
 // bulkSelectEventID returns a map from numeric event ID to string event ID.
 func (s *eventStatements) bulkSelectEventID(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
 	rows, err := s.bulkSelectEventIDStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
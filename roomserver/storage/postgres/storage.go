@@ -245,6 +245,13 @@ func (d *Database) EventNIDs(
 	return d.statements.bulkSelectEventNID(ctx, eventIDs)
 }
 
+// EventReferencesByID implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventReferencesByID(
+	ctx context.Context, eventIDs []string,
+) ([]gomatrixserverlib.EventReference, error) {
+	return d.statements.bulkSelectEventReferenceByID(ctx, eventIDs)
+}
+
 // Events implements input.EventDatabase
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
@@ -385,6 +392,24 @@ func (d *Database) GetTransactionEventID(
 	return eventID, err
 }
 
+// StoreEventOrigin implements input.EventDatabase
+func (d *Database) StoreEventOrigin(
+	ctx context.Context, eventID string, origin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.insertEventOrigin(ctx, eventID, string(origin))
+}
+
+// EventOrigin implements input.EventDatabase
+func (d *Database) EventOrigin(
+	ctx context.Context, eventID string,
+) (gomatrixserverlib.ServerName, error) {
+	origin, err := d.statements.selectEventOrigin(ctx, eventID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return gomatrixserverlib.ServerName(origin), err
+}
+
 type roomRecentEventsUpdater struct {
 	transaction
 	d                       *Database
@@ -0,0 +1,71 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const eventOriginsSchema = `
+	CREATE TABLE IF NOT EXISTS roomserver_event_origins (
+		event_id TEXT NOT NULL PRIMARY KEY,
+		origin TEXT NOT NULL
+	);
+`
+
+const insertEventOriginSQL = `
+	INSERT INTO roomserver_event_origins (event_id, origin) VALUES ($1, $2)
+	  ON CONFLICT (event_id) DO NOTHING
+`
+
+const selectEventOriginSQL = `
+	SELECT origin FROM roomserver_event_origins WHERE event_id = $1
+`
+
+type eventOriginStatements struct {
+	insertEventOriginStmt *sql.Stmt
+	selectEventOriginStmt *sql.Stmt
+}
+
+func (s *eventOriginStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventOriginsSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertEventOriginStmt, insertEventOriginSQL},
+		{&s.selectEventOriginStmt, selectEventOriginSQL},
+	}.prepare(db)
+}
+
+func (s *eventOriginStatements) insertEventOrigin(
+	ctx context.Context, txn *sql.Tx, eventID string, origin string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.insertEventOriginStmt)
+	_, err = stmt.ExecContext(ctx, eventID, origin)
+	return
+}
+
+func (s *eventOriginStatements) selectEventOrigin(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (origin string, err error) {
+	stmt := common.TxStmt(txn, s.selectEventOriginStmt)
+	err = stmt.QueryRowContext(ctx, eventID).Scan(&origin)
+	return
+}
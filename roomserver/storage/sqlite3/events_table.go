@@ -82,6 +82,9 @@ const bulkSelectStateAtEventAndReferenceSQL = "" +
 const bulkSelectEventReferenceSQL = "" +
 	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_nid IN ($1)"
 
+const bulkSelectEventReferenceByIDSQL = "" +
+	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_id IN ($1)"
+
 const bulkSelectEventIDSQL = "" +
 	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid IN ($1)"
 
@@ -390,6 +393,41 @@ func (s *eventStatements) bulkSelectEventReference(
 	return results, nil
 }
 
+// bulkSelectEventReferenceByID returns the references of the events with the
+// given string event IDs. If an event ID is not in the database then it is
+// omitted from the results.
+func (s *eventStatements) bulkSelectEventReferenceByID(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) ([]gomatrixserverlib.EventReference, error) {
+	///////////////
+	iEventIDs := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		iEventIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectEventReferenceByIDSQL, "($1)", common.QueryVariadic(len(iEventIDs)), 1)
+	selectPrep, err := txn.Prepare(selectOrig)
+	if err != nil {
+		return nil, err
+	}
+	///////////////
+
+	selectStmt := common.TxStmt(txn, selectPrep)
+	rows, err := selectStmt.QueryContext(ctx, iEventIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "bulkSelectEventReferenceByID: rows.close() failed")
+	results := make([]gomatrixserverlib.EventReference, 0, len(eventIDs))
+	for rows.Next() {
+		var result gomatrixserverlib.EventReference
+		if err = rows.Scan(&result.EventID, &result.EventSHA256); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
 // bulkSelectEventID returns a map from numeric event ID to string event ID.
 func (s *eventStatements) bulkSelectEventID(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
 	///////////////
@@ -293,6 +293,17 @@ func (d *Database) EventNIDs(
 	return
 }
 
+// EventReferencesByID implements query.RoomserverQueryAPIDatabase
+func (d *Database) EventReferencesByID(
+	ctx context.Context, eventIDs []string,
+) (references []gomatrixserverlib.EventReference, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		references, err = d.statements.bulkSelectEventReferenceByID(ctx, txn, eventIDs)
+		return err
+	})
+	return
+}
+
 // Events implements input.EventDatabase
 func (d *Database) Events(
 	ctx context.Context, eventNIDs []types.EventNID,
@@ -477,6 +488,24 @@ func (d *Database) GetTransactionEventID(
 	return eventID, err
 }
 
+// StoreEventOrigin implements input.EventDatabase
+func (d *Database) StoreEventOrigin(
+	ctx context.Context, eventID string, origin gomatrixserverlib.ServerName,
+) error {
+	return d.statements.insertEventOrigin(ctx, nil, eventID, string(origin))
+}
+
+// EventOrigin implements input.EventDatabase
+func (d *Database) EventOrigin(
+	ctx context.Context, eventID string,
+) (gomatrixserverlib.ServerName, error) {
+	origin, err := d.statements.selectEventOrigin(ctx, nil, eventID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return gomatrixserverlib.ServerName(origin), err
+}
+
 type roomRecentEventsUpdater struct {
 	transaction
 	d                       *Database
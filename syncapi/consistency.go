@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// consistencyCheckInterval is how often the consistency checks are repeated
+// after the first one at startup.
+const consistencyCheckInterval = time.Hour
+
+var consistencyCheckFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "consistency_check_failures_total",
+		Help:      "Number of times that the sync API database was found to be inconsistent with itself or with the roomserver output log",
+	},
+	// check is "topology" if the topology has reached a different stream
+	// position to the events, or "offsets" if there are events but we haven't
+	// recorded how far we have consumed the roomserver output log.
+	[]string{"check"},
+)
+
+func init() {
+	prometheus.MustRegister(consistencyCheckFailures)
+}
+
+// consistencyChecker looks for signs that the events stored by the sync API
+// have got out of step with each other or with the roomserver output log that
+// they were consumed from, which otherwise goes unnoticed until pagination
+// breaks.
+//
+// The stream positions of events come from a sequence which is shared with
+// other streams such as account data and invites, and events can also be
+// written by backfilling, so they can't be compared with Kafka offsets
+// directly. Instead we check that the topology has reached the same stream
+// position as the events, and that we know where we have consumed the
+// roomserver output log up to if we have stored any events from it.
+type consistencyChecker struct {
+	db    storage.Database
+	topic string
+}
+
+// start checks the database once and then again every interval until the
+// context is done.
+func (c *consistencyChecker) start(ctx context.Context, interval time.Duration) {
+	c.check(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.check(ctx)
+			}
+		}
+	}()
+}
+
+// check runs the consistency checks, logging a warning and counting a failure
+// for each one that fails. Returns false if any of them failed.
+func (c *consistencyChecker) check(ctx context.Context) bool {
+	events, topology, err := c.db.MaxStreamPositions(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get stream positions for consistency check")
+		return false
+	}
+	ok := true
+	if events != topology {
+		logrus.WithFields(logrus.Fields{
+			"events_position":   events,
+			"topology_position": topology,
+		}).Warn("The topology has reached a different stream position to the events, pagination may be broken")
+		consistencyCheckFailures.WithLabelValues("topology").Inc()
+		ok = false
+	}
+	if events == 0 {
+		return ok
+	}
+	offsets, err := c.db.PartitionOffsets(ctx, c.topic)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get partition offsets for consistency check")
+		return false
+	}
+	if len(offsets) == 0 {
+		logrus.WithFields(logrus.Fields{
+			"events_position": events,
+			"topic":           c.topic,
+		}).Warn("There are events but no offsets for the roomserver output log, it will be consumed again from the start")
+		consistencyCheckFailures.WithLabelValues("offsets").Inc()
+		ok = false
+	}
+	return ok
+}
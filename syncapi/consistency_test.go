@@ -0,0 +1,110 @@
+package syncapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const testTopic = "roomserverOutput"
+
+func mustWriteMessage(t *testing.T, db *sqlite3.SyncServerDatasource) gomatrixserverlib.HeaderedEvent {
+	privateKey := ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+	b := gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"msgtype":"m.text","body":"hello"}`),
+		Type:    "m.room.message",
+		Sender:  "@hornet:hollow.knight",
+		RoomID:  "!hallownest:hollow.knight",
+		Depth:   1,
+	}
+	e, err := b.Build(time.Now(), "hollow.knight", "ed25519:syncapi_test", privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+	if _, err = db.WriteEvent(context.Background(), &ev, nil, nil, nil, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	return ev
+}
+
+// The purpose of this test is to check that the consistency checker passes when the events, the topology and the
+// partition offsets agree, and that it logs a warning and counts a failure when the topology has been moved to a
+// different stream position to the events or the partition offsets are missing.
+func TestConsistencyChecker(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	checker := &consistencyChecker{db: db, topic: testTopic}
+	topologyFailures := consistencyCheckFailures.WithLabelValues("topology")
+	offsetsFailures := consistencyCheckFailures.WithLabelValues("offsets")
+	topologyBefore := testutil.ToFloat64(topologyFailures)
+	offsetsBefore := testutil.ToFloat64(offsetsFailures)
+
+	// An empty database is consistent.
+	if !checker.check(ctx) {
+		t.Errorf("expected an empty database to be consistent")
+	}
+
+	ev := mustWriteMessage(t, db)
+	if err = db.SetPartitionOffset(ctx, testTopic, 0, 0); err != nil {
+		t.Fatalf("SetPartitionOffset returned %s", err)
+	}
+	hook.Reset()
+	if !checker.check(ctx) {
+		t.Errorf("expected the database to be consistent after writing an event")
+	}
+	if len(hook.AllEntries()) != 0 {
+		t.Errorf("expected no warnings, got %d", len(hook.AllEntries()))
+	}
+
+	// Move the event to a stream position that the events table hasn't reached.
+	events, _, err := db.MaxStreamPositions(ctx)
+	if err != nil {
+		t.Fatalf("MaxStreamPositions returned %s", err)
+	}
+	if err = db.WriteEventInTopology(ctx, &ev, events+10, true); err != nil {
+		t.Fatalf("WriteEventInTopology returned %s", err)
+	}
+	if checker.check(ctx) {
+		t.Errorf("expected the check to fail when the topology is ahead of the events")
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != logrus.WarnLevel || entry.Data["topology_position"] != events+10 {
+		t.Errorf("expected a warning about the topology position, got %+v", entry)
+	}
+	if got := testutil.ToFloat64(topologyFailures) - topologyBefore; got != 1 {
+		t.Errorf("wrong number of topology failures: got %v want 1", got)
+	}
+
+	// Check against a topic that we haven't consumed anything from.
+	hook.Reset()
+	if err = db.WriteEventInTopology(ctx, &ev, events, true); err != nil {
+		t.Fatalf("WriteEventInTopology returned %s", err)
+	}
+	checker.topic = "unconsumed"
+	if checker.check(ctx) {
+		t.Errorf("expected the check to fail when there are no partition offsets")
+	}
+	entry = hook.LastEntry()
+	if entry == nil || entry.Level != logrus.WarnLevel || entry.Data["topic"] != "unconsumed" {
+		t.Errorf("expected a warning about the partition offsets, got %+v", entry)
+	}
+	if got := testutil.ToFloat64(offsetsFailures) - offsetsBefore; got != 1 {
+		t.Errorf("wrong number of offsets failures: got %v want 1", got)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// retentionPurgeBatchSize is roughly the most events that are deleted in
+	// a single database transaction.
+	retentionPurgeBatchSize = 1000
+	// retentionPurgePause is how long to wait between batches, so that a
+	// purge doesn't hog the database.
+	retentionPurgePause = time.Second
+)
+
+// eventTypeRetention is the type of the state event which holds the room's
+// message retention policy, see MSC1763.
+const eventTypeRetention = "m.room.retention"
+
+// retentionPurger deletes the events in rooms with an m.room.retention policy
+// which are older than the policy's max_lifetime. Events in the room's current
+// state are kept, as are the events at the room's latest position, so that the
+// room can still be synced and paginated. The max_lifetime of each policy is
+// clamped to minLifetime and maxLifetime, unless they are zero.
+type retentionPurger struct {
+	db          storage.Database
+	minLifetime time.Duration
+	maxLifetime time.Duration
+	batchSize   int
+	pause       time.Duration
+	now         func() time.Time
+}
+
+func newRetentionPurger(db storage.Database, minLifetime, maxLifetime time.Duration) *retentionPurger {
+	return &retentionPurger{
+		db:          db,
+		minLifetime: minLifetime,
+		maxLifetime: maxLifetime,
+		batchSize:   retentionPurgeBatchSize,
+		pause:       retentionPurgePause,
+		now:         time.Now,
+	}
+}
+
+// start purges every room once and then again every interval until the
+// context is done.
+func (p *retentionPurger) start(ctx context.Context, interval time.Duration) {
+	go func() {
+		p.purge(ctx)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.purge(ctx)
+			}
+		}
+	}()
+}
+
+// purge deletes the expired events in every room which has a retention
+// policy, a batch at a time.
+func (p *retentionPurger) purge(ctx context.Context) {
+	policies, err := p.db.CurrentStateEventsOfType(ctx, eventTypeRetention, "")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get room retention policies")
+		return
+	}
+	for _, policy := range policies {
+		maxLifetime, ok := retentionMaxLifetime(policy.Content())
+		if !ok {
+			continue
+		}
+		maxLifetime = p.clamp(maxLifetime)
+		cutoff := gomatrixserverlib.AsTimestamp(p.now().Add(-maxLifetime))
+		total := 0
+		for {
+			purged, err := p.db.PurgeEventsBefore(ctx, policy.RoomID(), cutoff, p.batchSize)
+			if err != nil {
+				logrus.WithError(err).WithField("room_id", policy.RoomID()).Error("Failed to purge expired events")
+				break
+			}
+			total += purged
+			if purged == 0 || !p.wait(ctx) {
+				break
+			}
+		}
+		if total > 0 {
+			logrus.WithFields(logrus.Fields{
+				"room_id": policy.RoomID(),
+				"purged":  total,
+			}).Info("Purged events older than the room's retention policy")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// clamp limits the max_lifetime of a room's policy to the lifetimes that the
+// server allows.
+func (p *retentionPurger) clamp(maxLifetime time.Duration) time.Duration {
+	if p.minLifetime > 0 && maxLifetime < p.minLifetime {
+		return p.minLifetime
+	}
+	if p.maxLifetime > 0 && maxLifetime > p.maxLifetime {
+		return p.maxLifetime
+	}
+	return maxLifetime
+}
+
+// wait pauses between batches. Returns false if the context is done.
+func (p *retentionPurger) wait(ctx context.Context) bool {
+	if p.pause <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(p.pause)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retentionMaxLifetime returns the max_lifetime of a retention policy.
+// Returns false if the policy doesn't limit how long events are kept.
+func retentionMaxLifetime(content []byte) (time.Duration, bool) {
+	var policy struct {
+		// The maximum lifetime of an event in milliseconds.
+		MaxLifetime *int64 `json:"max_lifetime"`
+	}
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return 0, false
+	}
+	if policy.MaxLifetime == nil || *policy.MaxLifetime <= 0 {
+		return 0, false
+	}
+	return time.Duration(*policy.MaxLifetime) * time.Millisecond, true
+}
@@ -0,0 +1,221 @@
+package syncapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustWriteRoomEvent(
+	t *testing.T, db *sqlite3.SyncServerDatasource, evType string, stateKey *string, content string,
+	depth int64, ts time.Time,
+) gomatrixserverlib.HeaderedEvent {
+	privateKey := ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+	b := gomatrixserverlib.EventBuilder{
+		Content:  []byte(content),
+		Type:     evType,
+		StateKey: stateKey,
+		Sender:   "@hornet:hollow.knight",
+		RoomID:   "!hallownest:hollow.knight",
+		Depth:    depth,
+	}
+	e, err := b.Build(ts, "hollow.knight", "ed25519:syncapi_test", privateKey, gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+	var addState []gomatrixserverlib.HeaderedEvent
+	if stateKey != nil {
+		addState = append(addState, ev)
+	}
+	if _, err = db.WriteEvent(context.Background(), &ev, addState, nil, nil, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	return ev
+}
+
+// The purpose of this test is to check that the purger deletes the events in a room which are older than the room's
+// retention policy allows, along with their positions in the topology, while keeping newer events and the room's
+// current state.
+func TestRetentionPurger(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	now := time.Now()
+	longAgo := now.Add(-72 * time.Hour)
+	twoDaysAgo := now.Add(-48 * time.Hour)
+	emptyStateKey := ""
+	message := `{"msgtype":"m.text","body":"hello"}`
+
+	create := mustWriteRoomEvent(t, db, "m.room.create", &emptyStateKey, `{"creator":"@hornet:hollow.knight"}`, 1, longAgo)
+	policy := mustWriteRoomEvent(t, db, eventTypeRetention, &emptyStateKey, `{"max_lifetime":86400000}`, 2, longAgo)
+	old := []gomatrixserverlib.HeaderedEvent{
+		mustWriteRoomEvent(t, db, "m.room.message", nil, message, 3, twoDaysAgo),
+		mustWriteRoomEvent(t, db, "m.room.message", nil, message, 3, twoDaysAgo.Add(time.Second)),
+		mustWriteRoomEvent(t, db, "m.room.message", nil, message, 4, twoDaysAgo.Add(2*time.Second)),
+	}
+	recent := []gomatrixserverlib.HeaderedEvent{
+		mustWriteRoomEvent(t, db, "m.room.message", nil, message, 5, now),
+		mustWriteRoomEvent(t, db, "m.room.message", nil, message, 6, now),
+	}
+
+	// A batch size of one means that the two events at depth 3 have to be
+	// purged together in a batch which is bigger than the limit.
+	purger := newRetentionPurger(db, 0, 0)
+	purger.batchSize = 1
+	purger.pause = 0
+	purger.purge(ctx)
+
+	for _, ev := range old {
+		events, err := db.Events(ctx, []string{ev.EventID()})
+		if err != nil {
+			t.Fatalf("Events returned %s", err)
+		}
+		if len(events) != 0 {
+			t.Errorf("expected old event %s to be purged", ev.EventID())
+		}
+	}
+	for _, depth := range []int64{3, 4} {
+		streamEvents, err := db.EventsAtTopologicalPosition(ctx, create.RoomID(), types.StreamPosition(depth))
+		if err != nil {
+			t.Fatalf("EventsAtTopologicalPosition returned %s", err)
+		}
+		if len(streamEvents) != 0 {
+			t.Errorf("expected no events at depth %d in the topology, got %d", depth, len(streamEvents))
+		}
+	}
+	for _, ev := range append([]gomatrixserverlib.HeaderedEvent{create, policy}, recent...) {
+		events, err := db.Events(ctx, []string{ev.EventID()})
+		if err != nil {
+			t.Fatalf("Events returned %s", err)
+		}
+		if len(events) != 1 {
+			t.Errorf("expected event %s of type %s to be kept", ev.EventID(), ev.Type())
+		}
+	}
+	for _, depth := range []int64{1, 2, 5, 6} {
+		streamEvents, err := db.EventsAtTopologicalPosition(ctx, create.RoomID(), types.StreamPosition(depth))
+		if err != nil {
+			t.Fatalf("EventsAtTopologicalPosition returned %s", err)
+		}
+		if len(streamEvents) != 1 {
+			t.Errorf("expected one event at depth %d in the topology, got %d", depth, len(streamEvents))
+		}
+	}
+
+	// Purging again doesn't find anything else to delete.
+	purged, err := db.PurgeEventsBefore(ctx, create.RoomID(), gomatrixserverlib.AsTimestamp(now.Add(-24*time.Hour)), 10)
+	if err != nil {
+		t.Fatalf("PurgeEventsBefore returned %s", err)
+	}
+	if purged != 0 {
+		t.Errorf("expected nothing more to purge, purged %d events", purged)
+	}
+}
+
+// The purpose of this test is to check that purging the events which had prev_events that we never got also removes
+// them from the room's backward extremities, so that /messages doesn't backfill the purged history again.
+func TestRetentionPurgerPrunesBackwardExtremities(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	now := time.Now()
+	twoDaysAgo := now.Add(-48 * time.Hour)
+	emptyStateKey := ""
+	message := `{"msgtype":"m.text","body":"hello"}`
+
+	mustWriteRoomEvent(t, db, eventTypeRetention, &emptyStateKey, `{"max_lifetime":86400000}`, 1, twoDaysAgo)
+	b := gomatrixserverlib.EventBuilder{
+		Content:    []byte(message),
+		Type:       "m.room.message",
+		Sender:     "@hornet:hollow.knight",
+		RoomID:     "!hallownest:hollow.knight",
+		Depth:      2,
+		PrevEvents: []string{"$missing:hollow.knight"},
+	}
+	e, err := b.Build(twoDaysAgo, "hollow.knight", "ed25519:syncapi_test", ed25519.NewKeyFromSeed(make([]byte, 32)), gomatrixserverlib.RoomVersionV4)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	gappy := e.Headered(gomatrixserverlib.RoomVersionV4)
+	if _, err = db.WriteEvent(ctx, &gappy, nil, nil, nil, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+	mustWriteRoomEvent(t, db, "m.room.message", nil, message, 3, now)
+
+	extremities, err := db.BackwardExtremitiesForRoom(ctx, gappy.RoomID())
+	if err != nil {
+		t.Fatalf("BackwardExtremitiesForRoom returned %s", err)
+	}
+	if len(extremities) != 1 || extremities[0] != gappy.EventID() {
+		t.Fatalf("expected %s to be a backward extremity before purging, got %v", gappy.EventID(), extremities)
+	}
+
+	purger := newRetentionPurger(db, 0, 0)
+	purger.pause = 0
+	purger.purge(ctx)
+
+	extremities, err = db.BackwardExtremitiesForRoom(ctx, gappy.RoomID())
+	if err != nil {
+		t.Fatalf("BackwardExtremitiesForRoom returned %s", err)
+	}
+	if len(extremities) != 0 {
+		t.Errorf("expected no backward extremities after purging, got %v", extremities)
+	}
+}
+
+// The purpose of this test is to check that a room's max_lifetime is clamped to the lifetimes that the server allows,
+// and is left alone when the clamps are disabled.
+func TestRetentionPurgerClamp(t *testing.T) {
+	testCases := []struct {
+		minLifetime, maxLifetime time.Duration
+		policy                   time.Duration
+		want                     time.Duration
+	}{
+		{0, 0, time.Minute, time.Minute},
+		{time.Hour, 0, time.Minute, time.Hour},
+		{time.Hour, 0, 48 * time.Hour, 48 * time.Hour},
+		{0, 24 * time.Hour, 48 * time.Hour, 24 * time.Hour},
+		{time.Hour, 24 * time.Hour, 2 * time.Hour, 2 * time.Hour},
+	}
+	for _, tc := range testCases {
+		purger := newRetentionPurger(nil, tc.minLifetime, tc.maxLifetime)
+		if got := purger.clamp(tc.policy); got != tc.want {
+			t.Errorf("clamp(%s) with min %s and max %s = %s, want %s", tc.policy, tc.minLifetime, tc.maxLifetime, got, tc.want)
+		}
+	}
+}
+
+// The purpose of this test is to check that only retention policies with a positive max_lifetime cause events to be
+// purged.
+func TestRetentionMaxLifetime(t *testing.T) {
+	testCases := []struct {
+		content string
+		want    time.Duration
+		wantOK  bool
+	}{
+		{`{"max_lifetime":86400000}`, 24 * time.Hour, true},
+		{`{"max_lifetime":0}`, 0, false},
+		{`{"max_lifetime":-1}`, 0, false},
+		{`{"min_lifetime":86400000}`, 0, false},
+		{`{"max_lifetime":"forever"}`, 0, false},
+	}
+	for _, tc := range testCases {
+		got, ok := retentionMaxLifetime([]byte(tc.content))
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("retentionMaxLifetime(%s) = %s, %t, want %s, %t", tc.content, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type roomAliasesResp struct {
+	Aliases []string `json:"aliases"`
+}
+
+// OnIncomingRoomAliasesRequest implements GET /rooms/{roomID}/aliases, which
+// returns the local aliases of a room. The user must either be joined to the
+// room or the room must be world readable.
+func OnIncomingRoomAliasesRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	rsAPI api.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	canSee, err := canSeeRoom(req, db, roomID, device.UserID)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	if !canSee {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of this room."),
+		}
+	}
+
+	queryReq := api.GetAliasesForRoomIDRequest{RoomID: roomID}
+	var queryRes api.GetAliasesForRoomIDResponse
+	if err = rsAPI.GetAliasesForRoomID(req.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomAliasesResp{Aliases: queryRes.Aliases}
+	if res.Aliases == nil {
+		res.Aliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// canSeeRoom returns true if the user is joined to the room or if the room's
+// history visibility is world_readable.
+func canSeeRoom(req *http.Request, db storage.Database, roomID, userID string) (bool, error) {
+	membershipEvent, err := db.GetStateEvent(req.Context(), roomID, gomatrixserverlib.MRoomMember, userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
+		return false, err
+	}
+	if membershipEvent != nil {
+		if membership, merr := membershipEvent.Membership(); merr == nil && membership == gomatrixserverlib.Join {
+			return true, nil
+		}
+	}
+
+	visibilityEvent, err := db.GetStateEvent(req.Context(), roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEvent failed")
+		return false, err
+	}
+	var roomState []gomatrixserverlib.Event
+	if visibilityEvent != nil {
+		roomState = append(roomState, visibilityEvent.Unwrap())
+	}
+	return common.ResolveHistoryVisibility(roomState) == common.HistoryVisibilityWorldReadable, nil
+}
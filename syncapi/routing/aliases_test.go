@@ -0,0 +1,171 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	testOrigin      = gomatrixserverlib.ServerName("hollow.knight")
+	testRoomVersion = gomatrixserverlib.RoomVersionV4
+	testKeyID       = gomatrixserverlib.KeyID("ed25519:routing_test")
+	testPrivateKey  = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+	testJoinedUser = fmt.Sprintf("@hornet:%s", testOrigin)
+	testOtherUser  = fmt.Sprintf("@quirrel:%s", testOrigin)
+)
+
+// aliasesRoomserverAPI is a roomserver API which only implements GetAliasesForRoomID.
+type aliasesRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	aliases map[string][]string
+}
+
+func (r *aliasesRoomserverAPI) GetAliasesForRoomID(
+	ctx context.Context,
+	request *api.GetAliasesForRoomIDRequest,
+	response *api.GetAliasesForRoomIDResponse,
+) error {
+	response.Aliases = r.aliases[request.RoomID]
+	return nil
+}
+
+// mustCreateRoom writes a room created by testJoinedUser with the given history visibility to the database.
+func mustCreateRoom(t *testing.T, db storage.Database, roomID, historyVisibility string) {
+	emptyStateKey := ""
+	joinedUser := testJoinedUser
+	builders := []gomatrixserverlib.EventBuilder{
+		{
+			Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testJoinedUser)),
+			Type:     gomatrixserverlib.MRoomCreate,
+			StateKey: &emptyStateKey,
+		},
+		{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &joinedUser,
+		},
+		{
+			Content:  []byte(fmt.Sprintf(`{"history_visibility":"%s"}`, historyVisibility)),
+			Type:     "m.room.history_visibility",
+			StateKey: &emptyStateKey,
+		},
+	}
+	for _, ev := range mustCreateEvents(t, roomID, builders) {
+		ev := ev
+		_, err := db.WriteEvent(
+			context.Background(), &ev, []gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, nil, nil, false,
+		)
+		if err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+}
+
+// mustCreateEvents builds a chain of events sent by testJoinedUser, each of which has the one before it as its prev_event.
+func mustCreateEvents(t *testing.T, roomID string, builders []gomatrixserverlib.EventBuilder) (events []gomatrixserverlib.HeaderedEvent) {
+	var prevEventIDs []string
+	for i := range builders {
+		b := &builders[i]
+		b.RoomID = roomID
+		b.Sender = testJoinedUser
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEventIDs
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events = append(events, e.Headered(testRoomVersion))
+		prevEventIDs = []string{e.EventID()}
+	}
+	return
+}
+
+func TestRoomAliases(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	privateRoomID := fmt.Sprintf("!private:%s", testOrigin)
+	worldReadableRoomID := fmt.Sprintf("!worldreadable:%s", testOrigin)
+	noAliasesRoomID := fmt.Sprintf("!noaliases:%s", testOrigin)
+	mustCreateRoom(t, db, privateRoomID, "shared")
+	mustCreateRoom(t, db, worldReadableRoomID, "world_readable")
+	mustCreateRoom(t, db, noAliasesRoomID, "shared")
+	rsAPI := &aliasesRoomserverAPI{
+		aliases: map[string][]string{
+			privateRoomID:       {"#private:hollow.knight", "#secret:hollow.knight"},
+			worldReadableRoomID: {"#public:hollow.knight"},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		userID      string
+		roomID      string
+		wantCode    int
+		wantAliases []string
+	}{
+		{
+			name:        "joined member",
+			userID:      testJoinedUser,
+			roomID:      privateRoomID,
+			wantCode:    http.StatusOK,
+			wantAliases: []string{"#private:hollow.knight", "#secret:hollow.knight"},
+		},
+		{
+			name:     "non-member in a private room",
+			userID:   testOtherUser,
+			roomID:   privateRoomID,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:        "non-member in a world readable room",
+			userID:      testOtherUser,
+			roomID:      worldReadableRoomID,
+			wantCode:    http.StatusOK,
+			wantAliases: []string{"#public:hollow.knight"},
+		},
+		{
+			name:        "room with no aliases",
+			userID:      testJoinedUser,
+			roomID:      noAliasesRoomID,
+			wantCode:    http.StatusOK,
+			wantAliases: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+tc.roomID+"/aliases", nil)
+		device := &authtypes.Device{UserID: tc.userID}
+		res := OnIncomingRoomAliasesRequest(req, device, db, rsAPI, tc.roomID)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.name, res.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		got, ok := res.JSON.(roomAliasesResp)
+		if !ok {
+			t.Errorf("%s: wrong response type: got %T", tc.name, res.JSON)
+			continue
+		}
+		if !reflect.DeepEqual(got.Aliases, tc.wantAliases) {
+			t.Errorf("%s: wrong aliases: got %v want %v", tc.name, got.Aliases, tc.wantAliases)
+		}
+	}
+}
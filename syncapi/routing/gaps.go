@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// roomGapsStatusSynced means that we have every earlier event of the
+	// events that we know of in the room.
+	roomGapsStatusSynced = "synced"
+	// roomGapsStatusHasGaps means that some of the events in the room refer
+	// to earlier events that we don't have.
+	roomGapsStatusHasGaps = "has_gaps"
+)
+
+type roomGapsResp struct {
+	Status string `json:"status"`
+	// The events whose prev_events we don't have all of.
+	BackwardExtremities []string `json:"backward_extremities"`
+}
+
+// OnIncomingRoomGapsRequest implements GET /rooms/{roomID}/gaps, which reports
+// whether we have all of the history of a room up to its latest events, or
+// whether there are gaps which need backfilling. The user must either be
+// joined to the room or the room must be world readable.
+func OnIncomingRoomGapsRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database, roomID string,
+) util.JSONResponse {
+	canSee, err := canSeeRoom(req, db, roomID, device.UserID)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	if !canSee {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of this room."),
+		}
+	}
+
+	backwardExtremities, err := db.BackwardExtremitiesForRoom(req.Context(), roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.BackwardExtremitiesForRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := roomGapsResp{
+		Status:              roomGapsStatusSynced,
+		BackwardExtremities: backwardExtremities,
+	}
+	if len(backwardExtremities) > 0 {
+		res.Status = roomGapsStatusHasGaps
+	} else {
+		res.BackwardExtremities = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that a room whose events all have their prev_events stored is reported as
+// synced, and that a room with an event whose prev_event we don't have is reported as having gaps at that event.
+func TestRoomGaps(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	syncedRoomID := fmt.Sprintf("!synced:%s", testOrigin)
+	gappyRoomID := fmt.Sprintf("!gappy:%s", testOrigin)
+	mustCreateRoom(t, db, syncedRoomID, "shared")
+	mustCreateRoom(t, db, gappyRoomID, "shared")
+
+	// An event arrives over federation referring to an event we never got.
+	b := gomatrixserverlib.EventBuilder{
+		RoomID:     gappyRoomID,
+		Sender:     testJoinedUser,
+		Type:       "m.room.message",
+		Content:    []byte(`{"msgtype":"m.text","body":"hello"}`),
+		Depth:      10,
+		PrevEvents: []string{fmt.Sprintf("$missing:%s", testOrigin)},
+	}
+	e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	ev := e.Headered(testRoomVersion)
+	if _, err = db.WriteEvent(context.Background(), &ev, nil, nil, nil, nil, false); err != nil {
+		t.Fatalf("WriteEvent failed: %s", err)
+	}
+
+	testCases := []struct {
+		name       string
+		userID     string
+		roomID     string
+		wantCode   int
+		wantStatus string
+		wantEvents []string
+	}{
+		{
+			name:       "synced room",
+			userID:     testJoinedUser,
+			roomID:     syncedRoomID,
+			wantCode:   http.StatusOK,
+			wantStatus: roomGapsStatusSynced,
+			wantEvents: []string{},
+		},
+		{
+			name:       "room with a gap",
+			userID:     testJoinedUser,
+			roomID:     gappyRoomID,
+			wantCode:   http.StatusOK,
+			wantStatus: roomGapsStatusHasGaps,
+			wantEvents: []string{ev.EventID()},
+		},
+		{
+			name:     "non-member",
+			userID:   testOtherUser,
+			roomID:   gappyRoomID,
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.dendrite/rooms/"+tc.roomID+"/gaps", nil)
+		device := &authtypes.Device{UserID: tc.userID}
+		res := OnIncomingRoomGapsRequest(req, device, db, tc.roomID)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.name, res.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		got, ok := res.JSON.(roomGapsResp)
+		if !ok {
+			t.Errorf("%s: wrong response type: got %T", tc.name, res.JSON)
+			continue
+		}
+		if got.Status != tc.wantStatus {
+			t.Errorf("%s: wrong status: got %q want %q", tc.name, got.Status, tc.wantStatus)
+		}
+		if !reflect.DeepEqual(got.BackwardExtremities, tc.wantEvents) {
+			t.Errorf("%s: wrong backward extremities: got %v want %v", tc.name, got.BackwardExtremities, tc.wantEvents)
+		}
+	}
+}
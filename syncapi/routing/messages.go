@@ -53,6 +53,10 @@ type messagesResp struct {
 
 const defaultMessagesLimit = 10
 
+// maxBackfillEvents is the maximum number of events that a single request to
+// /messages will backfill over federation.
+const maxBackfillEvents = 100
+
 // OnIncomingMessagesRequest implements the /messages endpoint from the
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
@@ -283,9 +287,13 @@ func (r *messagesReq) handleEmptyEventsSlice() (
 	events []gomatrixserverlib.HeaderedEvent, err error,
 ) {
 	backwardExtremities, err := r.db.BackwardExtremitiesForRoom(r.ctx, r.roomID)
+	if err != nil {
+		return
+	}
 
-	// Check if we have backward extremities for this room.
-	if len(backwardExtremities) > 0 {
+	// Check if we have backward extremities for this room. Backfilling only
+	// makes sense if we're going backward.
+	if len(backwardExtremities) > 0 && r.backwardOrdering {
 		// If so, retrieve as much events as needed through backfilling.
 		events, err = r.backfill(r.roomID, backwardExtremities, r.limit)
 		if err != nil {
@@ -293,7 +301,8 @@ func (r *messagesReq) handleEmptyEventsSlice() (
 		}
 	} else {
 		// If not, it means the slice was empty because we reached the room's
-		// creation, so return an empty slice.
+		// creation (or its latest event, if going forward), so return an
+		// empty slice.
 		events = []gomatrixserverlib.HeaderedEvent{}
 	}
 
@@ -369,11 +378,16 @@ func (e eventsByDepth) Less(i, j int) bool {
 // See: https://matrix.org/docs/spec/server_server/latest#get-matrix-federation-v1-backfill-roomid
 // It also stores the PDUs retrieved from the remote homeserver's response to
 // the database.
+// No more than maxBackfillEvents are requested, and if the remote homeserver
+// returns more events than requested then only the most recent ones are kept.
 // Returns with an empty string if the remote homeserver didn't return with any
 // event, or if there is no remote homeserver to contact.
 // Returns an error if there was an issue with retrieving the list of servers in
 // the room or sending the request.
 func (r *messagesReq) backfill(roomID string, fromEventIDs []string, limit int) ([]gomatrixserverlib.HeaderedEvent, error) {
+	if limit > maxBackfillEvents {
+		limit = maxBackfillEvents
+	}
 	var res api.QueryBackfillResponse
 	err := r.rsAPI.QueryBackfill(context.Background(), &api.QueryBackfillRequest{
 		RoomID:            roomID,
@@ -395,6 +409,9 @@ func (r *messagesReq) backfill(roomID string, fromEventIDs []string, limit int)
 	//  - anything less than the depth OR
 	//  - anything with the same depth and a lower stream position.
 	sort.Sort(eventsByDepth(res.Events))
+	if len(res.Events) > limit {
+		res.Events = res.Events[len(res.Events)-limit:]
+	}
 
 	// Store the events in the database, while marking them as unfit to show
 	// up in responses to sync requests.
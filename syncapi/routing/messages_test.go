@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// backfillRoomserverAPI is a roomserver API which only implements QueryBackfill. It returns every ancestor of the
+// requested events from history, ignoring the limit, like a remote server which returns more events than asked for.
+type backfillRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	history  map[string]gomatrixserverlib.HeaderedEvent
+	requests []api.QueryBackfillRequest
+	disabled bool
+}
+
+func (r *backfillRoomserverAPI) QueryBackfill(
+	ctx context.Context,
+	request *api.QueryBackfillRequest,
+	response *api.QueryBackfillResponse,
+) error {
+	if r.disabled {
+		return errors.New("unexpected backfill request")
+	}
+	r.requests = append(r.requests, *request)
+	var front []string
+	for _, eventID := range request.EarliestEventsIDs {
+		ev := r.history[eventID]
+		front = append(front, ev.PrevEventIDs()...)
+	}
+	for len(front) > 0 {
+		ev, ok := r.history[front[0]]
+		front = front[1:]
+		if ok {
+			response.Events = append(response.Events, ev)
+			front = append(front, ev.PrevEventIDs()...)
+		}
+	}
+	return nil
+}
+
+func mustGetMessages(
+	t *testing.T, db storage.Database, rsAPI api.RoomserverInternalAPI, roomID, from string, limit int,
+) messagesResp {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testOrigin
+	query := url.Values{
+		"from":  {from},
+		"dir":   {"b"},
+		"limit": {fmt.Sprintf("%d", limit)},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/rooms/"+roomID+"/messages?"+query.Encode(), nil)
+	res := OnIncomingMessagesRequest(req, db, roomID, nil, rsAPI, cfg)
+	if res.Code != http.StatusOK {
+		t.Fatalf("OnIncomingMessagesRequest returned %d: %+v", res.Code, res.JSON)
+	}
+	return res.JSON.(messagesResp)
+}
+
+func assertChunk(t *testing.T, got messagesResp, want []gomatrixserverlib.HeaderedEvent) {
+	var gotIDs, wantIDs []string
+	for _, ev := range got.Chunk {
+		gotIDs = append(gotIDs, ev.EventID)
+	}
+	for _, ev := range want {
+		wantIDs = append(wantIDs, ev.EventID())
+	}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Errorf("wrong events in chunk: got %v want %v", gotIDs, wantIDs)
+	}
+}
+
+// The purpose of this test is to check that paginating backwards past the earliest event that we have for a room
+// backfills older events, that no more events are backfilled than are needed or than maxBackfillEvents, and that the
+// backfilled events can be paginated locally afterwards.
+func TestMessagesBackfill(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	roomID := fmt.Sprintf("!backfill:%s", testOrigin)
+	emptyStateKey := ""
+	joinedUser := testJoinedUser
+	builders := []gomatrixserverlib.EventBuilder{
+		{
+			Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testJoinedUser)),
+			Type:     gomatrixserverlib.MRoomCreate,
+			StateKey: &emptyStateKey,
+		},
+		{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &joinedUser,
+		},
+	}
+	for i := 0; i < 3; i++ {
+		builders = append(builders, gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+		})
+	}
+	events := mustCreateEvents(t, roomID, builders)
+	create, member, messages := events[0], events[1], events[2:]
+	rsAPI := &backfillRoomserverAPI{
+		history: make(map[string]gomatrixserverlib.HeaderedEvent),
+	}
+	for _, ev := range events {
+		rsAPI.history[ev.EventID()] = ev
+	}
+
+	// We only have the messages, so the first of them is a backward extremity.
+	for i := range messages {
+		if _, err = db.WriteEvent(context.Background(), &messages[i], nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+	latest := messages[len(messages)-1]
+	depth, stream, err := db.EventPositionInTopology(context.Background(), latest.EventID())
+	if err != nil {
+		t.Fatalf("EventPositionInTopology failed: %s", err)
+	}
+	from := types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, depth, stream).String()
+
+	// We need one more event than we have. The remote server returns both the
+	// member and create events, but only the most recent one should be kept.
+	res := mustGetMessages(t, db, rsAPI, roomID, from, len(messages)+1)
+	assertChunk(t, res, []gomatrixserverlib.HeaderedEvent{messages[2], messages[1], messages[0], member})
+	if len(rsAPI.requests) != 1 || rsAPI.requests[0].Limit != 1 {
+		t.Fatalf("expected a single backfill request for 1 event, got %+v", rsAPI.requests)
+	}
+
+	// Carry on paginating from where we left off, asking for many more events
+	// than we are allowed to backfill.
+	res = mustGetMessages(t, db, rsAPI, roomID, res.End, 1000)
+	assertChunk(t, res, []gomatrixserverlib.HeaderedEvent{create})
+	if len(rsAPI.requests) != 2 || rsAPI.requests[1].Limit != maxBackfillEvents {
+		t.Fatalf("expected a second backfill request for %d events, got %+v", maxBackfillEvents, rsAPI.requests)
+	}
+
+	// Everything has been backfilled now, so paginating from the start again
+	// should return the whole room without asking the remote server.
+	rsAPI.disabled = true
+	res = mustGetMessages(t, db, rsAPI, roomID, from, 10)
+	assertChunk(t, res, []gomatrixserverlib.HeaderedEvent{messages[2], messages[1], messages[0], member, create})
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type relationsResp struct {
+	Chunk         []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch     string                          `json:"next_batch,omitempty"`
+	OriginalEvent gomatrixserverlib.ClientEvent   `json:"original_event"`
+}
+
+const (
+	defaultRelationsLimit = 5
+	maxRelationsLimit     = 100
+)
+
+// OnIncomingRelationsRequest implements the MSC2675 relations endpoint, which
+// returns the events that relate to a given event, most recent first. If
+// relType or eventType are not empty then only relations of that rel_type or
+// event type are returned.
+func OnIncomingRelationsRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	roomID, eventID, relType, eventType string,
+) util.JSONResponse {
+	var from *types.PaginationToken
+	if s := req.URL.Query().Get("from"); s != "" {
+		var err error
+		from, err = types.NewPaginationTokenFromString(s)
+		if err != nil || from.Type != types.PaginationTokenTypeTopology {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from parameter"),
+			}
+		}
+	}
+
+	limit := defaultRelationsLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxRelationsLimit {
+			limit = maxRelationsLimit
+		}
+	}
+
+	// Only return relations if the user can see the event that they relate
+	// to, i.e. if they are joined to the room or the room is world readable.
+	// Otherwise we act as though the event doesn't exist.
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Event not found"),
+	}
+	originalEvents, err := db.Events(req.Context(), []string{eventID})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(originalEvents) == 0 || originalEvents[0].RoomID() != roomID {
+		return notFound
+	}
+	canSee, err := canSeeRoom(req, db, roomID, device.UserID)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	if !canSee {
+		return notFound
+	}
+
+	streamEvents, next, err := db.RelatedEvents(req.Context(), roomID, eventID, relType, eventType, from, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.RelatedEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := relationsResp{
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(
+			db.StreamEventsToEvents(device, streamEvents), gomatrixserverlib.FormatAll,
+		),
+		OriginalEvent: gomatrixserverlib.HeaderedToClientEvent(originalEvents[0], gomatrixserverlib.FormatAll),
+	}
+	if next != nil {
+		res.NextBatch = next.String()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,66 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The purpose of this test is to check that the relations of an event are only returned to users who can see the
+// room that it is in, and that everyone else is told that the event doesn't exist.
+func TestRelationsHistoryVisibility(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	sharedRoomID := fmt.Sprintf("!shared:%s", testOrigin)
+	worldReadableRoomID := fmt.Sprintf("!worldreadable:%s", testOrigin)
+	mustCreateRoom(t, db, sharedRoomID, "shared")
+	mustCreateRoom(t, db, worldReadableRoomID, "world_readable")
+
+	parentIDs := make(map[string]string)
+	for _, roomID := range []string{sharedRoomID, worldReadableRoomID} {
+		b := gomatrixserverlib.EventBuilder{
+			RoomID:  roomID,
+			Sender:  testJoinedUser,
+			Type:    "m.room.message",
+			Content: []byte(`{"msgtype":"m.text","body":"hello"}`),
+			Depth:   10,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(testRoomVersion)
+		if _, err = db.WriteEvent(context.Background(), &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		parentIDs[roomID] = ev.EventID()
+	}
+
+	testCases := []struct {
+		name     string
+		userID   string
+		roomID   string
+		wantCode int
+	}{
+		{"member", testJoinedUser, sharedRoomID, http.StatusOK},
+		{"non-member", testOtherUser, sharedRoomID, http.StatusNotFound},
+		{"non-member of world readable room", testOtherUser, worldReadableRoomID, http.StatusOK},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/rooms/"+tc.roomID+"/relations/"+parentIDs[tc.roomID], nil)
+		device := &authtypes.Device{UserID: tc.userID}
+		res := OnIncomingRelationsRequest(req, device, db, tc.roomID, parentIDs[tc.roomID], "", "")
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: wrong status code: got %d want %d", tc.name, res.Code, tc.wantCode)
+		}
+	}
+}
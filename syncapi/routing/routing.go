@@ -31,6 +31,8 @@ import (
 )
 
 const pathPrefixR0 = "/_matrix/client/r0"
+const pathPrefixUnstable = "/_matrix/client/unstable"
+const pathPrefixAdmin = "/_dendrite/admin/v1"
 
 // Setup configures the given mux with sync-server listeners
 //
@@ -44,6 +46,7 @@ func Setup(
 	cfg *config.Dendrite,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+	unstableMux := apiMux.PathPrefix(pathPrefixUnstable).Subrouter()
 
 	authData := auth.Data{
 		AccountDB:   nil,
@@ -63,4 +66,65 @@ func Setup(
 		}
 		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], federation, rsAPI, cfg)
 	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/aliases", common.MakeAuthAPI("room_aliases", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingRoomAliasesRequest(req, device, syncDB, rsAPI, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	relationsHandler := common.MakeAuthAPI("room_relations", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingRelationsRequest(req, device, syncDB, vars["roomID"], vars["eventID"], vars["relType"], vars["eventType"])
+	})
+	unstableMux.Handle("/rooms/{roomID}/relations/{eventID}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", relationsHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	unstableMux.Handle("/org.matrix.dendrite/rooms/{roomID}/gaps", common.MakeAuthAPI("room_gaps", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingRoomGapsRequest(req, device, syncDB, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	timestampToEventClient := &federationTimestampToEventClient{federation: federation, cfg: cfg}
+	unstableMux.Handle("/org.matrix.msc3030/rooms/{roomID}/timestamp_to_event", common.MakeAuthAPI("room_timestamp_to_event", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := common.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return OnIncomingTimestampToEventRequest(req, device, syncDB, timestampToEventClient, cfg, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	// The admin endpoints are only served if they are protected.
+	adminAuth := common.BasicAuth{
+		Username: cfg.SyncAPI.AdminBasicAuth.Username,
+		Password: cfg.SyncAPI.AdminBasicAuth.Password,
+	}
+	if adminAuth.Username != "" && adminAuth.Password != "" {
+		adminMux := apiMux.PathPrefix(pathPrefixAdmin).Subrouter()
+		adminMux.Handle("/rooms/{roomID}/topology", common.WrapHandlerInBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			OnIncomingRoomTopologyExportRequest(w, req, syncDB, vars["roomID"])
+		}), adminAuth)).Methods(http.MethodGet)
+		adminMux.Handle("/rooms/{roomID}/topology/orphans", common.WrapHandlerInBasicAuth(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			vars, err := common.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			OnIncomingRoomTopologyOrphansRequest(w, req, syncDB, vars["roomID"])
+		}), adminAuth)).Methods(http.MethodGet, http.MethodDelete)
+	}
 }
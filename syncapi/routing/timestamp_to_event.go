@@ -0,0 +1,173 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type timestampToEventResp struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// timestampToEventClient asks a remote server for the event in a room which is
+// closest to a timestamp.
+type timestampToEventClient interface {
+	LookupTimestampToEvent(
+		ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string,
+	) (timestampToEventResp, error)
+}
+
+// federationTimestampToEventClient makes MSC3030 requests with a federation
+// client, which doesn't know about the endpoint yet.
+type federationTimestampToEventClient struct {
+	federation *gomatrixserverlib.FederationClient
+	cfg        *config.Dendrite
+}
+
+func (c *federationTimestampToEventClient) LookupTimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string,
+) (res timestampToEventResp, err error) {
+	query := url.Values{
+		"ts":  {strconv.FormatUint(uint64(ts), 10)},
+		"dir": {dir},
+	}
+	path := "/_matrix/federation/unstable/org.matrix.msc3030/timestamp_to_event/" + url.PathEscape(roomID) + "?" + query.Encode()
+	req := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+	if err = req.Sign(c.cfg.Matrix.ServerName, c.cfg.Matrix.KeyID, c.cfg.Matrix.PrivateKey); err != nil {
+		return
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return
+	}
+	err = c.federation.DoRequestAndParseResponse(ctx, httpReq, &res)
+	return
+}
+
+// OnIncomingTimestampToEventRequest implements the MSC3030 timestamp_to_event
+// endpoint, which returns the event in a room whose origin_server_ts is
+// closest to the given timestamp, looking forwards in time if dir is "f" and
+// backwards if it is "b". If we don't have a matching event then the other
+// servers in the room are asked in turn, as they may have events that we
+// don't, e.g. from before we joined.
+func OnIncomingTimestampToEventRequest(
+	req *http.Request, device *authtypes.Device, db storage.Database,
+	client timestampToEventClient, cfg *config.Dendrite, roomID string,
+) util.JSONResponse {
+	ts, err := strconv.ParseUint(req.URL.Query().Get("ts"), 10, 63)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := req.URL.Query().Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	canSee, err := canSeeRoom(req, db, roomID, device.UserID)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	if !canSee {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of this room."),
+		}
+	}
+
+	eventID, eventTS, err := db.EventNearestTimestamp(req.Context(), roomID, gomatrixserverlib.Timestamp(ts), dir == "f")
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.EventNearestTimestamp failed")
+		return jsonerror.InternalServerError()
+	}
+	if eventID != "" {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: timestampToEventResp{EventID: eventID, OriginServerTS: eventTS},
+		}
+	}
+
+	servers, err := remoteServersInRoom(req, db, roomID, cfg.Matrix.ServerName)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	for _, server := range servers {
+		res, err := client.LookupTimestampToEvent(req.Context(), server, roomID, gomatrixserverlib.Timestamp(ts), dir)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("server", server).Warn("Failed to look up timestamp_to_event over federation")
+			continue
+		}
+		if res.EventID != "" {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Unable to find an event in the given direction"),
+	}
+}
+
+// remoteServersInRoom returns the servers other than our own which have users
+// joined to the room, according to its current state.
+func remoteServersInRoom(
+	req *http.Request, db storage.Database, roomID string, ourServerName gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ServerName, error) {
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateFilter.Types = []string{gomatrixserverlib.MRoomMember}
+	stateEvents, err := db.GetStateEventsForRoom(req.Context(), roomID, &stateFilter)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.GetStateEventsForRoom failed")
+		return nil, err
+	}
+	seen := map[gomatrixserverlib.ServerName]bool{ourServerName: true}
+	var servers []gomatrixserverlib.ServerName
+	for _, ev := range stateEvents {
+		// Not every database applies the type filter.
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if membership, merr := ev.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+			continue
+		}
+		_, server, serr := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if serr != nil || seen[server] {
+			continue
+		}
+		seen[server] = true
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
@@ -0,0 +1,230 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testTimestampToEventClient is a timestampToEventClient which returns the given responses for each server, and
+// records which servers were asked.
+type testTimestampToEventClient struct {
+	responses map[gomatrixserverlib.ServerName]timestampToEventResp
+	asked     []gomatrixserverlib.ServerName
+}
+
+func (c *testTimestampToEventClient) LookupTimestampToEvent(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, ts gomatrixserverlib.Timestamp, dir string,
+) (timestampToEventResp, error) {
+	c.asked = append(c.asked, s)
+	res, ok := c.responses[s]
+	if !ok {
+		return res, errors.New("server unreachable")
+	}
+	return res, nil
+}
+
+// mustWriteEventsAt builds a chain of events, one every 10 seconds from the given time, and writes them to the
+// database. The events are sent by testJoinedUser unless the builder has a sender.
+func mustWriteEventsAt(
+	t *testing.T, db storage.Database, roomID string, start time.Time, builders []gomatrixserverlib.EventBuilder,
+) (events []gomatrixserverlib.HeaderedEvent) {
+	var prevEventIDs []string
+	for i := range builders {
+		b := &builders[i]
+		b.RoomID = roomID
+		if b.Sender == "" {
+			b.Sender = testJoinedUser
+		}
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEventIDs
+		e, err := b.Build(start.Add(time.Duration(i)*10*time.Second), testOrigin, testKeyID, testPrivateKey, testRoomVersion)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(testRoomVersion)
+		var addStateEvents []gomatrixserverlib.HeaderedEvent
+		var addStateEventIDs []string
+		if ev.StateKey() != nil {
+			addStateEvents = append(addStateEvents, ev)
+			addStateEventIDs = append(addStateEventIDs, ev.EventID())
+		}
+		if _, err = db.WriteEvent(context.Background(), &ev, addStateEvents, addStateEventIDs, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		events = append(events, ev)
+		prevEventIDs = []string{ev.EventID()}
+	}
+	return
+}
+
+// roomBuilders returns the builders for a room created by testJoinedUser, with any other members joined, followed by
+// the given number of messages.
+func roomBuilders(otherMembers []string, messages int) []gomatrixserverlib.EventBuilder {
+	emptyStateKey := ""
+	joinedUser := testJoinedUser
+	builders := []gomatrixserverlib.EventBuilder{
+		{
+			Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testJoinedUser)),
+			Type:     gomatrixserverlib.MRoomCreate,
+			StateKey: &emptyStateKey,
+		},
+		{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &joinedUser,
+		},
+		{
+			Content:  []byte(`{"history_visibility":"shared"}`),
+			Type:     "m.room.history_visibility",
+			StateKey: &emptyStateKey,
+		},
+	}
+	for i := range otherMembers {
+		builders = append(builders, gomatrixserverlib.EventBuilder{
+			Content:  []byte(`{"membership":"join"}`),
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &otherMembers[i],
+			Sender:   otherMembers[i],
+		})
+	}
+	for i := 0; i < messages; i++ {
+		builders = append(builders, gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+		})
+	}
+	return builders
+}
+
+func mustTimestampToEvent(
+	t *testing.T, db storage.Database, client timestampToEventClient, roomID string, ts time.Time, dir string,
+) (int, interface{}) {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testOrigin
+	query := url.Values{
+		"ts":  {fmt.Sprintf("%d", gomatrixserverlib.AsTimestamp(ts))},
+		"dir": {dir},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.msc3030/rooms/"+roomID+"/timestamp_to_event?"+query.Encode(), nil)
+	device := &authtypes.Device{UserID: testJoinedUser}
+	res := OnIncomingTimestampToEventRequest(req, device, db, client, cfg, roomID)
+	return res.Code, res.JSON
+}
+
+// The purpose of this test is to check that the event closest to a timestamp is found when looking forwards and
+// backwards, that an event at exactly the timestamp matches in both directions, and that there is no match past either
+// end of the room.
+func TestTimestampToEvent(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	roomID := fmt.Sprintf("!timestamps:%s", testOrigin)
+	start := time.Unix(1500000000, 0)
+	events := mustWriteEventsAt(t, db, roomID, start, roomBuilders(nil, 3))
+	first, second := events[len(events)-3], events[len(events)-2]
+	last := events[len(events)-1]
+
+	testCases := []struct {
+		name string
+		ts   time.Time
+		dir  string
+		want *gomatrixserverlib.HeaderedEvent
+	}{
+		{"forwards between events", first.OriginServerTS().Time().Add(time.Second), "f", &second},
+		{"backwards between events", second.OriginServerTS().Time().Add(-time.Second), "b", &first},
+		{"forwards at an event", second.OriginServerTS().Time(), "f", &second},
+		{"backwards at an event", second.OriginServerTS().Time(), "b", &second},
+		{"forwards after the last event", last.OriginServerTS().Time().Add(time.Second), "f", nil},
+		{"backwards before the first event", start.Add(-time.Second), "b", nil},
+	}
+	for _, tc := range testCases {
+		client := &testTimestampToEventClient{}
+		code, body := mustTimestampToEvent(t, db, client, roomID, tc.ts, tc.dir)
+		if len(client.asked) != 0 {
+			t.Errorf("%s: expected no federation requests for a room without other servers, got %v", tc.name, client.asked)
+		}
+		if tc.want == nil {
+			if code != http.StatusNotFound {
+				t.Errorf("%s: wrong status code: got %d want %d", tc.name, code, http.StatusNotFound)
+			}
+			continue
+		}
+		if code != http.StatusOK {
+			t.Errorf("%s: wrong status code: got %d want %d: %+v", tc.name, code, http.StatusOK, body)
+			continue
+		}
+		want := timestampToEventResp{EventID: tc.want.EventID(), OriginServerTS: tc.want.OriginServerTS()}
+		if got := body.(timestampToEventResp); got != want {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, want)
+		}
+	}
+
+	for _, query := range []url.Values{
+		{"dir": {"f"}},
+		{"ts": {"yesterday"}, "dir": {"f"}},
+		{"ts": {"-1"}, "dir": {"f"}},
+		{"ts": {"1500000000000"}},
+		{"ts": {"1500000000000"}, "dir": {"sideways"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/unstable/org.matrix.msc3030/rooms/"+roomID+"/timestamp_to_event?"+query.Encode(), nil)
+		device := &authtypes.Device{UserID: testJoinedUser}
+		res := OnIncomingTimestampToEventRequest(req, device, db, &testTimestampToEventClient{}, &config.Dendrite{}, roomID)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("query %s: wrong status code: got %d want %d", query.Encode(), res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// The purpose of this test is to check that if we don't have an event in the requested direction then the other
+// servers in the room are asked, skipping any which fail, until one of them has a matching event.
+func TestTimestampToEventFederationFallback(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	roomID := fmt.Sprintf("!fallback:%s", testOrigin)
+	start := time.Unix(1500000000, 0)
+	mustWriteEventsAt(t, db, roomID, start, roomBuilders([]string{"@zote:white.lady", "@bretta:dirtmouth"}, 1))
+
+	remote := timestampToEventResp{EventID: "$older:dirtmouth", OriginServerTS: gomatrixserverlib.AsTimestamp(start.Add(-time.Hour))}
+	client := &testTimestampToEventClient{
+		responses: map[gomatrixserverlib.ServerName]timestampToEventResp{
+			"dirtmouth": remote,
+		},
+	}
+	code, body := mustTimestampToEvent(t, db, client, roomID, start.Add(-time.Minute), "b")
+	if code != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want %d: %+v", code, http.StatusOK, body)
+	}
+	if got := body.(timestampToEventResp); got != remote {
+		t.Errorf("got %+v want %+v", got, remote)
+	}
+	// The servers can be asked in any order, but we must never ask ourselves.
+	for _, server := range client.asked {
+		if server == testOrigin {
+			t.Errorf("expected only remote servers to be asked, got %v", client.asked)
+		}
+	}
+
+	// No federation requests are needed if we have a matching event.
+	client = &testTimestampToEventClient{}
+	if code, body = mustTimestampToEvent(t, db, client, roomID, start, "f"); code != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want %d: %+v", code, http.StatusOK, body)
+	}
+	if len(client.asked) != 0 {
+		t.Errorf("expected no federation requests, got %v", client.asked)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/util"
+)
+
+// OnIncomingRoomTopologyExportRequest implements the admin endpoint
+// GET /_dendrite/admin/v1/rooms/{roomID}/topology, which exports the
+// position of every event in the topology of a room, in topological then
+// stream order, so that gaps and collisions which break pagination in the
+// room can be found. The positions are written as a JSON array one at a
+// time rather than being built into a single response, since large rooms
+// have a lot of them. It only reads the database.
+func OnIncomingRoomTopologyExportRequest(
+	w http.ResponseWriter, req *http.Request, db storage.Database, roomID string,
+) {
+	positions, err := db.FullTopologyForRoom(req.Context(), roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.FullTopologyForRoom failed")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = writeTopology(w, positions); err != nil {
+		// The status has already been sent, so the client sees a truncated
+		// response.
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to write the topology of the room")
+	}
+}
+
+type orphanedTopologyResponse struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+// OnIncomingRoomTopologyOrphansRequest implements the admin endpoints
+// GET and DELETE /_dendrite/admin/v1/rooms/{roomID}/topology/orphans. GET
+// lists the events in the topology of a room which aren't in the events table,
+// which pagination returns but can't load. DELETE removes them from the
+// topology and lists the events which were removed.
+func OnIncomingRoomTopologyOrphansRequest(
+	w http.ResponseWriter, req *http.Request, db storage.Database, roomID string,
+) {
+	var eventIDs []string
+	var err error
+	if req.Method == http.MethodDelete {
+		eventIDs, err = db.RemoveOrphanedTopology(req.Context(), roomID)
+	} else {
+		eventIDs, err = db.OrphanedTopologyEventIDs(req.Context(), roomID)
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Errorf("Failed to find orphaned events in the topology of room %s", roomID)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if req.Method == http.MethodDelete && len(eventIDs) > 0 {
+		util.GetLogger(req.Context()).WithField("room_id", roomID).Infof("Removed %d orphaned events from the topology", len(eventIDs))
+	}
+	if eventIDs == nil {
+		eventIDs = []string{}
+	}
+	responseJSON, err := json.Marshal(orphanedTopologyResponse{eventIDs})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseJSON)
+}
+
+// writeTopology writes the positions as a JSON array, encoding each of them
+// in turn.
+func writeTopology(w io.Writer, positions []types.TopologyPosition) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := range positions {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		positionJSON, err := json.Marshal(positions[i])
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(positionJSON); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
@@ -0,0 +1,56 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// The purpose of this test is to check that the topology export writes the positions of the events in a room as a JSON
+// array in topological order, and an empty array for a room we know nothing about.
+func TestRoomTopologyExport(t *testing.T) {
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	roomID := fmt.Sprintf("!topology:%s", testOrigin)
+	mustCreateRoom(t, db, roomID, "shared")
+
+	req := httptest.NewRequest(http.MethodGet, pathPrefixAdmin+"/rooms/"+roomID+"/topology", nil)
+	rec := httptest.NewRecorder()
+	OnIncomingRoomTopologyExportRequest(rec, req, db, roomID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %d want %d", rec.Code, http.StatusOK)
+	}
+	var got []types.TopologyPosition
+	if err = json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to unmarshal response %q: %s", rec.Body.String(), err)
+	}
+	want, err := db.FullTopologyForRoom(req.Context(), roomID)
+	if err != nil {
+		t.Fatalf("FullTopologyForRoom returned %s", err)
+	}
+	if len(want) == 0 {
+		t.Fatalf("expected the room to have events")
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong topology: got %+v want %+v", got, want)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Depth < got[i-1].Depth {
+			t.Errorf("event %s at depth %d is after depth %d", got[i].EventID, got[i].Depth, got[i-1].Depth)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	OnIncomingRoomTopologyExportRequest(rec, req, db, "!unknown:"+string(testOrigin))
+	if rec.Code != http.StatusOK || rec.Body.String() != "[]" {
+		t.Errorf("wrong response for an unknown room: got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -45,6 +45,9 @@ type Database interface {
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error)
+	// CurrentStateEventsOfType returns the current state event with the given type and state key in every room
+	// which has one.
+	CurrentStateEventsOfType(ctx context.Context, evType, stateKey string) ([]gomatrixserverlib.HeaderedEvent, error)
 	// GetStateEventsForRoom fetches the state events for a given room.
 	// Returns an empty slice if no state events could be found for this room.
 	// Returns an error if there was an issue with the retrieval.
@@ -55,10 +58,13 @@ type Database interface {
 	// sync response for the given user. Events returned will include any client
 	// transaction IDs associated with the given device. These transaction IDs come
 	// from when the device sent the event via an API that included a transaction
-	// ID.
-	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.PaginationToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
+	// ID. If fromPos is from a sync which was cut short by the limits then the
+	// rooms which it didn't send are sent, as far as the limits allow.
+	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.PaginationToken, numRecentEventsPerRoom int, wantFullState bool, limits types.SyncLimits) (*types.Response, error)
 	// CompleteSync returns a complete /sync API response for the given user.
-	CompleteSync(ctx context.Context, userID string, numRecentEventsPerRoom int) (*types.Response, error)
+	// If the rooms don't all fit in the limits then the next_batch token of the
+	// response says which of them are still to be sent.
+	CompleteSync(ctx context.Context, device authtypes.Device, numRecentEventsPerRoom int, limits types.SyncLimits) (*types.Response, error)
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
 	// Returns a map following the format data[roomID] = []dataTypes
@@ -88,14 +94,105 @@ type Database interface {
 	// RemoveTypingUser removes a typing user from the typing cache.
 	// Returns the newly calculated sync position for typing notifications.
 	RemoveTypingUser(userID, roomID string) types.StreamPosition
+	// SetPresence updates the presence of a user in the presence cache.
+	// Returns the newly calculated sync position for presence.
+	SetPresence(userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp) types.StreamPosition
+	// SetReceipt updates the receipt of the given type for a user in a room in the receipt cache.
+	// Returns the newly calculated sync position for receipts.
+	SetReceipt(roomID, receiptType, userID, eventID string, ts gomatrixserverlib.Timestamp) types.StreamPosition
+	// AddSendToDeviceMessage queues a message for a device, to be sent in /sync until the device acknowledges it by
+	// syncing from a later position. Returns the send-to-device position of the message.
+	AddSendToDeviceMessage(ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent) (types.StreamPosition, error)
+	// SetDeviceListChanged records that the device list of a user has changed in the device list cache.
+	// Returns the newly calculated sync position for device lists.
+	SetDeviceListChanged(userID string) types.StreamPosition
+	// EventNearestTimestamp returns the ID and origin_server_ts of the event in the room whose origin_server_ts
+	// is closest to the given timestamp, looking forwards in time if forward is true and backwards otherwise. An
+	// event at exactly the given timestamp matches in either direction. Returns an empty event ID if there is no
+	// such event.
+	EventNearestTimestamp(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, forward bool) (string, gomatrixserverlib.Timestamp, error)
+	// RelatedEvents returns up to limit events in the given room which relate to the given
+	// event through an m.relates_to key in their content, from the most recent backwards.
+	// Empty relType or eventType match any rel_type or event type. If from is not nil then
+	// only events which are topologically before it are returned. If there may be more
+	// related events then a topology token to fetch them from is also returned.
+	RelatedEvents(ctx context.Context, roomID, eventID, relType, eventType string, from *types.PaginationToken, limit int) ([]types.StreamEvent, *types.PaginationToken, error)
 	// GetEventsInRange retrieves all of the events on a given ordering using the
-	// given extremities and limit.
+	// given extremities and limit. For topological tokens, as used by /messages,
+	// the "from" token is inclusive and events at the depth of the "to" token
+	// are excluded.
 	GetEventsInRange(ctx context.Context, from, to *types.PaginationToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
+	// WriteEventInTopology stores the position of an event in its room's topology. If upsert
+	// is false then, as with WriteEvent, an event that is already in the topology keeps its
+	// existing position, and a new event is stored at pos unchanged. Events at the same depth
+	// are ordered by stream position. If upsert is true then any position previously stored for the event
+	// is replaced, e.g. to correct the position of an event that has been re-input, and any
+	// other event at the new position is removed.
+	WriteEventInTopology(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, upsert bool) error
+	// RebuildTopologyForRoom replaces the topology of a room with one derived from the depth and stream
+	// position of every event that is stored for the room, e.g. to repair it after rows have gone missing.
+	// It is safe to call more than once.
+	RebuildTopologyForRoom(ctx context.Context, roomID string) error
+	// PurgeEventsBefore deletes up to limit of the events in a room which were sent before the given time,
+	// oldest first, along with their positions in the room's topology. Events in the room's current state
+	// and events at the room's latest position are kept. The backward extremities of the deleted events are
+	// removed, so that they aren't backfilled again. Returns the number of events which were deleted.
+	PurgeEventsBefore(ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, limit int) (int, error)
+	// EventIDsInTopologicalRange returns the IDs of the events in a room which are
+	// between the lower and upper bounds of the room's topology, in chronological
+	// or antichronological order. Each bound says whether an event at exactly that
+	// position is included, e.g. /context needs both bounds to be exclusive so that
+	// the event it is centred on isn't returned twice. A limit which isn't positive is replaced with a default,
+	// and limits over a maximum are reduced to it. Returns an error if any of the positions are negative.
+	EventIDsInTopologicalRange(ctx context.Context, roomID string, lower, upper types.TopologyBound, limit int, chronologicalOrder bool) ([]string, error)
+	// MaxStreamPositions returns the latest stream position in the events table and in the topology. They
+	// should always be the same, as each event is written to both. Either is zero if there are no events.
+	MaxStreamPositions(ctx context.Context) (events types.StreamPosition, topology types.StreamPosition, err error)
+	// TopologyCollisions returns the depths in the topology of a room which are shared by more than minEvents
+	// events, with the number of events at each, in ascending order of depth. This is a diagnostic to help
+	// operators spot rooms with pathological DAGs, which are slow to paginate through.
+	TopologyCollisions(ctx context.Context, roomID string, minEvents int) ([]types.TopologyCollision, error)
+	// FullTopologyForRoom returns the depth and stream position of every event in the topology of a room, in
+	// topological then stream order. This is a diagnostic to help operators find gaps and collisions in rooms whose
+	// pagination is broken, and reads the whole topology of the room at once.
+	FullTopologyForRoom(ctx context.Context, roomID string) ([]types.TopologyPosition, error)
+	// RoomsByRecentActivity returns the rooms which a user is joined to, with the latest stream position in the
+	// topology of each, most recently active first, to back a sliding sync (MSC3575) room list. It skips offset rooms
+	// and returns up to limit of the rest. A limit which isn't positive is replaced with a default, and limits over a
+	// maximum are reduced to it. Returns an error if the offset is negative.
+	RoomsByRecentActivity(ctx context.Context, userID string, limit, offset int) ([]types.RoomActivity, error)
+	// RepairTopologyStreamPositions moves the events in the topology of a room which share their stream position with
+	// another event of the room to new stream positions, so that the stream positions within the room strictly
+	// increase and events at the same depth have a single order again, e.g. after an upsert. Returns the IDs of the
+	// events which were moved, which is empty if the stream positions already increase.
+	// types.NonMonotonicStreamPositions finds them without moving them.
+	RepairTopologyStreamPositions(ctx context.Context, roomID string) ([]string, error)
+	// EventIDsInStreamRange returns the IDs of up to limit events of every room whose stream positions in the topology
+	// are after from and no later than to, in stream order, for consumers such as search indexing or bulk export which
+	// walk the events of all rooms. A limit which isn't positive is replaced with a default, and limits over a maximum
+	// are reduced to it. Returns an error if either position is negative.
+	EventIDsInStreamRange(ctx context.Context, from, to types.StreamPosition, limit int) ([]string, error)
+	// OrphanedTopologyEventIDs returns the IDs of the events in the topology of a room which aren't in the events
+	// table, in topological then stream order. Pagination returns these event IDs but can't load the events.
+	OrphanedTopologyEventIDs(ctx context.Context, roomID string) ([]string, error)
+	// RemoveOrphanedTopology removes the events in the topology of a room which aren't in the events table, returning
+	// their IDs. Events which are in the events table but not the topology are restored by RebuildTopologyForRoom.
+	RemoveOrphanedTopology(ctx context.Context, roomID string) ([]string, error)
 	// EventPositionInTopology returns the depth and stream position of the given event.
 	EventPositionInTopology(ctx context.Context, eventID string) (depth types.StreamPosition, stream types.StreamPosition, err error)
 	// EventsAtTopologicalPosition returns all of the events matching a given
 	// position in the topology of a given room.
 	EventsAtTopologicalPosition(ctx context.Context, roomID string, pos types.StreamPosition) ([]types.StreamEvent, error)
+	// EventIDsForwardFromTopologicalPosition returns the IDs of up to limit events at or after the given position
+	// in the topology of a given room, in topological order, so that a client can catch up from that position. A
+	// limit which isn't positive is replaced with a default, and limits over a maximum are reduced to it.
+	EventIDsForwardFromTopologicalPosition(ctx context.Context, roomID string, pos types.StreamPosition, limit int) ([]string, error)
+	// EventIDsAroundTopologicalPosition returns the IDs of up to beforeLimit events immediately before and up to
+	// afterLimit events immediately after the given topological and stream position in a given room, such as the
+	// position of an event that a client wants the context of. The event at the position itself isn't included. The
+	// events before are nearest first, and the events after are in topological order. A limit which isn't positive
+	// selects no events on that side, and limits over a maximum are reduced to it.
+	EventIDsAroundTopologicalPosition(ctx context.Context, roomID string, pos, spos types.StreamPosition, beforeLimit, afterLimit int) (before, after []string, err error)
 	// BackwardExtremitiesForRoom returns the event IDs of all of the backward
 	// extremities we know of for a given room.
 	BackwardExtremitiesForRoom(ctx context.Context, roomID string) (backwardExtremities []string, err error)
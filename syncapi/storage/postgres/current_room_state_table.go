@@ -70,6 +70,11 @@ const deleteRoomStateByEventIDSQL = "" +
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
 
+const selectJoinedRoomsAfterSQL = "" +
+	"SELECT room_id, added_at FROM syncapi_current_room_state" +
+	" WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join' AND added_at > $2" +
+	" ORDER BY added_at ASC"
+
 const selectCurrentStateSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1" +
 	" AND ( $2::text[] IS NULL OR     sender  = ANY($2)  )" +
@@ -82,9 +87,19 @@ const selectCurrentStateSQL = "" +
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
 
+const selectUsersSharingRoomsSQL = "" +
+	"SELECT DISTINCT state_key FROM syncapi_current_room_state" +
+	" WHERE type = 'm.room.member' AND membership = 'join' AND room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND membership = 'join' AND state_key = $1" +
+	" )"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
+const selectStateEventsOfTypeSQL = "" +
+	"SELECT headered_event_json FROM syncapi_current_room_state WHERE type = $1 AND state_key = $2"
+
 const selectEventsWithEventIDsSQL = "" +
 	// TODO: The session_id and transaction_id blanks are here because otherwise
 	// the rowsToStreamEvents expects there to be exactly five columns. We need to
@@ -97,10 +112,13 @@ type currentRoomStateStatements struct {
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
 	selectRoomIDsWithMembershipStmt *sql.Stmt
+	selectJoinedRoomsAfterStmt      *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
+	selectUsersSharingRoomsStmt     *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	selectStateEventsOfTypeStmt     *sql.Stmt
 }
 
 func (s *currentRoomStateStatements) prepare(db *sql.DB) (err error) {
@@ -117,18 +135,27 @@ func (s *currentRoomStateStatements) prepare(db *sql.DB) (err error) {
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return
 	}
+	if s.selectJoinedRoomsAfterStmt, err = db.Prepare(selectJoinedRoomsAfterSQL); err != nil {
+		return
+	}
 	if s.selectCurrentStateStmt, err = db.Prepare(selectCurrentStateSQL); err != nil {
 		return
 	}
 	if s.selectJoinedUsersStmt, err = db.Prepare(selectJoinedUsersSQL); err != nil {
 		return
 	}
+	if s.selectUsersSharingRoomsStmt, err = db.Prepare(selectUsersSharingRoomsSQL); err != nil {
+		return
+	}
 	if s.selectEventsWithEventIDsStmt, err = db.Prepare(selectEventsWithEventIDsSQL); err != nil {
 		return
 	}
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return
 	}
+	if s.selectStateEventsOfTypeStmt, err = db.Prepare(selectStateEventsOfTypeSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -156,6 +183,29 @@ func (s *currentRoomStateStatements) selectJoinedUsers(
 	return result, rows.Err()
 }
 
+// selectUsersSharingRooms returns the IDs of all users who are joined to at
+// least one of the rooms the given user is joined to, including the user.
+func (s *currentRoomStateStatements) selectUsersSharingRooms(
+	ctx context.Context, txn *sql.Tx, userID string,
+) ([]string, error) {
+	stmt := common.TxStmt(txn, s.selectUsersSharingRoomsStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectUsersSharingRooms: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var memberUserID string
+		if err := rows.Scan(&memberUserID); err != nil {
+			return nil, err
+		}
+		result = append(result, memberUserID)
+	}
+	return result, rows.Err()
+}
+
 // SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 func (s *currentRoomStateStatements) selectRoomIDsWithMembership(
 	ctx context.Context,
@@ -181,6 +231,37 @@ func (s *currentRoomStateStatements) selectRoomIDsWithMembership(
 	return result, rows.Err()
 }
 
+// joinedRoom is a room which a user is joined to, along with the position at
+// which their membership event became part of the room state.
+type joinedRoom struct {
+	roomID  string
+	addedAt types.StreamPosition
+}
+
+// selectJoinedRoomsAfter returns the rooms which the given user is joined to
+// where their membership event became part of the room state after the given
+// position, in the order that it did.
+func (s *currentRoomStateStatements) selectJoinedRoomsAfter(
+	ctx context.Context, txn *sql.Tx, userID string, afterPos types.StreamPosition,
+) ([]joinedRoom, error) {
+	stmt := common.TxStmt(txn, s.selectJoinedRoomsAfterStmt)
+	rows, err := stmt.QueryContext(ctx, userID, afterPos)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectJoinedRoomsAfter: rows.close() failed")
+
+	var result []joinedRoom
+	for rows.Next() {
+		var room joinedRoom
+		if err := rows.Scan(&room.roomID, &room.addedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, room)
+	}
+	return result, rows.Err()
+}
+
 // CurrentState returns all the current state events for the given room.
 func (s *currentRoomStateStatements) selectCurrentState(
 	ctx context.Context, txn *sql.Tx, roomID string,
@@ -275,9 +356,9 @@ func rowsToEvents(rows *sql.Rows) ([]gomatrixserverlib.HeaderedEvent, error) {
 }
 
 func (s *currentRoomStateStatements) selectStateEvent(
-	ctx context.Context, roomID, evType, stateKey string,
+	ctx context.Context, txn *sql.Tx, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
-	stmt := s.selectStateEventStmt
+	stmt := common.TxStmt(txn, s.selectStateEventStmt)
 	var res []byte
 	err := stmt.QueryRowContext(ctx, roomID, evType, stateKey).Scan(&res)
 	if err == sql.ErrNoRows {
@@ -292,3 +373,16 @@ func (s *currentRoomStateStatements) selectStateEvent(
 	}
 	return &ev, err
 }
+
+// selectStateEventsOfType returns the current state event with the given type
+// and state key in every room which has one.
+func (s *currentRoomStateStatements) selectStateEventsOfType(
+	ctx context.Context, evType, stateKey string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	rows, err := s.selectStateEventsOfTypeStmt.QueryContext(ctx, evType, stateKey)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectStateEventsOfType: rows.close() failed")
+	return rowsToEvents(rows)
+}
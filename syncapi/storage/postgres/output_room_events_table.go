@@ -79,6 +79,9 @@ const insertEventSQL = "" +
 const selectEventsSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events WHERE event_id = ANY($1)"
 
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
 const selectRecentEventsSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
 	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
@@ -94,6 +97,11 @@ const selectEarlyEventsSQL = "" +
 	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id ASC LIMIT $4"
 
+const selectRoomEventsSQL = "" +
+	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
+	" WHERE room_id = $1" +
+	" ORDER BY id ASC"
+
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
@@ -113,10 +121,12 @@ const selectStateInRangeSQL = "" +
 type outputRoomEventsStatements struct {
 	insertEventStmt               *sql.Stmt
 	selectEventsStmt              *sql.Stmt
+	deleteEventsStmt              *sql.Stmt
 	selectMaxEventIDStmt          *sql.Stmt
 	selectRecentEventsStmt        *sql.Stmt
 	selectRecentEventsForSyncStmt *sql.Stmt
 	selectEarlyEventsStmt         *sql.Stmt
+	selectRoomEventsStmt          *sql.Stmt
 	selectStateInRangeStmt        *sql.Stmt
 }
 
@@ -131,6 +141,9 @@ func (s *outputRoomEventsStatements) prepare(db *sql.DB) (err error) {
 	if s.selectEventsStmt, err = db.Prepare(selectEventsSQL); err != nil {
 		return
 	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return
+	}
 	if s.selectMaxEventIDStmt, err = db.Prepare(selectMaxEventIDSQL); err != nil {
 		return
 	}
@@ -143,6 +156,9 @@ func (s *outputRoomEventsStatements) prepare(db *sql.DB) (err error) {
 	if s.selectEarlyEventsStmt, err = db.Prepare(selectEarlyEventsSQL); err != nil {
 		return
 	}
+	if s.selectRoomEventsStmt, err = db.Prepare(selectRoomEventsSQL); err != nil {
+		return
+	}
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return
 	}
@@ -350,6 +366,20 @@ func (s *outputRoomEventsStatements) selectEarlyEvents(
 	return events, nil
 }
 
+// selectRoomEvents returns every event that we have stored for the given room,
+// from oldest to latest.
+func (s *outputRoomEventsStatements) selectRoomEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]types.StreamEvent, error) {
+	stmt := common.TxStmt(txn, s.selectRoomEventsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomEvents: rows.close() failed")
+	return rowsToStreamEvents(rows)
+}
+
 // selectEvents returns the events for the given event IDs. If an event is
 // missing from the database, it will be omitted.
 func (s *outputRoomEventsStatements) selectEvents(
@@ -364,6 +394,16 @@ func (s *outputRoomEventsStatements) selectEvents(
 	return rowsToStreamEvents(rows)
 }
 
+// deleteEvents removes the events with the given event IDs. Event IDs which
+// aren't in the database are ignored.
+func (s *outputRoomEventsStatements) deleteEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteEventsStmt)
+	_, err = stmt.ExecContext(ctx, pq.StringArray(eventIDs))
+	return
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	var result []types.StreamEvent
 	for rows.Next() {
@@ -17,8 +17,10 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -35,26 +37,62 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events_topology (
 );
 -- The topological order will be used in events selection and ordering
 -- CREATE UNIQUE INDEX IF NOT EXISTS syncapi_event_topological_position_idx ON syncapi_output_room_events_topology(topological_position, stream_position, room_id);
+-- Finds the latest stream position in a room.
+CREATE INDEX IF NOT EXISTS syncapi_topology_room_stream_position_idx ON syncapi_output_room_events_topology(room_id, stream_position);
+-- Walks the events of every room in stream order.
+CREATE INDEX IF NOT EXISTS syncapi_topology_stream_position_idx ON syncapi_output_room_events_topology(stream_position);
 `
 
+// Only a conflict on the event ID is ignored, so that writing an event again
+// keeps its existing position. Any other conflict is an error.
 const insertEventInTopologySQL = "" +
 	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position)" +
 	" VALUES ($1, $2, $3, $4)" +
-	" ON CONFLICT DO NOTHING"
+	" ON CONFLICT (event_id) DO NOTHING"
 
+const insertOrUpdateEventInTopologySQL = "" +
+	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (event_id) DO UPDATE SET topological_position = $5, stream_position = $6"
+
+const updateStreamPositionInTopologySQL = "" +
+	"UPDATE syncapi_output_room_events_topology SET stream_position = $1 WHERE event_id = $2"
+
+const deleteOtherEventsAtPositionSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND topological_position = $2 AND stream_position = $3 AND event_id != $4"
+
+const deleteTopologyForRoomSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
+
+// Events which are part of the room's current state are never selected or
+// deleted here, so that the current state of the room can always be paged to.
+const selectEventIDsBelowPositionSQL = "" +
+	"SELECT event_id, topological_position FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND topological_position < $2" +
+	" AND event_id NOT IN (SELECT event_id FROM syncapi_current_room_state WHERE room_id = $3)" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $4"
+
+const deleteTopologyBelowPositionSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND topological_position < $2" +
+	" AND event_id NOT IN (SELECT event_id FROM syncapi_current_room_state WHERE room_id = $3)"
+
+// The bounds are always inclusive here: exclusive bounds are turned into
+// inclusive ones by selectEventIDsInRange.
 const selectEventIDsInRangeASCSQL = "" +
 	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	" ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $3 AND stream_position >= $4))" +
+	" AND (topological_position < $5 OR (topological_position = $6 AND stream_position <= $7))" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $8"
 
 const selectEventIDsInRangeDESCSQL = "" +
-	"SELECT event_id  FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	" ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $3 AND stream_position >= $4))" +
+	" AND (topological_position < $5 OR (topological_position = $6 AND stream_position <= $7))" +
+	" ORDER BY topological_position DESC, stream_position DESC LIMIT $8"
 
 const selectPositionInTopologySQL = "" +
 	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
@@ -64,17 +102,112 @@ const selectMaxPositionInTopologySQL = "" +
 	"SELECT MAX(topological_position), stream_position FROM syncapi_output_room_events_topology" +
 	" WHERE room_id = $1 ORDER BY stream_position DESC"
 
+// The stream positions in the topology are copied from the events table, so
+// both should have reached the same position.
+const selectMaxStreamPositionsSQL = "" +
+	"SELECT (SELECT MAX(id) FROM syncapi_output_room_events)," +
+	" (SELECT MAX(stream_position) FROM syncapi_output_room_events_topology)"
+
 const selectEventIDsFromPositionSQL = "" +
 	"SELECT event_id FROM syncapi_output_room_events_topology" +
 	" WHERE room_id = $1 AND topological_position = $2"
 
+const selectEventIDsForwardFromPositionSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND topological_position >= $2" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $3"
+
+// The event at the position itself is in neither set of neighbours.
+const selectEventIDsBeforePositionSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND (topological_position < $2 OR (topological_position = $3 AND stream_position < $4))" +
+	" ORDER BY topological_position DESC, stream_position DESC LIMIT $5"
+
+const selectEventIDsAfterPositionSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND (topological_position > $2 OR (topological_position = $3 AND stream_position > $4))" +
+	" ORDER BY topological_position ASC, stream_position ASC LIMIT $5"
+
+const selectTopologyCollisionsSQL = "" +
+	"SELECT topological_position, COUNT(*) FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" GROUP BY topological_position HAVING COUNT(*) > $2" +
+	" ORDER BY topological_position ASC"
+
+const selectFullTopologyForRoomSQL = "" +
+	"SELECT event_id, topological_position, stream_position FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" ORDER BY topological_position ASC, stream_position ASC"
+
+const selectOrphanedTopologySQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND NOT EXISTS (SELECT 1 FROM syncapi_output_room_events WHERE syncapi_output_room_events.event_id = syncapi_output_room_events_topology.event_id)" +
+	" ORDER BY topological_position ASC, stream_position ASC"
+
+const deleteOrphanedTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1" +
+	" AND NOT EXISTS (SELECT 1 FROM syncapi_output_room_events WHERE syncapi_output_room_events.event_id = syncapi_output_room_events_topology.event_id)"
+
+// Rooms with the same latest stream position are ordered by room ID so that
+// pages don't overlap.
+const selectRoomsByRecentActivitySQL = "" +
+	"SELECT room_id, MAX(stream_position) AS latest FROM syncapi_output_room_events_topology" +
+	" WHERE room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state" +
+	"  WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'" +
+	" )" +
+	" GROUP BY room_id" +
+	" ORDER BY latest DESC, room_id ASC LIMIT $2 OFFSET $3"
+
+// Events of different rooms can share a stream position, so they are ordered
+// by room and event ID after that so that pages don't overlap.
+const selectEventIDsInGlobalStreamRangeSQL = "" +
+	"SELECT event_id FROM syncapi_output_room_events_topology" +
+	" WHERE stream_position > $1 AND stream_position <= $2" +
+	" ORDER BY stream_position ASC, room_id ASC, event_id ASC LIMIT $3"
+
+const (
+	// defaultEventIDsInRangeLimit is the number of event IDs returned by
+	// selectEventIDsInRange if the limit isn't positive.
+	defaultEventIDsInRangeLimit = 10
+	// maxEventIDsInRangeLimit is the most event IDs that
+	// selectEventIDsInRange will return, whatever the limit.
+	maxEventIDsInRangeLimit = 1000
+	// defaultRoomsByRecentActivityLimit is the number of rooms returned by
+	// selectRoomsByRecentActivity if the limit isn't positive.
+	defaultRoomsByRecentActivityLimit = 20
+	// maxRoomsByRecentActivityLimit is the most rooms that
+	// selectRoomsByRecentActivity will return, whatever the limit.
+	maxRoomsByRecentActivityLimit = 1000
+)
+
 type outputRoomEventsTopologyStatements struct {
-	insertEventInTopologyStmt       *sql.Stmt
-	selectEventIDsInRangeASCStmt    *sql.Stmt
-	selectEventIDsInRangeDESCStmt   *sql.Stmt
-	selectPositionInTopologyStmt    *sql.Stmt
-	selectMaxPositionInTopologyStmt *sql.Stmt
-	selectEventIDsFromPositionStmt  *sql.Stmt
+	insertEventInTopologyStmt         *sql.Stmt
+	insertOrUpdateEventInTopologyStmt *sql.Stmt
+	updateStreamPositionStmt          *sql.Stmt
+	deleteOtherEventsAtPositionStmt   *sql.Stmt
+	deleteTopologyForRoomStmt         *sql.Stmt
+	deleteTopologyBelowPositionStmt   *sql.Stmt
+	selectEventIDsBelowPositionStmt   *sql.Stmt
+	selectEventIDsInRangeASCStmt      *sql.Stmt
+	selectEventIDsInRangeDESCStmt     *sql.Stmt
+	selectPositionInTopologyStmt      *sql.Stmt
+	selectMaxPositionInTopologyStmt   *sql.Stmt
+	selectMaxStreamPositionsStmt      *sql.Stmt
+	selectEventIDsFromPositionStmt    *sql.Stmt
+	selectEventIDsForwardStmt         *sql.Stmt
+	selectEventIDsBeforePositionStmt  *sql.Stmt
+	selectEventIDsAfterPositionStmt   *sql.Stmt
+	selectTopologyCollisionsStmt      *sql.Stmt
+	selectFullTopologyForRoomStmt     *sql.Stmt
+	selectRoomsByRecentActivityStmt   *sql.Stmt
+	selectOrphanedTopologyStmt        *sql.Stmt
+	deleteOrphanedTopologyStmt        *sql.Stmt
+	selectEventIDsInGlobalRangeStmt   *sql.Stmt
 }
 
 func (s *outputRoomEventsTopologyStatements) prepare(db *sql.DB) (err error) {
@@ -85,6 +218,24 @@ func (s *outputRoomEventsTopologyStatements) prepare(db *sql.DB) (err error) {
 	if s.insertEventInTopologyStmt, err = db.Prepare(insertEventInTopologySQL); err != nil {
 		return
 	}
+	if s.insertOrUpdateEventInTopologyStmt, err = db.Prepare(insertOrUpdateEventInTopologySQL); err != nil {
+		return
+	}
+	if s.updateStreamPositionStmt, err = db.Prepare(updateStreamPositionInTopologySQL); err != nil {
+		return
+	}
+	if s.deleteOtherEventsAtPositionStmt, err = db.Prepare(deleteOtherEventsAtPositionSQL); err != nil {
+		return
+	}
+	if s.deleteTopologyForRoomStmt, err = db.Prepare(deleteTopologyForRoomSQL); err != nil {
+		return
+	}
+	if s.deleteTopologyBelowPositionStmt, err = db.Prepare(deleteTopologyBelowPositionSQL); err != nil {
+		return
+	}
+	if s.selectEventIDsBelowPositionStmt, err = db.Prepare(selectEventIDsBelowPositionSQL); err != nil {
+		return
+	}
 	if s.selectEventIDsInRangeASCStmt, err = db.Prepare(selectEventIDsInRangeASCSQL); err != nil {
 		return
 	}
@@ -97,32 +248,157 @@ func (s *outputRoomEventsTopologyStatements) prepare(db *sql.DB) (err error) {
 	if s.selectMaxPositionInTopologyStmt, err = db.Prepare(selectMaxPositionInTopologySQL); err != nil {
 		return
 	}
+	if s.selectMaxStreamPositionsStmt, err = db.Prepare(selectMaxStreamPositionsSQL); err != nil {
+		return
+	}
 	if s.selectEventIDsFromPositionStmt, err = db.Prepare(selectEventIDsFromPositionSQL); err != nil {
 		return
 	}
+	if s.selectEventIDsForwardStmt, err = db.Prepare(selectEventIDsForwardFromPositionSQL); err != nil {
+		return
+	}
+	if s.selectEventIDsBeforePositionStmt, err = db.Prepare(selectEventIDsBeforePositionSQL); err != nil {
+		return
+	}
+	if s.selectEventIDsAfterPositionStmt, err = db.Prepare(selectEventIDsAfterPositionSQL); err != nil {
+		return
+	}
+	if s.selectTopologyCollisionsStmt, err = db.Prepare(selectTopologyCollisionsSQL); err != nil {
+		return
+	}
+	if s.selectFullTopologyForRoomStmt, err = db.Prepare(selectFullTopologyForRoomSQL); err != nil {
+		return
+	}
+	if s.selectRoomsByRecentActivityStmt, err = db.Prepare(selectRoomsByRecentActivitySQL); err != nil {
+		return
+	}
+	if s.selectOrphanedTopologyStmt, err = db.Prepare(selectOrphanedTopologySQL); err != nil {
+		return
+	}
+	if s.deleteOrphanedTopologyStmt, err = db.Prepare(deleteOrphanedTopologySQL); err != nil {
+		return
+	}
+	if s.selectEventIDsInGlobalRangeStmt, err = db.Prepare(selectEventIDsInGlobalStreamRangeSQL); err != nil {
+		return
+	}
 	return
 }
 
 // insertEventInTopology inserts the given event in the room's topology, based
-// on the event's depth.
+// on the event's depth, at the stream position pos. Nothing is inserted if the
+// event is already there, which is counted in tables.TopologyInsertConflicts.
 func (s *outputRoomEventsTopologyStatements) insertEventInTopology(
 	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
 ) (err error) {
 	stmt := common.TxStmt(txn, s.insertEventInTopologyStmt)
-	_, err = stmt.ExecContext(
+	res, err := stmt.ExecContext(
 		ctx, event.EventID(), event.Depth(), event.RoomID(), pos,
 	)
+	if err != nil {
+		return
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if inserted == 0 {
+		tables.TopologyInsertConflicts.WithLabelValues(event.RoomID()).Inc()
+	}
+	return
+}
+
+// updateStreamPositionInTopology moves the given event to another stream
+// position in its room's topology, at the same depth.
+func (s *outputRoomEventsTopologyStatements) updateStreamPositionInTopology(
+	ctx context.Context, txn *sql.Tx, eventID string, spos types.StreamPosition,
+) (err error) {
+	stmt := common.TxStmt(txn, s.updateStreamPositionStmt)
+	_, err = stmt.ExecContext(ctx, spos, eventID)
+	return
+}
+
+// insertOrUpdateEventInTopology inserts the given event in the room's topology,
+// or moves it to its new position if it is already there. Any other event that
+// is stored at the new position is removed first, so that the position stays
+// unique within the room.
+func (s *outputRoomEventsTopologyStatements) insertOrUpdateEventInTopology(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteOtherEventsAtPositionStmt)
+	if _, err = stmt.ExecContext(ctx, event.RoomID(), event.Depth(), pos, event.EventID()); err != nil {
+		return
+	}
+	stmt = common.TxStmt(txn, s.insertOrUpdateEventInTopologyStmt)
+	_, err = stmt.ExecContext(
+		ctx, event.EventID(), event.Depth(), event.RoomID(), pos, event.Depth(), pos,
+	)
 	return
 }
 
+// deleteTopologyForRoom removes every event of the given room from the room's
+// topology.
+func (s *outputRoomEventsTopologyStatements) deleteTopologyForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteTopologyForRoomStmt)
+	_, err = stmt.ExecContext(ctx, roomID)
+	return
+}
+
+// deleteTopologyBelowPosition removes every event of the given room which is
+// at a lower position than pos from the room's topology, apart from the
+// events in the room's current state.
+func (s *outputRoomEventsTopologyStatements) deleteTopologyBelowPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteTopologyBelowPositionStmt)
+	_, err = stmt.ExecContext(ctx, roomID, pos, roomID)
+	return
+}
+
+// selectEventIDsBelowPosition returns the IDs and positions of up to limit
+// events of the given room which are at a lower position than pos in the
+// room's topology, oldest first, leaving out the events in the room's
+// current state.
+func (s *outputRoomEventsTopologyStatements) selectEventIDsBelowPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition, limit int,
+) (eventIDs []string, positions []types.StreamPosition, err error) {
+	stmt := common.TxStmt(txn, s.selectEventIDsBelowPositionStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, pos, roomID, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventIDsBelowPosition: rows.close() failed")
+	for rows.Next() {
+		var eventID string
+		var position types.StreamPosition
+		if err = rows.Scan(&eventID, &position); err != nil {
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+		positions = append(positions, position)
+	}
+	return eventIDs, positions, rows.Err()
+}
+
 // selectEventIDsInRange selects the IDs of events which positions are within a
-// given range in a given room's topological order.
+// given range in a given room's topological order. Each bound says whether an
+// event at exactly that position is part of the range.
 // Returns an empty slice if no events match the given range.
 func (s *outputRoomEventsTopologyStatements) selectEventIDsInRange(
 	ctx context.Context, txn *sql.Tx, roomID string,
-	fromPos, toPos, toMicroPos types.StreamPosition,
+	lower, upper types.TopologyBound,
 	limit int, chronologicalOrder bool,
 ) (eventIDs []string, err error) {
+	if lower.Depth < 0 || lower.StreamPosition < 0 || upper.Depth < 0 || upper.StreamPosition < 0 {
+		return nil, fmt.Errorf("invalid topological range from %+v to %+v: positions must not be negative", lower, upper)
+	}
+	if limit <= 0 {
+		limit = defaultEventIDsInRangeLimit
+	} else if limit > maxEventIDsInRangeLimit {
+		limit = maxEventIDsInRangeLimit
+	}
+
 	// Decide on the selection's order according to whether chronological order
 	// is requested or not.
 	var stmt *sql.Stmt
@@ -132,8 +408,23 @@ func (s *outputRoomEventsTopologyStatements) selectEventIDsInRange(
 		stmt = common.TxStmt(txn, s.selectEventIDsInRangeDESCStmt)
 	}
 
+	// Stream positions are integers, so an exclusive bound is the same as an
+	// inclusive bound one stream position further into the range.
+	lowerStreamPos, upperStreamPos := lower.StreamPosition, upper.StreamPosition
+	if !lower.Inclusive {
+		lowerStreamPos++
+	}
+	if !upper.Inclusive {
+		upperStreamPos--
+	}
+
 	// Query the event IDs.
-	rows, err := stmt.QueryContext(ctx, roomID, fromPos, toPos, toPos, toMicroPos, limit)
+	rows, err := stmt.QueryContext(
+		ctx, roomID,
+		lower.Depth, lower.Depth, lowerStreamPos,
+		upper.Depth, upper.Depth, upperStreamPos,
+		limit,
+	)
 	if err == sql.ErrNoRows {
 		// If no event matched the request, return an empty slice.
 		return []string{}, nil
@@ -171,6 +462,19 @@ func (s *outputRoomEventsTopologyStatements) selectMaxPositionInTopology(
 	return
 }
 
+// selectMaxStreamPositions returns the latest stream position in the events
+// table and in the topology, reading both at once so that an event which is
+// being written can't be counted in one but not the other. Either is zero if
+// the table is empty.
+func (s *outputRoomEventsTopologyStatements) selectMaxStreamPositions(
+	ctx context.Context, txn *sql.Tx,
+) (events, topology types.StreamPosition, err error) {
+	var nullableEvents, nullableTopology sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxStreamPositionsStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableEvents, &nullableTopology)
+	return types.StreamPosition(nullableEvents.Int64), types.StreamPosition(nullableTopology.Int64), err
+}
+
 // selectEventIDsFromPosition returns the IDs of all events that have a given
 // position in the topology of a given room.
 func (s *outputRoomEventsTopologyStatements) selectEventIDsFromPosition(
@@ -195,3 +499,220 @@ func (s *outputRoomEventsTopologyStatements) selectEventIDsFromPosition(
 	}
 	return
 }
+
+// selectEventIDsForwardFromPosition returns the IDs of the events at or after
+// a given position in the topology of a given room, in topological order. A
+// limit which isn't positive is replaced with a default, and limits over a
+// maximum are reduced to it.
+func (s *outputRoomEventsTopologyStatements) selectEventIDsForwardFromPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, pos types.StreamPosition, limit int,
+) (eventIDs []string, err error) {
+	if limit <= 0 {
+		limit = defaultEventIDsInRangeLimit
+	} else if limit > maxEventIDsInRangeLimit {
+		limit = maxEventIDsInRangeLimit
+	}
+	stmt := common.TxStmt(txn, s.selectEventIDsForwardStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, pos, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventIDsForwardFromPosition: rows.close() failed")
+	eventIDs = []string{}
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectEventIDsAroundPosition returns the IDs of up to beforeLimit events
+// immediately before and up to afterLimit events immediately after the given
+// position in the topology of a given room, not including the event at the
+// position itself. The events before are in reverse topological order, nearest
+// first, and the events after are in topological order. A limit which isn't
+// positive selects no events on that side, and limits over a maximum are
+// reduced to it.
+func (s *outputRoomEventsTopologyStatements) selectEventIDsAroundPosition(
+	ctx context.Context, txn *sql.Tx, roomID string, pos, spos types.StreamPosition,
+	beforeLimit, afterLimit int,
+) (before, after []string, err error) {
+	before, err = s.selectEventIDsNextToPosition(
+		ctx, common.TxStmt(txn, s.selectEventIDsBeforePositionStmt), roomID, pos, spos, beforeLimit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, err = s.selectEventIDsNextToPosition(
+		ctx, common.TxStmt(txn, s.selectEventIDsAfterPositionStmt), roomID, pos, spos, afterLimit,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+func (s *outputRoomEventsTopologyStatements) selectEventIDsNextToPosition(
+	ctx context.Context, stmt *sql.Stmt, roomID string, pos, spos types.StreamPosition, limit int,
+) (eventIDs []string, err error) {
+	eventIDs = []string{}
+	if limit <= 0 {
+		return eventIDs, nil
+	} else if limit > maxEventIDsInRangeLimit {
+		limit = maxEventIDsInRangeLimit
+	}
+	rows, err := stmt.QueryContext(ctx, roomID, pos, pos, spos, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventIDsNextToPosition: rows.close() failed")
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// selectTopologyCollisions returns the depths in the topology of a given room
+// which are shared by more than minEvents events, in ascending order.
+func (s *outputRoomEventsTopologyStatements) selectTopologyCollisions(
+	ctx context.Context, txn *sql.Tx, roomID string, minEvents int,
+) (collisions []types.TopologyCollision, err error) {
+	stmt := common.TxStmt(txn, s.selectTopologyCollisionsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, minEvents)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectTopologyCollisions: rows.close() failed")
+	for rows.Next() {
+		var collision types.TopologyCollision
+		if err = rows.Scan(&collision.Depth, &collision.Count); err != nil {
+			return
+		}
+		collisions = append(collisions, collision)
+	}
+	return collisions, rows.Err()
+}
+
+// selectFullTopologyForRoom returns the position of every event in the
+// topology of a given room, in topological then stream order.
+func (s *outputRoomEventsTopologyStatements) selectFullTopologyForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (positions []types.TopologyPosition, err error) {
+	stmt := common.TxStmt(txn, s.selectFullTopologyForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectFullTopologyForRoom: rows.close() failed")
+	for rows.Next() {
+		var position types.TopologyPosition
+		if err = rows.Scan(&position.EventID, &position.Depth, &position.StreamPosition); err != nil {
+			return
+		}
+		positions = append(positions, position)
+	}
+	return positions, rows.Err()
+}
+
+// selectRoomsByRecentActivity returns the rooms which the given user is joined
+// to, with the latest stream position in the topology of each, most recently
+// active first. It skips offset rooms and returns up to limit of the rest. A
+// limit which isn't positive is replaced with a default, and limits over a
+// maximum are reduced to it.
+func (s *outputRoomEventsTopologyStatements) selectRoomsByRecentActivity(
+	ctx context.Context, txn *sql.Tx, userID string, limit, offset int,
+) (rooms []types.RoomActivity, err error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d: must not be negative", offset)
+	}
+	if limit <= 0 {
+		limit = defaultRoomsByRecentActivityLimit
+	} else if limit > maxRoomsByRecentActivityLimit {
+		limit = maxRoomsByRecentActivityLimit
+	}
+	stmt := common.TxStmt(txn, s.selectRoomsByRecentActivityStmt)
+	rows, err := stmt.QueryContext(ctx, userID, limit, offset)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectRoomsByRecentActivity: rows.close() failed")
+	for rows.Next() {
+		var room types.RoomActivity
+		if err = rows.Scan(&room.RoomID, &room.StreamPosition); err != nil {
+			return
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// selectOrphanedTopology returns the IDs of the events in the topology of a
+// given room which aren't in the events table, in topological then stream
+// order.
+func (s *outputRoomEventsTopologyStatements) selectOrphanedTopology(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (eventIDs []string, err error) {
+	stmt := common.TxStmt(txn, s.selectOrphanedTopologyStmt)
+	rows, err := stmt.QueryContext(ctx, roomID)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectOrphanedTopology: rows.close() failed")
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// deleteOrphanedTopology removes the events in the topology of a given room
+// which aren't in the events table.
+func (s *outputRoomEventsTopologyStatements) deleteOrphanedTopology(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteOrphanedTopologyStmt)
+	_, err = stmt.ExecContext(ctx, roomID)
+	return
+}
+
+// selectEventIDsInGlobalStreamRange returns the IDs of up to limit events of
+// any room whose stream positions are after fromPos and no later than toPos,
+// in stream order. A limit which isn't positive is replaced with a default,
+// and limits over a maximum are reduced to it.
+func (s *outputRoomEventsTopologyStatements) selectEventIDsInGlobalStreamRange(
+	ctx context.Context, txn *sql.Tx, fromPos, toPos types.StreamPosition, limit int,
+) (eventIDs []string, err error) {
+	if fromPos < 0 || toPos < 0 {
+		return nil, fmt.Errorf("invalid stream range from %d to %d: positions must not be negative", fromPos, toPos)
+	}
+	if limit <= 0 {
+		limit = defaultEventIDsInRangeLimit
+	} else if limit > maxEventIDsInRangeLimit {
+		limit = maxEventIDsInRangeLimit
+	}
+	stmt := common.TxStmt(txn, s.selectEventIDsInGlobalRangeStmt)
+	rows, err := stmt.QueryContext(ctx, fromPos, toPos, limit)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventIDsInGlobalStreamRange: rows.close() failed")
+	eventIDs = []string{}
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
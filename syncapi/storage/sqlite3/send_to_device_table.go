@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const sendToDeviceSchema = `
+-- Stores the messages sent directly to devices until the devices have received them.
+CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
+	-- The send-to-device position of the message. AUTOINCREMENT stops the
+	-- positions of deleted messages from being used again.
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The user and device that the message is for.
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	-- The JSON of the message, as it is sent in /sync.
+	event_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device (user_id, device_id, id);
+`
+
+const insertSendToDeviceMessageSQL = "" +
+	"INSERT INTO syncapi_send_to_device (user_id, device_id, event_json)" +
+	" VALUES ($1, $2, $3)"
+
+const selectSendToDeviceMessagesInRangeSQL = "" +
+	"SELECT event_json FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id > $3 AND id <= $4" +
+	" ORDER BY id ASC"
+
+const deleteSendToDeviceMessagesUpToSQL = "" +
+	"DELETE FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id <= $3"
+
+const selectMaxSendToDeviceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_send_to_device"
+
+type sendToDeviceStatements struct {
+	insertSendToDeviceMessageStmt         *sql.Stmt
+	selectSendToDeviceMessagesInRangeStmt *sql.Stmt
+	deleteSendToDeviceMessagesUpToStmt    *sql.Stmt
+	selectMaxSendToDeviceIDStmt           *sql.Stmt
+}
+
+func (s *sendToDeviceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(sendToDeviceSchema)
+	if err != nil {
+		return
+	}
+	if s.insertSendToDeviceMessageStmt, err = db.Prepare(insertSendToDeviceMessageSQL); err != nil {
+		return
+	}
+	if s.selectSendToDeviceMessagesInRangeStmt, err = db.Prepare(selectSendToDeviceMessagesInRangeSQL); err != nil {
+		return
+	}
+	if s.deleteSendToDeviceMessagesUpToStmt, err = db.Prepare(deleteSendToDeviceMessagesUpToSQL); err != nil {
+		return
+	}
+	if s.selectMaxSendToDeviceIDStmt, err = db.Prepare(selectMaxSendToDeviceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertSendToDeviceMessage queues a message for a device, returning its
+// send-to-device position.
+func (s *sendToDeviceStatements) insertSendToDeviceMessage(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, eventJSON []byte,
+) (pos types.StreamPosition, err error) {
+	stmt := common.TxStmt(txn, s.insertSendToDeviceMessageStmt)
+	res, err := stmt.ExecContext(ctx, userID, deviceID, eventJSON)
+	if err != nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	return types.StreamPosition(id), err
+}
+
+// selectSendToDeviceMessagesInRange returns the JSON of the messages for a
+// device after startPos and up to endPos, oldest first.
+func (s *sendToDeviceStatements) selectSendToDeviceMessagesInRange(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, startPos, endPos types.StreamPosition,
+) (eventJSONs [][]byte, err error) {
+	stmt := common.TxStmt(txn, s.selectSendToDeviceMessagesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, userID, deviceID, startPos, endPos)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectSendToDeviceMessagesInRange: rows.close() failed")
+	for rows.Next() {
+		var eventJSON []byte
+		if err = rows.Scan(&eventJSON); err != nil {
+			return
+		}
+		eventJSONs = append(eventJSONs, eventJSON)
+	}
+	return eventJSONs, rows.Err()
+}
+
+// deleteSendToDeviceMessagesUpTo deletes the messages for a device up to and
+// including pos.
+func (s *sendToDeviceStatements) deleteSendToDeviceMessagesUpTo(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, pos types.StreamPosition,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteSendToDeviceMessagesUpToStmt)
+	_, err = stmt.ExecContext(ctx, userID, deviceID, pos)
+	return
+}
+
+func (s *sendToDeviceStatements) selectMaxSendToDeviceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectMaxSendToDeviceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
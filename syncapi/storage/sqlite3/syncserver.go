@@ -21,7 +21,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
+	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -38,6 +40,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 )
 
 type stateDelta struct {
@@ -59,9 +62,15 @@ type SyncServerDatasource struct {
 	events              outputRoomEventsStatements
 	roomstate           currentRoomStateStatements
 	invites             inviteEventsStatements
+	sendToDevice        sendToDeviceStatements
 	eduCache            *cache.EDUCache
+	presenceCache       *cache.PresenceCache
+	receiptCache        *cache.ReceiptCache
+	deviceListCache     *cache.DeviceListCache
 	topology            outputRoomEventsTopologyStatements
 	backwardExtremities tables.BackwardsExtremities
+	eventRelations      tables.EventRelations
+	eventTimestamps     tables.EventTimestamps
 }
 
 // NewSyncServerDatasource creates a new sync server database
@@ -87,6 +96,9 @@ func NewSyncServerDatasource(dataSourceName string) (*SyncServerDatasource, erro
 		return nil, err
 	}
 	d.eduCache = cache.New()
+	d.presenceCache = cache.NewPresenceCache()
+	d.receiptCache = cache.NewReceiptCache()
+	d.deviceListCache = cache.NewDeviceListCache()
 	return &d, nil
 }
 
@@ -109,6 +121,9 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err = d.invites.prepare(d.db, &d.streamID); err != nil {
 		return err
 	}
+	if err = d.sendToDevice.prepare(d.db); err != nil {
+		return err
+	}
 	if err = d.topology.prepare(d.db); err != nil {
 		return err
 	}
@@ -116,6 +131,14 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	d.eventRelations, err = tables.NewEventRelations(d.db, &tables.SqliteEventRelationsStatements{})
+	if err != nil {
+		return err
+	}
+	d.eventTimestamps, err = tables.NewEventTimestamps(d.db, &tables.SqliteEventTimestampsStatements{})
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -202,6 +225,14 @@ func (d *SyncServerDatasource) WriteEvent(
 			return err
 		}
 
+		if err = d.handleEventRelation(ctx, txn, ev); err != nil {
+			return err
+		}
+
+		if err = d.eventTimestamps.InsertEventTimestamp(ctx, txn, ev.EventID(), ev.RoomID(), ev.OriginServerTS()); err != nil {
+			return err
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -213,6 +244,93 @@ func (d *SyncServerDatasource) WriteEvent(
 	return pduPosition, returnErr
 }
 
+// handleEventRelation records the event that the given event relates to, if
+// it has a valid m.relates_to key in its content. Relations to the event
+// itself, or to an event that we know is in another room, are ignored.
+func (d *SyncServerDatasource) handleEventRelation(
+	ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent,
+) error {
+	relatesTo := gjson.GetBytes(ev.Content(), "m\\.relates_to")
+	relatesToEventID := relatesTo.Get("event_id").Str
+	relType := relatesTo.Get("rel_type").Str
+	if relatesToEventID == "" || relType == "" || relatesToEventID == ev.EventID() {
+		return nil
+	}
+	relatesToEvents, err := d.events.selectEvents(ctx, txn, []string{relatesToEventID})
+	if err != nil {
+		return err
+	}
+	if len(relatesToEvents) > 0 && relatesToEvents[0].RoomID() != ev.RoomID() {
+		return nil
+	}
+	return d.eventRelations.InsertEventRelation(
+		ctx, txn, ev.EventID(), ev.RoomID(), relatesToEventID, relType, ev.Type(),
+	)
+}
+
+// EventNearestTimestamp returns the ID and origin_server_ts of the event in the
+// room which is closest to the given timestamp, in the given direction.
+// Returns an empty event ID if there is no such event.
+func (d *SyncServerDatasource) EventNearestTimestamp(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, forward bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	return d.eventTimestamps.SelectEventNearestTimestamp(ctx, roomID, ts, forward)
+}
+
+// RelatedEvents returns up to limit events in the given room which relate to
+// the given event, from the most recent backwards. If relType or eventType are not empty then
+// only relations of that rel_type or event type are returned. If from is not
+// nil then only events topologically before it are returned. If there may be
+// more related events then a token to fetch them from is also returned.
+func (d *SyncServerDatasource) RelatedEvents(
+	ctx context.Context, roomID, eventID, relType, eventType string,
+	from *types.PaginationToken, limit int,
+) ([]types.StreamEvent, *types.PaginationToken, error) {
+	beforeDepth := types.StreamPosition(math.MaxInt64)
+	beforeStreamPos := types.StreamPosition(math.MaxInt64)
+	if from != nil {
+		beforeDepth, beforeStreamPos = from.PDUPosition, from.EDUTypingPosition
+	}
+	// Ask for one more relation than we need so that we know whether there
+	// are any more to come.
+	relations, err := d.eventRelations.SelectEventRelations(
+		ctx, roomID, eventID, relType, eventType, beforeDepth, beforeStreamPos, limit+1,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	var next *types.PaginationToken
+	if len(relations) > limit {
+		relations = relations[:limit]
+		last := relations[len(relations)-1]
+		next = types.NewPaginationTokenFromTypeAndPosition(
+			types.PaginationTokenTypeTopology, last.Depth, last.StreamPosition,
+		)
+	}
+
+	eventIDs := make([]string, len(relations))
+	for i := range relations {
+		eventIDs[i] = relations[i].EventID
+	}
+	streamEvents, err := d.events.selectEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The events aren't necessarily returned in the order we asked for them,
+	// so put them back into topological order.
+	eventsByID := make(map[string]types.StreamEvent, len(streamEvents))
+	for _, ev := range streamEvents {
+		eventsByID[ev.EventID()] = ev
+	}
+	events := make([]types.StreamEvent, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		if ev, ok := eventsByID[id]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, next, nil
+}
+
 func (d *SyncServerDatasource) updateRoomState(
 	ctx context.Context, txn *sql.Tx,
 	removedEventIDs []string,
@@ -253,7 +371,15 @@ func (d *SyncServerDatasource) updateRoomState(
 func (d *SyncServerDatasource) GetStateEvent(
 	ctx context.Context, roomID, evType, stateKey string,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
-	return d.roomstate.selectStateEvent(ctx, roomID, evType, stateKey)
+	return d.roomstate.selectStateEvent(ctx, nil, roomID, evType, stateKey)
+}
+
+// CurrentStateEventsOfType returns the current state event with the given
+// type and state key in every room which has one.
+func (d *SyncServerDatasource) CurrentStateEventsOfType(
+	ctx context.Context, evType, stateKey string,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	return d.roomstate.selectStateEventsOfType(ctx, evType, stateKey)
 }
 
 // GetStateEventsForRoom fetches the state events for a given room.
@@ -281,26 +407,28 @@ func (d *SyncServerDatasource) GetEventsInRange(
 	// events must be retrieved from the rooms' topology table rather than the
 	// table contaning the syncapi server's whole stream of events.
 	if from.Type == types.PaginationTokenTypeTopology {
-		// TODO: ARGH CONFUSING
-		// Determine the backward and forward limit, i.e. the upper and lower
-		// limits to the selection in the room's topology, from the direction.
-		var backwardLimit, forwardLimit, forwardMicroLimit types.StreamPosition
+		// Determine the lower and upper bounds of the selection in the room's
+		// topology from the direction. /messages needs the "from" token to be
+		// inclusive, down to its stream position, when paginating backwards,
+		// and events at the depth of the "to" token to be excluded. The lower
+		// bound excludes every event at its depth, which is the same as an
+		// inclusive bound at the start of the next depth.
+		var lower, upper types.TopologyBound
 		if backwardOrdering {
 			// Backward ordering is antichronological (latest event to oldest
 			// one).
-			backwardLimit = to.PDUPosition
-			forwardLimit = from.PDUPosition
-			forwardMicroLimit = from.EDUTypingPosition
+			lower = types.TopologyBound{Depth: to.PDUPosition + 1, Inclusive: true}
+			upper = types.TopologyBound{Depth: from.PDUPosition, StreamPosition: from.EDUTypingPosition, Inclusive: true}
 		} else {
 			// Forward ordering is chronological (oldest event to latest one).
-			backwardLimit = from.PDUPosition
-			forwardLimit = to.PDUPosition
+			lower = types.TopologyBound{Depth: from.PDUPosition + 1, Inclusive: true}
+			upper = types.TopologyBound{Depth: to.PDUPosition, Inclusive: false}
 		}
 
 		// Select the event IDs from the defined range.
 		var eIDs []string
 		eIDs, err = d.topology.selectEventIDsInRange(
-			ctx, nil, roomID, backwardLimit, forwardLimit, forwardMicroLimit, limit, !backwardOrdering,
+			ctx, nil, roomID, lower, upper, limit, !backwardOrdering,
 		)
 		if err != nil {
 			return
@@ -371,6 +499,228 @@ func (d *SyncServerDatasource) EventsAtTopologicalPosition(
 	return d.events.selectEvents(ctx, nil, eIDs)
 }
 
+// EventIDsForwardFromTopologicalPosition returns the IDs of up to limit events
+// at or after the given position in the topology of the given room, in
+// topological order.
+func (d *SyncServerDatasource) EventIDsForwardFromTopologicalPosition(
+	ctx context.Context, roomID string, pos types.StreamPosition, limit int,
+) ([]string, error) {
+	return d.topology.selectEventIDsForwardFromPosition(ctx, nil, roomID, pos, limit)
+}
+
+// EventIDsAroundTopologicalPosition returns the IDs of up to beforeLimit
+// events immediately before and up to afterLimit events immediately after the
+// given position in the topology of the given room.
+func (d *SyncServerDatasource) EventIDsAroundTopologicalPosition(
+	ctx context.Context, roomID string, pos, spos types.StreamPosition, beforeLimit, afterLimit int,
+) (before, after []string, err error) {
+	return d.topology.selectEventIDsAroundPosition(ctx, nil, roomID, pos, spos, beforeLimit, afterLimit)
+}
+
+// WriteEventInTopology stores the position of the given event in its room's
+// topology. If upsert is true then any position previously stored for the
+// event is replaced.
+func (d *SyncServerDatasource) WriteEventInTopology(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, upsert bool,
+) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if upsert {
+			return d.topology.insertOrUpdateEventInTopology(ctx, txn, ev, pos)
+		}
+		return d.topology.insertEventInTopology(ctx, txn, ev, pos)
+	})
+}
+
+// RebuildTopologyForRoom replaces the topology of the given room with one
+// derived from the events that are stored for it.
+func (d *SyncServerDatasource) RebuildTopologyForRoom(ctx context.Context, roomID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.rebuildTopologyForRoom(ctx, txn, roomID)
+	})
+}
+
+// rebuildTopologyForRoom re-derives the position in the topology of every
+// event that is stored for the room from its depth and stream position, and
+// replaces the room's topology with them. This repairs a topology which is
+// missing rows, e.g. because of a crash between storing an event and
+// inserting it in the topology. Rebuilding a topology which is already
+// correct leaves it unchanged.
+func (d *SyncServerDatasource) rebuildTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) error {
+	events, err := d.events.selectRoomEvents(ctx, txn, roomID)
+	if err != nil {
+		return err
+	}
+	if err = d.topology.deleteTopologyForRoom(ctx, txn, roomID); err != nil {
+		return err
+	}
+	for i := range events {
+		if err = d.topology.insertOrUpdateEventInTopology(ctx, txn, &events[i].HeaderedEvent, events[i].StreamPosition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeEventsBefore deletes up to limit of the events in the given room which
+// were sent before the given time, oldest first, along with their positions
+// in the room's topology. Only whole depths are purged, unless a single depth
+// holds more than limit events in which case all of them are purged at once,
+// so that the room can still be paginated through afterwards. Events in the
+// room's current state and events at the room's latest position are kept.
+// The backward extremities of the purged events are removed, so that
+// /messages doesn't backfill the purged history again.
+func (d *SyncServerDatasource) PurgeEventsBefore(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, limit int,
+) (purged int, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		cutoff, ok, err := d.eventTimestamps.SelectTopologicalPositionAtOrAfterTimestamp(ctx, txn, roomID, ts)
+		if err != nil || !ok {
+			return err
+		}
+		eventIDs, positions, err := d.topology.selectEventIDsBelowPosition(ctx, txn, roomID, cutoff, limit)
+		if err != nil {
+			return err
+		}
+		if len(eventIDs) == 0 {
+			return nil
+		}
+		if len(eventIDs) == limit {
+			last := positions[len(positions)-1]
+			if last > positions[0] {
+				// Leave the last depth we selected for the next batch, as
+				// some of its events may not have been selected.
+				cutoff = last
+				for positions[len(positions)-1] == last {
+					positions = positions[:len(positions)-1]
+				}
+				eventIDs = eventIDs[:len(positions)]
+			} else {
+				cutoff = last + 1
+				eventIDs, _, err = d.topology.selectEventIDsBelowPosition(ctx, txn, roomID, cutoff, math.MaxInt32)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err = d.events.deleteEvents(ctx, txn, eventIDs); err != nil {
+			return err
+		}
+		if err = d.eventTimestamps.DeleteEventTimestamps(ctx, txn, eventIDs); err != nil {
+			return err
+		}
+		if err = d.topology.deleteTopologyBelowPosition(ctx, txn, roomID, cutoff); err != nil {
+			return err
+		}
+		if err = d.backwardExtremities.DeleteBackwardExtremitiesOfPurgedEvents(ctx, txn, roomID); err != nil {
+			return err
+		}
+		purged = len(eventIDs)
+		return nil
+	})
+	return
+}
+
+// EventIDsInTopologicalRange returns the IDs of the events in the given room
+// which are between the lower and upper bounds of the room's topology.
+func (d *SyncServerDatasource) EventIDsInTopologicalRange(
+	ctx context.Context, roomID string, lower, upper types.TopologyBound,
+	limit int, chronologicalOrder bool,
+) ([]string, error) {
+	return d.topology.selectEventIDsInRange(ctx, nil, roomID, lower, upper, limit, chronologicalOrder)
+}
+
+// MaxStreamPositions returns the latest stream position of the events and of
+// the topology.
+func (d *SyncServerDatasource) MaxStreamPositions(
+	ctx context.Context,
+) (events types.StreamPosition, topology types.StreamPosition, err error) {
+	return d.topology.selectMaxStreamPositions(ctx, nil)
+}
+
+// TopologyCollisions returns the depths in the topology of the given room
+// which are shared by more than minEvents events.
+func (d *SyncServerDatasource) TopologyCollisions(
+	ctx context.Context, roomID string, minEvents int,
+) ([]types.TopologyCollision, error) {
+	return d.topology.selectTopologyCollisions(ctx, nil, roomID, minEvents)
+}
+
+// FullTopologyForRoom returns the position of every event in the topology
+// of the given room, in topological then stream order.
+func (d *SyncServerDatasource) FullTopologyForRoom(
+	ctx context.Context, roomID string,
+) ([]types.TopologyPosition, error) {
+	return d.topology.selectFullTopologyForRoom(ctx, nil, roomID)
+}
+
+// RoomsByRecentActivity returns the rooms which the given user is joined to,
+// most recently active first, for a page of a sliding sync room list.
+func (d *SyncServerDatasource) RoomsByRecentActivity(
+	ctx context.Context, userID string, limit, offset int,
+) ([]types.RoomActivity, error) {
+	return d.topology.selectRoomsByRecentActivity(ctx, nil, userID, limit, offset)
+}
+
+// RepairTopologyStreamPositions moves the events in the topology of the given
+// room which share their stream position with another event of the room to
+// new stream positions, so that they strictly increase. Returns the IDs of the
+// events which were moved.
+func (d *SyncServerDatasource) RepairTopologyStreamPositions(
+	ctx context.Context, roomID string,
+) (eventIDs []string, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		eventIDs = nil
+		positions, err := d.topology.selectFullTopologyForRoom(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+		moved := types.NonMonotonicStreamPositions(positions)
+		// Move the events with the highest new stream positions first, so
+		// that no event is moved onto a position which another event at the
+		// same depth still has until it is moved itself.
+		for i := len(moved) - 1; i >= 0; i-- {
+			if err = d.topology.updateStreamPositionInTopology(ctx, txn, moved[i].EventID, moved[i].StreamPosition); err != nil {
+				return err
+			}
+			eventIDs = append(eventIDs, moved[i].EventID)
+		}
+		return nil
+	})
+	return
+}
+
+// EventIDsInStreamRange returns the IDs of the events of every room whose
+// stream positions are after from and no later than to, in stream order.
+func (d *SyncServerDatasource) EventIDsInStreamRange(
+	ctx context.Context, from, to types.StreamPosition, limit int,
+) ([]string, error) {
+	return d.topology.selectEventIDsInGlobalStreamRange(ctx, nil, from, to, limit)
+}
+
+// OrphanedTopologyEventIDs returns the IDs of the events in the topology of
+// the given room which aren't in the events table.
+func (d *SyncServerDatasource) OrphanedTopologyEventIDs(
+	ctx context.Context, roomID string,
+) ([]string, error) {
+	return d.topology.selectOrphanedTopology(ctx, nil, roomID)
+}
+
+// RemoveOrphanedTopology removes the events in the topology of the given room
+// which aren't in the events table. Returns the IDs of the events which were
+// removed.
+func (d *SyncServerDatasource) RemoveOrphanedTopology(
+	ctx context.Context, roomID string,
+) (eventIDs []string, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		eventIDs, err = d.topology.selectOrphanedTopology(ctx, txn, roomID)
+		if err != nil || len(eventIDs) == 0 {
+			return err
+		}
+		return d.topology.deleteOrphanedTopology(ctx, txn, roomID)
+	})
+	return
+}
+
 func (d *SyncServerDatasource) EventPositionInTopology(
 	ctx context.Context, eventID string,
 ) (depth types.StreamPosition, stream types.StreamPosition, err error) {
@@ -434,6 +784,14 @@ func (d *SyncServerDatasource) syncPositionTx(
 	}
 	sp.PDUPosition = types.StreamPosition(maxEventID)
 	sp.EDUTypingPosition = types.StreamPosition(d.eduCache.GetLatestSyncPosition())
+	sp.EDUPresencePosition = types.StreamPosition(d.presenceCache.GetLatestSyncPosition())
+	sp.EDUReceiptPosition = types.StreamPosition(d.receiptCache.GetLatestSyncPosition())
+	sp.EDUDeviceListPosition = types.StreamPosition(d.deviceListCache.GetLatestSyncPosition())
+	maxSendToDeviceID, err := d.sendToDevice.selectMaxSendToDeviceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp.SendToDevicePosition = types.StreamPosition(maxSendToDeviceID)
 	sp.Type = types.PaginationTokenTypeStream
 	return
 }
@@ -530,9 +888,195 @@ func (d *SyncServerDatasource) addTypingDeltaToResponse(
 	return nil
 }
 
+// addPresenceDeltaToResponse adds the presence of all users who share a room
+// with the given user, and whose presence has changed since the specified
+// position, to a sync response.
+func (d *SyncServerDatasource) addPresenceDeltaToResponse(
+	ctx context.Context,
+	userID string,
+	since types.PaginationToken,
+	res *types.Response,
+) error {
+	updates := d.presenceCache.GetPresenceUpdatedAfter(int64(since.EDUPresencePosition))
+	if len(updates) == 0 {
+		return nil
+	}
+	sharedUserIDs, err := d.roomstate.selectUsersSharingRooms(ctx, nil, userID)
+	if err != nil {
+		return err
+	}
+	sharesRoom := map[string]bool{userID: true}
+	for _, sharedUserID := range sharedUserIDs {
+		sharesRoom[sharedUserID] = true
+	}
+
+	presenceFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in request
+	for _, update := range updates {
+		if !sharesRoom[update.UserID] || !presenceFilterAllows(&presenceFilter, update.UserID) {
+			continue
+		}
+		if presenceFilter.Limit > 0 && len(res.Presence.Events) >= presenceFilter.Limit {
+			break
+		}
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   "m.presence",
+			Sender: update.UserID,
+		}
+		content := map[string]interface{}{
+			"presence": update.Presence,
+		}
+		if update.StatusMsg != nil {
+			content["status_msg"] = *update.StatusMsg
+		}
+		if update.LastActiveTS != 0 {
+			content["last_active_ago"] = time.Since(update.LastActiveTS.Time()).Nanoseconds() / int64(time.Millisecond)
+		}
+		if ev.Content, err = json.Marshal(content); err != nil {
+			return err
+		}
+		res.Presence.Events = append(res.Presence.Events, ev)
+	}
+	return nil
+}
+
+// addReceiptDeltaToResponse adds an m.receipt ephemeral event to each of the
+// joined rooms with the receipts that have changed in that room since the
+// specified position.
+func (d *SyncServerDatasource) addReceiptDeltaToResponse(
+	since types.PaginationToken,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	var jr types.JoinResponse
+	var ok bool
+	var err error
+	for _, roomID := range joinedRoomIDs {
+		receipts := d.receiptCache.GetReceiptsUpdatedAfter(roomID, int64(since.EDUReceiptPosition))
+		if len(receipts) == 0 {
+			continue
+		}
+		// The content maps event IDs to receipt types to user IDs to the
+		// receipt.
+		content := map[string]map[string]map[string]interface{}{}
+		for _, receipt := range receipts {
+			if _, ok = content[receipt.EventID]; !ok {
+				content[receipt.EventID] = map[string]map[string]interface{}{}
+			}
+			if _, ok = content[receipt.EventID][receipt.ReceiptType]; !ok {
+				content[receipt.EventID][receipt.ReceiptType] = map[string]interface{}{}
+			}
+			content[receipt.EventID][receipt.ReceiptType][receipt.UserID] = map[string]interface{}{
+				"ts": receipt.Timestamp,
+			}
+		}
+		ev := gomatrixserverlib.ClientEvent{
+			Type: "m.receipt",
+		}
+		if ev.Content, err = json.Marshal(content); err != nil {
+			return err
+		}
+
+		if jr, ok = res.Rooms.Join[roomID]; !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// addDeviceListDeltaToResponse adds the users whose device lists the client
+// should fetch again, and the users whose device lists it can stop tracking,
+// since the specified position to a sync response. A user is changed if their
+// device list has changed and they share a room with the given user, or if
+// they have just started sharing a room with the given user. A user is left if
+// they have just stopped sharing any rooms with the given user. The response
+// must already contain the PDUs for the sync.
+func (d *SyncServerDatasource) addDeviceListDeltaToResponse(
+	ctx context.Context,
+	userID string,
+	since types.PaginationToken,
+	res *types.Response,
+) error {
+	sharedUserIDs, err := d.roomstate.selectUsersSharingRooms(ctx, nil, userID)
+	if err != nil {
+		return err
+	}
+	sharesRoom := map[string]bool{userID: true}
+	for _, sharedUserID := range sharedUserIDs {
+		sharesRoom[sharedUserID] = true
+	}
+
+	changed := map[string]bool{}
+	for _, changedUserID := range d.deviceListCache.GetUsersChangedAfter(int64(since.EDUDeviceListPosition)) {
+		if sharesRoom[changedUserID] {
+			changed[changedUserID] = true
+		}
+	}
+
+	// Look at the membership changes in the rooms in the response to find the
+	// users who the user has started or stopped sharing a room with.
+	var memberships []gomatrixserverlib.ClientEvent
+	var changedRoomIDs []string
+	for roomID, jr := range res.Rooms.Join {
+		var events []gomatrixserverlib.ClientEvent
+		events = append(events, jr.State.Events...)
+		events = append(events, jr.Timeline.Events...)
+		if membershipOf(userID, events) == gomatrixserverlib.Join {
+			// The user has joined the room, so every member is new to them.
+			changedRoomIDs = append(changedRoomIDs, roomID)
+		}
+		memberships = append(memberships, events...)
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		// The user has left the room, so none of the members may be shared.
+		changedRoomIDs = append(changedRoomIDs, roomID)
+		memberships = append(memberships, lr.State.Events...)
+		memberships = append(memberships, lr.Timeline.Events...)
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateFilter.Types = []string{gomatrixserverlib.MRoomMember}
+	for _, roomID := range changedRoomIDs {
+		stateEvents, err := d.roomstate.selectCurrentState(ctx, nil, roomID, &stateFilter)
+		if err != nil {
+			return err
+		}
+		memberships = append(memberships, gomatrixserverlib.HeaderedToClientEvents(
+			stateEvents, gomatrixserverlib.FormatSync,
+		)...)
+	}
+
+	left := map[string]bool{}
+	for _, ev := range memberships {
+		if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil || *ev.StateKey == userID {
+			continue
+		}
+		memberUserID := *ev.StateKey
+		if sharesRoom[memberUserID] {
+			if gjson.GetBytes(ev.Content, "membership").Str == gomatrixserverlib.Join {
+				changed[memberUserID] = true
+			}
+		} else {
+			left[memberUserID] = true
+		}
+	}
+
+	for changedUserID := range changed {
+		res.DeviceLists.Changed = append(res.DeviceLists.Changed, changedUserID)
+	}
+	for leftUserID := range left {
+		res.DeviceLists.Left = append(res.DeviceLists.Left, leftUserID)
+	}
+	sort.Strings(res.DeviceLists.Changed)
+	sort.Strings(res.DeviceLists.Left)
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *SyncServerDatasource) addEDUDeltaToResponse(
+	ctx context.Context,
+	userID string,
 	fromPos, toPos types.PaginationToken,
 	joinedRoomIDs []string,
 	res *types.Response,
@@ -542,6 +1086,24 @@ func (d *SyncServerDatasource) addEDUDeltaToResponse(
 		err = d.addTypingDeltaToResponse(
 			fromPos, joinedRoomIDs, res,
 		)
+		if err != nil {
+			return
+		}
+	}
+
+	if fromPos.EDUPresencePosition != toPos.EDUPresencePosition {
+		err = d.addPresenceDeltaToResponse(
+			ctx, userID, fromPos, res,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	if fromPos.EDUReceiptPosition != toPos.EDUReceiptPosition {
+		err = d.addReceiptDeltaToResponse(
+			fromPos, joinedRoomIDs, res,
+		)
 	}
 
 	return
@@ -558,8 +1120,10 @@ func (d *SyncServerDatasource) IncrementalSync(
 	fromPos, toPos types.PaginationToken,
 	numRecentEventsPerRoom int,
 	wantFullState bool,
+	limits types.SyncLimits,
 ) (*types.Response, error) {
 	nextBatchPos := fromPos.WithUpdates(toPos)
+	nextBatchPos.PendingRoomsPosition = 0
 	res := types.NewResponse(nextBatchPos)
 
 	var joinedRoomIDs []string
@@ -577,8 +1141,34 @@ func (d *SyncServerDatasource) IncrementalSync(
 		return nil, err
 	}
 
+	if fromPos.PendingRoomsPosition != 0 {
+		// The complete sync that this follows on from was cut short, so send
+		// the rooms which it didn't get to.
+		nextBatchPos.PendingRoomsPosition, err = d.addJoinedRoomsToResponse(
+			ctx, nil, device.UserID, fromPos.PendingRoomsPosition, toPos.PDUPosition,
+			numRecentEventsPerRoom, limits, res,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res.NextBatch = nextBatchPos.String()
+	}
+
 	err = d.addEDUDeltaToResponse(
-		fromPos, toPos, joinedRoomIDs, res,
+		ctx, device.UserID, fromPos, toPos, joinedRoomIDs, res,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromPos.EDUDeviceListPosition != toPos.EDUDeviceListPosition || fromPos.PDUPosition != toPos.PDUPosition {
+		if err = d.addDeviceListDeltaToResponse(ctx, device.UserID, fromPos, res); err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.addSendToDeviceMessagesToResponse(
+		ctx, device, fromPos.SendToDevicePosition, nextBatchPos.SendToDevicePosition, res,
 	)
 	if err != nil {
 		return nil, err
@@ -587,12 +1177,92 @@ func (d *SyncServerDatasource) IncrementalSync(
 	return res, nil
 }
 
+// addJoinedRoomsToResponse adds the current state and recent events of the
+// rooms which the user joined after afterPos to the response, in the order
+// that they joined them, until the limits are reached. The rooms which don't
+// fit are removed from the response, since it may have had only the changes
+// in them, and the position of the last room which did fit is returned so
+// that the rest can be sent next time. Returns zero if every room fitted.
+func (d *SyncServerDatasource) addJoinedRoomsToResponse(
+	ctx context.Context, txn *sql.Tx, userID string,
+	afterPos, toPos types.StreamPosition,
+	numRecentEventsPerRoom int, limits types.SyncLimits,
+	res *types.Response,
+) (pendingPos types.StreamPosition, err error) {
+	rooms, err := d.roomstate.selectJoinedRoomsAfter(ctx, txn, userID, afterPos)
+	if err != nil {
+		return 0, err
+	}
+
+	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
+
+	var numEvents int
+	for i, room := range rooms {
+		// Always add at least one room, so that each response makes progress.
+		if i > 0 && limits.Reached(i, numEvents) {
+			for _, pending := range rooms[i:] {
+				delete(res.Rooms.Join, pending.roomID)
+			}
+			return rooms[i-1].addedAt, nil
+		}
+
+		var stateEvents []gomatrixserverlib.HeaderedEvent
+		stateEvents, err = d.currentStateForSync(ctx, txn, room.roomID, userID, &stateFilter)
+		if err != nil {
+			return
+		}
+		// Shorten the timeline to fit in what is left of the limit. It keeps at
+		// least one event so that the client has somewhere to paginate from.
+		limit := numRecentEventsPerRoom
+		if left := limits.MaxEvents - numEvents - len(stateEvents); limits.MaxEvents > 0 && left < limit {
+			limit = left
+			if limit < 1 {
+				limit = 1
+			}
+		}
+		// TODO: When filters are added, we may need to call this multiple times to get enough events.
+		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
+		var recentStreamEvents []types.StreamEvent
+		var limited bool
+		recentStreamEvents, limited, err = d.selectRecentEventsLimited(
+			ctx, txn, room.roomID, types.StreamPosition(0), toPos, limit,
+		)
+		if err != nil {
+			return
+		}
+
+		// Retrieve the backward topology position, i.e. the position just
+		// before the oldest event in the timeline.
+		var backwardTopologyPos, backwardStreamPos types.StreamPosition
+		backwardTopologyPos, backwardStreamPos, err = d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+		if err != nil {
+			return
+		}
+
+		// We don't include a device here as we don't need to send down
+		// transaction IDs for complete syncs
+		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
+		stateEvents = removeDuplicates(stateEvents, recentEvents)
+		jr := types.NewJoinResponse()
+		jr.Timeline.PrevBatch = types.NewPaginationTokenFromTypeAndPosition(
+			types.PaginationTokenTypeTopology, backwardTopologyPos, backwardStreamPos,
+		).String()
+		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+		jr.Timeline.Limited = limited
+		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
+		res.Rooms.Join[room.roomID] = *jr
+		numEvents += len(stateEvents) + len(recentEvents)
+	}
+	return 0, nil
+}
+
 // getResponseWithPDUsForCompleteSync creates a response and adds all PDUs needed
 // to it. It returns toPos and joinedRoomIDs for use of adding EDUs.
 func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 	ctx context.Context,
 	userID string,
 	numRecentEventsPerRoom int,
+	limits types.SyncLimits,
 ) (
 	res *types.Response,
 	toPos types.PaginationToken,
@@ -623,57 +1293,17 @@ func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 
 	res = types.NewResponse(toPos)
 
-	// Extract room state and recent events for all rooms the user is joined to.
-	joinedRoomIDs, err = d.roomstate.selectRoomIDsWithMembership(ctx, txn, userID, gomatrixserverlib.Join)
+	// Add the state and recent events of the rooms the user is joined to,
+	// for as many of them as fit in the limits.
+	toPos.PendingRoomsPosition, err = d.addJoinedRoomsToResponse(
+		ctx, txn, userID, 0, toPos.PDUPosition, numRecentEventsPerRoom, limits, res,
+	)
 	if err != nil {
 		return
 	}
-
-	stateFilterPart := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
-
-	// Build up a /sync response. Add joined rooms.
-	for _, roomID := range joinedRoomIDs {
-		var stateEvents []gomatrixserverlib.HeaderedEvent
-		stateEvents, err = d.roomstate.selectCurrentState(ctx, txn, roomID, &stateFilterPart)
-		if err != nil {
-			return
-		}
-		//fmt.Println("State events:", stateEvents)
-		// TODO: When filters are added, we may need to call this multiple times to get enough events.
-		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-		var recentStreamEvents []types.StreamEvent
-		recentStreamEvents, err = d.events.selectRecentEvents(
-			ctx, txn, roomID, types.StreamPosition(0), toPos.PDUPosition,
-			numRecentEventsPerRoom, true, true,
-		)
-		if err != nil {
-			return
-		}
-		//fmt.Println("Recent stream events:", recentStreamEvents)
-
-		// Retrieve the backward topology position, i.e. the position of the
-		// oldest event in the room's topology.
-		var backwardTopologyPos, backwardTopologyStreamPos types.StreamPosition
-		backwardTopologyPos, backwardTopologyStreamPos, err = d.topology.selectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-		if backwardTopologyPos-1 <= 0 {
-			backwardTopologyPos = types.StreamPosition(1)
-		} else {
-			backwardTopologyPos--
-			backwardTopologyStreamPos += 1000 // this has to be bigger than the number of events we backfill per request
-		}
-
-		// We don't include a device here as we don't need to send down
-		// transaction IDs for complete syncs
-		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
-		stateEvents = removeDuplicates(stateEvents, recentEvents)
-		jr := types.NewJoinResponse()
-		jr.Timeline.PrevBatch = types.NewPaginationTokenFromTypeAndPosition(
-			types.PaginationTokenTypeTopology, backwardTopologyPos, backwardTopologyStreamPos,
-		).String()
-		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = true
-		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
-		res.Rooms.Join[roomID] = *jr
+	res.NextBatch = toPos.String()
+	for roomID := range res.Rooms.Join {
+		joinedRoomIDs = append(joinedRoomIDs, roomID)
 	}
 
 	if err = d.addInvitesToResponse(ctx, txn, userID, 0, toPos.PDUPosition, res); err != nil {
@@ -686,10 +1316,10 @@ func (d *SyncServerDatasource) getResponseWithPDUsForCompleteSync(
 
 // CompleteSync returns a complete /sync API response for the given user.
 func (d *SyncServerDatasource) CompleteSync(
-	ctx context.Context, userID string, numRecentEventsPerRoom int,
+	ctx context.Context, device authtypes.Device, numRecentEventsPerRoom int, limits types.SyncLimits,
 ) (*types.Response, error) {
 	res, toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, userID, numRecentEventsPerRoom,
+		ctx, device.UserID, numRecentEventsPerRoom, limits,
 	)
 	if err != nil {
 		return nil, err
@@ -697,15 +1327,68 @@ func (d *SyncServerDatasource) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.PaginationToken{}, toPos, joinedRoomIDs, res,
+		ctx, device.UserID, types.PaginationToken{}, toPos, joinedRoomIDs, res,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	// The client has no token, so it hasn't acknowledged any of the messages
+	// for the device and all of them are sent.
+	err = d.addSendToDeviceMessagesToResponse(ctx, device, 0, toPos.SendToDevicePosition, res)
+	if err != nil {
+		return nil, err
+	}
+
 	return res, nil
 }
 
+// addSendToDeviceMessagesToResponse adds the messages for the device after
+// fromPos and up to toPos to the response. A client only syncs from fromPos
+// once it has received the response which ended there, so the messages up to
+// fromPos have been delivered and are deleted first. Messages aren't deleted
+// when they are sent, so that they are sent again if the response is lost.
+func (d *SyncServerDatasource) addSendToDeviceMessagesToResponse(
+	ctx context.Context, device authtypes.Device, fromPos, toPos types.StreamPosition, res *types.Response,
+) error {
+	if fromPos > 0 {
+		err := d.sendToDevice.deleteSendToDeviceMessagesUpTo(ctx, nil, device.UserID, device.ID, fromPos)
+		if err != nil {
+			return err
+		}
+	}
+	if fromPos >= toPos {
+		return nil
+	}
+	eventJSONs, err := d.sendToDevice.selectSendToDeviceMessagesInRange(
+		ctx, nil, device.UserID, device.ID, fromPos, toPos,
+	)
+	if err != nil {
+		return err
+	}
+	for _, eventJSON := range eventJSONs {
+		var event types.SendToDeviceEvent
+		if err = json.Unmarshal(eventJSON, &event); err != nil {
+			return err
+		}
+		res.ToDevice.Events = append(res.ToDevice.Events, event)
+	}
+	return nil
+}
+
+// AddSendToDeviceMessage queues a message for a device until the device
+// acknowledges it by syncing from a position after it.
+// Returns the send-to-device position of the message.
+func (d *SyncServerDatasource) AddSendToDeviceMessage(
+	ctx context.Context, userID, deviceID string, event types.SendToDeviceEvent,
+) (types.StreamPosition, error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	return d.sendToDevice.insertSendToDeviceMessage(ctx, nil, userID, deviceID, eventJSON)
+}
+
 var txReadOnlySnapshot = sql.TxOptions{
 	// Set the isolation level so that we see a snapshot of the database.
 	// In PostgreSQL repeatable read transactions will see a snapshot taken
@@ -791,6 +1474,28 @@ func (d *SyncServerDatasource) RemoveTypingUser(
 	return types.StreamPosition(d.eduCache.RemoveUser(userID, roomID))
 }
 
+func (d *SyncServerDatasource) SetPresence(
+	userID, presence string, statusMsg *string, lastActiveTS gomatrixserverlib.Timestamp,
+) types.StreamPosition {
+	return types.StreamPosition(d.presenceCache.SetPresence(userID, presence, statusMsg, lastActiveTS))
+}
+
+// SetReceipt updates the receipt of the given type for a user in a room in
+// the receipt cache.
+// Returns the newly calculated sync position for receipts.
+func (d *SyncServerDatasource) SetReceipt(
+	roomID, receiptType, userID, eventID string, ts gomatrixserverlib.Timestamp,
+) types.StreamPosition {
+	return types.StreamPosition(d.receiptCache.SetReceipt(roomID, receiptType, userID, eventID, ts))
+}
+
+// SetDeviceListChanged records that the device list of a user has changed in
+// the device list cache.
+// Returns the newly calculated sync position for device lists.
+func (d *SyncServerDatasource) SetDeviceListChanged(userID string) types.StreamPosition {
+	return types.StreamPosition(d.deviceListCache.SetDeviceListChanged(userID))
+}
+
 func (d *SyncServerDatasource) addInvitesToResponse(
 	ctx context.Context, txn *sql.Tx,
 	userID string,
@@ -810,24 +1515,44 @@ func (d *SyncServerDatasource) addInvitesToResponse(
 	return nil
 }
 
-// Retrieve the backward topology position, i.e. the position of the
-// oldest event in the room's topology.
+// selectRecentEventsLimited returns the latest events in the room between
+// the two positions, up to the limit, from oldest to latest. One more event
+// than the limit is selected so that we can tell whether there were more
+// events than we returned, in which case the timeline is limited and the
+// client needs to paginate back from its prev_batch to get the rest.
+func (d *SyncServerDatasource) selectRecentEventsLimited(
+	ctx context.Context, txn *sql.Tx,
+	roomID string, fromPos, toPos types.StreamPosition, limit int,
+) (events []types.StreamEvent, limited bool, err error) {
+	events, err = d.events.selectRecentEvents(ctx, txn, roomID, fromPos, toPos, limit+1, true, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(events) > limit {
+		return events[len(events)-limit:], true, nil
+	}
+	return events, false, nil
+}
+
+// getBackwardTopologyPos returns the position in the room's topology just
+// before the first of the given events, to be used as the prev_batch token of
+// a timeline. /messages includes the stream position of a topology token when
+// paginating backwards, so the token is at the depth of the first event and
+// one stream position before it: events at the same depth which were written
+// before it are returned by the next page, but the event itself isn't.
+// Returns the start of the topology if there are no events.
 func (d *SyncServerDatasource) getBackwardTopologyPos(
 	ctx context.Context, txn *sql.Tx,
 	events []types.StreamEvent,
-) (pos, spos types.StreamPosition) {
-	if len(events) > 0 {
-		pos, spos, _ = d.topology.selectPositionInTopology(ctx, txn, events[0].EventID())
-	}
-	// go to the previous position so we don't pull out the same event twice
-	// FIXME: This could be done more nicely by being explicit with inclusive/exclusive rules
-	if pos-1 <= 0 {
-		pos = types.StreamPosition(1)
-	} else {
-		pos = pos - 1
-		spos += 1000 // this has to be bigger than the number of events we backfill per request
+) (pos, spos types.StreamPosition, err error) {
+	if len(events) == 0 {
+		return types.StreamPosition(1), 0, nil
 	}
-	return
+	pos, spos, err = d.topology.selectPositionInTopology(ctx, txn, events[0].EventID())
+	if err != nil {
+		return
+	}
+	return pos, spos - 1, nil
 }
 
 // addRoomDeltaToResponse adds a room state delta to a sync response
@@ -850,16 +1575,19 @@ func (d *SyncServerDatasource) addRoomDeltaToResponse(
 		// This is all "okay" assuming history_visibility == "shared" which it is by default.
 		endPos = delta.membershipPos
 	}
-	recentStreamEvents, err := d.events.selectRecentEvents(
+	recentStreamEvents, limited, err := d.selectRecentEventsLimited(
 		ctx, txn, delta.roomID, types.StreamPosition(fromPos), types.StreamPosition(endPos),
-		numRecentEventsPerRoom, true, true,
+		numRecentEventsPerRoom,
 	)
 	if err != nil {
 		return err
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents)
-	backwardTopologyPos, backwardStreamPos := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+	backwardTopologyPos, backwardStreamPos, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+	if err != nil {
+		return err
+	}
 
 	switch delta.membership {
 	case gomatrixserverlib.Join:
@@ -869,7 +1597,7 @@ func (d *SyncServerDatasource) addRoomDeltaToResponse(
 			types.PaginationTokenTypeTopology, backwardTopologyPos, backwardStreamPos,
 		).String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
@@ -882,7 +1610,7 @@ func (d *SyncServerDatasource) addRoomDeltaToResponse(
 			types.PaginationTokenTypeTopology, backwardTopologyPos, backwardStreamPos,
 		).String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -1016,7 +1744,7 @@ func (d *SyncServerDatasource) getStateDeltas(
 				if membership == gomatrixserverlib.Join {
 					// send full room state down instead of a delta
 					var s []types.StreamEvent
-					s, err = d.currentStateStreamEventsForRoom(ctx, txn, roomID, stateFilterPart)
+					s, err = d.currentStateStreamEventsForRoom(ctx, txn, roomID, userID, stateFilterPart)
 					if err != nil {
 						return nil, nil, err
 					}
@@ -1070,7 +1798,7 @@ func (d *SyncServerDatasource) getStateDeltasForFullStateSync(
 
 	// Add full states for all joined rooms
 	for _, joinedRoomID := range joinedRoomIDs {
-		s, stateErr := d.currentStateStreamEventsForRoom(ctx, txn, joinedRoomID, stateFilterPart)
+		s, stateErr := d.currentStateStreamEventsForRoom(ctx, txn, joinedRoomID, userID, stateFilterPart)
 		if stateErr != nil {
 			return nil, nil, stateErr
 		}
@@ -1111,11 +1839,45 @@ func (d *SyncServerDatasource) getStateDeltasForFullStateSync(
 	return deltas, joinedRoomIDs, nil
 }
 
+// currentStateForSync returns the current state of the room which passes the
+// filter, as it is sent to the given user in /sync. The essential state events
+// that the filter left out, such as m.room.encryption, are added back in, so
+// that a restrictive filter can't stop the client from using the room.
+func (d *SyncServerDatasource) currentStateForSync(
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
+	stateFilterPart *gomatrixserverlib.StateFilter,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	stateEvents, err := d.roomstate.selectCurrentState(ctx, txn, roomID, stateFilterPart)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[gomatrixserverlib.StateKeyTuple]bool, len(stateEvents))
+	for i := range stateEvents {
+		if stateKey := stateEvents[i].StateKey(); stateKey != nil {
+			have[gomatrixserverlib.StateKeyTuple{EventType: stateEvents[i].Type(), StateKey: *stateKey}] = true
+		}
+	}
+	for _, tuple := range types.EssentialSyncState(userID) {
+		if have[tuple] {
+			continue
+		}
+		var ev *gomatrixserverlib.HeaderedEvent
+		ev, err = d.roomstate.selectStateEvent(ctx, txn, roomID, tuple.EventType, tuple.StateKey)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil {
+			stateEvents = append(stateEvents, *ev)
+		}
+	}
+	return stateEvents, nil
+}
+
 func (d *SyncServerDatasource) currentStateStreamEventsForRoom(
-	ctx context.Context, txn *sql.Tx, roomID string,
+	ctx context.Context, txn *sql.Tx, roomID, userID string,
 	stateFilterPart *gomatrixserverlib.StateFilter,
 ) ([]types.StreamEvent, error) {
-	allState, err := d.roomstate.selectCurrentState(ctx, txn, roomID, stateFilterPart)
+	allState, err := d.currentStateForSync(ctx, txn, roomID, userID, stateFilterPart)
 	if err != nil {
 		return nil, err
 	}
@@ -1186,3 +1948,35 @@ func getMembershipFromEvent(ev *gomatrixserverlib.HeaderedEvent, userID string)
 	}
 	return ""
 }
+
+// presenceFilterAllows returns whether the presence of the given user passes
+// the sender rules of the given presence filter.
+func presenceFilterAllows(filter *gomatrixserverlib.EventFilter, userID string) bool {
+	for _, notSender := range filter.NotSenders {
+		if notSender == userID {
+			return false
+		}
+	}
+	if filter.Senders == nil {
+		return true
+	}
+	for _, sender := range filter.Senders {
+		if sender == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// membershipOf returns the membership of the given user in the last of the
+// events which is an m.room.member event for them, or an empty string if
+// there isn't one.
+func membershipOf(userID string, events []gomatrixserverlib.ClientEvent) string {
+	membership := ""
+	for _, ev := range events {
+		if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil && *ev.StateKey == userID {
+			membership = gjson.GetBytes(ev.Content, "membership").Str
+		}
+	}
+	return membership
+}
@@ -0,0 +1,717 @@
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var (
+	testOrigin     = gomatrixserverlib.ServerName("hollow.knight")
+	testRoomID     = fmt.Sprintf("!hallownest:%s", testOrigin)
+	testUserID     = fmt.Sprintf("@hornet:%s", testOrigin)
+	testKeyID      = gomatrixserverlib.KeyID("ed25519:sqlite3_test")
+	testPrivateKey = ed25519.NewKeyFromSeed([]byte{
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32,
+	})
+)
+
+type topologyPosition struct {
+	depth, stream types.StreamPosition
+}
+
+// The purpose of this test is to check that rebuilding the topology of a room restores the positions of events whose
+// rows have been deleted, and that rebuilding it again changes nothing.
+func TestRebuildTopologyForRoom(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+
+	var eventIDs, prevEventIDs []string
+	for i := 0; i < 5; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content:    []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:       "m.room.message",
+			Sender:     testUserID,
+			RoomID:     testRoomID,
+			Depth:      int64(i + 1),
+			PrevEvents: prevEventIDs,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		eventIDs = append(eventIDs, ev.EventID())
+		prevEventIDs = []string{ev.EventID()}
+	}
+
+	want := make(map[string]topologyPosition)
+	for _, eventID := range eventIDs {
+		depth, stream, err := d.EventPositionInTopology(ctx, eventID)
+		if err != nil {
+			t.Fatalf("EventPositionInTopology failed: %s", err)
+		}
+		want[eventID] = topologyPosition{depth, stream}
+	}
+
+	// Lose the rows for some of the events, as if we had crashed before
+	// inserting them in the topology.
+	for _, eventID := range []string{eventIDs[1], eventIDs[3]} {
+		if _, err = d.db.Exec("DELETE FROM syncapi_output_room_events_topology WHERE event_id = $1", eventID); err != nil {
+			t.Fatalf("failed to delete topology row: %s", err)
+		}
+	}
+	if _, _, err = d.EventPositionInTopology(ctx, eventIDs[1]); err == nil {
+		t.Fatalf("expected the topology row for %s to be missing", eventIDs[1])
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = d.RebuildTopologyForRoom(ctx, testRoomID); err != nil {
+			t.Fatalf("RebuildTopologyForRoom returned %s", err)
+		}
+		for _, eventID := range eventIDs {
+			depth, stream, err := d.EventPositionInTopology(ctx, eventID)
+			if err != nil {
+				t.Fatalf("EventPositionInTopology failed for %s after rebuild %d: %s", eventID, i+1, err)
+			}
+			if got := (topologyPosition{depth, stream}); got != want[eventID] {
+				t.Errorf("wrong position for %s after rebuild %d: got %+v want %+v", eventID, i+1, got, want[eventID])
+			}
+		}
+	}
+}
+
+// The purpose of this test is to check that the limit on a topological range is replaced with a default if it isn't
+// positive, is capped at a maximum, and that ranges with negative positions are rejected.
+func TestEventIDsInTopologicalRangeLimits(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	var prevEventIDs []string
+	for i := 0; i < maxEventIDsInRangeLimit+5; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content:    []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:       "m.room.message",
+			Sender:     testUserID,
+			RoomID:     testRoomID,
+			Depth:      int64(i + 1),
+			PrevEvents: prevEventIDs,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		prevEventIDs = []string{ev.EventID()}
+	}
+	lower := types.TopologyBound{Inclusive: true}
+	upper := types.TopologyBound{Depth: maxEventIDsInRangeLimit + 5, StreamPosition: maxEventIDsInRangeLimit + 100, Inclusive: true}
+
+	testCases := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"zero limit", 0, defaultEventIDsInRangeLimit},
+		{"negative limit", -1, defaultEventIDsInRangeLimit},
+		{"limit within range", 20, 20},
+		{"limit over the maximum", maxEventIDsInRangeLimit + 1, maxEventIDsInRangeLimit},
+	}
+	for _, tc := range testCases {
+		eventIDs, err := d.EventIDsInTopologicalRange(ctx, testRoomID, lower, upper, tc.limit, true)
+		if err != nil {
+			t.Errorf("%s: EventIDsInTopologicalRange returned %s", tc.name, err)
+			continue
+		}
+		if len(eventIDs) != tc.want {
+			t.Errorf("%s: got %d event IDs, want %d", tc.name, len(eventIDs), tc.want)
+		}
+	}
+
+	negative := types.TopologyBound{Depth: -1, Inclusive: true}
+	if _, err = d.EventIDsInTopologicalRange(ctx, testRoomID, negative, upper, 10, true); err == nil {
+		t.Errorf("expected an error for a negative lower bound")
+	}
+	negative = types.TopologyBound{Depth: 10, StreamPosition: -1, Inclusive: true}
+	if _, err = d.EventIDsInTopologicalRange(ctx, testRoomID, lower, negative, 10, true); err == nil {
+		t.Errorf("expected an error for a negative upper bound")
+	}
+}
+
+// The purpose of this test is to check that depths which are shared by more than the given number of events are
+// reported as collisions, and that depths with fewer events aren't.
+func TestTopologyCollisions(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	// Write four events at depth 2, two at depth 3 and one at depth 4.
+	for i, depth := range []int64{2, 2, 2, 2, 3, 3, 4} {
+		b := gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserID,
+			RoomID:  testRoomID,
+			Depth:   depth,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		minEvents int
+		want      []types.TopologyCollision
+	}{
+		{1, []types.TopologyCollision{{Depth: 2, Count: 4}, {Depth: 3, Count: 2}}},
+		{3, []types.TopologyCollision{{Depth: 2, Count: 4}}},
+		{4, nil},
+	}
+	for _, tc := range testCases {
+		got, err := d.TopologyCollisions(ctx, testRoomID, tc.minEvents)
+		if err != nil {
+			t.Fatalf("TopologyCollisions(%d) returned %s", tc.minEvents, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("TopologyCollisions(%d): got %+v want %+v", tc.minEvents, got, tc.want)
+		}
+	}
+
+	got, err := d.TopologyCollisions(ctx, "!unknown:"+string(testOrigin), 1)
+	if err != nil {
+		t.Fatalf("TopologyCollisions returned %s for an unknown room", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected no collisions for an unknown room, got %+v", got)
+	}
+}
+
+// The purpose of this test is to check that the export of a room's topology has every event in the room, in
+// topological order and then in stream order for events at the same depth, whatever order they were written in.
+func TestFullTopologyForRoom(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	var events []gomatrixserverlib.HeaderedEvent
+	var streamPositions []types.StreamPosition
+	for i, depth := range []int64{3, 1, 2, 3, 2} {
+		b := gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserID,
+			RoomID:  testRoomID,
+			Depth:   depth,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		pos, err := d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false)
+		if err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		events = append(events, ev)
+		streamPositions = append(streamPositions, pos)
+	}
+
+	var want []types.TopologyPosition
+	for _, i := range []int{1, 2, 4, 0, 3} {
+		want = append(want, types.TopologyPosition{
+			EventID:        events[i].EventID(),
+			Depth:          types.StreamPosition(events[i].Depth()),
+			StreamPosition: streamPositions[i],
+		})
+	}
+	got, err := d.FullTopologyForRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("FullTopologyForRoom returned %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FullTopologyForRoom: got %+v want %+v", got, want)
+	}
+
+	got, err = d.FullTopologyForRoom(ctx, "!unknown:"+string(testOrigin))
+	if err != nil {
+		t.Fatalf("FullTopologyForRoom returned %s for an unknown room", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected no events for an unknown room, got %+v", got)
+	}
+}
+
+// The purpose of this test is to check that the events at or after a topological position are returned in topological
+// order, that the limit is respected either side of the number of matching events, and that nothing is returned from a
+// position beyond the newest event.
+func TestEventIDsForwardFromTopologicalPosition(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	var eventIDs, prevEventIDs []string
+	for i := 0; i < 5; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content:    []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:       "m.room.message",
+			Sender:     testUserID,
+			RoomID:     testRoomID,
+			Depth:      int64(i + 1),
+			PrevEvents: prevEventIDs,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		eventIDs = append(eventIDs, ev.EventID())
+		prevEventIDs = []string{ev.EventID()}
+	}
+
+	testCases := []struct {
+		name  string
+		pos   types.StreamPosition
+		limit int
+		want  []string
+	}{
+		{"limit below the number of events", 3, 2, eventIDs[2:4]},
+		{"limit equal to the number of events", 3, 3, eventIDs[2:]},
+		{"limit above the number of events", 3, 4, eventIDs[2:]},
+		{"from the oldest event", 1, 10, eventIDs},
+		{"from the newest event", 5, 10, eventIDs[4:]},
+		{"beyond the newest event", 6, 10, []string{}},
+	}
+	for _, tc := range testCases {
+		got, err := d.EventIDsForwardFromTopologicalPosition(ctx, testRoomID, tc.pos, tc.limit)
+		if err != nil {
+			t.Errorf("%s: EventIDsForwardFromTopologicalPosition returned %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The purpose of this test is to check that the neighbours of an event are the nearest events either side of it, with
+// the events before it nearest first, and that an event at the start or the end of a room's history has no neighbours
+// on that side. The event itself is never one of its own neighbours.
+func TestEventIDsAroundTopologicalPosition(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	var eventIDs, prevEventIDs []string
+	for i := 0; i < 5; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content:    []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:       "m.room.message",
+			Sender:     testUserID,
+			RoomID:     testRoomID,
+			Depth:      int64(i + 1),
+			PrevEvents: prevEventIDs,
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		eventIDs = append(eventIDs, ev.EventID())
+		prevEventIDs = []string{ev.EventID()}
+	}
+
+	testCases := []struct {
+		name        string
+		event       int
+		beforeLimit int
+		afterLimit  int
+		wantBefore  []string
+		wantAfter   []string
+	}{
+		{"middle", 2, 1, 1, []string{eventIDs[1]}, []string{eventIDs[3]}},
+		{"middle with room to spare", 2, 10, 10, []string{eventIDs[1], eventIDs[0]}, eventIDs[3:]},
+		{"middle with only events before", 2, 2, 0, []string{eventIDs[1], eventIDs[0]}, []string{}},
+		{"start", 0, 3, 3, []string{}, eventIDs[1:4]},
+		{"end", 4, 3, 3, []string{eventIDs[3], eventIDs[2], eventIDs[1]}, []string{}},
+	}
+	for _, tc := range testCases {
+		pos, spos, err := d.topology.selectPositionInTopology(ctx, nil, eventIDs[tc.event])
+		if err != nil {
+			t.Fatalf("%s: selectPositionInTopology returned %s", tc.name, err)
+		}
+		before, after, err := d.EventIDsAroundTopologicalPosition(ctx, testRoomID, pos, spos, tc.beforeLimit, tc.afterLimit)
+		if err != nil {
+			t.Errorf("%s: EventIDsAroundTopologicalPosition returned %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(before, tc.wantBefore) {
+			t.Errorf("%s: got events before %v want %v", tc.name, before, tc.wantBefore)
+		}
+		if !reflect.DeepEqual(after, tc.wantAfter) {
+			t.Errorf("%s: got events after %v want %v", tc.name, after, tc.wantAfter)
+		}
+	}
+}
+
+// The purpose of this test is to check that the state of an encrypted room sent in /sync always includes the
+// m.room.encryption event, the create event and the user's own membership, however restrictive the state filter is,
+// and that none of them is sent twice when the filter lets them through.
+func TestCurrentStateForSyncKeepsEssentialState(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	stateKey := ""
+	userStateKey := testUserID
+	var prevEventIDs []string
+	for i, b := range []gomatrixserverlib.EventBuilder{
+		{Type: gomatrixserverlib.MRoomCreate, StateKey: &stateKey, Content: []byte(`{"creator":"` + testUserID + `"}`)},
+		{Type: gomatrixserverlib.MRoomMember, StateKey: &userStateKey, Content: []byte(`{"membership":"join"}`)},
+		{Type: "m.room.name", StateKey: &stateKey, Content: []byte(`{"name":"Hallownest"}`)},
+		{Type: types.MRoomEncryption, StateKey: &stateKey, Content: []byte(`{"algorithm":"m.megolm.v1.aes-sha2"}`)},
+	} {
+		b.Sender = testUserID
+		b.RoomID = testRoomID
+		b.Depth = int64(i + 1)
+		b.PrevEvents = prevEventIDs
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, []gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		prevEventIDs = []string{ev.EventID()}
+	}
+
+	containsURL := true
+	testCases := []struct {
+		name      string
+		filter    gomatrixserverlib.StateFilter
+		minEvents int
+	}{
+		{"default filter", gomatrixserverlib.DefaultStateFilter(), 4},
+		{"limit of one event", gomatrixserverlib.StateFilter{Limit: 1}, 3},
+		{"filter matching nothing", gomatrixserverlib.StateFilter{Limit: 10, ContainsURL: &containsURL}, 3},
+	}
+	for _, tc := range testCases {
+		stateEvents, err := d.currentStateForSync(ctx, nil, testRoomID, testUserID, &tc.filter)
+		if err != nil {
+			t.Fatalf("%s: currentStateForSync returned %s", tc.name, err)
+		}
+		got := make(map[gomatrixserverlib.StateKeyTuple]int)
+		for i := range stateEvents {
+			got[gomatrixserverlib.StateKeyTuple{EventType: stateEvents[i].Type(), StateKey: *stateEvents[i].StateKey()}]++
+		}
+		for _, tuple := range types.EssentialSyncState(testUserID) {
+			if got[tuple] != 1 {
+				t.Errorf("%s: got %d %s events with state key %q, want 1", tc.name, got[tuple], tuple.EventType, tuple.StateKey)
+			}
+		}
+		if len(stateEvents) < tc.minEvents {
+			t.Errorf("%s: got %d state events, want at least %d", tc.name, len(stateEvents), tc.minEvents)
+		}
+	}
+}
+
+// The purpose of this test is to check that inserting an event in the topology again is counted as a conflict and keeps
+// the event's existing position, even at another stream position, and that inserting a new event isn't a conflict and
+// stores the stream position that it was given, even if it is before the room's latest.
+func TestInsertEventInTopologyCountsConflicts(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	conflicts := tables.TopologyInsertConflicts.WithLabelValues(testRoomID)
+	before := testutil.ToFloat64(conflicts)
+
+	var events []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 2; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserID,
+			RoomID:  testRoomID,
+			Depth:   int64(i + 1),
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events = append(events, e.Headered(gomatrixserverlib.RoomVersionV4))
+	}
+
+	if err = d.topology.insertEventInTopology(ctx, nil, &events[0], 1); err != nil {
+		t.Fatalf("insertEventInTopology returned %s", err)
+	}
+	if got := testutil.ToFloat64(conflicts) - before; got != 0 {
+		t.Errorf("wrong number of conflicts after inserting a new event: got %v want 0", got)
+	}
+	if err = d.topology.insertEventInTopology(ctx, nil, &events[0], 1); err != nil {
+		t.Fatalf("insertEventInTopology returned %s for a duplicate", err)
+	}
+	if got := testutil.ToFloat64(conflicts) - before; got != 1 {
+		t.Errorf("wrong number of conflicts after inserting a duplicate: got %v want 1", got)
+	}
+	if err = d.topology.insertEventInTopology(ctx, nil, &events[0], 7); err != nil {
+		t.Fatalf("insertEventInTopology returned %s for a duplicate at another position", err)
+	}
+	if got := testutil.ToFloat64(conflicts) - before; got != 2 {
+		t.Errorf("wrong number of conflicts after inserting a duplicate at another position: got %v want 2", got)
+	}
+	if _, spos, err := d.topology.selectPositionInTopology(ctx, nil, events[0].EventID()); err != nil || spos != 1 {
+		t.Errorf("duplicate moved the event: got stream position %d, %v want 1", spos, err)
+	}
+	if err = d.topology.insertEventInTopology(ctx, nil, &events[1], 0); err != nil {
+		t.Fatalf("insertEventInTopology returned %s", err)
+	}
+	if got := testutil.ToFloat64(conflicts) - before; got != 2 {
+		t.Errorf("wrong number of conflicts after inserting another new event: got %v want 2", got)
+	}
+	if _, spos, err := d.topology.selectPositionInTopology(ctx, nil, events[1].EventID()); err != nil || spos != 0 {
+		t.Errorf("new event wasn't stored at its stream position: got %d, %v want 0", spos, err)
+	}
+}
+
+// The purpose of this test is to check that the rooms which a user is joined to are listed most recently active
+// first, leaving out rooms which the user isn't joined to, and that paginating through them visits every room once.
+func TestRoomsByRecentActivity(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	writeEvent := func(roomID, sender string, stateKey *string, content string) {
+		b := gomatrixserverlib.EventBuilder{
+			Content:  []byte(content),
+			Type:     "m.room.message",
+			Sender:   sender,
+			RoomID:   roomID,
+			Depth:    1,
+			StateKey: stateKey,
+		}
+		if stateKey != nil {
+			b.Type = gomatrixserverlib.MRoomMember
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		var addState []gomatrixserverlib.HeaderedEvent
+		var addStateIDs []string
+		if stateKey != nil {
+			addState, addStateIDs = []gomatrixserverlib.HeaderedEvent{ev}, []string{ev.EventID()}
+		}
+		if _, err = d.WriteEvent(ctx, &ev, addState, addStateIDs, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+
+	roomIDs := make([]string, 4)
+	userStateKey := testUserID
+	for i := range roomIDs {
+		roomIDs[i] = fmt.Sprintf("!room%d:%s", i, testOrigin)
+		writeEvent(roomIDs[i], testUserID, &userStateKey, `{"membership":"join"}`)
+	}
+	// Another user is joined to a room that is more active than any of ours.
+	otherUserID := fmt.Sprintf("@zote:%s", testOrigin)
+	otherRoomID := fmt.Sprintf("!elsewhere:%s", testOrigin)
+	writeEvent(otherRoomID, otherUserID, &otherUserID, `{"membership":"join"}`)
+	writeEvent(roomIDs[1], testUserID, nil, `{"msgtype":"m.text","body":"first"}`)
+	writeEvent(roomIDs[0], testUserID, nil, `{"msgtype":"m.text","body":"second"}`)
+	writeEvent(otherRoomID, otherUserID, nil, `{"msgtype":"m.text","body":"third"}`)
+
+	want := []string{roomIDs[0], roomIDs[1], roomIDs[3], roomIDs[2]}
+	var got []string
+	var lastPos types.StreamPosition
+	for offset := 0; offset < 2*len(want); offset += 2 {
+		rooms, err := d.RoomsByRecentActivity(ctx, testUserID, 2, offset)
+		if err != nil {
+			t.Fatalf("RoomsByRecentActivity(offset %d) returned %s", offset, err)
+		}
+		if offset >= len(want) && len(rooms) != 0 {
+			t.Errorf("expected no rooms after the last page, got %+v", rooms)
+		}
+		for _, room := range rooms {
+			if len(got) > 0 && room.StreamPosition >= lastPos {
+				t.Errorf("room %s at position %d isn't before the previous room at %d", room.RoomID, room.StreamPosition, lastPos)
+			}
+			got = append(got, room.RoomID)
+			lastPos = room.StreamPosition
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong rooms: got %v want %v", got, want)
+	}
+
+	if _, err = d.RoomsByRecentActivity(ctx, testUserID, 2, -1); err == nil {
+		t.Errorf("expected an error for a negative offset")
+	}
+}
+
+// The purpose of this test is to check that an event in the topology of a room which isn't in the events table is
+// found by the consistency check and removed by the repair, and that the rest of the room's topology is kept.
+func TestRemoveOrphanedTopology(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	var events []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserID,
+			RoomID:  testRoomID,
+			Depth:   int64(i + 1),
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		events = append(events, e.Headered(gomatrixserverlib.RoomVersionV4))
+	}
+	for i := range events[:2] {
+		if _, err = d.WriteEvent(ctx, &events[i], nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+	}
+	// The last event only makes it into the topology, as if it had been
+	// deleted from the events table since.
+	orphan := events[2]
+	if err = d.WriteEventInTopology(ctx, &orphan, 100, false); err != nil {
+		t.Fatalf("WriteEventInTopology failed: %s", err)
+	}
+
+	eventIDs, err := d.OrphanedTopologyEventIDs(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("OrphanedTopologyEventIDs returned %s", err)
+	}
+	if !reflect.DeepEqual(eventIDs, []string{orphan.EventID()}) {
+		t.Fatalf("wrong orphaned events: got %v want [%s]", eventIDs, orphan.EventID())
+	}
+
+	removed, err := d.RemoveOrphanedTopology(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RemoveOrphanedTopology returned %s", err)
+	}
+	if !reflect.DeepEqual(removed, []string{orphan.EventID()}) {
+		t.Errorf("wrong removed events: got %v want [%s]", removed, orphan.EventID())
+	}
+	if eventIDs, err = d.OrphanedTopologyEventIDs(ctx, testRoomID); err != nil || len(eventIDs) != 0 {
+		t.Errorf("expected no orphaned events after the repair, got %v (err %v)", eventIDs, err)
+	}
+	if _, _, err = d.EventPositionInTopology(ctx, orphan.EventID()); err == nil {
+		t.Errorf("expected %s to be removed from the topology", orphan.EventID())
+	}
+	for i := range events[:2] {
+		if _, _, err = d.EventPositionInTopology(ctx, events[i].EventID()); err != nil {
+			t.Errorf("expected %s to stay in the topology: %s", events[i].EventID(), err)
+		}
+	}
+
+	// Running the repair again finds nothing to remove.
+	if removed, err = d.RemoveOrphanedTopology(ctx, testRoomID); err != nil || len(removed) != 0 {
+		t.Errorf("expected nothing to be removed the second time, got %v (err %v)", removed, err)
+	}
+}
+
+// The purpose of this test is to check that events are selected across rooms in stream order, between exclusive and
+// inclusive stream positions, and that the limit is applied to the events of all rooms together.
+func TestEventIDsInStreamRange(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	roomIDs := []string{fmt.Sprintf("!first:%s", testOrigin), fmt.Sprintf("!second:%s", testOrigin)}
+	var eventIDs []string
+	for i := 0; i < 6; i++ {
+		b := gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"msgtype":"m.text","body":"message %d"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserID,
+			RoomID:  roomIDs[i%len(roomIDs)],
+			Depth:   int64(i/len(roomIDs) + 1),
+		}
+		e, err := b.Build(time.Now(), testOrigin, testKeyID, testPrivateKey, gomatrixserverlib.RoomVersionV4)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		ev := e.Headered(gomatrixserverlib.RoomVersionV4)
+		if _, err = d.WriteEvent(ctx, &ev, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent failed: %s", err)
+		}
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	_, firstPos, err := d.EventPositionInTopology(ctx, eventIDs[0])
+	if err != nil {
+		t.Fatalf("EventPositionInTopology returned %s", err)
+	}
+
+	testCases := []struct {
+		name     string
+		from, to types.StreamPosition
+		limit    int
+		want     []string
+	}{
+		{"every event", 0, firstPos + 5, 0, eventIDs},
+		{"limited", 0, firstPos + 5, 4, eventIDs[:4]},
+		{"exclusive from and inclusive to", firstPos + 1, firstPos + 3, 0, eventIDs[2:4]},
+		{"next page", firstPos + 3, firstPos + 5, 10, eventIDs[4:]},
+		{"empty range", firstPos + 5, firstPos + 10, 0, []string{}},
+	}
+	for _, tc := range testCases {
+		got, err := d.EventIDsInStreamRange(ctx, tc.from, tc.to, tc.limit)
+		if err != nil {
+			t.Errorf("%s: EventIDsInStreamRange returned %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: wrong event IDs: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+	if _, err = d.EventIDsInStreamRange(ctx, -1, firstPos, 0); err == nil {
+		t.Errorf("expected an error for a negative stream position")
+	}
+}
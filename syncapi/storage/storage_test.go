@@ -3,7 +3,9 @@ package storage_test
 import (
 	"context"
 	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -147,6 +149,7 @@ func TestSyncResponse(t *testing.T) {
 		DoSync       func() (*types.Response, error)
 		WantTimeline []gomatrixserverlib.HeaderedEvent
 		WantState    []gomatrixserverlib.HeaderedEvent
+		WantLimited  bool
 	}{
 		// The purpose of this test is to make sure that incremental syncs are including up to the latest events.
 		// It's a basic sanity test that sync works. It creates a `since` token that is on the penultimate event.
@@ -157,7 +160,7 @@ func TestSyncResponse(t *testing.T) {
 				from := types.NewPaginationTokenFromTypeAndPosition( // pretend we are at the penultimate event
 					types.PaginationTokenTypeStream, positions[len(positions)-2], types.StreamPosition(0),
 				)
-				return db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false)
+				return db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false, types.SyncLimits{})
 			},
 			WantTimeline: events[len(events)-1:],
 		},
@@ -170,10 +173,11 @@ func TestSyncResponse(t *testing.T) {
 					types.PaginationTokenTypeStream, positions[len(positions)-11], types.StreamPosition(0),
 				)
 				// limit is set to 5
-				return db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false)
+				return db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false, types.SyncLimits{})
 			},
 			// want the last 5 events, NOT the last 10.
 			WantTimeline: events[len(events)-5:],
+			WantLimited:  true,
 		},
 		// The purpose of this test is to check that CompleteSync returns all the current state as well as
 		// honouring the `numRecentEventsPerRoom` value
@@ -181,19 +185,20 @@ func TestSyncResponse(t *testing.T) {
 			Name: "CompleteSync limited",
 			DoSync: func() (*types.Response, error) {
 				// limit set to 5
-				return db.CompleteSync(ctx, testUserIDA, 5)
+				return db.CompleteSync(ctx, testUserDeviceA, 5, types.SyncLimits{})
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
 			// want all state for the room
-			WantState: state,
+			WantState:   state,
+			WantLimited: true,
 		},
 		// The purpose of this test is to check that CompleteSync can return everything with a high enough
 		// `numRecentEventsPerRoom`.
 		{
 			Name: "CompleteSync",
 			DoSync: func() (*types.Response, error) {
-				return db.CompleteSync(ctx, testUserIDA, len(events)+1)
+				return db.CompleteSync(ctx, testUserDeviceA, len(events)+1, types.SyncLimits{})
 			},
 			WantTimeline: events,
 			// We want no state at all as that field in /sync is the delta between the token (beginning of time)
@@ -217,6 +222,9 @@ func TestSyncResponse(t *testing.T) {
 			}
 			assertEventsEqual(st, "state for "+testRoomID, false, roomRes.State.Events, tc.WantState)
 			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, tc.WantTimeline)
+			if roomRes.Timeline.Limited != tc.WantLimited {
+				st.Errorf("timeline limited got %t want %t", roomRes.Timeline.Limited, tc.WantLimited)
+			}
 		})
 	}
 }
@@ -234,7 +242,7 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 		types.PaginationTokenTypeStream, positions[len(positions)-2], types.StreamPosition(0),
 	)
 
-	res, err := db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false)
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false, types.SyncLimits{})
 	if err != nil {
 		t.Fatalf("failed to IncrementalSync with latest token")
 	}
@@ -264,6 +272,152 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-6:len(events)-1]))
 }
 
+// The purpose of this test is to check that when more events happened in a room since the since token than the
+// timeline limit, the timeline is truncated to the latest events and marked as limited, and that paginating backwards
+// from its prev_batch token returns the events which were truncated.
+func TestIncrementalSyncLimitedPrevBatch(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	// pretend we are 10 events behind, with a limit of 5
+	from := types.NewPaginationTokenFromTypeAndPosition(
+		types.PaginationTokenTypeStream, positions[len(positions)-11], types.StreamPosition(0),
+	)
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to IncrementalSync: %s", err)
+	}
+	roomRes, ok := res.Rooms.Join[testRoomID]
+	if !ok {
+		t.Fatalf("IncrementalSync response missing room %s - response: %+v", testRoomID, res)
+	}
+	assertEventsEqual(t, "IncrementalSync Timeline", false, roomRes.Timeline.Events, events[len(events)-5:])
+	if !roomRes.Timeline.Limited {
+		t.Errorf("expected the timeline to be limited")
+	}
+
+	prevBatchToken, err := types.NewPaginationTokenFromString(roomRes.Timeline.PrevBatch)
+	if err != nil {
+		t.Fatalf("failed to NewPaginationTokenFromString for prev_batch %q: %s", roomRes.Timeline.PrevBatch, err)
+	}
+	// the 5 events which didn't fit in the timeline are the next ones back from prev_batch
+	to := types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, 0, 0)
+	paginatedEvents, err := db.GetEventsInRange(ctx, prevBatchToken, to, testRoomID, 5, true)
+	if err != nil {
+		t.Fatalf("GetEventsInRange returned an error: %s", err)
+	}
+	gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-10:len(events)-5]))
+}
+
+// The purpose of this test is to check that paginating backwards from the prev_batch token of a sync timeline returns
+// the events immediately before the timeline, with no gap or overlap, even if the first event in the timeline shares its
+// depth with events which aren't in the timeline. This test creates a DAG like:
+//                            .-----> Message ---.
+//     Create -> Membership --------> Message -------> Message
+//                            `-----> Message ---`
+// depth  1          2                   3                 4
+//
+// and syncs so that the timeline starts with the last of the forked messages.
+func TestGetEventsInRangeWithPrevBatchSameDepth(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+
+	var events []gomatrixserverlib.HeaderedEvent
+	events = append(events, MustCreateEvent(t, testRoomID, nil, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(fmt.Sprintf(`{"room_version":"4","creator":"%s"}`, testUserIDA)),
+		Type:     "m.room.create",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	}))
+	events = append(events, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(fmt.Sprintf(`{"membership":"join"}`)),
+		Type:     "m.room.member",
+		StateKey: &testUserIDA,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	}))
+	// fork the dag into three, same prev_events and depth
+	parent := []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}
+	depth := int64(len(events) + 1)
+	for i := 0; i < 3; i++ {
+		events = append(events, MustCreateEvent(t, testRoomID, parent, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Message A %d"}`, i+1)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   depth,
+		}))
+	}
+	// merge the fork, prev_events are all 3 messages, depth is increased by 1.
+	events = append(events, MustCreateEvent(t, testRoomID, events[len(events)-3:], &gomatrixserverlib.EventBuilder{
+		Content: []byte(fmt.Sprintf(`{"body":"Message merge"}`)),
+		Type:    "m.room.message",
+		Sender:  testUserIDA,
+		Depth:   depth + 1,
+	}))
+	positions := MustWriteEvents(t, db, events)
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	testCases := []struct {
+		Name   string
+		DoSync func() (*types.Response, error)
+	}{
+		{
+			Name: "IncrementalSync",
+			DoSync: func() (*types.Response, error) {
+				from := types.NewPaginationTokenFromTypeAndPosition( // pretend we are at the second forked message
+					types.PaginationTokenTypeStream, positions[len(positions)-3], types.StreamPosition(0),
+				)
+				return db.IncrementalSync(ctx, testUserDeviceA, *from, latest, 5, false, types.SyncLimits{})
+			},
+		},
+		{
+			Name: "CompleteSync",
+			DoSync: func() (*types.Response, error) {
+				return db.CompleteSync(ctx, testUserDeviceA, 2, types.SyncLimits{})
+			},
+		},
+	}
+	// head towards the beginning of time
+	to := types.NewPaginationTokenFromTypeAndPosition(types.PaginationTokenTypeTopology, 0, 0)
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(st *testing.T) {
+			res, err := tc.DoSync()
+			if err != nil {
+				st.Fatalf("failed to do sync: %s", err)
+			}
+			roomRes, ok := res.Rooms.Join[testRoomID]
+			if !ok {
+				st.Fatalf("sync response missing room %s - response: %+v", testRoomID, res)
+			}
+			// the timeline starts with the last forked message
+			assertEventsEqual(st, "timeline for "+testRoomID, false, roomRes.Timeline.Events, events[len(events)-2:])
+
+			prevBatchToken, err := types.NewPaginationTokenFromString(roomRes.Timeline.PrevBatch)
+			if err != nil {
+				st.Fatalf("failed to NewPaginationTokenFromString for prev_batch %q: %s", roomRes.Timeline.PrevBatch, err)
+			}
+			paginatedEvents, err := db.GetEventsInRange(ctx, prevBatchToken, to, testRoomID, len(events), true)
+			if err != nil {
+				st.Fatalf("GetEventsInRange returned an error: %s", err)
+			}
+			gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+			// want every event before the timeline, including the other forked messages at the same depth
+			assertEventsEqual(st, "paginating from prev_batch", true, gots, reversed(events[:len(events)-2]))
+		})
+	}
+}
+
 // The purpose of this test is to ensure that backfill does indeed go backwards, using a stream token.
 func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 	t.Parallel()
@@ -466,6 +620,794 @@ func TestGetEventsInRangeWithEventsInsertedLikeBackfill(t *testing.T) {
 	}
 }
 
+// The purpose of this test is to pin down which events are returned at the boundaries of a topological range for
+// each combination of inclusive and exclusive bounds.
+func TestEventIDsInTopologicalRangeBoundaries(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	bound := func(eventID string, inclusive bool) types.TopologyBound {
+		depth, streamPos, err := db.EventPositionInTopology(ctx, eventID)
+		if err != nil {
+			t.Fatalf("failed to get EventPositionInTopology: %s", err)
+		}
+		return types.TopologyBound{Depth: depth, StreamPosition: streamPos, Inclusive: inclusive}
+	}
+	lowerEvent, upperEvent := events[5].EventID(), events[8].EventID()
+
+	testCases := []struct {
+		Name  string
+		Lower types.TopologyBound
+		Upper types.TopologyBound
+		Wants []gomatrixserverlib.HeaderedEvent
+	}{
+		{
+			Name:  "inclusive lower, inclusive upper",
+			Lower: bound(lowerEvent, true),
+			Upper: bound(upperEvent, true),
+			Wants: events[5:9],
+		},
+		{
+			Name:  "inclusive lower, exclusive upper",
+			Lower: bound(lowerEvent, true),
+			Upper: bound(upperEvent, false),
+			Wants: events[5:8],
+		},
+		{
+			Name:  "exclusive lower, inclusive upper",
+			Lower: bound(lowerEvent, false),
+			Upper: bound(upperEvent, true),
+			Wants: events[6:9],
+		},
+		{
+			Name:  "exclusive lower, exclusive upper",
+			Lower: bound(lowerEvent, false),
+			Upper: bound(upperEvent, false),
+			Wants: events[6:8],
+		},
+		{
+			Name:  "exclusive bounds at the same position",
+			Lower: bound(lowerEvent, false),
+			Upper: bound(lowerEvent, false),
+			Wants: nil,
+		},
+	}
+	for _, tc := range testCases {
+		gotIDs, err := db.EventIDsInTopologicalRange(ctx, testRoomID, tc.Lower, tc.Upper, 100, true)
+		if err != nil {
+			t.Fatalf("%s: EventIDsInTopologicalRange returned an error: %s", tc.Name, err)
+		}
+		if len(gotIDs) != len(tc.Wants) {
+			t.Errorf("%s: got %d event IDs, want %d", tc.Name, len(gotIDs), len(tc.Wants))
+			continue
+		}
+		for i := range gotIDs {
+			if gotIDs[i] != tc.Wants[i].EventID() {
+				t.Errorf("%s: event ID %d: got %s want %s", tc.Name, i, gotIDs[i], tc.Wants[i].EventID())
+			}
+		}
+	}
+}
+
+// The purpose of this test is to check that a presence update for a user who shares a room with the syncing user
+// appears in the next incremental sync, and that presence for users who don't share a room is left out.
+func TestSyncResponsePresence(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	db.SetPresence(fmt.Sprintf("@stranger:%s", testOrigin), "online", nil, 0)
+	statusMsg := "Gone to Greenpath"
+	db.SetPresence(testUserIDB, "unavailable", &statusMsg, gomatrixserverlib.AsTimestamp(time.Now()))
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if !to.IsAfter(from) {
+		t.Fatalf("expected sync position %s to be after %s", to.String(), from.String())
+	}
+
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.Presence.Events) != 1 {
+		t.Fatalf("got %d presence events, want 1: %+v", len(res.Presence.Events), res.Presence.Events)
+	}
+	ev := res.Presence.Events[0]
+	if ev.Type != "m.presence" || ev.Sender != testUserIDB {
+		t.Errorf("got presence event of type %s from %s, want m.presence from %s", ev.Type, ev.Sender, testUserIDB)
+	}
+	var content struct {
+		Presence  string `json:"presence"`
+		StatusMsg string `json:"status_msg"`
+	}
+	if err = json.Unmarshal(ev.Content, &content); err != nil {
+		t.Fatalf("failed to unmarshal presence content: %s", err)
+	}
+	if content.Presence != "unavailable" || content.StatusMsg != statusMsg {
+		t.Errorf("got presence content %s", string(ev.Content))
+	}
+
+	// Syncing again from the new position shouldn't return the same presence again.
+	res, err = db.IncrementalSync(ctx, testUserDeviceA, to, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.Presence.Events) != 0 {
+		t.Errorf("got %d presence events, want 0", len(res.Presence.Events))
+	}
+}
+
+// The purpose of this test is to check that a send-to-device message is delivered to its device in /sync, that it is
+// delivered again if the client syncs from the same position because it didn't get the response, and that it isn't
+// delivered again once the client has acknowledged it by syncing from the next_batch of the response.
+func TestSyncResponseSendToDevice(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	message := types.SendToDeviceEvent{
+		Sender:  testUserIDB,
+		Type:    "m.room_key",
+		Content: json.RawMessage(`{"algorithm":"m.megolm.v1.aes-sha2","room_id":"` + testRoomID + `"}`),
+	}
+	otherDevice := authtypes.Device{UserID: testUserIDA, ID: "device_id_other"}
+	for _, device := range []authtypes.Device{testUserDeviceA, otherDevice} {
+		if _, err = db.AddSendToDeviceMessage(ctx, device.UserID, device.ID, message); err != nil {
+			t.Fatalf("AddSendToDeviceMessage failed: %s", err)
+		}
+	}
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if !to.IsAfter(from) {
+		t.Fatalf("expected sync position %s to be after %s", to.String(), from.String())
+	}
+
+	// The first response is lost, so the client syncs from the same position again and gets the message again.
+	var res *types.Response
+	for i := 0; i < 2; i++ {
+		res, err = db.IncrementalSync(ctx, testUserDeviceA, from, to, 5, false, types.SyncLimits{})
+		if err != nil {
+			t.Fatalf("failed to do sync: %s", err)
+		}
+		if len(res.ToDevice.Events) != 1 || !reflect.DeepEqual(res.ToDevice.Events[0], message) {
+			t.Fatalf("sync %d: got to-device events %+v, want %+v", i, res.ToDevice.Events, message)
+		}
+	}
+
+	// Syncing from the next_batch of the response acknowledges the message, so it isn't sent again.
+	next, err := types.NewPaginationTokenFromString(res.NextBatch)
+	if err != nil {
+		t.Fatalf("failed to parse next_batch %q: %s", res.NextBatch, err)
+	}
+	res, err = db.IncrementalSync(ctx, testUserDeviceA, *next, *next, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.ToDevice.Events) != 0 {
+		t.Errorf("got %d to-device events after acknowledging them, want 0", len(res.ToDevice.Events))
+	}
+	res, err = db.CompleteSync(ctx, testUserDeviceA, 5, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.ToDevice.Events) != 0 {
+		t.Errorf("got %d to-device events in a complete sync after acknowledging them, want 0", len(res.ToDevice.Events))
+	}
+
+	// The message for the other device hasn't been acknowledged.
+	res, err = db.CompleteSync(ctx, otherDevice, 5, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.ToDevice.Events) != 1 {
+		t.Errorf("got %d to-device events for the other device, want 1", len(res.ToDevice.Events))
+	}
+}
+
+// The purpose of this test is to check that a read receipt, such as one received over federation, appears in an
+// m.receipt ephemeral event in the next incremental sync, that it isn't delivered again by the sync after that, and that
+// receipts for rooms the user isn't joined to are left out.
+func TestSyncResponseReceipts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	readEventID := events[len(events)-1].EventID()
+	ts := gomatrixserverlib.AsTimestamp(time.Now())
+	db.SetReceipt(testRoomID, "m.read", testUserIDB, readEventID, ts)
+	db.SetReceipt(fmt.Sprintf("!elsewhere:%s", testOrigin), "m.read", testUserIDB, "$elsewhere", ts)
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if !to.IsAfter(from) {
+		t.Fatalf("expected sync position %s to be after %s", to.String(), from.String())
+	}
+
+	receiptEvents := func(res *types.Response) (receipts []gomatrixserverlib.ClientEvent) {
+		for roomID, jr := range res.Rooms.Join {
+			for _, ev := range jr.Ephemeral.Events {
+				if ev.Type != "m.receipt" {
+					continue
+				}
+				if roomID != testRoomID {
+					t.Errorf("got m.receipt event for room %s which the user isn't joined to", roomID)
+				}
+				receipts = append(receipts, ev)
+			}
+		}
+		return
+	}
+
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	receipts := receiptEvents(res)
+	if len(receipts) != 1 {
+		t.Fatalf("got %d m.receipt events, want 1", len(receipts))
+	}
+	var content map[string]map[string]map[string]struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	if err = json.Unmarshal(receipts[0].Content, &content); err != nil {
+		t.Fatalf("failed to unmarshal receipt content: %s", err)
+	}
+	if got, ok := content[readEventID]["m.read"][testUserIDB]; !ok || got.TS != ts || len(content) != 1 {
+		t.Errorf("got receipt content %s, want a single m.read receipt for %s from %s", string(receipts[0].Content), readEventID, testUserIDB)
+	}
+
+	// Syncing again from the new position shouldn't return the same receipt again.
+	res, err = db.IncrementalSync(ctx, testUserDeviceA, to, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if receipts = receiptEvents(res); len(receipts) != 0 {
+		t.Errorf("got %d m.receipt events, want 0", len(receipts))
+	}
+}
+
+// The purpose of this test is to check that a device list change for a user who shares a room with the syncing user
+// appears in device_lists.changed of the next incremental sync exactly once, and that changes for users who don't share
+// a room are left out.
+func TestSyncResponseDeviceLists(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	db.SetDeviceListChanged(testUserIDB)
+	db.SetDeviceListChanged(fmt.Sprintf("@stranger:%s", testOrigin))
+	db.SetDeviceListChanged(testUserIDB)
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if !to.IsAfter(from) {
+		t.Fatalf("expected sync position %s to be after %s", to.String(), from.String())
+	}
+
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if !reflect.DeepEqual(res.DeviceLists.Changed, []string{testUserIDB}) {
+		t.Errorf("got changed device lists %v, want [%s]", res.DeviceLists.Changed, testUserIDB)
+	}
+	if len(res.DeviceLists.Left) != 0 {
+		t.Errorf("got left device lists %v, want none", res.DeviceLists.Left)
+	}
+
+	// Syncing again from the new position shouldn't return the same change again.
+	res, err = db.IncrementalSync(ctx, testUserDeviceA, to, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.DeviceLists.Changed) != 0 {
+		t.Errorf("got changed device lists %v, want none", res.DeviceLists.Changed)
+	}
+}
+
+// The purpose of this test is to check that a complete sync for a user in more rooms than fit in the limits only has as
+// many rooms as fit, with the timeline of the last one shortened, and that following on from its next_batch sends the
+// rest of the rooms, each exactly once, until a token with nothing left to send.
+func TestCompleteSyncLimits(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	var roomIDs []string
+	for i := 0; i < 5; i++ {
+		roomID := fmt.Sprintf("!room%d:%s", i, testOrigin)
+		roomIDs = append(roomIDs, roomID)
+		events, _ := SimpleRoom(t, roomID, testUserIDA, testUserIDB)
+		MustWriteEvents(t, db, events)
+	}
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	// Each room has 3 state events, so the first room takes 3+5 events and the second only has space for 1 more.
+	limits := types.SyncLimits{MaxRooms: 2, MaxEvents: 12}
+
+	res, err := db.CompleteSync(ctx, testUserDeviceA, 5, limits)
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	if len(res.Rooms.Join) != 2 {
+		t.Fatalf("got %d joined rooms, want 2", len(res.Rooms.Join))
+	}
+	if first := res.Rooms.Join[roomIDs[0]]; len(first.Timeline.Events) != 5 {
+		t.Errorf("got %d timeline events in the first room, want 5", len(first.Timeline.Events))
+	}
+	second := res.Rooms.Join[roomIDs[1]]
+	if len(second.Timeline.Events) != 1 || !second.Timeline.Limited {
+		t.Errorf("got %d timeline events with limited %v in the second room, want 1 and limited", len(second.Timeline.Events), second.Timeline.Limited)
+	}
+
+	seen := make(map[string]int)
+	for roomID := range res.Rooms.Join {
+		seen[roomID]++
+	}
+	for i := 0; ; i++ {
+		var next *types.PaginationToken
+		next, err = types.NewPaginationTokenFromString(res.NextBatch)
+		if err != nil {
+			t.Fatalf("failed to parse next_batch %q: %s", res.NextBatch, err)
+		}
+		if next.PendingRoomsPosition == 0 {
+			break
+		}
+		if i == 5 {
+			t.Fatalf("still rooms pending after %d syncs", i)
+		}
+		res, err = db.IncrementalSync(ctx, testUserDeviceA, *next, latest, 5, false, limits)
+		if err != nil {
+			t.Fatalf("failed to do sync: %s", err)
+		}
+		if len(res.Rooms.Join) > 2 {
+			t.Errorf("got %d joined rooms in a following sync, want at most 2", len(res.Rooms.Join))
+		}
+		for roomID, jr := range res.Rooms.Join {
+			seen[roomID]++
+			if len(jr.State.Events) == 0 {
+				t.Errorf("room %s was sent without its state", roomID)
+			}
+		}
+	}
+	for _, roomID := range roomIDs {
+		if seen[roomID] != 1 {
+			t.Errorf("room %s was sent %d times, want once", roomID, seen[roomID])
+		}
+	}
+}
+
+// The purpose of this test is to check that a typing user appears in an m.typing ephemeral event in the next
+// incremental sync, and that they are removed from it again once their typing notification expires.
+func TestSyncResponseTyping(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	expired := make(chan types.StreamPosition, 1)
+	db.SetTypingTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		expired <- types.StreamPosition(latestSyncPosition)
+	})
+	expireTime := time.Now().Add(100 * time.Millisecond)
+	to := from
+	to.EDUTypingPosition = db.AddTypingUser(testUserIDB, testRoomID, &expireTime)
+
+	assertTypingUsers := func(from, to types.PaginationToken, want []string) {
+		t.Helper()
+		res, err := db.IncrementalSync(ctx, testUserDeviceA, from, to, 5, false, types.SyncLimits{})
+		if err != nil {
+			t.Fatalf("failed to do sync: %s", err)
+		}
+		var typing []gomatrixserverlib.ClientEvent
+		for _, ev := range res.Rooms.Join[testRoomID].Ephemeral.Events {
+			if ev.Type == gomatrixserverlib.MTyping {
+				typing = append(typing, ev)
+			}
+		}
+		if len(typing) != 1 {
+			t.Fatalf("got %d m.typing events, want 1", len(typing))
+		}
+		var content struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err = json.Unmarshal(typing[0].Content, &content); err != nil {
+			t.Fatalf("failed to unmarshal m.typing content: %s", err)
+		}
+		if len(content.UserIDs) != len(want) || (len(want) == 1 && content.UserIDs[0] != want[0]) {
+			t.Errorf("got typing users %v, want %v", content.UserIDs, want)
+		}
+	}
+	assertTypingUsers(from, to, []string{testUserIDB})
+
+	select {
+	case pos := <-expired:
+		from, to.EDUTypingPosition = to, pos
+	case <-time.After(5 * time.Second):
+		t.Fatalf("typing notification did not expire")
+	}
+	assertTypingUsers(from, to, []string{})
+}
+
+// The purpose of this test is to check that an invited user's next sync has the room under invite, with the stripped
+// state that was sent with the invite followed by the invite event itself, and that the invite event is still there
+// when no state was sent with it.
+func TestSyncResponseInvite(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	invitee := fmt.Sprintf("@grimm:%s", testOrigin)
+	inviteeDevice := authtypes.Device{UserID: invitee, ID: "device_id_C"}
+	name := MustCreateEvent(t, testRoomID, events[len(events)-1:], &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"name":"Hallownest"}`),
+		Type:     gomatrixserverlib.MRoomName,
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 1),
+	})
+	avatar := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{name}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"url":"mxc://hollow.knight/pale"}`),
+		Type:     "m.room.avatar",
+		StateKey: &emptyStateKey,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 2),
+	})
+	invite := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{avatar}, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &invitee,
+		Sender:   testUserIDA,
+		Depth:    int64(len(events) + 3),
+	})
+	if err = invite.SetUnsignedField("invite_room_state", []gomatrixserverlib.InviteV2StrippedState{
+		gomatrixserverlib.NewInviteV2StrippedState(&name.Event),
+		gomatrixserverlib.NewInviteV2StrippedState(&avatar.Event),
+	}); err != nil {
+		t.Fatalf("failed to set invite_room_state: %s", err)
+	}
+	if _, err = db.AddInviteEvent(ctx, invite); err != nil {
+		t.Fatalf("failed to add invite event: %s", err)
+	}
+
+	// An invite to another room, without any stripped state.
+	otherRoomID := fmt.Sprintf("!kingdomsedge:%s", testOrigin)
+	otherInvite := MustCreateEvent(t, otherRoomID, nil, &gomatrixserverlib.EventBuilder{
+		Content:  []byte(`{"membership":"invite"}`),
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &invitee,
+		Sender:   testUserIDB,
+		Depth:    1,
+	})
+	if _, err = db.AddInviteEvent(ctx, otherInvite); err != nil {
+		t.Fatalf("failed to add invite event: %s", err)
+	}
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	res, err := db.IncrementalSync(ctx, inviteeDevice, from, to, 5, false, types.SyncLimits{})
+	if err != nil {
+		t.Fatalf("failed to do sync: %s", err)
+	}
+	assertInviteState := func(roomID string, want []gomatrixserverlib.HeaderedEvent) {
+		t.Helper()
+		ir, ok := res.Rooms.Invite[roomID]
+		if !ok {
+			t.Fatalf("sync response missing invite for room %s - response: %+v", roomID, res)
+		}
+		var got []gomatrixserverlib.InviteV2StrippedState
+		if err := json.Unmarshal(ir.InviteState.Events, &got); err != nil {
+			t.Fatalf("failed to unmarshal invite_state for room %s: %s", roomID, err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d invite_state events for room %s, want %d: %s", len(got), roomID, len(want), string(ir.InviteState.Events))
+		}
+		for i := range want {
+			if got[i].Type() != want[i].Type() || got[i].Sender() != want[i].Sender() ||
+				got[i].StateKey() == nil || *got[i].StateKey() != *want[i].StateKey() ||
+				string(got[i].Content()) != string(want[i].Content()) {
+				t.Errorf("invite_state event %d for room %s: got %s want %s event from %s", i, roomID, string(ir.InviteState.Events), want[i].Type(), want[i].Sender())
+			}
+		}
+	}
+	assertInviteState(testRoomID, []gomatrixserverlib.HeaderedEvent{name, avatar, invite})
+	assertInviteState(otherRoomID, []gomatrixserverlib.HeaderedEvent{otherInvite})
+	if _, ok := res.Rooms.Join[testRoomID]; ok {
+		t.Errorf("invited user's sync response has room %s under join", testRoomID)
+	}
+}
+
+// The purpose of this test is to check that related events can be filtered by rel_type and event type, and that
+// paginating through a large number of annotations returns each of them exactly once, most recent first.
+func TestRelatedEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	parent := events[len(events)-1]
+	var annotations, references []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 25; i++ {
+		eventType, relType := "m.reaction", "m.annotation"
+		if i%5 == 0 {
+			eventType, relType = "m.room.message", "m.reference"
+		}
+		events = append(events, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{events[len(events)-1]}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"m.relates_to":{"rel_type":"%s","event_id":"%s","key":"%d"}}`, relType, parent.EventID(), i)),
+			Type:    eventType,
+			Sender:  testUserIDB,
+			Depth:   int64(len(events) + 1),
+		}))
+		if relType == "m.annotation" {
+			annotations = append(annotations, events[len(events)-1])
+		} else {
+			references = append(references, events[len(events)-1])
+		}
+	}
+	MustWriteEvents(t, db, events)
+
+	assertRelatedEvents := func(msg string, gots []types.StreamEvent, wants []gomatrixserverlib.HeaderedEvent) {
+		t.Helper()
+		if len(gots) != len(wants) {
+			t.Fatalf("%s: got %d related events, want %d", msg, len(gots), len(wants))
+		}
+		for i := range gots {
+			if gots[i].EventID() != wants[i].EventID() {
+				t.Errorf("%s: related event %d: got %s want %s", msg, i, gots[i].EventID(), wants[i].EventID())
+			}
+		}
+	}
+
+	gots, next, err := db.RelatedEvents(ctx, testRoomID, parent.EventID(), "m.reference", "", nil, 100)
+	if err != nil {
+		t.Fatalf("RelatedEvents returned an error: %s", err)
+	}
+	assertRelatedEvents("filtered by rel_type", gots, reversed(references))
+	if next != nil {
+		t.Errorf("expected no next token when all related events were returned, got %s", next.String())
+	}
+
+	gots, _, err = db.RelatedEvents(ctx, testRoomID, parent.EventID(), "m.annotation", "m.room.message", nil, 100)
+	if err != nil {
+		t.Fatalf("RelatedEvents returned an error: %s", err)
+	}
+	assertRelatedEvents("filtered by rel_type and event type", gots, nil)
+
+	var paginated []types.StreamEvent
+	var from *types.PaginationToken
+	for i := 0; ; i++ {
+		if i > len(annotations) {
+			t.Fatalf("pagination did not finish after %d pages", i)
+		}
+		gots, from, err = db.RelatedEvents(ctx, testRoomID, parent.EventID(), "m.annotation", "m.reaction", from, 3)
+		if err != nil {
+			t.Fatalf("RelatedEvents returned an error: %s", err)
+		}
+		paginated = append(paginated, gots...)
+		if from == nil {
+			break
+		}
+	}
+	assertRelatedEvents("paginated annotations", paginated, reversed(annotations))
+}
+
+// The purpose of this test is to check that events in another room which claim to relate to an event are never
+// returned as its relations, whether they were written before or after the event itself.
+func TestRelatedEventsIgnoresOtherRooms(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	parent := events[len(events)-1]
+	otherRoomID := fmt.Sprintf("!kingdomsedge:%s", testOrigin)
+	otherEvents, _ := SimpleRoom(t, otherRoomID, testUserIDA, testUserIDB)
+	relation := func(roomID string, prev gomatrixserverlib.HeaderedEvent) gomatrixserverlib.HeaderedEvent {
+		return MustCreateEvent(t, roomID, []gomatrixserverlib.HeaderedEvent{prev}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"m.relates_to":{"rel_type":"m.annotation","event_id":"%s","key":"x"}}`, parent.EventID())),
+			Type:    "m.reaction",
+			Sender:  testUserIDB,
+			Depth:   prev.Depth() + 1,
+		})
+	}
+	// One event in the other room is written before the event it claims to
+	// relate to, and one after it.
+	before := relation(otherRoomID, otherEvents[len(otherEvents)-1])
+	after := relation(otherRoomID, before)
+	inRoom := relation(testRoomID, parent)
+	MustWriteEvents(t, db, append(otherEvents, before))
+	MustWriteEvents(t, db, append(events, inRoom, after))
+
+	gots, _, err := db.RelatedEvents(ctx, testRoomID, parent.EventID(), "", "", nil, 100)
+	if err != nil {
+		t.Fatalf("RelatedEvents returned an error: %s", err)
+	}
+	if len(gots) != 1 || gots[0].EventID() != inRoom.EventID() {
+		gotIDs := make([]string, len(gots))
+		for i := range gots {
+			gotIDs[i] = gots[i].EventID()
+		}
+		t.Errorf("wrong related events: got %v want [%s]", gotIDs, inRoom.EventID())
+	}
+	gots, _, err = db.RelatedEvents(ctx, otherRoomID, parent.EventID(), "", "", nil, 100)
+	if err != nil {
+		t.Fatalf("RelatedEvents returned an error: %s", err)
+	}
+	if len(gots) != 0 {
+		t.Errorf("expected no related events in %s, got %d", otherRoomID, len(gots))
+	}
+}
+
+// The purpose of this test is to check that writing an event to the topology again at a new position is ignored by
+// default, but moves the event when upserting.
+func TestWriteEventInTopologyUpsert(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	ev := events[len(events)-1]
+
+	depth, streamPos, err := db.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		t.Fatalf("failed to get EventPositionInTopology: %s", err)
+	}
+	newStreamPos := streamPos + 1000
+
+	if err = db.WriteEventInTopology(ctx, &ev, newStreamPos, false); err != nil {
+		t.Fatalf("WriteEventInTopology without upsert returned an error: %s", err)
+	}
+	gotDepth, gotStreamPos, err := db.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		t.Fatalf("failed to get EventPositionInTopology: %s", err)
+	}
+	if gotDepth != depth || gotStreamPos != streamPos {
+		t.Errorf("without upsert: got position (%d, %d) want unchanged (%d, %d)", gotDepth, gotStreamPos, depth, streamPos)
+	}
+
+	if err = db.WriteEventInTopology(ctx, &ev, newStreamPos, true); err != nil {
+		t.Fatalf("WriteEventInTopology with upsert returned an error: %s", err)
+	}
+	gotDepth, gotStreamPos, err = db.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		t.Fatalf("failed to get EventPositionInTopology: %s", err)
+	}
+	if gotDepth != depth || gotStreamPos != newStreamPos {
+		t.Errorf("with upsert: got position (%d, %d) want (%d, %d)", gotDepth, gotStreamPos, depth, newStreamPos)
+	}
+}
+
+// The purpose of this test is to check that events at the same depth which are written to the topology out of stream
+// order keep the stream positions they were written with and paginate in stream order, that writing one of them again
+// doesn't move it, and that stream positions which an upsert has left shared by two events are repaired.
+func TestTopologyStreamPositionsWithinRoom(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest := events[len(events)-1]
+	latestPos := positions[len(positions)-1]
+
+	var siblings []gomatrixserverlib.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		siblings = append(siblings, MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{latest}, &gomatrixserverlib.EventBuilder{
+			Content: []byte(fmt.Sprintf(`{"body":"Sibling %d","msgtype":"m.text"}`, i)),
+			Type:    "m.room.message",
+			Sender:  testUserIDA,
+			Depth:   latest.Depth() + 1,
+		}))
+	}
+	for i, spos := range []types.StreamPosition{latestPos + 3, latestPos + 1, latestPos + 2} {
+		if err := db.WriteEventInTopology(ctx, &siblings[i], spos, false); err != nil {
+			t.Fatalf("WriteEventInTopology returned an error: %s", err)
+		}
+	}
+	if err := db.WriteEventInTopology(ctx, &siblings[0], latestPos+4, false); err != nil {
+		t.Fatalf("WriteEventInTopology returned an error for a duplicate: %s", err)
+	}
+	for i, want := range []types.StreamPosition{latestPos + 3, latestPos + 1, latestPos + 2} {
+		if _, got, err := db.EventPositionInTopology(ctx, siblings[i].EventID()); err != nil || got != want {
+			t.Errorf("sibling %d: got stream position %d, %v want %d", i, got, err, want)
+		}
+	}
+
+	depth := types.StreamPosition(latest.Depth() + 1)
+	lower := types.TopologyBound{Depth: depth, Inclusive: true}
+	upper := types.TopologyBound{Depth: depth, StreamPosition: latestPos + 100, Inclusive: true}
+	var paginated []string
+	for {
+		eventIDs, err := db.EventIDsInTopologicalRange(ctx, testRoomID, lower, upper, 1, true)
+		if err != nil {
+			t.Fatalf("EventIDsInTopologicalRange returned an error: %s", err)
+		}
+		if len(eventIDs) == 0 {
+			break
+		}
+		paginated = append(paginated, eventIDs...)
+		if lower.Depth, lower.StreamPosition, err = db.EventPositionInTopology(ctx, eventIDs[0]); err != nil {
+			t.Fatalf("failed to get EventPositionInTopology: %s", err)
+		}
+		lower.Inclusive = false
+	}
+	want := []string{siblings[1].EventID(), siblings[2].EventID(), siblings[0].EventID()}
+	if !reflect.DeepEqual(paginated, want) {
+		t.Errorf("wrong order paginating forwards: got %v want %v", paginated, want)
+	}
+	lower = types.TopologyBound{Depth: depth, Inclusive: true}
+	backwards, err := db.EventIDsInTopologicalRange(ctx, testRoomID, lower, upper, 10, false)
+	if err != nil {
+		t.Fatalf("EventIDsInTopologicalRange returned an error: %s", err)
+	}
+	if want := []string{want[2], want[1], want[0]}; !reflect.DeepEqual(backwards, want) {
+		t.Errorf("wrong order paginating backwards: got %v want %v", backwards, want)
+	}
+
+	// An upsert can put an event at the stream position of an event at another depth.
+	if err = db.WriteEventInTopology(ctx, &siblings[2], positions[0], true); err != nil {
+		t.Fatalf("WriteEventInTopology with upsert returned an error: %s", err)
+	}
+	topology, err := db.FullTopologyForRoom(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("FullTopologyForRoom returned an error: %s", err)
+	}
+	if moved := types.NonMonotonicStreamPositions(topology); len(moved) == 0 || moved[0].EventID != siblings[2].EventID() {
+		t.Fatalf("expected %s to be found first, got %+v", siblings[2].EventID(), moved)
+	}
+	repaired, err := db.RepairTopologyStreamPositions(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("RepairTopologyStreamPositions returned an error: %s", err)
+	}
+	if len(repaired) == 0 {
+		t.Errorf("expected events to be repaired")
+	}
+	if topology, err = db.FullTopologyForRoom(ctx, testRoomID); err != nil {
+		t.Fatalf("FullTopologyForRoom returned an error: %s", err)
+	}
+	if len(topology) != len(events)+len(siblings) {
+		t.Errorf("wrong number of events in the topology after repairing: got %d want %d", len(topology), len(events)+len(siblings))
+	}
+	if moved := types.NonMonotonicStreamPositions(topology); len(moved) != 0 {
+		t.Errorf("stream positions still shared after repairing: %+v", moved)
+	}
+	if repaired, err = db.RepairTopologyStreamPositions(ctx, testRoomID); err != nil || len(repaired) != 0 {
+		t.Errorf("expected nothing to repair a second time, got %v, %v", repaired, err)
+	}
+}
+
 func assertEventsEqual(t *testing.T, msg string, checkRoomID bool, gots []gomatrixserverlib.ClientEvent, wants []gomatrixserverlib.HeaderedEvent) {
 	if len(gots) != len(wants) {
 		t.Fatalf("%s response returned %d events, want %d", msg, len(gots), len(wants))
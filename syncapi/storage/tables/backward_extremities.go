@@ -28,8 +28,16 @@ type BackwardsExtremitiesStatements interface {
 	InsertBackwardExtremity() string
 	SelectBackwardExtremitiesForRoom() string
 	DeleteBackwardExtremity() string
+	DeleteBackwardExtremitiesOfPurgedEvents() string
 }
 
+// The SQL is the same for both databases, so both sets of statements share it.
+// Backward extremities are always events that we have, so any whose event is
+// no longer in the output room events has been purged.
+const deleteBackwardExtremitiesOfPurgedEventsSQL = "" +
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1" +
+	" AND event_id NOT IN (SELECT event_id FROM syncapi_output_room_events WHERE room_id = $1)"
+
 type PostgresBackwardsExtremitiesStatements struct{}
 
 func (s *PostgresBackwardsExtremitiesStatements) Schema() string {
@@ -58,6 +66,9 @@ func (s *PostgresBackwardsExtremitiesStatements) SelectBackwardExtremitiesForRoo
 func (s *PostgresBackwardsExtremitiesStatements) DeleteBackwardExtremity() string {
 	return "DELETE FROM syncapi_backward_extremities WHERE room_id = $1 AND prev_event_id = $2"
 }
+func (s *PostgresBackwardsExtremitiesStatements) DeleteBackwardExtremitiesOfPurgedEvents() string {
+	return deleteBackwardExtremitiesOfPurgedEventsSQL
+}
 
 type SqliteBackwardsExtremitiesStatements struct{}
 
@@ -93,6 +104,10 @@ func (s *SqliteBackwardsExtremitiesStatements) DeleteBackwardExtremity() string
 		"DELETE FROM syncapi_backward_extremities WHERE room_id = $1 AND prev_event_id = $2"
 }
 
+func (s *SqliteBackwardsExtremitiesStatements) DeleteBackwardExtremitiesOfPurgedEvents() string {
+	return deleteBackwardExtremitiesOfPurgedEventsSQL
+}
+
 // BackwardsExtremities keeps track of backwards extremities for a room.
 // Backwards extremities are the earliest (DAG-wise) known events which we have
 // the entire event JSON. These event IDs are used in federation requests to fetch
@@ -116,6 +131,7 @@ type BackwardsExtremities struct {
 	insertBackwardExtremityStmt          *sql.Stmt
 	selectBackwardExtremitiesForRoomStmt *sql.Stmt
 	deleteBackwardExtremityStmt          *sql.Stmt
+	deleteOfPurgedEventsStmt             *sql.Stmt
 }
 
 // NewBackwardsExtremities prepares the table
@@ -133,6 +149,9 @@ func NewBackwardsExtremities(db *sql.DB, stmts BackwardsExtremitiesStatements) (
 	if table.deleteBackwardExtremityStmt, err = db.Prepare(stmts.DeleteBackwardExtremity()); err != nil {
 		return
 	}
+	if table.deleteOfPurgedEventsStmt, err = db.Prepare(stmts.DeleteBackwardExtremitiesOfPurgedEvents()); err != nil {
+		return
+	}
 	return
 }
 
@@ -173,3 +192,13 @@ func (s *BackwardsExtremities) DeleteBackwardExtremity(
 	_, err = txn.Stmt(s.deleteBackwardExtremityStmt).ExecContext(ctx, roomID, knownEventID)
 	return
 }
+
+// DeleteBackwardExtremitiesOfPurgedEvents removes the backwards extremities of
+// a room whose events have been purged, so that we don't backfill the history
+// before them again.
+func (s *BackwardsExtremities) DeleteBackwardExtremitiesOfPurgedEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (err error) {
+	_, err = txn.Stmt(s.deleteOfPurgedEventsStmt).ExecContext(ctx, roomID)
+	return
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// EventRelationsStatements contains the SQL statements to implement.
+// See EventRelations to see the parameter and response types.
+type EventRelationsStatements interface {
+	Schema() string
+	InsertEventRelation() string
+	SelectEventRelations() string
+}
+
+// The SQL is the same for both databases, so both sets of statements share it.
+const eventRelationsSchema = `
+-- Stores which events relate to which other events, e.g. annotations or replies.
+CREATE TABLE IF NOT EXISTS syncapi_event_relations (
+	-- The ID of the event which relates to another event.
+	event_id TEXT PRIMARY KEY,
+	-- The room that both events are in.
+	room_id TEXT NOT NULL,
+	-- The ID of the event that is related to.
+	relates_to_event_id TEXT NOT NULL,
+	-- The rel_type of the relation, e.g. 'm.annotation'.
+	rel_type TEXT NOT NULL,
+	-- The type of the event which relates to another event.
+	event_type TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_event_relations_relates_to_idx ON syncapi_event_relations(relates_to_event_id);
+`
+
+const insertEventRelationSQL = "" +
+	"INSERT INTO syncapi_event_relations (event_id, room_id, relates_to_event_id, rel_type, event_type)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+// Related events are returned from the most recent backwards, starting
+// before the given topological position. Only events in the given room are
+// returned, as an event in another room could claim to relate to any event.
+const selectEventRelationsSQL = "" +
+	"SELECT r.event_id, t.topological_position, t.stream_position" +
+	" FROM syncapi_event_relations r" +
+	" INNER JOIN syncapi_output_room_events_topology t ON r.event_id = t.event_id" +
+	" WHERE r.relates_to_event_id = $1 AND r.room_id = $2" +
+	" AND ($3 = '' OR r.rel_type = $3)" +
+	" AND ($4 = '' OR r.event_type = $4)" +
+	" AND (t.topological_position < $5 OR (t.topological_position = $5 AND t.stream_position < $6))" +
+	" ORDER BY t.topological_position DESC, t.stream_position DESC" +
+	" LIMIT $7"
+
+type PostgresEventRelationsStatements struct{}
+
+func (s *PostgresEventRelationsStatements) Schema() string {
+	return eventRelationsSchema
+}
+func (s *PostgresEventRelationsStatements) InsertEventRelation() string {
+	return insertEventRelationSQL
+}
+func (s *PostgresEventRelationsStatements) SelectEventRelations() string {
+	return selectEventRelationsSQL
+}
+
+type SqliteEventRelationsStatements struct{}
+
+func (s *SqliteEventRelationsStatements) Schema() string {
+	return eventRelationsSchema
+}
+func (s *SqliteEventRelationsStatements) InsertEventRelation() string {
+	return insertEventRelationSQL
+}
+func (s *SqliteEventRelationsStatements) SelectEventRelations() string {
+	return selectEventRelationsSQL
+}
+
+// EventRelation is an event which relates to another event, along with its
+// position in the room's topology.
+type EventRelation struct {
+	EventID        string
+	Depth          types.StreamPosition
+	StreamPosition types.StreamPosition
+}
+
+// EventRelations keeps track of events which relate to other events, as
+// described by the m.relates_to key in their content.
+type EventRelations struct {
+	insertEventRelationStmt  *sql.Stmt
+	selectEventRelationsStmt *sql.Stmt
+}
+
+// NewEventRelations prepares the table
+func NewEventRelations(db *sql.DB, stmts EventRelationsStatements) (table EventRelations, err error) {
+	_, err = db.Exec(stmts.Schema())
+	if err != nil {
+		return
+	}
+	if table.insertEventRelationStmt, err = db.Prepare(stmts.InsertEventRelation()); err != nil {
+		return
+	}
+	if table.selectEventRelationsStmt, err = db.Prepare(stmts.SelectEventRelations()); err != nil {
+		return
+	}
+	return
+}
+
+// InsertEventRelation records that an event relates to another event.
+func (s *EventRelations) InsertEventRelation(
+	ctx context.Context, txn *sql.Tx, eventID, roomID, relatesToEventID, relType, eventType string,
+) (err error) {
+	_, err = common.TxStmt(txn, s.insertEventRelationStmt).ExecContext(
+		ctx, eventID, roomID, relatesToEventID, relType, eventType,
+	)
+	return
+}
+
+// SelectEventRelations retrieves up to limit events in the given room which
+// relate to the given event and which are topologically before the given
+// position, from the most recent backwards. An empty relType or eventType
+// matches any value.
+func (s *EventRelations) SelectEventRelations(
+	ctx context.Context, roomID, relatesToEventID, relType, eventType string,
+	beforeDepth, beforeStreamPos types.StreamPosition, limit int,
+) (relations []EventRelation, err error) {
+	rows, err := s.selectEventRelationsStmt.QueryContext(
+		ctx, relatesToEventID, roomID, relType, eventType, beforeDepth, beforeStreamPos, limit,
+	)
+	if err != nil {
+		return
+	}
+	defer common.CloseAndLogIfError(ctx, rows, "selectEventRelations: rows.close() failed")
+
+	for rows.Next() {
+		var relation EventRelation
+		if err = rows.Scan(&relation.EventID, &relation.Depth, &relation.StreamPosition); err != nil {
+			return
+		}
+		relations = append(relations, relation)
+	}
+
+	return relations, rows.Err()
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// EventTimestampsStatements contains the SQL statements to implement.
+// See EventTimestamps to see the parameter and response types.
+type EventTimestampsStatements interface {
+	Schema() string
+	InsertEventTimestamp() string
+	SelectEventAtOrAfterTimestamp() string
+	SelectEventAtOrBeforeTimestamp() string
+	SelectTopologicalPositionAtOrAfterTimestamp() string
+	DeleteEventTimestamp() string
+}
+
+// The SQL is the same for both databases, so both sets of statements share it.
+const eventTimestampsSchema = `
+-- Stores the origin_server_ts of events, so that the event closest to a given
+-- time can be found.
+CREATE TABLE IF NOT EXISTS syncapi_event_timestamps (
+	-- The ID of the event.
+	event_id TEXT PRIMARY KEY,
+	-- The room that the event is in.
+	room_id TEXT NOT NULL,
+	-- The origin_server_ts of the event, in milliseconds since the epoch.
+	origin_server_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_event_timestamps_room_ts_idx ON syncapi_event_timestamps(room_id, origin_server_ts);
+`
+
+const insertEventTimestampSQL = "" +
+	"INSERT INTO syncapi_event_timestamps (event_id, room_id, origin_server_ts)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+// Events with the same timestamp are ordered by their position in the room's
+// topology, so that the earliest one is found when looking forwards and the
+// latest one when looking backwards.
+const selectEventAtOrAfterTimestampSQL = "" +
+	"SELECT e.event_id, e.origin_server_ts" +
+	" FROM syncapi_event_timestamps e" +
+	" INNER JOIN syncapi_output_room_events_topology t ON e.event_id = t.event_id" +
+	" WHERE e.room_id = $1 AND e.origin_server_ts >= $2" +
+	" ORDER BY e.origin_server_ts ASC, t.topological_position ASC, t.stream_position ASC" +
+	" LIMIT 1"
+
+const selectEventAtOrBeforeTimestampSQL = "" +
+	"SELECT e.event_id, e.origin_server_ts" +
+	" FROM syncapi_event_timestamps e" +
+	" INNER JOIN syncapi_output_room_events_topology t ON e.event_id = t.event_id" +
+	" WHERE e.room_id = $1 AND e.origin_server_ts <= $2" +
+	" ORDER BY e.origin_server_ts DESC, t.topological_position DESC, t.stream_position DESC" +
+	" LIMIT 1"
+
+// The topological position of the earliest event in the room which was sent
+// at or after the given time. If every event in the room was sent before then
+// this is the room's latest position instead, so that the room is never left
+// without any events. NULL if the room has no events at all.
+const selectTopologicalPositionAtOrAfterTimestampSQL = "" +
+	"SELECT COALESCE(" +
+	" (SELECT MIN(t.topological_position)" +
+	"  FROM syncapi_event_timestamps e" +
+	"  INNER JOIN syncapi_output_room_events_topology t ON e.event_id = t.event_id" +
+	"  WHERE e.room_id = $1 AND e.origin_server_ts >= $2)," +
+	" (SELECT MAX(topological_position) FROM syncapi_output_room_events_topology WHERE room_id = $3)" +
+	")"
+
+const deleteEventTimestampSQL = "" +
+	"DELETE FROM syncapi_event_timestamps WHERE event_id = $1"
+
+type PostgresEventTimestampsStatements struct{}
+
+func (s *PostgresEventTimestampsStatements) Schema() string {
+	return eventTimestampsSchema
+}
+func (s *PostgresEventTimestampsStatements) InsertEventTimestamp() string {
+	return insertEventTimestampSQL
+}
+func (s *PostgresEventTimestampsStatements) SelectEventAtOrAfterTimestamp() string {
+	return selectEventAtOrAfterTimestampSQL
+}
+func (s *PostgresEventTimestampsStatements) SelectEventAtOrBeforeTimestamp() string {
+	return selectEventAtOrBeforeTimestampSQL
+}
+func (s *PostgresEventTimestampsStatements) SelectTopologicalPositionAtOrAfterTimestamp() string {
+	return selectTopologicalPositionAtOrAfterTimestampSQL
+}
+func (s *PostgresEventTimestampsStatements) DeleteEventTimestamp() string {
+	return deleteEventTimestampSQL
+}
+
+type SqliteEventTimestampsStatements struct{}
+
+func (s *SqliteEventTimestampsStatements) Schema() string {
+	return eventTimestampsSchema
+}
+func (s *SqliteEventTimestampsStatements) InsertEventTimestamp() string {
+	return insertEventTimestampSQL
+}
+func (s *SqliteEventTimestampsStatements) SelectEventAtOrAfterTimestamp() string {
+	return selectEventAtOrAfterTimestampSQL
+}
+func (s *SqliteEventTimestampsStatements) SelectEventAtOrBeforeTimestamp() string {
+	return selectEventAtOrBeforeTimestampSQL
+}
+func (s *SqliteEventTimestampsStatements) SelectTopologicalPositionAtOrAfterTimestamp() string {
+	return selectTopologicalPositionAtOrAfterTimestampSQL
+}
+func (s *SqliteEventTimestampsStatements) DeleteEventTimestamp() string {
+	return deleteEventTimestampSQL
+}
+
+// EventTimestamps keeps track of the origin_server_ts of events, so that the
+// event closest to a given time can be found, e.g. for MSC3030.
+type EventTimestamps struct {
+	insertEventTimestampStmt           *sql.Stmt
+	selectEventAtOrAfterTimestampStmt  *sql.Stmt
+	selectEventAtOrBeforeTimestampStmt *sql.Stmt
+	selectPositionAfterTimestampStmt   *sql.Stmt
+	deleteEventTimestampStmt           *sql.Stmt
+}
+
+// NewEventTimestamps prepares the table
+func NewEventTimestamps(db *sql.DB, stmts EventTimestampsStatements) (table EventTimestamps, err error) {
+	_, err = db.Exec(stmts.Schema())
+	if err != nil {
+		return
+	}
+	if table.insertEventTimestampStmt, err = db.Prepare(stmts.InsertEventTimestamp()); err != nil {
+		return
+	}
+	if table.selectEventAtOrAfterTimestampStmt, err = db.Prepare(stmts.SelectEventAtOrAfterTimestamp()); err != nil {
+		return
+	}
+	if table.selectEventAtOrBeforeTimestampStmt, err = db.Prepare(stmts.SelectEventAtOrBeforeTimestamp()); err != nil {
+		return
+	}
+	if table.selectPositionAfterTimestampStmt, err = db.Prepare(stmts.SelectTopologicalPositionAtOrAfterTimestamp()); err != nil {
+		return
+	}
+	if table.deleteEventTimestampStmt, err = db.Prepare(stmts.DeleteEventTimestamp()); err != nil {
+		return
+	}
+	return
+}
+
+// InsertEventTimestamp records the origin_server_ts of an event.
+func (s *EventTimestamps) InsertEventTimestamp(
+	ctx context.Context, txn *sql.Tx, eventID, roomID string, ts gomatrixserverlib.Timestamp,
+) (err error) {
+	_, err = common.TxStmt(txn, s.insertEventTimestampStmt).ExecContext(
+		ctx, eventID, roomID, int64(ts),
+	)
+	return
+}
+
+// SelectEventNearestTimestamp returns the ID and origin_server_ts of the
+// event in the room which is closest to the given timestamp, looking forwards
+// in time if forward is true and backwards otherwise. An event at exactly the
+// given timestamp matches in either direction. Returns an empty event ID if
+// there is no such event.
+func (s *EventTimestamps) SelectEventNearestTimestamp(
+	ctx context.Context, roomID string, ts gomatrixserverlib.Timestamp, forward bool,
+) (eventID string, eventTS gomatrixserverlib.Timestamp, err error) {
+	stmt := s.selectEventAtOrBeforeTimestampStmt
+	if forward {
+		stmt = s.selectEventAtOrAfterTimestampStmt
+	}
+	var originServerTS int64
+	err = stmt.QueryRowContext(ctx, roomID, int64(ts)).Scan(&eventID, &originServerTS)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return eventID, gomatrixserverlib.Timestamp(originServerTS), err
+}
+
+// SelectTopologicalPositionAtOrAfterTimestamp returns the position in the
+// room's topology of the earliest event in the room whose origin_server_ts is
+// at or after the given timestamp, or the room's latest position if every
+// event is older than that. Returns false if the room has no events.
+func (s *EventTimestamps) SelectTopologicalPositionAtOrAfterTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts gomatrixserverlib.Timestamp,
+) (pos types.StreamPosition, ok bool, err error) {
+	var position sql.NullInt64
+	stmt := common.TxStmt(txn, s.selectPositionAfterTimestampStmt)
+	if err = stmt.QueryRowContext(ctx, roomID, int64(ts), roomID).Scan(&position); err != nil {
+		return
+	}
+	return types.StreamPosition(position.Int64), position.Valid, nil
+}
+
+// DeleteEventTimestamps forgets the origin_server_ts of the given events.
+func (s *EventTimestamps) DeleteEventTimestamps(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) (err error) {
+	stmt := common.TxStmt(txn, s.deleteEventTimestampStmt)
+	for _, eventID := range eventIDs {
+		if _, err = stmt.ExecContext(ctx, eventID); err != nil {
+			return
+		}
+	}
+	return
+}
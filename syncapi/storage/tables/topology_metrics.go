@@ -0,0 +1,35 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// TopologyInsertConflicts counts the events which weren't inserted in the
+// topology of a room as new rows, because the event or its position was
+// already there. An occasional conflict is a re-delivered event, but a high
+// rate points to an ingestion bug or a room with pathological depths.
+var TopologyInsertConflicts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "topology_insert_conflicts_total",
+		Help:      "Number of events whose insert into the topology of a room conflicted with an existing row",
+	},
+	[]string{"room_id"},
+)
+
+func init() {
+	prometheus.MustRegister(TopologyInsertConflicts)
+}
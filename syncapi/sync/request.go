@@ -16,6 +16,7 @@ package sync
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -73,14 +74,24 @@ func getTimeout(timeoutMS string) time.Duration {
 }
 
 // getSyncStreamPosition tries to parse a 'since' token taken from the API to a
-// types.PaginationToken. If the string is empty then (nil, nil) is returned.
+// types.PaginationToken. If the string is empty then (nil, nil) is returned,
+// which means that the sync is an initial sync.
 // There are two forms of tokens: The full length form containing all PDU and EDU
 // positions separated by "_", and the short form containing only the PDU
 // position. Short form can be used for, e.g., `prev_batch` tokens.
+// Topology tokens, which come from /messages, are positions in a single room
+// rather than in the sync stream so they are rejected.
 func getPaginationToken(since string) (*types.PaginationToken, error) {
 	if since == "" {
 		return nil, nil
 	}
 
-	return types.NewPaginationTokenFromString(since)
+	token, err := types.NewPaginationTokenFromString(since)
+	if err != nil {
+		return nil, fmt.Errorf("invalid since token %q: %w", since, err)
+	}
+	if token.Type != types.PaginationTokenTypeStream {
+		return nil, fmt.Errorf("invalid since token %q: expected a stream token but got a %q token", since, token.Type)
+	}
+	return token, nil
 }
@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func newSyncHTTPRequest(since string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/_matrix/client/r0/sync?since="+url.QueryEscape(since), nil)
+}
+
+// The purpose of this test is to check that stream tokens are accepted as since tokens, that an empty since token
+// means an initial sync, and that anything else is rejected.
+func TestNewSyncRequestSinceToken(t *testing.T) {
+	device := authtypes.Device{UserID: "@alice:localhost", ID: "device"}
+
+	req, err := newSyncRequest(newSyncHTTPRequest("s5_3_1"), device)
+	if err != nil {
+		t.Fatalf("newSyncRequest returned an error for a valid token: %s", err)
+	}
+	want := types.PaginationToken{
+		Type:                types.PaginationTokenTypeStream,
+		PDUPosition:         5,
+		EDUTypingPosition:   3,
+		EDUPresencePosition: 1,
+	}
+	if req.since == nil || *req.since != want {
+		t.Errorf("wrong since token: got %+v want %+v", req.since, want)
+	}
+
+	req, err = newSyncRequest(newSyncHTTPRequest(""), device)
+	if err != nil {
+		t.Fatalf("newSyncRequest returned an error for an empty token: %s", err)
+	}
+	if req.since != nil {
+		t.Errorf("expected an empty token to mean an initial sync, got %+v", req.since)
+	}
+
+	for _, since := range []string{"garbage", "s", "s5_x", "s-1", "t5_3"} {
+		if _, err = newSyncRequest(newSyncHTTPRequest(since), device); err == nil {
+			t.Errorf("expected newSyncRequest to reject since token %q", since)
+		}
+	}
+}
+
+// The purpose of this test is to check that a malformed since token is rejected with M_INVALID_PARAM before any
+// work is done for the sync.
+func TestOnIncomingSyncRequestMalformedSinceToken(t *testing.T) {
+	rp := &RequestPool{}
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "device"}
+	res := rp.OnIncomingSyncRequest(newSyncHTTPRequest("garbage"), device)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("wrong status code: got %d want %d", res.Code, http.StatusBadRequest)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	var matrixErr jsonerror.MatrixError
+	if err = json.Unmarshal(body, &matrixErr); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if matrixErr.ErrCode != "M_INVALID_PARAM" {
+		t.Errorf("wrong error code: got %s want M_INVALID_PARAM", matrixErr.ErrCode)
+	}
+}
@@ -33,11 +33,12 @@ type RequestPool struct {
 	db        storage.Database
 	accountDB accounts.Database
 	notifier  *Notifier
+	limits    types.SyncLimits
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database, limits types.SyncLimits) *RequestPool {
+	return &RequestPool{db, adb, n, limits}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -50,9 +51,12 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 	userID := device.UserID
 	syncReq, err := newSyncRequest(req, *device)
 	if err != nil {
+		// Only the since token can be rejected. This deliberately isn't
+		// M_UNKNOWN_TOKEN, which clients take to mean that their access
+		// token is no longer valid.
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.Unknown(err.Error()),
+			JSON: jsonerror.InvalidParam(err.Error()),
 		}
 	}
 	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
@@ -135,9 +139,9 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.PaginationToken) (res *types.Response, err error) {
 	// TODO: handle ignored users
 	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, req.limit)
+		res, err = rp.db.CompleteSync(req.ctx, req.device, req.limit, rp.limits)
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, req.limit, req.wantFullState)
+		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, req.limit, req.wantFullState, rp.limits)
 	}
 
 	if err != nil {
@@ -153,11 +157,9 @@ func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
 	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
-	// TODO: Account data doesn't have a sync position of its own, meaning that
-	// account data might be sent multiple time to the client if multiple account
-	// data keys were set between two message. This isn't a huge issue since the
-	// duplicate data doesn't represent a huge quantity of data, but an optimisation
-	// here would be making sure each data is sent only once to the client.
+	// Account data shares the PDU stream position. Each time an account data
+	// type is updated it is moved to a new position in the stream, so every
+	// change is sent to the client exactly once.
 	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
 		return nil, err
@@ -214,7 +216,12 @@ func (rp *RequestPool) appendAccountData(
 
 		// Append the data to the response
 		if len(roomID) > 0 {
-			jr := data.Rooms.Join[roomID]
+			// The room might not be in the response yet if nothing else
+			// happened in it since the last sync.
+			jr, ok := data.Rooms.Join[roomID]
+			if !ok {
+				jr = *types.NewJoinResponse()
+			}
 			jr.AccountData.Events = events
 			data.Rooms.Join[roomID] = jr
 		} else {
@@ -226,8 +233,10 @@ func (rp *RequestPool) appendAccountData(
 }
 
 // shouldReturnImmediately returns whether the /sync request is an initial sync,
-// or timeout=0, or full_state=true, in any of the cases the request should
-// return immediately.
+// or timeout=0, or full_state=true, or follows on from a sync which was cut
+// short by the limits, in any of the cases the request should return
+// immediately.
 func shouldReturnImmediately(syncReq *syncRequest) bool {
-	return syncReq.since == nil || syncReq.timeout == 0 || syncReq.wantFullState
+	return syncReq.since == nil || syncReq.timeout == 0 || syncReq.wantFullState ||
+		syncReq.since.PendingRoomsPosition != 0
 }
@@ -0,0 +1,156 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// accountDataDatabase is an accounts database which only implements the account data lookups.
+type accountDataDatabase struct {
+	accounts.Database
+	// Keyed by room ID, then by type. Global account data has an empty room ID.
+	data map[string]map[string]gomatrixserverlib.ClientEvent
+}
+
+func (d *accountDataDatabase) GetAccountDataByType(
+	ctx context.Context, localpart, roomID, dataType string,
+) (*gomatrixserverlib.ClientEvent, error) {
+	ev := d.data[roomID][dataType]
+	return &ev, nil
+}
+
+// The purpose of this test is to check that account data which is set between two syncs appears in the next
+// incremental sync, both at the top level and in the room it belongs to, and that it isn't sent again in the sync after
+// that.
+func TestIncrementalSyncAccountData(t *testing.T) {
+	const userID = "@alice:localhost"
+	const roomID = "!room:localhost"
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	accountDB := &accountDataDatabase{
+		data: map[string]map[string]gomatrixserverlib.ClientEvent{
+			"": {
+				"m.direct": {Type: "m.direct", Content: []byte(`{}`)},
+			},
+			roomID: {
+				"m.tag": {Type: "m.tag", Content: []byte(`{"tags":{}}`)},
+			},
+		},
+	}
+	rp := NewRequestPool(db, nil, accountDB, types.SyncLimits{})
+	device := authtypes.Device{UserID: userID, ID: "device"}
+
+	before, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatalf("SyncPosition returned %s", err)
+	}
+	if _, err = db.UpsertAccountData(context.Background(), userID, "", "m.direct"); err != nil {
+		t.Fatalf("UpsertAccountData returned %s", err)
+	}
+	if _, err = db.UpsertAccountData(context.Background(), userID, roomID, "m.tag"); err != nil {
+		t.Fatalf("UpsertAccountData returned %s", err)
+	}
+	after, err := db.SyncPosition(context.Background())
+	if err != nil {
+		t.Fatalf("SyncPosition returned %s", err)
+	}
+
+	syncAt := func(since types.PaginationToken) *types.Response {
+		res, err := rp.currentSyncForUser(syncRequest{
+			ctx:    context.Background(),
+			device: device,
+			limit:  defaultTimelineLimit,
+			since:  &since,
+		}, after)
+		if err != nil {
+			t.Fatalf("currentSyncForUser returned %s", err)
+		}
+		return res
+	}
+
+	res := syncAt(before)
+	if len(res.AccountData.Events) != 1 || res.AccountData.Events[0].Type != "m.direct" {
+		t.Errorf("expected m.direct in the global account data, got %+v", res.AccountData.Events)
+	}
+	room, ok := res.Rooms.Join[roomID]
+	if !ok {
+		t.Fatalf("expected room %s to be in the response", roomID)
+	}
+	if len(room.AccountData.Events) != 1 || room.AccountData.Events[0].Type != "m.tag" {
+		t.Errorf("expected m.tag in the room account data, got %+v", room.AccountData.Events)
+	}
+	if room.Timeline.Events == nil || room.State.Events == nil {
+		t.Errorf("expected the room's timeline and state to be empty lists rather than null")
+	}
+
+	res = syncAt(after)
+	if len(res.AccountData.Events) != 0 {
+		t.Errorf("expected no global account data in the next sync, got %+v", res.AccountData.Events)
+	}
+	if _, ok := res.Rooms.Join[roomID]; ok {
+		t.Errorf("expected room %s not to be in the next sync", roomID)
+	}
+}
+
+// The purpose of this test is to check that moving a user's fully read marker in a room, which stores it as m.fully_read
+// room account data, sends the new marker in the room's account data in the next incremental sync, and only then.
+func TestIncrementalSyncFullyReadMarker(t *testing.T) {
+	const userID = "@alice:localhost"
+	const roomID = "!room:localhost"
+	db, err := sqlite3.NewSyncServerDatasource("file::memory:")
+	if err != nil {
+		t.Fatalf("NewSyncServerDatasource returned %s", err)
+	}
+	accountDB := &accountDataDatabase{
+		data: map[string]map[string]gomatrixserverlib.ClientEvent{roomID: {}},
+	}
+	rp := NewRequestPool(db, nil, accountDB, types.SyncLimits{})
+	device := authtypes.Device{UserID: userID, ID: "device"}
+
+	setFullyRead := func(eventID string) types.PaginationToken {
+		accountDB.data[roomID]["m.fully_read"] = gomatrixserverlib.ClientEvent{
+			Type:    "m.fully_read",
+			Content: []byte(fmt.Sprintf(`{"event_id":%q}`, eventID)),
+		}
+		if _, err = db.UpsertAccountData(context.Background(), userID, roomID, "m.fully_read"); err != nil {
+			t.Fatalf("UpsertAccountData returned %s", err)
+		}
+		pos, err := db.SyncPosition(context.Background())
+		if err != nil {
+			t.Fatalf("SyncPosition returned %s", err)
+		}
+		return pos
+	}
+	syncFrom := func(since, to types.PaginationToken) []gomatrixserverlib.ClientEvent {
+		res, err := rp.currentSyncForUser(syncRequest{
+			ctx:    context.Background(),
+			device: device,
+			limit:  defaultTimelineLimit,
+			since:  &since,
+		}, to)
+		if err != nil {
+			t.Fatalf("currentSyncForUser returned %s", err)
+		}
+		return res.Rooms.Join[roomID].AccountData.Events
+	}
+
+	first := setFullyRead("$first:localhost")
+	second := setFullyRead("$second:localhost")
+
+	events := syncFrom(first, second)
+	if len(events) != 1 || events[0].Type != "m.fully_read" || string(events[0].Content) != `{"event_id":"$second:localhost"}` {
+		t.Errorf("expected the new m.fully_read marker in the room account data, got %+v", events)
+	}
+	if events = syncFrom(second, second); len(events) != 0 {
+		t.Errorf("expected no room account data once the marker has been sent, got %+v", events)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/routing"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
 )
 
 // SetupSyncAPIComponent sets up and registers HTTP handlers for the SyncAPI
@@ -58,7 +59,23 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB)
+	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB, types.SyncLimits{
+		MaxRooms:  int(cfg.SyncAPI.MaxRoomsPerResponse),
+		MaxEvents: int(cfg.SyncAPI.MaxEventsPerResponse),
+	})
+
+	// Check the database before the consumers start writing to it.
+	checker := &consistencyChecker{
+		db:    syncDB,
+		topic: string(base.Cfg.Kafka.Topics.OutputRoomEvent),
+	}
+	checker.start(context.Background(), consistencyCheckInterval)
+
+	if retention := cfg.SyncAPI.Retention; retention.Enabled {
+		newRetentionPurger(syncDB, retention.MinLifetime, retention.MaxLifetime).start(
+			context.Background(), retention.PurgeInterval,
+		)
+	}
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
 		base.Cfg, base.KafkaConsumer, notifier, syncDB, rsAPI,
@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -47,6 +48,68 @@ type StreamEvent struct {
 	ExcludeFromSync bool
 }
 
+// TopologyBound is one end of a range of positions in a room's topology.
+// Events are ordered by depth, and events at the same depth are then ordered
+// by their stream position.
+type TopologyBound struct {
+	Depth          StreamPosition
+	StreamPosition StreamPosition
+	// Whether an event at exactly this position is part of the range.
+	Inclusive bool
+}
+
+// TopologyCollision is a depth in a room's topology which is shared by
+// several events, and the number of events at that depth.
+type TopologyCollision struct {
+	Depth StreamPosition
+	Count int
+}
+
+// TopologyPosition is the position of an event in a room's topology.
+type TopologyPosition struct {
+	EventID        string         `json:"event_id"`
+	Depth          StreamPosition `json:"topological_position"`
+	StreamPosition StreamPosition `json:"stream_position"`
+}
+
+// RoomActivity is a room and the latest stream position in its topology,
+// which is when something last happened in the room.
+type RoomActivity struct {
+	RoomID         string         `json:"room_id"`
+	StreamPosition StreamPosition `json:"stream_position"`
+}
+
+// NonMonotonicStreamPositions finds the events in a room's topology which
+// share their stream position with another event of the room, which events
+// inserted by the topology table never do. Each of them but the first is given
+// the stream position after the one before it, moving later events along as
+// needed, so that the stream positions strictly increase. Events at the same
+// stream position are taken in topological order, then by event ID. Returns
+// the events which need to move with their new stream positions, in ascending
+// order of those, or nothing if the stream positions already increase.
+func NonMonotonicStreamPositions(positions []TopologyPosition) []TopologyPosition {
+	sorted := make([]TopologyPosition, len(positions))
+	copy(sorted, positions)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.StreamPosition != b.StreamPosition {
+			return a.StreamPosition < b.StreamPosition
+		}
+		if a.Depth != b.Depth {
+			return a.Depth < b.Depth
+		}
+		return a.EventID < b.EventID
+	})
+	var moved []TopologyPosition
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].StreamPosition <= sorted[i-1].StreamPosition {
+			sorted[i].StreamPosition = sorted[i-1].StreamPosition + 1
+			moved = append(moved, sorted[i])
+		}
+	}
+	return moved
+}
+
 // PaginationTokenType represents the type of a pagination token.
 // It can be either "s" (representing a position in the whole stream of events)
 // or "t" (representing a position in a room's topology/depth).
@@ -73,6 +136,21 @@ type PaginationToken struct {
 	// TODO: Given how different the positions are depending on the token type, they should probably be renamed
 	//       or use different structs altogether.
 	EDUTypingPosition StreamPosition
+	// For /sync, this is the presence EDU position. Unused for /messages.
+	EDUPresencePosition StreamPosition
+	// For /sync, this is the receipt EDU position. Unused for /messages.
+	EDUReceiptPosition StreamPosition
+	// For /sync, this is the device list position. Unused for /messages.
+	EDUDeviceListPosition StreamPosition
+	// For /sync, this is set when a complete sync was cut short by SyncLimits,
+	// to the position of the membership event of the last joined room that was
+	// sent in full. The rooms joined after it haven't been sent yet. Unused for
+	// /messages.
+	PendingRoomsPosition StreamPosition
+	// For /sync, this is the send-to-device message position. The messages
+	// for the device up to this position have been delivered, and are
+	// deleted when the client syncs from it. Unused for /messages.
+	SendToDevicePosition StreamPosition
 }
 
 // NewPaginationTokenFromString takes a string of the form "xyyyy..." where "x"
@@ -120,6 +198,61 @@ func NewPaginationTokenFromString(s string) (token *PaginationToken, err error)
 		}
 	}
 
+	// Try to get the presence position. Only stream tokens have one.
+	if len(positions) >= 3 && token.Type == PaginationTokenTypeStream {
+		if presPos, err := strconv.ParseInt(positions[2], 10, 64); err != nil {
+			return nil, err
+		} else if presPos < 0 {
+			return nil, errors.New("negative EDU presence position not allowed")
+		} else {
+			token.EDUPresencePosition = StreamPosition(presPos)
+		}
+	}
+
+	// Try to get the receipt position. Only stream tokens have one.
+	if len(positions) >= 4 && token.Type == PaginationTokenTypeStream {
+		if recPos, err := strconv.ParseInt(positions[3], 10, 64); err != nil {
+			return nil, err
+		} else if recPos < 0 {
+			return nil, errors.New("negative EDU receipt position not allowed")
+		} else {
+			token.EDUReceiptPosition = StreamPosition(recPos)
+		}
+	}
+
+	// Try to get the device list position. Only stream tokens have one.
+	if len(positions) >= 5 && token.Type == PaginationTokenTypeStream {
+		if devPos, err := strconv.ParseInt(positions[4], 10, 64); err != nil {
+			return nil, err
+		} else if devPos < 0 {
+			return nil, errors.New("negative EDU device list position not allowed")
+		} else {
+			token.EDUDeviceListPosition = StreamPosition(devPos)
+		}
+	}
+
+	// Try to get the pending rooms position. Only stream tokens have one.
+	if len(positions) >= 6 && token.Type == PaginationTokenTypeStream {
+		if roomsPos, err := strconv.ParseInt(positions[5], 10, 64); err != nil {
+			return nil, err
+		} else if roomsPos < 0 {
+			return nil, errors.New("negative pending rooms position not allowed")
+		} else {
+			token.PendingRoomsPosition = StreamPosition(roomsPos)
+		}
+	}
+
+	// Try to get the send-to-device position. Only stream tokens have one.
+	if len(positions) >= 7 && token.Type == PaginationTokenTypeStream {
+		if toDevicePos, err := strconv.ParseInt(positions[6], 10, 64); err != nil {
+			return nil, err
+		} else if toDevicePos < 0 {
+			return nil, errors.New("negative send-to-device position not allowed")
+		} else {
+			token.SendToDevicePosition = StreamPosition(toDevicePos)
+		}
+	}
+
 	return
 }
 
@@ -138,6 +271,28 @@ func NewPaginationTokenFromTypeAndPosition(
 // String translates a PaginationToken to a string of the "xyyyy..." (see
 // NewPaginationToken to know what it represents).
 func (p *PaginationToken) String() string {
+	if p.Type == PaginationTokenTypeStream && p.SendToDevicePosition != 0 {
+		// The send-to-device position comes after the pending rooms position,
+		// so that has to be included too, even if it's zero.
+		return fmt.Sprintf(
+			"%s%d_%d_%d_%d_%d_%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition, p.EDUPresencePosition, p.EDUReceiptPosition,
+			p.EDUDeviceListPosition, p.PendingRoomsPosition, p.SendToDevicePosition,
+		)
+	}
+	if p.Type == PaginationTokenTypeStream && p.PendingRoomsPosition != 0 {
+		// Only the tokens of syncs that were cut short have a pending rooms
+		// position, so it's left out of every other token.
+		return fmt.Sprintf(
+			"%s%d_%d_%d_%d_%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition, p.EDUPresencePosition, p.EDUReceiptPosition,
+			p.EDUDeviceListPosition, p.PendingRoomsPosition,
+		)
+	}
+	if p.Type == PaginationTokenTypeStream {
+		return fmt.Sprintf(
+			"%s%d_%d_%d_%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition, p.EDUPresencePosition, p.EDUReceiptPosition,
+			p.EDUDeviceListPosition,
+		)
+	}
 	return fmt.Sprintf("%s%d_%d", p.Type, p.PDUPosition, p.EDUTypingPosition)
 }
 
@@ -152,13 +307,61 @@ func (pt *PaginationToken) WithUpdates(other PaginationToken) PaginationToken {
 	if other.EDUTypingPosition != 0 {
 		ret.EDUTypingPosition = other.EDUTypingPosition
 	}
+	if other.EDUPresencePosition != 0 {
+		ret.EDUPresencePosition = other.EDUPresencePosition
+	}
+	if other.EDUReceiptPosition != 0 {
+		ret.EDUReceiptPosition = other.EDUReceiptPosition
+	}
+	if other.EDUDeviceListPosition != 0 {
+		ret.EDUDeviceListPosition = other.EDUDeviceListPosition
+	}
+	if other.SendToDevicePosition != 0 {
+		ret.SendToDevicePosition = other.SendToDevicePosition
+	}
 	return ret
 }
 
 // IsAfter returns whether one PaginationToken refers to states newer than another PaginationToken.
 func (sp *PaginationToken) IsAfter(other PaginationToken) bool {
 	return sp.PDUPosition > other.PDUPosition ||
-		sp.EDUTypingPosition > other.EDUTypingPosition
+		sp.EDUTypingPosition > other.EDUTypingPosition ||
+		sp.EDUPresencePosition > other.EDUPresencePosition ||
+		sp.EDUReceiptPosition > other.EDUReceiptPosition ||
+		sp.EDUDeviceListPosition > other.EDUDeviceListPosition ||
+		sp.SendToDevicePosition > other.SendToDevicePosition
+}
+
+// SyncLimits caps the size of a /sync response, so that a complete sync for a
+// user in many large rooms can't build a huge response. Rooms which don't fit
+// are sent in the following responses. Zero means no cap.
+type SyncLimits struct {
+	// The most joined rooms to send in full in one response.
+	MaxRooms int
+	// The most state and timeline events of joined rooms to send in full in
+	// one response. The timelines of the last rooms are shortened to fit.
+	MaxEvents int
+}
+
+// Reached returns whether a response with the given numbers of rooms and
+// events can't have any more rooms added to it.
+func (l SyncLimits) Reached(rooms, events int) bool {
+	return (l.MaxRooms > 0 && rooms >= l.MaxRooms) || (l.MaxEvents > 0 && events >= l.MaxEvents)
+}
+
+// MRoomEncryption is the type of the state event which enables end-to-end
+// encryption in a room.
+const MRoomEncryption = "m.room.encryption"
+
+// EssentialSyncState returns the state which is always sent with the full
+// state of a room in /sync for the given user, whatever the state filter says.
+// Clients can't set up a room, or end-to-end encryption in it, without it.
+func EssentialSyncState(userID string) []gomatrixserverlib.StateKeyTuple {
+	return []gomatrixserverlib.StateKeyTuple{
+		{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+		{EventType: MRoomEncryption, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+	}
 }
 
 // PrevEventRef represents a reference to a previous event in a state event upgrade
@@ -182,6 +385,24 @@ type Response struct {
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
+	// The users whose devices the client should fetch again, because they
+	// have changed or the user has started sharing a room with them, and the
+	// users whose devices the client no longer needs to track.
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	ToDevice struct {
+		Events []SendToDeviceEvent `json:"events"`
+	} `json:"to_device"`
+}
+
+// SendToDeviceEvent is a message sent directly to a device rather than to a
+// room, such as the keys of an encrypted room.
+type SendToDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -201,14 +422,22 @@ func NewResponse(token PaginationToken) *Response {
 	//       This also applies to NewJoinResponse, NewInviteResponse and NewLeaveResponse.
 	res.AccountData.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
+	res.DeviceLists.Changed = make([]string, 0)
+	res.DeviceLists.Left = make([]string, 0)
+	res.ToDevice.Events = make([]SendToDeviceEvent, 0)
 
 	// Fill next_batch with a pagination token. Since this is a response to a sync request, we can assume
 	// we'll always return a stream token.
-	res.NextBatch = NewPaginationTokenFromTypeAndPosition(
+	nextBatch := NewPaginationTokenFromTypeAndPosition(
 		PaginationTokenTypeStream,
 		StreamPosition(token.PDUPosition),
 		StreamPosition(token.EDUTypingPosition),
-	).String()
+	)
+	nextBatch.EDUPresencePosition = token.EDUPresencePosition
+	nextBatch.EDUReceiptPosition = token.EDUReceiptPosition
+	nextBatch.EDUDeviceListPosition = token.EDUDeviceListPosition
+	nextBatch.SendToDevicePosition = token.SendToDevicePosition
+	res.NextBatch = nextBatch.String()
 
 	return &res
 }
@@ -220,7 +449,10 @@ func (r *Response) IsEmpty() bool {
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
-		len(r.Presence.Events) == 0
+		len(r.Presence.Events) == 0 &&
+		len(r.DeviceLists.Changed) == 0 &&
+		len(r.DeviceLists.Left) == 0 &&
+		len(r.ToDevice.Events) == 0
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' key.
@@ -258,16 +490,44 @@ type InviteResponse struct {
 	} `json:"invite_state"`
 }
 
-// NewInviteResponse creates an empty response with initialised arrays.
+// NewInviteResponse creates a response for the invite event. The invite_state
+// is the stripped state that was sent with the invite, e.g. the name and avatar
+// of the room, along with the invite event itself if it isn't already there so
+// that clients can tell who the invite is from.
 func NewInviteResponse(event gomatrixserverlib.HeaderedEvent) *InviteResponse {
 	res := InviteResponse{}
 	res.InviteState.Events = json.RawMessage{'[', ']'}
+	var inviteState []gomatrixserverlib.InviteV2StrippedState
 	if inviteRoomState := gjson.GetBytes(event.Unsigned(), "invite_room_state"); inviteRoomState.Exists() {
-		res.InviteState.Events = json.RawMessage(inviteRoomState.Raw)
+		if err := json.Unmarshal([]byte(inviteRoomState.Raw), &inviteState); err != nil {
+			// Pass the state on as it was given to us rather than dropping it.
+			res.InviteState.Events = json.RawMessage(inviteRoomState.Raw)
+			return &res
+		}
+	}
+	if !hasStrippedStateEvent(inviteState, event.Type(), event.StateKey()) {
+		inviteState = append(inviteState, gomatrixserverlib.NewInviteV2StrippedState(&event.Event))
+	}
+	if inviteStateJSON, err := json.Marshal(inviteState); err == nil {
+		res.InviteState.Events = inviteStateJSON
 	}
 	return &res
 }
 
+// hasStrippedStateEvent returns true if the stripped state has an event with
+// the given type and state key.
+func hasStrippedStateEvent(state []gomatrixserverlib.InviteV2StrippedState, eventType string, stateKey *string) bool {
+	for i := range state {
+		if state[i].Type() != eventType {
+			continue
+		}
+		if sk := state[i].StateKey(); sk != nil && stateKey != nil && *sk == *stateKey {
+			return true
+		}
+	}
+	return false
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type LeaveResponse struct {
 	State struct {
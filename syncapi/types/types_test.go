@@ -17,6 +17,45 @@ func TestNewPaginationTokenFromString(t *testing.T) {
 			PDUPosition:       3,
 			EDUTypingPosition: 1,
 		},
+		"s3_1_2": PaginationToken{
+			Type:                PaginationTokenTypeStream,
+			PDUPosition:         3,
+			EDUTypingPosition:   1,
+			EDUPresencePosition: 2,
+		},
+		"s3_1_2_5": PaginationToken{
+			Type:                PaginationTokenTypeStream,
+			PDUPosition:         3,
+			EDUTypingPosition:   1,
+			EDUPresencePosition: 2,
+			EDUReceiptPosition:  5,
+		},
+		"s3_1_2_5_7": PaginationToken{
+			Type:                  PaginationTokenTypeStream,
+			PDUPosition:           3,
+			EDUTypingPosition:     1,
+			EDUPresencePosition:   2,
+			EDUReceiptPosition:    5,
+			EDUDeviceListPosition: 7,
+		},
+		"s3_1_2_5_7_4": PaginationToken{
+			Type:                  PaginationTokenTypeStream,
+			PDUPosition:           3,
+			EDUTypingPosition:     1,
+			EDUPresencePosition:   2,
+			EDUReceiptPosition:    5,
+			EDUDeviceListPosition: 7,
+			PendingRoomsPosition:  4,
+		},
+		"s3_1_2_5_7_0_6": PaginationToken{
+			Type:                  PaginationTokenTypeStream,
+			PDUPosition:           3,
+			EDUTypingPosition:     1,
+			EDUPresencePosition:   2,
+			EDUReceiptPosition:    5,
+			EDUDeviceListPosition: 7,
+			SendToDevicePosition:  6,
+		},
 		"t3_1_4": PaginationToken{
 			Type:              PaginationTokenTypeTopology,
 			PDUPosition:       3,
@@ -32,6 +71,7 @@ func TestNewPaginationTokenFromString(t *testing.T) {
 		"b",
 		"b-1",
 		"-4",
+		"s3_1_2_5_7_0_-6",
 	}
 
 	for test, expected := range shouldPass {